@@ -0,0 +1,155 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unixDialer dials a unix socket regardless of the requested port, standing
+// in for a vsock device in tests.
+type unixDialer string
+
+func (d unixDialer) DialPort(ctx context.Context, port uint32) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "unix", string(d))
+}
+
+func newTestClient(t *testing.T) (*Client, string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "agent-test")
+	require.NoError(t, err)
+
+	socketPath := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	go NewServer(log.NewEntry(log.New())).Serve(listener)
+
+	return NewClient(unixDialer(socketPath), DefaultPort), dir, func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPing(t *testing.T) {
+	client, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	version, err := client.Ping(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, ProtocolVersion, version)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, client.WaitReady(ctx, 10*time.Millisecond))
+}
+
+func TestWaitReadyTimeout(t *testing.T) {
+	client := NewClient(unixDialer("/does/not/exist"), DefaultPort)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, client.WaitReady(ctx, 10*time.Millisecond))
+}
+
+func TestExec(t *testing.T) {
+	client, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	var stdout, stderr bytes.Buffer
+	exitCode, err := client.Exec(context.Background(), Command{
+		Args:   []string{"sh", "-c", "cat; echo oops >&2; exit 3"},
+		Stdin:  strings.NewReader("hello from the host"),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, exitCode)
+	assert.Equal(t, "hello from the host", stdout.String())
+	assert.Equal(t, "oops\n", stderr.String())
+
+	exitCode, err = client.Exec(context.Background(), Command{
+		Args: []string{"/does/not/exist"},
+	})
+	assert.IsType(t, &RemoteError{}, err)
+	assert.Equal(t, -1, exitCode)
+}
+
+func TestExecCancel(t *testing.T) {
+	client, dir, cleanup := newTestClient(t)
+	defer cleanup()
+
+	pidFile := filepath.Join(dir, "pid")
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		_, err := client.Exec(ctx, Command{
+			Args: []string{"sh", "-c", "echo $$ > " + pidFile + "; exec sleep 60"},
+		})
+		errCh <- err
+	}()
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(pidFile)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errCh:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Exec did not return after its context was cancelled")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	client, dir, cleanup := newTestClient(t)
+	defer cleanup()
+
+	contents := bytes.Repeat([]byte("firecracker"), 10000)
+	guestPath := filepath.Join(dir, "copied")
+
+	err := client.CopyIn(context.Background(), bytes.NewReader(contents), guestPath, 0600)
+	require.NoError(t, err)
+
+	info, err := os.Stat(guestPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	var out bytes.Buffer
+	err = client.CopyOut(context.Background(), guestPath, &out)
+	require.NoError(t, err)
+	assert.Equal(t, contents, out.Bytes())
+
+	err = client.CopyOut(context.Background(), filepath.Join(dir, "missing"), &out)
+	assert.IsType(t, &RemoteError{}, err)
+
+	err = client.CopyIn(context.Background(), bytes.NewReader(contents), filepath.Join(dir, "missing", "file"), 0600)
+	assert.IsType(t, &RemoteError{}, err)
+}
@@ -0,0 +1,291 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultReadyPollInterval = 100 * time.Millisecond
+
+// PortDialer connects to a port inside the guest. It is implemented by
+// firecracker.VsockDialer.
+type PortDialer interface {
+	DialPort(ctx context.Context, port uint32) (net.Conn, error)
+}
+
+// Command describes a process to run inside the guest.
+type Command struct {
+	// Args holds the command line arguments, including the command itself as
+	// Args[0]. The command is looked up in the guest's PATH if it contains no
+	// path separators.
+	Args []string `json:"args"`
+
+	// Env specifies the environment of the process, each entry in the form
+	// "key=value". If Env is nil, the agent's environment is used.
+	Env []string `json:"env,omitempty"`
+
+	// Dir specifies the working directory of the process. If empty, the
+	// agent's working directory is used.
+	Dir string `json:"dir,omitempty"`
+
+	// Stdin, Stdout and Stderr are streamed to and from the process. Any of
+	// them may be nil.
+	Stdin  io.Reader `json:"-"`
+	Stdout io.Writer `json:"-"`
+	Stderr io.Writer `json:"-"`
+}
+
+// RemoteError is returned when the agent failed to carry out an operation,
+// for example because a command could not be started or a file could not be
+// opened in the guest.
+type RemoteError struct {
+	Op      string
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "agent " + e.Op + ": " + e.Message
+}
+
+// Client talks to the guest agent.
+type Client struct {
+	dialer PortDialer
+	port   uint32
+}
+
+// NewClient returns a Client that reaches the agent on the given port through
+// the provided dialer.
+func NewClient(dialer PortDialer, port uint32) *Client {
+	return &Client{
+		dialer: dialer,
+		port:   port,
+	}
+}
+
+// Ping checks that the agent is reachable and returns the protocol version it
+// speaks.
+func (c *Client) Ping(ctx context.Context) (int, error) {
+	var res result
+	err := c.do(ctx, request{Op: opPing}, func(conn *clientConn) error {
+		var err error
+		res, err = conn.waitResult(nil)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return res.Version, nil
+}
+
+// WaitReady polls the agent until it responds to a ping or the context is
+// done. A zero interval uses a default of 100ms.
+func (c *Client) WaitReady(ctx context.Context, interval time.Duration) error {
+	if interval == 0 {
+		interval = defaultReadyPollInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := c.Ping(ctx); err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Exec runs the command inside the guest and waits for it to finish, streaming
+// its stdin, stdout and stderr. It returns the exit code of the process. A
+// process killed by a signal reports an exit code of 128 plus the signal
+// number. Cancelling the context kills the process.
+func (c *Client) Exec(ctx context.Context, cmd Command) (int, error) {
+	var res result
+	err := c.do(ctx, request{Op: opExec, Exec: &cmd}, func(conn *clientConn) error {
+		if cmd.Stdin != nil {
+			go func() {
+				// if reading stdin fails, close the process' stdin rather than
+				// leaving it waiting for more input
+				if _, ok := conn.fw.copyToFrames(frameStdin, cmd.Stdin).(*sourceError); ok {
+					conn.fw.writeFrame(frameStdin, nil)
+				}
+			}()
+		} else if err := conn.fw.writeFrame(frameStdin, nil); err != nil {
+			return err
+		}
+
+		var err error
+		res, err = conn.waitResult(func(t frameType, payload []byte) error {
+			var w io.Writer
+			switch t {
+			case frameStdout:
+				w = cmd.Stdout
+			case frameStderr:
+				w = cmd.Stderr
+			default:
+				return errors.Errorf("unexpected frame type %d", t)
+			}
+
+			if w == nil {
+				return nil
+			}
+
+			_, err := w.Write(payload)
+			return err
+		})
+		return err
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	return res.ExitCode, nil
+}
+
+// CopyIn writes the contents of src to the file at dstPath inside the guest,
+// creating or replacing it with the given permission bits.
+func (c *Client) CopyIn(ctx context.Context, src io.Reader, dstPath string, mode os.FileMode) error {
+	return c.do(ctx, request{Op: opCopyIn, Path: dstPath, Mode: uint32(mode.Perm())}, func(conn *clientConn) error {
+		// The agent may reject the request before reading all of the data, in
+		// which case its result explains why sending the data failed. If src
+		// itself failed, the copy is aborted by closing the connection.
+		copyErr := conn.fw.copyToFrames(frameData, src)
+		if _, ok := copyErr.(*sourceError); ok {
+			return copyErr
+		}
+
+		if _, err := conn.waitResult(nil); err != nil {
+			if _, ok := err.(*RemoteError); ok || copyErr == nil {
+				return err
+			}
+		}
+
+		return copyErr
+	})
+}
+
+// CopyOut writes the contents of the file at srcPath inside the guest to dst.
+func (c *Client) CopyOut(ctx context.Context, srcPath string, dst io.Writer) error {
+	return c.do(ctx, request{Op: opCopyOut, Path: srcPath}, func(conn *clientConn) error {
+		_, err := conn.waitResult(func(t frameType, payload []byte) error {
+			if t != frameData {
+				return errors.Errorf("unexpected frame type %d", t)
+			}
+
+			_, err := dst.Write(payload)
+			return err
+		})
+		return err
+	})
+}
+
+// do opens a connection to the agent, sends the request and runs fn. The
+// connection is closed when the context is done.
+func (c *Client) do(ctx context.Context, req request, fn func(*clientConn) error) error {
+	conn, err := c.dialer.DialPort(ctx, c.port)
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to agent on port %d", c.port)
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := writeRequest(conn, req); err != nil {
+		return c.ctxErr(ctx, errors.Wrapf(err, "failed to send %s request", req.Op))
+	}
+
+	cc := &clientConn{
+		op: req.Op,
+		r:  bufio.NewReader(conn),
+		fw: &frameWriter{w: conn},
+	}
+
+	return c.ctxErr(ctx, fn(cc))
+}
+
+// ctxErr prefers the context's error over errors caused by closing the
+// connection when the context was done.
+func (c *Client) ctxErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+type clientConn struct {
+	op string
+	r  *bufio.Reader
+	fw *frameWriter
+}
+
+// waitResult reads frames until the result frame arrives, passing any other
+// frames to onFrame.
+func (cc *clientConn) waitResult(onFrame func(frameType, []byte) error) (result, error) {
+	var res result
+	for {
+		t, payload, err := readFrame(cc.r)
+		if err != nil {
+			return res, errors.Wrapf(err, "failed to read %s response", cc.op)
+		}
+
+		if t == frameResult {
+			if err := json.Unmarshal(payload, &res); err != nil {
+				return res, errors.Wrapf(err, "failed to parse %s result", cc.op)
+			}
+
+			if res.Error != "" {
+				return res, &RemoteError{Op: cc.op, Message: res.Error}
+			}
+
+			return res, nil
+		}
+
+		// empty frames only mark the end of a stream
+		if len(payload) == 0 {
+			continue
+		}
+
+		if onFrame == nil {
+			return res, errors.Errorf("unexpected frame type %d in %s response", t, cc.op)
+		}
+
+		if err := onFrame(t, payload); err != nil {
+			return res, err
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// fc-agent is the guest side of the agent package. It listens on a vsock port
+// inside the guest and serves exec and file transfer requests from the host.
+package main
+
+import (
+	"flag"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk/agent"
+)
+
+func main() {
+	port := flag.Uint("port", uint(agent.DefaultPort), "vsock port to listen on")
+	debug := flag.Bool("debug", false, "enable debug logging")
+	flag.Parse()
+
+	logger := log.New()
+	if *debug {
+		logger.SetLevel(log.DebugLevel)
+	}
+	entry := log.NewEntry(logger)
+
+	listener, err := agent.ListenVsock(uint32(*port))
+	if err != nil {
+		entry.WithError(err).Error("failed to listen")
+		os.Exit(1)
+	}
+
+	entry.Infof("listening on vsock port %d", *port)
+	if err := agent.NewServer(entry).Serve(listener); err != nil {
+		entry.WithError(err).Error("failed to serve")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+/*
+Package agent implements a small guest agent and the host-side client used to
+talk to it over a Firecracker vsock device. It allows running commands in the
+guest with streamed stdio, copying files in and out of the guest and checking
+that the guest is ready, without requiring networking or SSH in the guest.
+
+The guest side is provided by the fc-agent binary in the cmd/fc-agent
+directory, which should be started by the guest's init system. The host side
+is the Client, which is usually constructed with the VsockDialer of a
+firecracker.Machine:
+
+	dialer, err := machine.VsockDialer()
+	if err != nil {
+		return err
+	}
+	client := agent.NewClient(dialer, agent.DefaultPort)
+
+# Protocol
+
+Every operation uses its own connection. The client starts by sending a single
+JSON encoded request terminated by a newline. Afterwards both peers exchange
+frames, each made of a one byte frame type, a four byte big-endian payload
+length and the payload itself. A zero length stdin or data frame marks the end
+of the corresponding stream. The server always ends an operation by sending a
+result frame carrying a JSON encoded result.
+*/
+package agent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultPort is the vsock port the guest agent listens on by default.
+const DefaultPort uint32 = 10789
+
+// ProtocolVersion is reported by the agent in response to a ping.
+const ProtocolVersion = 1
+
+const (
+	opPing    = "ping"
+	opExec    = "exec"
+	opCopyIn  = "copy_in"
+	opCopyOut = "copy_out"
+)
+
+type frameType byte
+
+const (
+	frameStdin frameType = iota + 1
+	frameStdout
+	frameStderr
+	frameData
+	frameResult
+)
+
+// maxFrameSize bounds the payload of a single frame.
+const maxFrameSize = 1 << 20
+
+// chunkSize is the size of the buffer used when streaming data into frames.
+const chunkSize = 32 * 1024
+
+// request is the first message sent by the client on a connection.
+type request struct {
+	Op string `json:"op"`
+
+	// Exec is set for exec operations.
+	Exec *Command `json:"exec,omitempty"`
+
+	// Path and Mode are set for copy operations.
+	Path string `json:"path,omitempty"`
+	Mode uint32 `json:"mode,omitempty"`
+}
+
+// result is the final message sent by the server on a connection.
+type result struct {
+	Version  int    `json:"version,omitempty"`
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+}
+
+// frameWriter serializes frames written from multiple goroutines.
+type frameWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (fw *frameWriter) writeFrame(t frameType, payload []byte) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	var header [5]byte
+	header[0] = byte(t)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := fw.w.Write(header[:]); err != nil {
+		return err
+	}
+
+	if len(payload) == 0 {
+		return nil
+	}
+
+	_, err := fw.w.Write(payload)
+	return err
+}
+
+func (fw *frameWriter) writeResult(res result) error {
+	payload, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+
+	return fw.writeFrame(frameResult, payload)
+}
+
+// copyToFrames streams the contents of r as frames of type t, followed by an
+// empty frame marking the end of the stream.
+func (fw *frameWriter) copyToFrames(t frameType, r io.Reader) error {
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if werr := fw.writeFrame(t, buf[:n]); werr != nil {
+				return werr
+			}
+		}
+
+		if err == io.EOF {
+			return fw.writeFrame(t, nil)
+		} else if err != nil {
+			return &sourceError{err: err}
+		}
+	}
+}
+
+// sourceError is returned by copyToFrames when reading from its source
+// fails, as opposed to failing to send frames to the peer.
+type sourceError struct {
+	err error
+}
+
+func (e *sourceError) Error() string {
+	return "failed to read source: " + e.err.Error()
+}
+
+// streamWriter is an io.Writer that sends everything written to it as frames
+// of a single type.
+type streamWriter struct {
+	fw *frameWriter
+	t  frameType
+}
+
+func (sw streamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > chunkSize {
+			n = chunkSize
+		}
+
+		if err := sw.fw.writeFrame(sw.t, p[:n]); err != nil {
+			return written, err
+		}
+
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+func readFrame(r *bufio.Reader) (frameType, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxFrameSize {
+		return 0, nil, errors.Errorf("frame of %d bytes exceeds maximum of %d bytes", length, maxFrameSize)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	return frameType(header[0]), payload, nil
+}
+
+func writeRequest(w io.Writer, req request) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(payload, '\n'))
+	return err
+}
+
+func readRequest(r *bufio.Reader) (request, error) {
+	var req request
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return req, err
+	}
+
+	err = json.Unmarshal(line, &req)
+	return req, err
+}
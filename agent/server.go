@@ -0,0 +1,224 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package agent
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Server is the guest side of the agent. It serves requests from Clients on
+// the connections accepted from a listener.
+type Server struct {
+	logger *log.Entry
+}
+
+// NewServer returns a new Server that logs to the provided logger.
+func NewServer(logger *log.Entry) *Server {
+	return &Server{
+		logger: logger,
+	}
+}
+
+// Serve accepts connections from the listener and serves each of them in its
+// own goroutine. It returns when the listener fails to accept a connection.
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	fw := &frameWriter{w: conn}
+
+	req, err := readRequest(r)
+	if err != nil {
+		s.logger.WithError(err).Warn("failed to read request")
+		return
+	}
+
+	s.logger.Debugf("serving %s request", req.Op)
+
+	var res result
+	switch req.Op {
+	case opPing:
+		res.Version = ProtocolVersion
+	case opExec:
+		res, err = s.exec(req, r, fw)
+	case opCopyIn:
+		err = s.copyIn(req, r)
+	case opCopyOut:
+		err = s.copyOut(req, fw)
+	default:
+		err = errors.Errorf("unknown operation %q", req.Op)
+	}
+
+	if err != nil {
+		s.logger.WithError(err).Warnf("%s request failed", req.Op)
+		res.Error = err.Error()
+	}
+
+	if err := fw.writeResult(res); err != nil {
+		s.logger.WithError(err).Warnf("failed to send %s result", req.Op)
+	}
+}
+
+func (s *Server) exec(req request, r *bufio.Reader, fw *frameWriter) (result, error) {
+	var res result
+	if req.Exec == nil || len(req.Exec.Args) == 0 {
+		return res, errors.New("no command specified")
+	}
+
+	cmd := exec.Command(req.Exec.Args[0], req.Exec.Args[1:]...)
+	cmd.Env = req.Exec.Env
+	cmd.Dir = req.Exec.Dir
+	cmd.Stdout = streamWriter{fw: fw, t: frameStdout}
+	cmd.Stderr = streamWriter{fw: fw, t: frameStderr}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return res, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return res, err
+	}
+
+	// Forward stdin frames to the process until the client signals the end
+	// of stdin. If the client goes away before the process exits, the process
+	// is killed.
+	go func() {
+		stdinClosed := false
+		for {
+			t, payload, err := readFrame(r)
+			if err != nil {
+				if !stdinClosed {
+					stdin.Close()
+				}
+				cmd.Process.Kill()
+				return
+			}
+
+			if t != frameStdin || stdinClosed {
+				continue
+			}
+
+			if len(payload) == 0 {
+				stdinClosed = true
+				stdin.Close()
+				continue
+			}
+
+			if _, err := stdin.Write(payload); err != nil {
+				s.logger.WithError(err).Debug("failed to write to process stdin")
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		res.ExitCode = exitCode(exitErr)
+		err = nil
+	}
+
+	return res, err
+}
+
+func exitCode(exitErr *exec.ExitError) int {
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return -1
+	}
+
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+
+	return status.ExitStatus()
+}
+
+func (s *Server) copyIn(req request, r *bufio.Reader) error {
+	if req.Path == "" {
+		return errors.New("no path specified")
+	}
+
+	// write to a temporary file first so a failed copy does not leave a
+	// partial file behind
+	tmp, err := ioutil.TempFile(filepath.Dir(req.Path), "."+filepath.Base(req.Path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	for {
+		t, payload, err := readFrame(r)
+		if err != nil {
+			return errors.Wrap(err, "failed to read file contents")
+		}
+
+		if t != frameData {
+			return errors.Errorf("unexpected frame type %d", t)
+		}
+
+		if len(payload) == 0 {
+			break
+		}
+
+		if _, err := tmp.Write(payload); err != nil {
+			return err
+		}
+	}
+
+	mode := os.FileMode(req.Mode)
+	if mode == 0 {
+		mode = 0644
+	}
+
+	if err := tmp.Chmod(mode); err != nil {
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), req.Path)
+}
+
+func (s *Server) copyOut(req request, fw *frameWriter) error {
+	f, err := os.Open(req.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return fw.copyToFrames(frameData, f)
+}
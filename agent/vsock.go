@@ -0,0 +1,137 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// VsockAddr is the address of an AF_VSOCK socket.
+type VsockAddr struct {
+	CID  uint32
+	Port uint32
+}
+
+// Network returns the address's network name, "vsock".
+func (a *VsockAddr) Network() string {
+	return "vsock"
+}
+
+func (a *VsockAddr) String() string {
+	return fmt.Sprintf("%d:%d", a.CID, a.Port)
+}
+
+// ListenVsock listens for AF_VSOCK connections on the given port. It is meant
+// to be used inside the guest, where Firecracker delivers host-initiated
+// vsock connections.
+func ListenVsock(port uint32) (net.Listener, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create vsock socket")
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_ANY, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrapf(err, "failed to bind vsock port %d", port)
+	}
+
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrapf(err, "failed to listen on vsock port %d", port)
+	}
+
+	addr := &VsockAddr{CID: unix.VMADDR_CID_ANY, Port: port}
+
+	// as for vsockConn, the runtime poller waits for connections, and closing
+	// the file wakes up any pending Accept, which shutdown does not do for
+	// listening AF_VSOCK sockets
+	file := os.NewFile(uintptr(fd), "vsock-listener:"+addr.String())
+	rawConn, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "failed to listen on vsock port %d", port)
+	}
+
+	return &vsockListener{
+		file:    file,
+		rawConn: rawConn,
+		addr:    addr,
+	}, nil
+}
+
+type vsockListener struct {
+	file    *os.File
+	rawConn syscall.RawConn
+	addr    *VsockAddr
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	var connFd int
+	var sa unix.Sockaddr
+	var acceptErr error
+	err := l.rawConn.Read(func(fd uintptr) bool {
+		connFd, sa, acceptErr = unix.Accept4(int(fd), unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK)
+		// wait for a connection to be ready when there is none yet
+		return acceptErr != unix.EAGAIN
+	})
+	if err == nil {
+		err = acceptErr
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to accept vsock connection")
+	}
+
+	remote := &VsockAddr{}
+	if vmAddr, ok := sa.(*unix.SockaddrVM); ok {
+		remote.CID = vmAddr.CID
+		remote.Port = vmAddr.Port
+	}
+
+	return &vsockConn{
+		File:   os.NewFile(uintptr(connFd), "vsock:"+remote.String()),
+		local:  l.addr,
+		remote: remote,
+	}, nil
+}
+
+func (l *vsockListener) Close() error {
+	return l.file.Close()
+}
+
+func (l *vsockListener) Addr() net.Addr {
+	return l.addr
+}
+
+// vsockConn is a net.Conn backed by a non-blocking AF_VSOCK socket. os.File
+// registers such file descriptors with the runtime poller, which provides
+// blocking reads and writes as well as deadlines.
+type vsockConn struct {
+	*os.File
+	local  *VsockAddr
+	remote *VsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *vsockConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,46 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package agent
+
+import (
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVsockListenerCloseUnblocksServe(t *testing.T) {
+	listener, err := ListenVsock(DefaultPort + 1)
+	if err != nil {
+		t.Skipf("vsock is not available: %v", err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- NewServer(log.NewEntry(log.New())).Serve(listener)
+	}()
+
+	// give Serve time to block in Accept
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, listener.Close())
+
+	select {
+	case err := <-served:
+		assert.Error(t, err, "Serve should return the error of Accept on a closed listener")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the listener was closed")
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"debug/elf"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// KernelFormatELF is an uncompressed ELF kernel image, such as vmlinux.
+	KernelFormatELF = "elf"
+	// KernelFormatARM64Image is an uncompressed arm64 kernel image, such as
+	// arch/arm64/boot/Image.
+	KernelFormatARM64Image = "arm64-image"
+)
+
+const (
+	// kernelVersionPrefix starts the banner the kernel prints when booting,
+	// which is stored uncompressed in the image.
+	kernelVersionPrefix = "Linux version "
+	// maxKernelVersionLength bounds the kernel banner.
+	maxKernelVersionLength = 256
+
+	// arm64ImageMagicOffset is the offset of the magic number in the arm64
+	// kernel image header, see Documentation/arm64/booting.rst
+	arm64ImageMagicOffset = 56
+	arm64ImageMagic       = "ARM\x64"
+
+	// bzImageMagicOffset is the offset of the signature of the x86 boot
+	// protocol header found in bzImages, see Documentation/x86/boot.rst
+	bzImageMagicOffset = 0x202
+	bzImageMagic       = "HdrS"
+
+	// kernelHeaderLength is enough of a kernel image to tell its format.
+	kernelHeaderLength = bzImageMagicOffset + len(bzImageMagic)
+
+	// maxCompressionMagicLength is the length of the longest magic number of
+	// compressionMagics.
+	maxCompressionMagicLength = 6
+)
+
+// elfMachines maps the host architectures Firecracker runs on to the ELF
+// machine of the kernels it can boot.
+var elfMachines = map[string]elf.Machine{
+	"amd64": elf.EM_X86_64,
+	"arm64": elf.EM_AARCH64,
+}
+
+// compressionMagics identifies the compression formats supported by the
+// kernel for initrds by the magic number of their first bytes.
+var compressionMagics = []struct {
+	name  string
+	magic []byte
+}{
+	{name: "gzip", magic: []byte{0x1f, 0x8b}},
+	{name: "bzip2", magic: []byte("BZh")},
+	{name: "xz", magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{name: "lzma", magic: []byte{0x5d, 0x00, 0x00}},
+	{name: "lzo", magic: []byte{0x89, 'L', 'Z', 'O', 0x00}},
+	{name: "lz4", magic: []byte{0x02, 0x21, 0x4c, 0x18}},
+	{name: "zstd", magic: []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// cpioMagics are the magic numbers of the "newc" and "crc" cpio formats
+// supported by the kernel for initrds.
+var cpioMagics = [][]byte{[]byte("070701"), []byte("070702")}
+
+// KernelInfo describes a kernel image.
+type KernelInfo struct {
+	// Format is the format of the image, KernelFormatELF or
+	// KernelFormatARM64Image.
+	Format string
+
+	// Arch is the architecture the kernel is built for, using the names of
+	// runtime.GOARCH.
+	Arch string
+
+	// Version is the banner the kernel prints when booting, such as
+	// "Linux version 4.14.55 (...) #1 SMP ...", or blank if it was not found.
+	Version string
+}
+
+// InspectKernelImage checks that the file at path is a kernel image
+// Firecracker can boot on this host, which is an uncompressed ELF vmlinux, or
+// an uncompressed Image on arm64, and returns its description. Compressed
+// kernel images, such as bzImages, are reported as errors. Finding the kernel
+// version requires the whole image to be read.
+func InspectKernelImage(path string) (*KernelInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open kernel image")
+	}
+	defer f.Close()
+
+	info, err := inspectKernelFormat(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "failed to seek kernel image")
+	}
+
+	info.Version, err = findKernelVersion(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read kernel image")
+	}
+
+	return info, nil
+}
+
+// checkKernelImage runs the checks of InspectKernelImage that only read the
+// headers of the kernel image at path, leaving out the search for its version.
+func checkKernelImage(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to open kernel image")
+	}
+	defer f.Close()
+
+	_, err = inspectKernelFormat(f)
+	return err
+}
+
+// inspectKernelFormat returns the format and architecture of the kernel image
+// read from f, which are found in its headers.
+func inspectKernelFormat(f *os.File) (*KernelInfo, error) {
+	header := make([]byte, kernelHeaderLength)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, errors.Wrap(err, "failed to read kernel image header")
+	}
+	header = header[:n]
+
+	info := &KernelInfo{}
+	switch {
+	case bytes.HasPrefix(header, []byte(elf.ELFMAG)):
+		elfFile, err := elf.NewFile(f)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse ELF kernel image")
+		}
+
+		if elfFile.Type != elf.ET_EXEC {
+			return nil, errors.Errorf("ELF kernel image is of type %s, not an executable", elfFile.Type)
+		}
+
+		info.Format = KernelFormatELF
+		for arch, machine := range elfMachines {
+			if elfFile.Machine == machine {
+				info.Arch = arch
+			}
+		}
+		if info.Arch == "" {
+			return nil, errors.Errorf("ELF kernel image is built for unsupported machine %s", elfFile.Machine)
+		}
+	case hasMagicAt(header, arm64ImageMagicOffset, arm64ImageMagic):
+		info.Format = KernelFormatARM64Image
+		info.Arch = "arm64"
+	case hasMagicAt(header, bzImageMagicOffset, bzImageMagic):
+		return nil, errors.New("kernel image is a compressed bzImage, Firecracker requires an uncompressed " +
+			"vmlinux, which is found at the root of the kernel build tree or can be extracted with " +
+			"scripts/extract-vmlinux")
+	default:
+		if compression := compressionOf(header); compression != "" {
+			return nil, errors.Errorf("kernel image is %s compressed, Firecracker requires an uncompressed kernel image", compression)
+		}
+		return nil, errors.New("kernel image is not an ELF vmlinux or an arm64 Image")
+	}
+
+	if _, ok := elfMachines[runtime.GOARCH]; ok && info.Arch != runtime.GOARCH {
+		return nil, errors.Errorf("kernel image is built for %s, which cannot be booted on %s hosts", info.Arch, runtime.GOARCH)
+	}
+
+	return info, nil
+}
+
+// InitrdInfo describes an initrd.
+type InitrdInfo struct {
+	// Compression is the compression format of the initrd, such as "gzip",
+	// or blank if it is not compressed.
+	Compression string
+}
+
+// InspectInitrd checks that the file at path looks like an initrd the kernel
+// can unpack, which is a cpio archive in the "newc" format, optionally
+// compressed, and returns its description. The contents of gzip and bzip2
+// compressed initrds are checked too, while other compression formats are
+// only recognized by their magic number.
+func InspectInitrd(path string) (*InitrdInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open initrd")
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header, err := r.Peek(maxCompressionMagicLength)
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "failed to read initrd header")
+	}
+
+	info := &InitrdInfo{}
+	if isCPIO(header) {
+		return info, nil
+	}
+
+	info.Compression = compressionOf(header)
+
+	var contents io.Reader
+	switch info.Compression {
+	case "":
+		return nil, errors.New("initrd is neither a cpio archive nor compressed")
+	case "gzip":
+		gzipReader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read gzip compressed initrd")
+		}
+		contents = gzipReader
+	case "bzip2":
+		contents = bzip2.NewReader(r)
+	default:
+		return info, nil
+	}
+
+	contentsHeader := make([]byte, len(cpioMagics[0]))
+	if _, err := io.ReadFull(contents, contentsHeader); err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s compressed initrd", info.Compression)
+	}
+
+	if !isCPIO(contentsHeader) {
+		return nil, errors.Errorf("initrd is %s compressed but does not contain a cpio archive", info.Compression)
+	}
+
+	return info, nil
+}
+
+func hasMagicAt(header []byte, offset int, magic string) bool {
+	return len(header) >= offset+len(magic) && string(header[offset:offset+len(magic)]) == magic
+}
+
+func compressionOf(header []byte) string {
+	for _, compression := range compressionMagics {
+		if bytes.HasPrefix(header, compression.magic) {
+			return compression.name
+		}
+	}
+
+	return ""
+}
+
+func isCPIO(header []byte) bool {
+	for _, magic := range cpioMagics {
+		if bytes.HasPrefix(header, magic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// findKernelVersion returns the first kernel banner found in r, if any.
+func findKernelVersion(r io.Reader) (string, error) {
+	const chunkSize = 64 * 1024
+	prefix := []byte(kernelVersionPrefix)
+
+	// each read is appended to the end of the previous chunk that may hold the
+	// start of a banner
+	buf := make([]byte, 0, chunkSize+maxKernelVersionLength)
+	for {
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+
+		if i := bytes.Index(buf, prefix); i >= 0 && (len(buf)-i >= maxKernelVersionLength || err != nil) {
+			banner := buf[i:]
+			if len(banner) > maxKernelVersionLength {
+				banner = banner[:maxKernelVersionLength]
+			}
+			if end := bytes.IndexAny(banner, "\x00\n"); end >= 0 {
+				banner = banner[:end]
+			}
+			return string(banner), nil
+		}
+
+		if err == io.EOF {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+
+		if len(buf) == cap(buf) {
+			keep := maxKernelVersionLength
+			if i := bytes.Index(buf, prefix); i >= 0 {
+				keep = len(buf) - i
+			}
+			buf = buf[:copy(buf, buf[len(buf)-keep:])]
+		}
+	}
+}
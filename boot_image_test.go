@@ -0,0 +1,238 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testKernelVersion = "Linux version 4.14.55-84.37.amzn2.x86_64 (mockbuild@ip-10-0-1-79) #1 SMP Wed Jul 25 18:47:15 UTC 2018"
+
+// hostELFMachine returns the ELF machine of the kernels the host can boot.
+func hostELFMachine() elf.Machine {
+	if machine, ok := elfMachines[runtime.GOARCH]; ok {
+		return machine
+	}
+	return elf.EM_X86_64
+}
+
+// testELFKernel returns a minimal ELF executable for the given machine
+// followed by padding bytes and the kernel banner.
+func testELFKernel(t *testing.T, machine elf.Machine, padding int) []byte {
+	t.Helper()
+
+	header := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(machine),
+		Version:   uint32(elf.EV_CURRENT),
+		Ehsize:    64,
+		Phentsize: 56,
+		Shentsize: 64,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var buf bytes.Buffer
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, header))
+	buf.Write(make([]byte, padding))
+	buf.WriteString(testKernelVersion + "\n\x00more rodata")
+	return buf.Bytes()
+}
+
+// writeTestKernel writes a minimal kernel image for the host to path.
+func writeTestKernel(t *testing.T, path string) {
+	t.Helper()
+	require.NoError(t, ioutil.WriteFile(path, testELFKernel(t, hostELFMachine(), 0), 0600))
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestInspectKernelImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestInspectKernelImage")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	otherMachine := elf.EM_AARCH64
+	if hostELFMachine() == elf.EM_AARCH64 {
+		otherMachine = elf.EM_X86_64
+	}
+
+	arm64Image := make([]byte, 64)
+	copy(arm64Image[arm64ImageMagicOffset:], arm64ImageMagic)
+
+	bzImage := make([]byte, 1024)
+	copy(bzImage[bzImageMagicOffset:], bzImageMagic)
+
+	cases := []struct {
+		name        string
+		contents    []byte
+		expected    *KernelInfo
+		expectedErr string
+	}{
+		{
+			name:     "vmlinux",
+			contents: testELFKernel(t, hostELFMachine(), 0),
+			expected: &KernelInfo{Format: KernelFormatELF, Arch: runtime.GOARCH, Version: testKernelVersion},
+		},
+		{
+			name:     "version across read chunks",
+			contents: testELFKernel(t, hostELFMachine(), 64*1024-70),
+			expected: &KernelInfo{Format: KernelFormatELF, Arch: runtime.GOARCH, Version: testKernelVersion},
+		},
+		{
+			name:        "other architecture",
+			contents:    testELFKernel(t, otherMachine, 0),
+			expectedErr: "cannot be booted",
+		},
+		{
+			name:        "unsupported machine",
+			contents:    testELFKernel(t, elf.EM_386, 0),
+			expectedErr: "unsupported machine",
+		},
+		{
+			name:        "bzImage",
+			contents:    bzImage,
+			expectedErr: "bzImage",
+		},
+		{
+			name:        "compressed",
+			contents:    gzipped(t, testELFKernel(t, hostELFMachine(), 0)),
+			expectedErr: "gzip compressed",
+		},
+		{
+			name:        "unknown",
+			contents:    []byte("not a kernel"),
+			expectedErr: "not an ELF vmlinux",
+		},
+	}
+
+	if runtime.GOARCH == "arm64" {
+		cases = append(cases, struct {
+			name        string
+			contents    []byte
+			expected    *KernelInfo
+			expectedErr string
+		}{
+			name:     "arm64 Image",
+			contents: arm64Image,
+			expected: &KernelInfo{Format: KernelFormatARM64Image, Arch: "arm64"},
+		})
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(dir, c.name)
+			require.NoError(t, ioutil.WriteFile(path, c.contents, 0600))
+
+			// validation only checks the headers, with the same outcome
+			checkErr := checkKernelImage(path)
+
+			info, err := InspectKernelImage(path)
+			if c.expectedErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), c.expectedErr)
+				require.Error(t, checkErr)
+				assert.Contains(t, checkErr.Error(), c.expectedErr)
+				return
+			}
+
+			assert.NoError(t, checkErr)
+
+			require.NoError(t, err)
+			assert.Equal(t, c.expected, info)
+		})
+	}
+}
+
+func TestInspectInitrd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestInspectInitrd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cpio := []byte("070701000000000000000000000000000000000000000000")
+
+	cases := []struct {
+		name        string
+		contents    []byte
+		expected    *InitrdInfo
+		expectedErr string
+	}{
+		{
+			name:     "cpio",
+			contents: cpio,
+			expected: &InitrdInfo{},
+		},
+		{
+			name:     "gzip compressed cpio",
+			contents: gzipped(t, cpio),
+			expected: &InitrdInfo{Compression: "gzip"},
+		},
+		{
+			name:     "xz compressed",
+			contents: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00},
+			expected: &InitrdInfo{Compression: "xz"},
+		},
+		{
+			name:        "gzip compressed garbage",
+			contents:    gzipped(t, []byte("not a cpio archive")),
+			expectedErr: "does not contain a cpio archive",
+		},
+		{
+			name:        "unknown",
+			contents:    []byte("not an initrd"),
+			expectedErr: "neither a cpio archive nor compressed",
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(dir, c.name)
+			require.NoError(t, ioutil.WriteFile(path, c.contents, 0600))
+
+			info, err := InspectInitrd(path)
+			if c.expectedErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), c.expectedErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, c.expected, info)
+		})
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// fc-gc cleans up the resources left behind by SDK processes that exited
+// without cleaning up after their VMs, such as network namespaces, CNI
+// networks, IPAM allocations, tap devices, sockets, fifos and jail
+// directories. With -dry-run, it only lists them.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// stringList is a flag which can be repeated
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func main() {
+	var cfg firecracker.GCConfig
+	var execNames, cniBinPath, fileGlobs, tapGlobs, ipamStorePaths stringList
+	flag.Var(&execNames, "exec-name", "name of the Firecracker binary (repeatable, default \"firecracker\")")
+	flag.StringVar(&cfg.ChrootBaseDir, "chroot-base-dir", "", "chroot base directory of the jailer (default \"/srv/jailer\")")
+	flag.StringVar(&cfg.CNICacheDir, "cni-cache-dir", "", "directory of the CNI cache directories of VMs (default \"/var/lib/cni\")")
+	flag.Var(&cniBinPath, "cni-bin-dir", "directory of the CNI plugins (repeatable, default \"/opt/cni/bin\")")
+	flag.StringVar(&cfg.NetNSDir, "netns-dir", "", "directory of the network namespaces of VMs (default \"/var/run/netns\")")
+	flag.Var(&fileGlobs, "file-glob", "glob pattern of API sockets and fifos (repeatable)")
+	flag.Var(&tapGlobs, "tap-glob", "glob pattern of tap device names (repeatable)")
+	flag.Var(&ipamStorePaths, "ipam-store", "path of an IPAM store (repeatable)")
+	flag.DurationVar(&cfg.MinAge, "min-age", time.Minute, "minimum age of the resources to clean up, negative to ignore their age")
+	dryRun := flag.Bool("dry-run", false, "list the resources without cleaning them up")
+	debug := flag.Bool("debug", false, "enable debug logging")
+	flag.Parse()
+
+	logger := log.New()
+	if *debug {
+		logger.SetLevel(log.DebugLevel)
+	}
+	cfg.Logger = log.NewEntry(logger)
+	cfg.ExecNames = execNames
+	cfg.CNIBinPath = cniBinPath
+	cfg.FileGlobs = fileGlobs
+	cfg.TapGlobs = tapGlobs
+	cfg.IPAMStorePaths = ipamStorePaths
+
+	gc := firecracker.NewGarbageCollector(cfg)
+	ctx := context.Background()
+
+	var resources []firecracker.GCResource
+	var err error
+	if *dryRun {
+		resources, err = gc.Inventory(ctx)
+	} else {
+		resources, err = gc.Collect(ctx)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tVMID\tPATH\tIP\tSTATE")
+	for _, resource := range resources {
+		state := "collected"
+		if *dryRun {
+			state = "orphaned"
+			if resource.InUse {
+				state = "in use"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", resource.Kind, resource.VMID, resource.Path, resource.IP, state)
+	}
+	w.Flush()
+
+	if err != nil {
+		cfg.Logger.WithError(err).Error("failed to collect resources")
+		os.Exit(1)
+	}
+}
@@ -3,3 +3,9 @@ package args
 const TCRedirectTapName = "TC_REDIRECT_TAP_NAME"
 const TCRedirectTapUID = "TC_REDIRECT_TAP_UID"
 const TCRedirectTapGID = "TC_REDIRECT_TAP_GID"
+const TCRedirectTapMTU = "TC_REDIRECT_TAP_MTU"
+const TCRedirectTapQueues = "TC_REDIRECT_TAP_QUEUES"
+const TCRedirectTapVNetHeader = "TC_REDIRECT_TAP_VNET_HDR"
+const TCRedirectTapVMMac = "TC_REDIRECT_TAP_VM_MAC"
+const TCRedirectTapMode = "TC_REDIRECT_TAP_MODE"
+const TCRedirectTapBridgeName = "TC_REDIRECT_TAP_BRIDGE_NAME"
@@ -14,12 +14,16 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	pluginargs "github.com/firecracker-microvm/firecracker-go-sdk/cni/cmd/tc-redirect-tap/args"
+	"net"
 	"os"
 	"strconv"
 	"strings"
 
+	pluginargs "github.com/firecracker-microvm/firecracker-go-sdk/cni/cmd/tc-redirect-tap/args"
+
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
@@ -28,10 +32,26 @@ import (
 	"github.com/containernetworking/plugins/pkg/utils/buildversion"
 	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 
 	"github.com/firecracker-microvm/firecracker-go-sdk/cni/internal"
 )
 
+const (
+	// redirectModeTC connects the tap device and the redirect interface with a pair of u32
+	// redirect filters on their ingress qdiscs
+	redirectModeTC = "tc"
+	// redirectModeEBPF connects the tap device and the redirect interface with a pair of eBPF
+	// redirect filters on their ingress qdiscs, which cost less per packet than u32 filters
+	redirectModeEBPF = "ebpf"
+	// redirectModeBridge attaches the tap device and the redirect interface to a bridge,
+	// which is only shared with other redirect interfaces if its name is configured
+	redirectModeBridge = "bridge"
+	// redirectModeMacvtap is not supported, see plugin.validate
+	redirectModeMacvtap = "macvtap"
+)
+
 func main() {
 	skel.PluginMain(add, check, del,
 		// support CNI versions that support plugin chaining
@@ -121,10 +141,21 @@ func newPlugin(args *skel.CmdArgs) (*plugin, error) {
 		}
 	}
 
+	conf, err := parseNetConf(args.StdinData)
+	if err != nil {
+		return nil, err
+	}
+
 	plugin := &plugin{
 		NetlinkOps: internal.DefaultNetlinkOps(),
+		tapName:    defaultTapName(args.ContainerID, args.IfName),
 		tapUID:     os.Geteuid(),
 		tapGID:     os.Getegid(),
+		tapQueues:  1,
+		vnetHeader: true,
+
+		redirectMode: redirectModeTC,
+		bridgeName:   defaultBridgeName(args.IfName),
 
 		// given the use case of supporting VMs, we call the "containerID" a "vmID"
 		vmID: args.ContainerID,
@@ -135,32 +166,265 @@ func newPlugin(args *skel.CmdArgs) (*plugin, error) {
 
 		currentResult: currentResult,
 	}
+
+	// settings of the network configuration are applied first, so that the
+	// CNI args can override them
+	err = plugin.applyNetConf(conf)
+	if err != nil {
+		return nil, err
+	}
+
 	parsedArgs, err := extractArgs(args.Args)
 	if err != nil {
 		return nil, err
 	}
 
+	err = plugin.applyArgs(parsedArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	err = plugin.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return plugin, nil
+}
+
+// netConf is the network configuration of the plugin, which can be used to
+// set the same settings as the CNI args in a conflist.
+type netConf struct {
+	types.NetConf
+
+	// TapName is the name of the tap device, see TC_REDIRECT_TAP_NAME
+	TapName string `json:"tapName,omitempty"`
+	// TapUID is the uid of the user-owner of the tap device, see TC_REDIRECT_TAP_UID
+	TapUID *int `json:"tapUID,omitempty"`
+	// TapGID is the gid of the group-owner of the tap device, see TC_REDIRECT_TAP_GID
+	TapGID *int `json:"tapGID,omitempty"`
+	// TapMTU overrides the MTU of the tap device, see TC_REDIRECT_TAP_MTU
+	TapMTU *int `json:"tapMTU,omitempty"`
+	// TapQueues is the number of queues of the tap device, see TC_REDIRECT_TAP_QUEUES
+	TapQueues *int `json:"tapQueues,omitempty"`
+	// VNetHeader enables vnet headers on the tap device, see TC_REDIRECT_TAP_VNET_HDR
+	VNetHeader *bool `json:"vnetHeader,omitempty"`
+	// VMMac is the MAC address of the VM's interface, see TC_REDIRECT_TAP_VM_MAC
+	VMMac string `json:"vmMac,omitempty"`
+	// RedirectMode is how the tap device is connected to the redirect interface, see
+	// TC_REDIRECT_TAP_MODE
+	RedirectMode string `json:"redirectMode,omitempty"`
+	// BridgeName is the name of the bridge used by the bridge redirect mode, see
+	// TC_REDIRECT_TAP_BRIDGE_NAME
+	BridgeName string `json:"bridgeName,omitempty"`
+}
+
+func parseNetConf(stdinData []byte) (*netConf, error) {
+	conf := &netConf{}
+	err := json.Unmarshal(stdinData, conf)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse network configuration")
+	}
+
+	return conf, nil
+}
+
+func (p *plugin) applyNetConf(conf *netConf) error {
+	if conf.TapName != "" {
+		p.tapName = conf.TapName
+	}
+
+	if conf.TapUID != nil {
+		p.tapUID = *conf.TapUID
+	}
+
+	if conf.TapGID != nil {
+		p.tapGID = *conf.TapGID
+	}
+
+	if conf.TapMTU != nil {
+		p.tapMTU = *conf.TapMTU
+	}
+
+	if conf.TapQueues != nil {
+		p.tapQueues = *conf.TapQueues
+	}
+
+	if conf.VNetHeader != nil {
+		p.vnetHeader = *conf.VNetHeader
+	}
+
+	if conf.VMMac != "" {
+		vmMac, err := net.ParseMAC(conf.VMMac)
+		if err != nil {
+			return errors.Wrapf(err, "vmMac should be a MAC address, got %q", conf.VMMac)
+		}
+		p.vmMac = vmMac
+	}
+
+	if conf.RedirectMode != "" {
+		p.redirectMode = conf.RedirectMode
+	}
+
+	if conf.BridgeName != "" {
+		p.bridgeName = conf.BridgeName
+	}
+
+	return nil
+}
+
+func (p *plugin) applyArgs(parsedArgs map[string]string) error {
 	if tapName, wasDefined := parsedArgs[pluginargs.TCRedirectTapName]; wasDefined {
-		plugin.tapName = tapName
+		p.tapName = tapName
+	}
+
+	intArgs := []struct {
+		key   string
+		name  string
+		value *int
+	}{
+		{key: pluginargs.TCRedirectTapUID, name: "tapUID", value: &p.tapUID},
+		{key: pluginargs.TCRedirectTapGID, name: "tapGID", value: &p.tapGID},
+		{key: pluginargs.TCRedirectTapMTU, name: "tapMTU", value: &p.tapMTU},
+		{key: pluginargs.TCRedirectTapQueues, name: "tapQueues", value: &p.tapQueues},
 	}
+	for _, arg := range intArgs {
+		val, wasDefined := parsedArgs[arg.key]
+		if !wasDefined {
+			continue
+		}
 
-	if tapUIDVal, wasDefined := parsedArgs[pluginargs.TCRedirectTapUID]; wasDefined {
-		tapUID, err := strconv.Atoi(tapUIDVal)
+		intVal, err := strconv.Atoi(val)
 		if err != nil {
-			return nil, errors.Wrapf(err, "tapUID should be numeric convertible, got %q", tapUIDVal)
+			return errors.Wrapf(err, "%s should be numeric convertible, got %q", arg.name, val)
 		}
-		plugin.tapUID = tapUID
+		*arg.value = intVal
 	}
 
-	if tapGIDVal, wasDefined := parsedArgs[pluginargs.TCRedirectTapGID]; wasDefined {
-		tapGID, err := strconv.Atoi(tapGIDVal)
+	if vnetHeaderVal, wasDefined := parsedArgs[pluginargs.TCRedirectTapVNetHeader]; wasDefined {
+		vnetHeader, err := strconv.ParseBool(vnetHeaderVal)
 		if err != nil {
-			return nil, errors.Wrapf(err, "tapGID should be numeric convertible, got %q", tapGIDVal)
+			return errors.Wrapf(err, "vnetHeader should be a boolean, got %q", vnetHeaderVal)
 		}
-		plugin.tapGID = tapGID
+		p.vnetHeader = vnetHeader
 	}
 
-	return plugin, nil
+	if vmMacVal, wasDefined := parsedArgs[pluginargs.TCRedirectTapVMMac]; wasDefined {
+		vmMac, err := net.ParseMAC(vmMacVal)
+		if err != nil {
+			return errors.Wrapf(err, "vmMac should be a MAC address, got %q", vmMacVal)
+		}
+		p.vmMac = vmMac
+	}
+
+	if redirectMode, wasDefined := parsedArgs[pluginargs.TCRedirectTapMode]; wasDefined {
+		p.redirectMode = redirectMode
+	}
+
+	if bridgeName, wasDefined := parsedArgs[pluginargs.TCRedirectTapBridgeName]; wasDefined {
+		p.bridgeName = bridgeName
+	}
+
+	return nil
+}
+
+const (
+	// minMTU is the minimum MTU of IPv4 devices
+	minMTU = 68
+	maxMTU = 65535
+
+	// maxTapQueues is the maximum number of queues of a tap device supported by the kernel
+	maxTapQueues = 256
+)
+
+// validate returns an error if the settings of the plugin are invalid
+func (p plugin) validate() error {
+	err := validateDeviceName("tap", p.tapName)
+	if err != nil {
+		return err
+	}
+
+	if p.tapUID < 0 {
+		return errors.Errorf("invalid tapUID %d", p.tapUID)
+	}
+
+	if p.tapGID < 0 {
+		return errors.Errorf("invalid tapGID %d", p.tapGID)
+	}
+
+	if p.tapMTU != 0 && (p.tapMTU < minMTU || p.tapMTU > maxMTU) {
+		return errors.Errorf("tapMTU %d should be between %d and %d", p.tapMTU, minMTU, maxMTU)
+	}
+
+	if p.tapQueues < 1 || p.tapQueues > maxTapQueues {
+		return errors.Errorf("tapQueues %d should be between 1 and %d", p.tapQueues, maxTapQueues)
+	}
+
+	if p.vmMac != nil && (len(p.vmMac) != 6 || p.vmMac[0]&0x01 != 0) {
+		return errors.Errorf("vmMac %q should be a unicast Ethernet address", p.vmMac.String())
+	}
+
+	switch p.redirectMode {
+	case redirectModeTC, redirectModeEBPF:
+	case redirectModeBridge:
+		err := validateDeviceName("bridge", p.bridgeName)
+		if err != nil {
+			return err
+		}
+	case redirectModeMacvtap:
+		// Firecracker opens its tap devices through /dev/net/tun, which macvtap devices can't
+		// be opened with
+		return errors.Errorf("redirect mode %q is not supported by Firecracker, use one of %q, %q or %q",
+			p.redirectMode, redirectModeTC, redirectModeBridge, redirectModeEBPF)
+	default:
+		return errors.Errorf("unknown redirect mode %q, expected one of %q, %q or %q",
+			p.redirectMode, redirectModeTC, redirectModeBridge, redirectModeEBPF)
+	}
+
+	return nil
+}
+
+func validateDeviceName(kind, name string) error {
+	if name == "" || len(name) >= unix.IFNAMSIZ {
+		return errors.Errorf("%s name %q should have between 1 and %d characters",
+			kind, name, unix.IFNAMSIZ-1)
+	}
+
+	if strings.ContainsAny(name, "/: \t\n") {
+		return errors.Errorf("%s name %q contains invalid characters", kind, name)
+	}
+
+	return nil
+}
+
+// defaultVMMac returns the MAC address of the VM's interface in the bridge redirect mode, in
+// which the VM can't use the MAC address of the redirect interface attached to the same bridge.
+// It is a locally administered unicast address derived from the vmID and redirect interface name.
+func defaultVMMac(vmID, redirectInterfaceName string) net.HardwareAddr {
+	sum := sha256.Sum256([]byte(vmID + "/" + redirectInterfaceName + "/mac"))
+
+	return net.HardwareAddr{sum[0]&0xfe | 0x02, sum[1], sum[2], sum[3], sum[4], sum[5]}
+}
+
+// defaultTapName returns the name of the tap device paired with the provided
+// redirect interface for the provided VM. Deriving it from both keeps the taps
+// of several VMs sharing a network namespace apart, and allows them to be
+// found again by DEL even without the previous result.
+func defaultTapName(vmID, redirectInterfaceName string) string {
+	sum := sha256.Sum256([]byte(vmID + "/" + redirectInterfaceName))
+
+	// device names are limited to 15 characters
+	return "tap" + hex.EncodeToString(sum[:])[:12]
+}
+
+// defaultBridgeName returns the name of the bridge of the bridge redirect mode for the
+// provided redirect interface. Each redirect interface gets its own bridge, so the VMs of a
+// network namespace are not joined on a single L2 segment unless a bridge name is configured.
+func defaultBridgeName(redirectInterfaceName string) string {
+	sum := sha256.Sum256([]byte(redirectInterfaceName + "/bridge"))
+
+	// device names are limited to 15 characters
+	return "fcbr" + hex.EncodeToString(sum[:])[:11]
 }
 
 func getCurrentResult(args *skel.CmdArgs) (*current.Result, error) {
@@ -197,8 +461,9 @@ type plugin struct {
 	// be a hypervisor/VM ID in addition to a network namespace path)
 	vmID string
 
-	// tapName is the name that the VM's tap device will be created with. If it's
-	// unset, it will be with a name decided automatically by the kernel
+	// tapName is the name that the VM's tap device will be created with. Unless
+	// it's provided in the CNI args, it is derived from the vmID and the redirect
+	// interface name
 	tapName string
 
 	// tapUID is the uid of the user-owner of the tap device
@@ -207,6 +472,29 @@ type plugin struct {
 	// tapGID is the gid of the group-owner of the tap device
 	tapGID int
 
+	// tapMTU is the MTU of the tap device. If 0, the MTU of the redirect interface is used
+	tapMTU int
+
+	// tapQueues is the number of queues of the tap device, more than 1 creates a
+	// multi-queue tap device
+	tapQueues int
+
+	// vnetHeader specifies whether the tap device parses the vnet headers added by the
+	// VM's virtio_net implementation
+	vnetHeader bool
+
+	// vmMac is the MAC address the VM's internal interface should be configured with.
+	// If nil, the MAC address of the redirect interface is used, or one derived from the
+	// vmID in the bridge redirect mode
+	vmMac net.HardwareAddr
+
+	// redirectMode is how the tap device is connected to the redirect interface
+	redirectMode string
+
+	// bridgeName is the name of the bridge the tap device and the redirect interface are
+	// attached to in the bridge redirect mode
+	bridgeName string
+
 	// redirectInterfaceName is the name of the device that the tap device will have a
 	// u32 redirect filter pair with. It's provided by the client via the CNI runtime
 	// config "IfName" parameter
@@ -231,34 +519,47 @@ func (p plugin) add() error {
 
 		redirectIPs := internal.InterfaceIPs(
 			p.currentResult, redirectLink.Attrs().Name, p.netNS.Path())
-		if len(redirectIPs) != 1 {
-			return errors.Errorf(
-				"expected to find 1 IP on redirect interface %q, but instead found %+v",
-				redirectLink.Attrs().Name, redirectIPs)
+		if len(redirectIPs) == 0 {
+			return errors.Errorf("expected to find at least 1 IP on redirect interface %q, but found none",
+				redirectLink.Attrs().Name)
 		}
-		redirectIP := redirectIPs[0]
 
-		tapLink, err := p.CreateTap(p.tapName, redirectLink.Attrs().MTU, p.tapUID, p.tapGID)
+		// Several VMs can share the network namespace, but all of the traffic of a
+		// redirect interface goes to a single tap, so each VM needs its own.
+		inUse, err := p.redirectInUse(redirectLink)
 		if err != nil {
 			return err
 		}
-
-		err = p.AddIngressQdisc(tapLink)
-		if err != nil {
-			return err
+		if inUse {
+			return errors.Errorf(
+				"redirect interface %q is already redirected to a tap device, each VM requires its own redirect interface",
+				redirectLink.Attrs().Name)
 		}
 
-		err = p.AddIngressQdisc(redirectLink)
-		if err != nil {
-			return err
+		tapMTU := p.tapMTU
+		if tapMTU == 0 {
+			tapMTU = redirectLink.Attrs().MTU
 		}
 
-		err = p.AddRedirectFilter(tapLink, redirectLink)
+		tapLink, err := p.CreateTap(p.tapName, internal.TapOptions{
+			MTU:          tapMTU,
+			OwnerUID:     p.tapUID,
+			OwnerGID:     p.tapGID,
+			Queues:       p.tapQueues,
+			NoVNetHeader: !p.vnetHeader,
+		})
 		if err != nil {
 			return err
 		}
 
-		err = p.AddRedirectFilter(redirectLink, tapLink)
+		switch p.redirectMode {
+		case redirectModeBridge:
+			err = p.addBridge(tapLink, redirectLink)
+		case redirectModeEBPF:
+			err = p.addFilters(tapLink, redirectLink, p.AddBPFRedirectFilter)
+		default:
+			err = p.addFilters(tapLink, redirectLink, p.AddRedirectFilter)
+		}
 		if err != nil {
 			return err
 		}
@@ -281,40 +582,118 @@ func (p plugin) add() error {
 		p.currentResult.Interfaces = append(p.currentResult.Interfaces, &current.Interface{
 			Name:    tapLink.Attrs().Name,
 			Sandbox: p.vmID,
-			Mac:     redirectLink.Attrs().HardwareAddr.String(),
+			Mac:     p.vmMacAddr(redirectLink).String(),
 		})
 		vmIfaceIndex := len(p.currentResult.Interfaces) - 1
 
 		// Add the IP configuration that should be applied to the VM internally by
-		// associating the IPConfig with the vmIface. We use the redirectIface's IP.
-		p.currentResult.IPs = append(p.currentResult.IPs, &current.IPConfig{
-			Version:   redirectIP.Version,
-			Address:   redirectIP.Address,
-			Gateway:   redirectIP.Gateway,
-			Interface: &vmIfaceIndex,
-		})
+		// associating the IPConfig with the vmIface. We use all of the redirectIface's
+		// IPs, both IPv4 and IPv6.
+		for _, redirectIP := range redirectIPs {
+			p.currentResult.IPs = append(p.currentResult.IPs, &current.IPConfig{
+				Version:   redirectIP.Version,
+				Address:   redirectIP.Address,
+				Gateway:   redirectIP.Gateway,
+				Interface: &vmIfaceIndex,
+			})
+		}
 
 		return nil
 	})
 }
 
+// vmMacAddr returns the MAC address the VM's internal interface should be configured with
+func (p plugin) vmMacAddr(redirectLink netlink.Link) net.HardwareAddr {
+	if p.vmMac != nil {
+		return p.vmMac
+	}
+
+	// Frames sent to the MAC address of a bridge port are delivered to the bridge itself,
+	// so the VM can't take over the MAC address of the redirect interface in that mode.
+	if p.redirectMode == redirectModeBridge {
+		return defaultVMMac(p.vmID, p.redirectInterfaceName)
+	}
+
+	return redirectLink.Attrs().HardwareAddr
+}
+
+// redirectInUse returns whether the redirect interface is already connected to a tap device
+func (p plugin) redirectInUse(redirectLink netlink.Link) (bool, error) {
+	if p.redirectMode == redirectModeBridge {
+		return redirectLink.Attrs().MasterIndex != 0, nil
+	}
+
+	_, err := p.GetIngressQdisc(redirectLink)
+	switch err.(type) {
+	case nil:
+		return true, nil
+	case *internal.QdiscNotFoundError:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// addFilters redirects the traffic of the tap device and the redirect interface to each other
+// with the filters added by the provided function
+func (p plugin) addFilters(
+	tapLink, redirectLink netlink.Link,
+	addFilter func(sourceLink, targetLink netlink.Link) error,
+) error {
+	err := p.AddIngressQdisc(tapLink)
+	if err != nil {
+		return err
+	}
+
+	err = p.AddIngressQdisc(redirectLink)
+	if err != nil {
+		return err
+	}
+
+	err = addFilter(tapLink, redirectLink)
+	if err != nil {
+		return err
+	}
+
+	return addFilter(redirectLink, tapLink)
+}
+
+// addBridge attaches the tap device and the redirect interface to the bridge, creating it if
+// needed
+func (p plugin) addBridge(tapLink, redirectLink netlink.Link) error {
+	bridgeLink, err := p.GetLink(p.bridgeName)
+	switch err.(type) {
+	case nil:
+	case *internal.LinkNotFoundError:
+		bridgeLink, err = p.CreateBridge(p.bridgeName, redirectLink.Attrs().MTU, nil)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create bridge %q", p.bridgeName)
+		}
+	default:
+		return errors.Wrapf(err, "failure finding bridge %q", p.bridgeName)
+	}
+
+	err = p.SetMaster(redirectLink, bridgeLink)
+	if err != nil {
+		return err
+	}
+
+	return p.SetMaster(tapLink, bridgeLink)
+}
+
 func (p plugin) del() error {
 	return p.netNS.Do(func(_ ns.NetNS) error {
 		var multiErr *multierror.Error
 
-		// try to remove the qdisc we added from the redirect interface
+		// try to disconnect the redirect interface from the tap device
 		redirectLink, err := p.GetLink(p.redirectInterfaceName)
 		switch err.(type) {
 
 		case nil:
-			// the link exists, so try removing the qdisc
-			err := p.RemoveIngressQdisc(redirectLink)
-			switch err.(type) {
-			case nil, *internal.QdiscNotFoundError:
-				// we removed successfully or there already wasn't a qdisc, nothing to do
-			default:
-				multiErr = multierror.Append(multiErr, errors.Wrapf(err,
-					"failed to remove ingress qdisc from %q", redirectLink.Attrs().Name))
+			// the link exists, so try disconnecting it
+			err := p.delRedirect(redirectLink)
+			if err != nil {
+				multiErr = multierror.Append(multiErr, err)
 			}
 
 		case *internal.LinkNotFoundError:
@@ -325,34 +704,108 @@ func (p plugin) del() error {
 				errors.Wrapf(err, "failure finding device %q", p.redirectInterfaceName))
 		}
 
-		// if there was no previous result, we can't find the vm-tap pair, so we are done here
-		if p.currentResult == nil {
-			return multiErr.ErrorOrNil()
-		}
+		// find the tap device we added from the vm-tap pair of the previous result or,
+		// if there was no previous result or it doesn't have the pair (such as when ADD
+		// failed), from the tap name keyed by the vmID
+		tapName := p.tapName
+		if p.currentResult != nil {
+			_, tapIface, err := internal.VMTapPair(p.currentResult, p.vmID)
+			switch err.(type) {
+			case nil:
+				tapName = tapIface.Name
 
-		// try to remove the tap device we added
-		_, tapIface, err := internal.VMTapPair(p.currentResult, p.vmID)
-		switch err.(type) {
+			case internal.LinkNotFoundError, *internal.LinkNotFoundError:
+				// the pair isn't in the result, fall back to the tap name
 
-		case nil:
-			err = p.RemoveLink(tapIface.Name)
+			default:
+				return multierror.Append(multiErr, err).ErrorOrNil()
+			}
+		}
+
+		if tapName != "" {
+			// try to remove the tap device we added
+			err = p.RemoveLink(tapName)
 			switch err.(type) {
 			case nil, *internal.LinkNotFoundError:
 				// we removed successfully or someone else beat us to removing it first
 			default:
 				multiErr = multierror.Append(multiErr, errors.Wrapf(err,
-					"failure removing device %q", tapIface.Name))
+					"failure removing device %q", tapName))
 			}
+		}
 
-		case *internal.LinkNotFoundError:
-			// if the link doesn't exist, there's nothing to do
+		return multierror.Append(multiErr, p.delBridge()).ErrorOrNil()
+	})
+}
+
+// delRedirect disconnects the redirect interface from the tap device
+func (p plugin) delRedirect(redirectLink netlink.Link) error {
+	if p.redirectMode == redirectModeBridge {
+		if redirectLink.Attrs().MasterIndex == 0 {
+			return nil
+		}
 
+		bridgeLink, err := p.GetLink(p.bridgeName)
+		switch err.(type) {
+		case nil:
+		case *internal.LinkNotFoundError:
+			// the redirect interface is attached to some other device, leave it alone
+			return nil
 		default:
-			multiErr = multierror.Append(multiErr, err)
+			return errors.Wrapf(err, "failure finding bridge %q", p.bridgeName)
 		}
 
-		return multiErr.ErrorOrNil()
-	})
+		if redirectLink.Attrs().MasterIndex != bridgeLink.Attrs().Index {
+			return nil
+		}
+
+		return p.SetNoMaster(redirectLink)
+	}
+
+	// removing the qdisc removes the filters attached to it
+	err := p.RemoveIngressQdisc(redirectLink)
+	switch err.(type) {
+	case nil, *internal.QdiscNotFoundError:
+		// we removed successfully or there already wasn't a qdisc, nothing to do
+		return nil
+	default:
+		return errors.Wrapf(err,
+			"failed to remove ingress qdisc from %q", redirectLink.Attrs().Name)
+	}
+}
+
+// delBridge removes the bridge of the bridge redirect mode once no device is attached to it
+func (p plugin) delBridge() error {
+	if p.redirectMode != redirectModeBridge {
+		return nil
+	}
+
+	bridgeLink, err := p.GetLink(p.bridgeName)
+	switch err.(type) {
+	case nil:
+	case *internal.LinkNotFoundError:
+		return nil
+	default:
+		return errors.Wrapf(err, "failure finding bridge %q", p.bridgeName)
+	}
+
+	ports, err := p.GetMasterPorts(bridgeLink)
+	if err != nil {
+		return err
+	}
+
+	// the bridge is still used by other VMs
+	if len(ports) > 0 {
+		return nil
+	}
+
+	err = p.RemoveLink(p.bridgeName)
+	switch err.(type) {
+	case nil, *internal.LinkNotFoundError:
+		return nil
+	default:
+		return errors.Wrapf(err, "failure removing bridge %q", p.bridgeName)
+	}
 }
 
 func (p plugin) check() error {
@@ -372,28 +825,61 @@ func (p plugin) check() error {
 			return err
 		}
 
-		_, err = p.GetIngressQdisc(tapLink)
-		if err != nil {
-			return err
+		switch p.redirectMode {
+		case redirectModeBridge:
+			return p.checkBridge(tapLink, redirectLink)
+		case redirectModeEBPF:
+			return p.checkFilters(tapLink, redirectLink, p.GetBPFRedirectFilter)
+		default:
+			return p.checkFilters(tapLink, redirectLink, p.GetRedirectFilter)
 		}
+	})
+}
 
-		_, err = p.GetIngressQdisc(redirectLink)
-		if err != nil {
-			return err
-		}
+// checkFilters verifies that the traffic of the tap device and the redirect interface is
+// redirected to each other with the filters returned by the provided function
+func (p plugin) checkFilters(
+	tapLink, redirectLink netlink.Link,
+	getFilter func(sourceLink, targetLink netlink.Link) (netlink.Filter, error),
+) error {
+	_, err := p.GetIngressQdisc(tapLink)
+	if err != nil {
+		return err
+	}
 
-		_, err = p.GetRedirectFilter(tapLink, redirectLink)
-		if err != nil {
-			return err
-		}
+	_, err = p.GetIngressQdisc(redirectLink)
+	if err != nil {
+		return err
+	}
 
-		_, err = p.GetRedirectFilter(redirectLink, tapLink)
-		if err != nil {
-			return err
+	_, err = getFilter(tapLink, redirectLink)
+	if err != nil {
+		return err
+	}
+
+	_, err = getFilter(redirectLink, tapLink)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// checkBridge verifies that the tap device and the redirect interface are attached to the bridge
+func (p plugin) checkBridge(tapLink, redirectLink netlink.Link) error {
+	bridgeLink, err := p.GetLink(p.bridgeName)
+	if err != nil {
+		return err
+	}
+
+	for _, link := range []netlink.Link{tapLink, redirectLink} {
+		if link.Attrs().MasterIndex != bridgeLink.Attrs().Index {
+			return errors.Errorf("device %q is not attached to bridge %q",
+				link.Attrs().Name, p.bridgeName)
 		}
+	}
 
-		return nil
-	})
+	return nil
 }
 
 type NoPreviousResultError struct{}
@@ -36,8 +36,13 @@ const (
 	redirectInterfaceName = "veth0"
 	redirectMTU           = 1337
 	redirectMacStr        = "22:33:44:55:66:77"
+	redirectIndex         = 1
+
+	bridgeName  = "br0"
+	bridgeIndex = 3
 
 	tapName   = "tap0"
+	tapIndex  = 2
 	tapUID    = 123
 	tapGID    = 456
 	tapMacStr = "11:22:33:44:55:66"
@@ -87,6 +92,10 @@ func defaultTestPlugin() *plugin {
 		tapName:               tapName,
 		tapUID:                tapUID,
 		tapGID:                tapGID,
+		tapQueues:             1,
+		vnetHeader:            true,
+		redirectMode:          redirectModeTC,
+		bridgeName:            bridgeName,
 		redirectInterfaceName: redirectInterfaceName,
 		netNS:                 netNS,
 
@@ -153,6 +162,123 @@ func TestAdd(t *testing.T) {
 		"adding tap device should increase CNI result IPs by 1")
 	assert.Equal(t, newResult.IPs[0], origRedirectIP,
 		"adding tap device should not modify original redirect IP")
+
+	assert.Equal(t, internal.TapOptions{
+		MTU:      redirectMTU,
+		OwnerUID: tapUID,
+		OwnerGID: tapGID,
+		Queues:   1,
+	}, testPlugin.NetlinkOps.(*internal.MockNetlinkOps).CreateTapOptions,
+		"tap device should be created with the MTU of the redirect interface and a vnet header")
+}
+
+func TestAddTapOptions(t *testing.T) {
+	testPlugin := defaultTestPlugin()
+	testPlugin.tapMTU = 9000
+	testPlugin.tapQueues = 4
+	testPlugin.vnetHeader = false
+	testPlugin.vmMac = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+
+	err := testPlugin.add()
+	require.NoError(t, err, "failed to add tap device")
+
+	assert.Equal(t, internal.TapOptions{
+		MTU:          9000,
+		OwnerUID:     tapUID,
+		OwnerGID:     tapGID,
+		Queues:       4,
+		NoVNetHeader: true,
+	}, testPlugin.NetlinkOps.(*internal.MockNetlinkOps).CreateTapOptions)
+
+	require.Len(t, testPlugin.currentResult.Interfaces, 3)
+	assert.Equal(t, "02:00:00:00:00:01", testPlugin.currentResult.Interfaces[2].Mac,
+		"vm iface in result should have the provided mac addr")
+}
+
+func TestAddDualStack(t *testing.T) {
+	testPlugin := defaultTestPlugin()
+	redirectIfacesIndex := 0
+	redirectIPv6 := &current.IPConfig{
+		Version:   "6",
+		Interface: &redirectIfacesIndex,
+		Address: net.IPNet{
+			IP:   net.ParseIP("2001:db8::2"),
+			Mask: net.CIDRMask(64, 128),
+		},
+		Gateway: net.ParseIP("2001:db8::1"),
+	}
+	testPlugin.currentResult.IPs = append(testPlugin.currentResult.IPs, redirectIPv6)
+
+	err := testPlugin.add()
+	require.NoError(t, err, "failed to add tap device")
+	newResult := testPlugin.currentResult
+
+	require.Len(t, newResult.IPs, 4,
+		"adding tap device should add both IPs of the redirect interface to the vm interface")
+	for i, redirectIP := range newResult.IPs[:2] {
+		vmIP := newResult.IPs[i+2]
+		assert.Equal(t, redirectIP.Address, vmIP.Address)
+		assert.Equal(t, redirectIP.Gateway, vmIP.Gateway)
+		require.NotNil(t, vmIP.Interface)
+		assert.Equal(t, 2, *vmIP.Interface, "expected vm IP to be associated with the vm interface")
+	}
+}
+
+func TestAddMultipleIPs(t *testing.T) {
+	testPlugin := defaultTestPlugin()
+	redirectIfacesIndex := 0
+	for _, address := range []string{"10.0.1.2/24", "2001:db8::2/64", "2001:db8:1::2/64"} {
+		ip, ipNet, err := net.ParseCIDR(address)
+		require.NoError(t, err)
+
+		version := "4"
+		if ip.To4() == nil {
+			version = "6"
+		}
+
+		testPlugin.currentResult.IPs = append(testPlugin.currentResult.IPs, &current.IPConfig{
+			Version:   version,
+			Interface: &redirectIfacesIndex,
+			Address:   net.IPNet{IP: ip, Mask: ipNet.Mask},
+		})
+	}
+
+	err := testPlugin.add()
+	require.NoError(t, err, "failed to add tap device")
+	newResult := testPlugin.currentResult
+
+	vmIPs := internal.InterfaceIPs(newResult, tapName, vmID)
+	require.Len(t, vmIPs, 4, "adding tap device should add all IPs of the redirect interface to the vm interface")
+	for i, vmIP := range vmIPs {
+		assert.Equal(t, newResult.IPs[i].Address, vmIP.Address)
+	}
+}
+
+func TestAddFailsNoIPs(t *testing.T) {
+	testPlugin := defaultTestPlugin()
+	testPlugin.currentResult.IPs = nil
+
+	err := testPlugin.add()
+	require.Error(t, err, "tap device add should fail without any address on the redirect interface")
+	assert.Len(t, testPlugin.currentResult.Interfaces, 1,
+		"tap device add should not append tap interface to results on error")
+}
+
+func TestAddMultipleVMs(t *testing.T) {
+	testPlugin := defaultTestPlugin()
+	nlOps := testPlugin.NetlinkOps.(*internal.MockNetlinkOps)
+
+	err := testPlugin.add()
+	require.NoError(t, err, "failed to add tap device")
+
+	// another VM in the same netns must use another redirect interface
+	otherPlugin := defaultTestPlugin()
+	otherPlugin.NetlinkOps = nlOps
+	otherPlugin.vmID = "another-vm"
+
+	err = otherPlugin.add()
+	require.Error(t, err, "tap device add should fail for a redirect interface already in use")
+	assert.Contains(t, err.Error(), "already redirected")
 }
 
 func TestAddFailsQdiscErr(t *testing.T) {
@@ -332,6 +458,37 @@ func TestDelFailsGetLinkErr(t *testing.T) {
 	assert.Contains(t, err.Error(), nlOps.GetLinkErr.Error())
 }
 
+func TestDelWithoutPreviousResult(t *testing.T) {
+	testPlugin := defaultTestPlugin()
+	mockOps := testPlugin.NetlinkOps.(*internal.MockNetlinkOps)
+
+	err := testPlugin.add()
+	require.NoError(t, err, "failed to add")
+
+	testPlugin.currentResult = nil
+	err = testPlugin.del()
+	require.NoError(t, err, "failed to del")
+
+	assert.Equal(t, []string{tapName}, mockOps.RemoveLinkCalls,
+		"del should remove the tap device named after the vm without a previous result")
+}
+
+func TestDefaultTapName(t *testing.T) {
+	name := defaultTapName(vmID, redirectInterfaceName)
+	assert.Len(t, name, 15, "expected tap name to have the maximum device name length")
+	assert.Equal(t, name, defaultTapName(vmID, redirectInterfaceName), "expected tap name to be stable")
+	assert.NotEqual(t, name, defaultTapName("another-vm", redirectInterfaceName))
+	assert.NotEqual(t, name, defaultTapName(vmID, "veth1"))
+}
+
+func TestDefaultBridgeName(t *testing.T) {
+	name := defaultBridgeName(redirectInterfaceName)
+	assert.Len(t, name, 15, "expected bridge name to have the maximum device name length")
+	assert.Equal(t, name, defaultBridgeName(redirectInterfaceName), "expected bridge name to be stable")
+	assert.NotEqual(t, name, defaultBridgeName("veth1"),
+		"expected each redirect interface to get its own bridge")
+}
+
 func TestCheck(t *testing.T) {
 	testPlugin := defaultTestPlugin()
 
@@ -349,14 +506,142 @@ func TestCheckFails(t *testing.T) {
 	require.Error(t, err, "check should fail when configuration not as expected")
 }
 
-func TestNewPlugin(t *testing.T) {
+func TestAddEBPF(t *testing.T) {
+	testPlugin := defaultTestPlugin()
+	testPlugin.redirectMode = redirectModeEBPF
+	nlOps := testPlugin.NetlinkOps.(*internal.MockNetlinkOps)
+
+	err := testPlugin.add()
+	require.NoError(t, err, "failed to add tap device")
+
+	assert.Equal(t, []string{tapName, redirectInterfaceName}, nlOps.IngressQdiscs)
+	assert.Equal(t, []string{tapName, redirectInterfaceName}, nlOps.AddBPFRedirectFilterCalls,
+		"eBPF redirect filters should be added in both directions")
+	assert.Equal(t, redirectMac.String(), testPlugin.currentResult.Interfaces[2].Mac)
+
+	err = testPlugin.check()
+	require.NoError(t, err, "failed to check")
+
+	nlOps.GetBPFRedirectFilterErr = errors.New("filter gone")
+	err = testPlugin.check()
+	require.Error(t, err, "check should fail when the eBPF filters are missing")
+
+	err = testPlugin.del()
+	require.NoError(t, err, "failed to del")
+	assert.Equal(t, []netlink.Link{nlOps.RedirectIface}, nlOps.RemoveIngressQdiscCalls)
+	assert.Equal(t, []string{tapName}, nlOps.RemoveLinkCalls)
+}
+
+// bridgeTestPlugin returns a plugin in the bridge redirect mode whose tap device and redirect
+// interface are attached to the bridge if attached is true
+func bridgeTestPlugin(attached bool) *plugin {
+	testPlugin := defaultTestPlugin()
+	testPlugin.redirectMode = redirectModeBridge
+
+	masterIndex := 0
+	if attached {
+		masterIndex = bridgeIndex
+	}
+
+	nlOps := testPlugin.NetlinkOps.(*internal.MockNetlinkOps)
+	nlOps.CreatedTap = &internal.MockLink{LinkAttrs: netlink.LinkAttrs{
+		Name:         tapName,
+		Index:        tapIndex,
+		HardwareAddr: tapMac,
+		MasterIndex:  masterIndex,
+	}}
+	nlOps.RedirectIface = &internal.MockLink{LinkAttrs: netlink.LinkAttrs{
+		Name:         redirectInterfaceName,
+		Index:        redirectIndex,
+		HardwareAddr: redirectMac,
+		MTU:          redirectMTU,
+		MasterIndex:  masterIndex,
+	}}
+	nlOps.CreatedBridge = &internal.MockLink{LinkAttrs: netlink.LinkAttrs{
+		Name:  bridgeName,
+		Index: bridgeIndex,
+	}}
+
+	return testPlugin
+}
+
+func TestAddBridge(t *testing.T) {
+	testPlugin := bridgeTestPlugin(false)
+	nlOps := testPlugin.NetlinkOps.(*internal.MockNetlinkOps)
+
+	err := testPlugin.add()
+	require.NoError(t, err, "failed to add tap device")
+
+	assert.Equal(t, []string{redirectInterfaceName, tapName}, nlOps.SetMasterCalls,
+		"redirect interface and tap device should be attached to the bridge")
+	assert.Empty(t, nlOps.IngressQdiscs, "no qdisc should be added in bridge mode")
+
+	require.Len(t, testPlugin.currentResult.Interfaces, 3)
+	assert.Equal(t, defaultVMMac(vmID, redirectInterfaceName).String(),
+		testPlugin.currentResult.Interfaces[2].Mac,
+		"vm iface should not reuse the mac addr of the bridged redirect interface")
+}
+
+func TestAddBridgeFailsInUse(t *testing.T) {
+	testPlugin := bridgeTestPlugin(true)
+
+	err := testPlugin.add()
+	require.Error(t, err, "tap device add should fail for a redirect interface already bridged")
+	assert.Contains(t, err.Error(), "already redirected")
+}
+
+func TestCheckBridge(t *testing.T) {
+	testPlugin := bridgeTestPlugin(true)
+	testPlugin.currentResult.Interfaces = append(testPlugin.currentResult.Interfaces,
+		&current.Interface{Name: tapName, Sandbox: netNS.Path()},
+		&current.Interface{Name: tapName, Sandbox: vmID},
+	)
+
+	err := testPlugin.check()
+	require.NoError(t, err, "failed to check")
+
+	detachedPlugin := bridgeTestPlugin(false)
+	detachedPlugin.currentResult = testPlugin.currentResult
+	err = detachedPlugin.check()
+	require.Error(t, err, "check should fail when devices are not attached to the bridge")
+}
+
+func TestDelBridge(t *testing.T) {
+	testPlugin := bridgeTestPlugin(true)
+	nlOps := testPlugin.NetlinkOps.(*internal.MockNetlinkOps)
+
+	// the bridge is kept while other VMs use it
+	nlOps.MasterPorts = []netlink.Link{&internal.MockLink{LinkAttrs: netlink.LinkAttrs{Name: "tap1"}}}
+	err := testPlugin.del()
+	require.NoError(t, err, "failed to del")
+	assert.Equal(t, []string{redirectInterfaceName}, nlOps.SetNoMasterCalls)
+	assert.Equal(t, []string{tapName}, nlOps.RemoveLinkCalls)
+	assert.Empty(t, nlOps.RemoveIngressQdiscCalls)
+
+	nlOps.MasterPorts = nil
+	nlOps.RemoveLinkCalls = nil
+	err = testPlugin.del()
+	require.NoError(t, err, "failed to del")
+	assert.Equal(t, []string{tapName, bridgeName}, nlOps.RemoveLinkCalls,
+		"the bridge should be removed once unused")
+}
+
+func TestDefaultVMMac(t *testing.T) {
+	mac := defaultVMMac(vmID, redirectInterfaceName)
+	assert.Equal(t, mac, defaultVMMac(vmID, redirectInterfaceName), "expected mac addr to be stable")
+	assert.NotEqual(t, mac, defaultVMMac("another-vm", redirectInterfaceName))
+	assert.Equal(t, byte(0x02), mac[0]&0x03, "expected a locally administered unicast address")
+}
+
+func newPluginTestArgs(t *testing.T, pluginConf map[string]interface{}) *skel.CmdArgs {
+	t.Helper()
+
 	expectedResult := defaultTestPlugin().currentResult
-	nspath := "/tmp/IDoNotExist"
-	netConf := &types.NetConf{
-		CNIVersion: "0.3.1",
-		Name:       "my-lil-network",
-		Type:       "my-lil-plugin",
-		RawPrevResult: map[string]interface{}{
+	netConf := map[string]interface{}{
+		"cniVersion": "0.3.1",
+		"name":       "my-lil-network",
+		"type":       "my-lil-plugin",
+		"prevResult": map[string]interface{}{
 			"cniVersion": "0.3.1",
 			"interfaces": expectedResult.Interfaces,
 			"ips":        expectedResult.IPs,
@@ -364,18 +649,39 @@ func TestNewPlugin(t *testing.T) {
 			"dns":        expectedResult.DNS,
 		},
 	}
-	rawPrevResultBytes, err := json.Marshal(netConf)
+	for key, value := range pluginConf {
+		netConf[key] = value
+	}
+
+	stdinData, err := json.Marshal(netConf)
 	require.NoError(t, err, "failed to marshal JSON")
-	testArgs := skel.CmdArgs{
+
+	return &skel.CmdArgs{
 		ContainerID: "continer-id",
-		Netns:       nspath,
+		Netns:       "/tmp/IDoNotExist",
 		IfName:      "test-name",
-		Args:        "TC_REDIRECT_TAP_NAME=tap_name;TC_REDIRECT_TAP_UID=123;TC_REDIRECT_TAP_GID=321",
 		Path:        "",
-		StdinData:   rawPrevResultBytes,
+		StdinData:   stdinData,
 	}
+}
+
+func TestNewPlugin(t *testing.T) {
+	testArgs := newPluginTestArgs(t, nil)
 
-	plugin, err := newPlugin(&testArgs)
+	plugin, err := newPlugin(testArgs)
+	require.NoError(t, err, "failed to create new plugin")
+	assert.Equal(t, defaultTapName("continer-id", "test-name"), plugin.tapName,
+		"tap name should be derived from the container ID and IfName without TC_REDIRECT_TAP_NAME")
+	assert.Equal(t, 1, plugin.tapQueues, "tap device should have a single queue by default")
+	assert.True(t, plugin.vnetHeader, "tap device should have a vnet header by default")
+	assert.Zero(t, plugin.tapMTU)
+	assert.Nil(t, plugin.vmMac)
+	assert.Equal(t, redirectModeTC, plugin.redirectMode, "u32 redirect filters should be used by default")
+	assert.Equal(t, defaultBridgeName("test-name"), plugin.bridgeName,
+		"bridge name should be derived from IfName without TC_REDIRECT_TAP_BRIDGE_NAME")
+
+	testArgs.Args = "TC_REDIRECT_TAP_NAME=tap_name;TC_REDIRECT_TAP_UID=123;TC_REDIRECT_TAP_GID=321"
+	plugin, err = newPlugin(testArgs)
 	require.NoError(t, err, "failed to create new plugin")
 	assert.Equal(t, plugin.tapName, "tap_name",
 		"TC_REDIRECT_TAP_NAME should be equal to `tap_name`")
@@ -385,6 +691,83 @@ func TestNewPlugin(t *testing.T) {
 		"TC_REDIRECT_TAP_NAME should be equal to `123`")
 }
 
+func TestNewPluginNetConf(t *testing.T) {
+	testArgs := newPluginTestArgs(t, map[string]interface{}{
+		"tapName":      "conf_tap",
+		"tapUID":       0,
+		"tapGID":       42,
+		"tapMTU":       9000,
+		"tapQueues":    2,
+		"vnetHeader":   false,
+		"vmMac":        "02:00:00:00:00:01",
+		"redirectMode": "bridge",
+		"bridgeName":   "conf_br",
+	})
+
+	plugin, err := newPlugin(testArgs)
+	require.NoError(t, err, "failed to create new plugin")
+	assert.Equal(t, "conf_tap", plugin.tapName)
+	assert.Equal(t, 0, plugin.tapUID)
+	assert.Equal(t, 42, plugin.tapGID)
+	assert.Equal(t, 9000, plugin.tapMTU)
+	assert.Equal(t, 2, plugin.tapQueues)
+	assert.False(t, plugin.vnetHeader)
+	assert.Equal(t, "02:00:00:00:00:01", plugin.vmMac.String())
+	assert.Equal(t, redirectModeBridge, plugin.redirectMode)
+	assert.Equal(t, "conf_br", plugin.bridgeName)
+
+	// CNI args override the network configuration
+	testArgs.Args = "TC_REDIRECT_TAP_NAME=args_tap;TC_REDIRECT_TAP_GID=7;TC_REDIRECT_TAP_MTU=1400;" +
+		"TC_REDIRECT_TAP_QUEUES=1;TC_REDIRECT_TAP_VNET_HDR=true;TC_REDIRECT_TAP_VM_MAC=02:00:00:00:00:02;" +
+		"TC_REDIRECT_TAP_MODE=ebpf"
+	plugin, err = newPlugin(testArgs)
+	require.NoError(t, err, "failed to create new plugin")
+	assert.Equal(t, "args_tap", plugin.tapName)
+	assert.Equal(t, 0, plugin.tapUID, "settings missing from the CNI args should be kept")
+	assert.Equal(t, 7, plugin.tapGID)
+	assert.Equal(t, 1400, plugin.tapMTU)
+	assert.Equal(t, 1, plugin.tapQueues)
+	assert.True(t, plugin.vnetHeader)
+	assert.Equal(t, "02:00:00:00:00:02", plugin.vmMac.String())
+	assert.Equal(t, redirectModeEBPF, plugin.redirectMode)
+}
+
+func TestNewPluginFailsValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		pluginConf map[string]interface{}
+		args       string
+	}{
+		{name: "long tap name", pluginConf: map[string]interface{}{"tapName": "a-very-long-tap-name"}},
+		{name: "invalid tap name", args: "TC_REDIRECT_TAP_NAME=tap/0"},
+		{name: "negative uid", pluginConf: map[string]interface{}{"tapUID": -1}},
+		{name: "negative gid", args: "TC_REDIRECT_TAP_GID=-1"},
+		{name: "small mtu", pluginConf: map[string]interface{}{"tapMTU": 10}},
+		{name: "large mtu", args: "TC_REDIRECT_TAP_MTU=100000"},
+		{name: "no queues", pluginConf: map[string]interface{}{"tapQueues": 0}},
+		{name: "non numeric queues", args: "TC_REDIRECT_TAP_QUEUES=many"},
+		{name: "invalid vnet header", args: "TC_REDIRECT_TAP_VNET_HDR=maybe"},
+		{name: "invalid mac", pluginConf: map[string]interface{}{"vmMac": "not-a-mac"}},
+		{name: "multicast mac", args: "TC_REDIRECT_TAP_VM_MAC=01:00:5e:00:00:01"},
+		{name: "long mac", pluginConf: map[string]interface{}{"vmMac": "02:00:00:00:00:00:00:01"}},
+		{name: "invalid type", pluginConf: map[string]interface{}{"tapMTU": "1500"}},
+		{name: "unknown mode", pluginConf: map[string]interface{}{"redirectMode": "carrier-pigeon"}},
+		{name: "macvtap mode", args: "TC_REDIRECT_TAP_MODE=macvtap"},
+		{name: "long bridge name", pluginConf: map[string]interface{}{
+			"redirectMode": "bridge",
+			"bridgeName":   "a-very-long-bridge-name",
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testArgs := newPluginTestArgs(t, tc.pluginConf)
+			testArgs.Args = tc.args
+
+			_, err := newPlugin(testArgs)
+			assert.Error(t, err)
+		})
+	}
+}
+
 func TestExtractArgs(t *testing.T) {
 	cliArgs := "key1=val1;key2=val2"
 	parsedArgs, err := extractArgs(cliArgs)
@@ -0,0 +1,351 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+/*
+Package hostnet sets up the host side of a VM's network without CNI. It
+creates the tap device used by the VM and, optionally, attaches it to a bridge
+with masquerade NAT for egress traffic.
+
+A bridge is created the first time a tap is attached to it and is shared by
+every tap attached to it afterwards. The bridges created by this package are
+marked with the "firecracker-go-sdk" alias, and the NAT rules it adds with an
+iptables comment of the same value. Once no tap is attached to a bridge
+anymore, the teardown of whichever VM detached the last one removes the marked
+rules of the bridge and, if it is marked, the bridge, so nothing is leaked when
+the VM that created them exits first. Bridges and rules managed outside of this
+package, such as an existing br0, are left alone.
+
+NAT rules are managed with the iptables command, which must be available on
+the host. NAT enables IPv4 forwarding on the host, which is left enabled by the
+teardown as other networks of the host may rely on it.
+*/
+package hostnet
+
+import (
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk/cni/internal"
+)
+
+const defaultMTU = 1500
+
+// Config specifies the host network devices of a VM's network interface.
+type Config struct {
+	// TapName is the name of the tap device to create.
+	TapName string
+
+	// MTU of the tap device and, when it is created, of the bridge. Defaults to
+	// 1500.
+	MTU int
+
+	// OwnerUID and OwnerGID are the user and group allowed to open the tap
+	// device, which must match those Firecracker runs as.
+	OwnerUID int
+	OwnerGID int
+
+	// Bridge (optional) attaches the tap device to a bridge.
+	Bridge *BridgeConfig
+}
+
+// BridgeConfig specifies a bridge that tap devices are attached to.
+type BridgeConfig struct {
+	// Name of the bridge device.
+	Name string
+
+	// Address (optional) is assigned to the bridge when it is created. It is
+	// generally used as the gateway of the VMs attached to the bridge.
+	Address *net.IPNet
+
+	// NAT masquerades traffic from the subnet of Address leaving the host
+	// through any other device. Address must be an IPv4 address. It enables
+	// IPv4 forwarding, which is left enabled by the teardown.
+	NAT bool
+}
+
+// Validate returns an error if the configuration is incomplete or invalid.
+func (c Config) Validate() error {
+	if c.TapName == "" {
+		return errors.New("a tap device name must be provided")
+	}
+
+	if c.MTU < 0 {
+		return errors.Errorf("invalid MTU %d", c.MTU)
+	}
+
+	if c.Bridge == nil {
+		return nil
+	}
+
+	if c.Bridge.Name == "" {
+		return errors.New("a bridge name must be provided")
+	}
+
+	if c.Bridge.NAT && (c.Bridge.Address == nil || c.Bridge.Address.IP.To4() == nil) {
+		return errors.Errorf("NAT requires an IPv4 address for bridge %q", c.Bridge.Name)
+	}
+
+	return nil
+}
+
+// Setup creates the devices and NAT rules specified by the configuration in
+// the current network namespace. It returns a function tearing them down as
+// Teardown does, which must be called from the same network namespace. If
+// Setup fails, everything it set up is torn down.
+func Setup(c Config) (func() error, error) {
+	h := defaultHostNetwork()
+	return h.setup(c)
+}
+
+// Teardown removes the tap device specified by the configuration from the
+// current network namespace. Once no device is attached to its bridge anymore,
+// the NAT rules added by this package for the bridge are removed, and so is
+// the bridge if it was created by this package. It can be used to tear down
+// what was set up by Setup in another process, such as one that crashed.
+func Teardown(c Config) error {
+	h := defaultHostNetwork()
+	return h.teardown(c)
+}
+
+const (
+	ipForwardSysctlPath = "/proc/sys/net/ipv4/ip_forward"
+
+	// sdkMarker is the alias of the bridges created by this package and the
+	// comment of the iptables rules it adds, so they can be removed by the
+	// teardown of any VM using them.
+	sdkMarker = "firecracker-go-sdk"
+)
+
+type hostNetwork struct {
+	netlinkOps          internal.NetlinkOps
+	iptables            func(args ...string) error
+	ipForwardSysctlPath string
+}
+
+func defaultHostNetwork() hostNetwork {
+	return hostNetwork{
+		netlinkOps:          internal.DefaultNetlinkOps(),
+		iptables:            iptables,
+		ipForwardSysctlPath: ipForwardSysctlPath,
+	}
+}
+
+func (h hostNetwork) setup(c Config) (_ func() error, err error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	if c.MTU == 0 {
+		c.MTU = defaultMTU
+	}
+
+	tapCreated := false
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		// a tap that already existed may be used by another VM
+		var teardownErr error
+		if tapCreated {
+			teardownErr = h.teardown(c)
+		} else if c.Bridge != nil {
+			teardownErr = h.teardownBridge(c.Bridge)
+		}
+		if teardownErr != nil {
+			err = multierror.Append(err, teardownErr)
+		}
+	}()
+
+	var bridge netlink.Link
+	if c.Bridge != nil {
+		bridge, err = h.setupBridge(c.Bridge, c.MTU)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tap, err := h.netlinkOps.CreateTap(c.TapName, internal.TapOptions{
+		MTU:      c.MTU,
+		OwnerUID: c.OwnerUID,
+		OwnerGID: c.OwnerGID,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create tap device %q", c.TapName)
+	}
+	tapCreated = true
+
+	if bridge != nil {
+		if err := h.netlinkOps.SetMaster(tap, bridge); err != nil {
+			return nil, err
+		}
+	}
+
+	return func() error {
+		return h.teardown(c)
+	}, nil
+}
+
+func (h hostNetwork) teardown(c Config) error {
+	var result *multierror.Error
+
+	err := h.netlinkOps.RemoveLink(c.TapName)
+	if _, ok := err.(*internal.LinkNotFoundError); !ok && err != nil {
+		result = multierror.Append(result, errors.Wrapf(err, "failed to remove tap device %q", c.TapName))
+	}
+
+	if c.Bridge != nil {
+		result = multierror.Append(result, h.teardownBridge(c.Bridge))
+	}
+
+	return result.ErrorOrNil()
+}
+
+// setupBridge returns the bridge, creating it and its NAT rules if needed.
+// Bridges created here are marked with sdkMarker as their alias.
+func (h hostNetwork) setupBridge(c *BridgeConfig, mtu int) (netlink.Link, error) {
+	bridge, err := h.netlinkOps.GetLink(c.Name)
+	if _, ok := err.(*internal.LinkNotFoundError); ok {
+		bridge, err = h.netlinkOps.CreateBridge(c.Name, mtu, c.Address)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create bridge %q", c.Name)
+		}
+
+		if err := h.netlinkOps.SetAlias(bridge, sdkMarker); err != nil {
+			// without its alias, the bridge would not be removed by teardownBridge
+			if removeErr := h.netlinkOps.RemoveLink(c.Name); removeErr != nil {
+				err = multierror.Append(err, removeErr)
+			}
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to get bridge %q", c.Name)
+	}
+
+	if c.NAT {
+		// IPv4 forwarding is left enabled by the teardown, as other networks
+		// of the host may rely on it too
+		if err := ioutil.WriteFile(h.ipForwardSysctlPath, []byte("1"), 0644); err != nil {
+			return nil, errors.Wrap(err, "failed to enable IPv4 forwarding")
+		}
+
+		for _, rule := range natRules(c) {
+			// rules are left in place by the setup of other VMs using the bridge
+			if h.iptables(rule.args("-C")...) == nil {
+				continue
+			}
+
+			if err := h.iptables(rule.args("-A")...); err != nil {
+				return nil, errors.Wrapf(err, "failed to add NAT rule for bridge %q", c.Name)
+			}
+		}
+	}
+
+	return bridge, nil
+}
+
+// teardownBridge removes the NAT rules added for the bridge, and the bridge if
+// it is marked as created by setupBridge, once no device is attached to it.
+// Bridges and rules managed outside of this package are left alone.
+func (h hostNetwork) teardownBridge(c *BridgeConfig) error {
+	bridge, err := h.netlinkOps.GetLink(c.Name)
+	if _, ok := err.(*internal.LinkNotFoundError); ok {
+		bridge = nil
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to get bridge %q", c.Name)
+	}
+
+	if bridge != nil {
+		ports, err := h.netlinkOps.GetMasterPorts(bridge)
+		if err != nil {
+			return errors.Wrapf(err, "failed to list devices attached to bridge %q", c.Name)
+		}
+
+		// the bridge is still used by other VMs
+		if len(ports) > 0 {
+			return nil
+		}
+	}
+
+	var result *multierror.Error
+	if c.NAT {
+		for _, rule := range natRules(c) {
+			if h.iptables(rule.args("-C")...) == nil {
+				result = multierror.Append(result, h.iptables(rule.args("-D")...))
+			}
+		}
+	}
+
+	if bridge != nil && bridge.Attrs().Alias == sdkMarker {
+		err := h.netlinkOps.RemoveLink(c.Name)
+		if _, ok := err.(*internal.LinkNotFoundError); !ok && err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "failed to remove bridge %q", c.Name))
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
+type iptablesRule struct {
+	table string
+	chain string
+	spec  []string
+}
+
+// args returns the iptables arguments applying the provided command, such as
+// "-A" or "-D", to the rule. The rule is commented with sdkMarker, which
+// tells it apart from identical rules managed outside of this package.
+func (r iptablesRule) args(command string) []string {
+	args := append([]string{"-w", "-t", r.table, command, r.chain}, r.spec...)
+	return append(args, "-m", "comment", "--comment", sdkMarker)
+}
+
+// natRules returns the iptables rules masquerading the traffic of the
+// bridge's subnet and allowing it to be forwarded.
+func natRules(c *BridgeConfig) []iptablesRule {
+	subnet := net.IPNet{IP: c.Address.IP.Mask(c.Address.Mask), Mask: c.Address.Mask}
+
+	return []iptablesRule{
+		{
+			table: "nat",
+			chain: "POSTROUTING",
+			spec:  []string{"-s", subnet.String(), "!", "-o", c.Name, "-j", "MASQUERADE"},
+		},
+		{
+			table: "filter",
+			chain: "FORWARD",
+			spec:  []string{"-i", c.Name, "!", "-o", c.Name, "-j", "ACCEPT"},
+		},
+		{
+			table: "filter",
+			chain: "FORWARD",
+			spec:  []string{"-o", c.Name, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+		},
+	}
+}
+
+func iptables(args ...string) error {
+	output, err := exec.Command("iptables", args...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "iptables %s failed: %s",
+			strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
@@ -0,0 +1,332 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package hostnet
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk/cni/internal"
+)
+
+const (
+	tapName    = "tap0"
+	bridgeName = "fcbr0"
+)
+
+// fakeIPTables keeps the rules added with "-A" and removed with "-D"
+type fakeIPTables struct {
+	rules map[string]struct{}
+}
+
+func (f *fakeIPTables) run(args ...string) error {
+	var command string
+	var rule []string
+	for _, arg := range args {
+		switch arg {
+		case "-A", "-C", "-D":
+			command = arg
+		default:
+			rule = append(rule, arg)
+		}
+	}
+	key := strings.Join(rule, " ")
+
+	_, exists := f.rules[key]
+	switch command {
+	case "-A":
+		f.rules[key] = struct{}{}
+	case "-D":
+		if !exists {
+			return errors.New("rule does not exist")
+		}
+		delete(f.rules, key)
+	case "-C":
+		if !exists {
+			return errors.New("rule does not exist")
+		}
+	}
+
+	return nil
+}
+
+func testHostNetwork(t *testing.T, netlinkOps *internal.MockNetlinkOps, iptables *fakeIPTables) (hostNetwork, func()) {
+	dir, err := ioutil.TempDir("", t.Name())
+	require.NoError(t, err)
+
+	return hostNetwork{
+		netlinkOps:          netlinkOps,
+		iptables:            iptables.run,
+		ipForwardSysctlPath: filepath.Join(dir, "ip_forward"),
+	}, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSetupTap(t *testing.T) {
+	netlinkOps := &internal.MockNetlinkOps{
+		CreatedTap: &internal.MockLink{LinkAttrs: netlink.LinkAttrs{Name: tapName}},
+	}
+	h, cleanup := testHostNetwork(t, netlinkOps, &fakeIPTables{})
+	defer cleanup()
+
+	teardown, err := h.setup(Config{TapName: tapName})
+	require.NoError(t, err)
+	assert.Empty(t, netlinkOps.SetMasterCalls)
+
+	require.NoError(t, teardown())
+	assert.Equal(t, []string{tapName}, netlinkOps.RemoveLinkCalls)
+}
+
+func TestSetupBridgeWithNAT(t *testing.T) {
+	netlinkOps := &internal.MockNetlinkOps{
+		CreatedTap:    &internal.MockLink{LinkAttrs: netlink.LinkAttrs{Name: tapName}},
+		CreatedBridge: &internal.MockLink{LinkAttrs: netlink.LinkAttrs{Name: bridgeName}},
+		GetLinkErr:    &internal.LinkNotFoundError{},
+	}
+	iptables := &fakeIPTables{rules: make(map[string]struct{})}
+	h, cleanup := testHostNetwork(t, netlinkOps, iptables)
+	defer cleanup()
+
+	teardown, err := h.setup(Config{
+		TapName: tapName,
+		Bridge: &BridgeConfig{
+			Name:    bridgeName,
+			Address: &net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(24, 32)},
+			NAT:     true,
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{tapName}, netlinkOps.SetMasterCalls)
+	assert.Contains(t, iptables.rules,
+		"-w -t nat POSTROUTING -s 10.0.0.0/24 ! -o fcbr0 -j MASQUERADE -m comment --comment firecracker-go-sdk")
+	assert.Len(t, iptables.rules, 3)
+
+	ipForward, err := ioutil.ReadFile(h.ipForwardSysctlPath)
+	require.NoError(t, err)
+	assert.Equal(t, "1", string(ipForward))
+
+	// the bridge is kept while other devices are attached to it
+	netlinkOps.MasterPorts = []netlink.Link{&internal.MockLink{LinkAttrs: netlink.LinkAttrs{Name: "tap1"}}}
+	netlinkOps.GetLinkErr = nil
+	require.NoError(t, teardown())
+	assert.Equal(t, []string{tapName}, netlinkOps.RemoveLinkCalls)
+	assert.Len(t, iptables.rules, 3)
+
+	// the setup of another tap reuses the bridge and its rules, and its
+	// teardown removes them once the bridge is unused, even though they were
+	// created by another setup
+	teardown, err = h.setup(Config{
+		TapName: tapName,
+		Bridge: &BridgeConfig{
+			Name:    bridgeName,
+			Address: &net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(24, 32)},
+			NAT:     true,
+		},
+	})
+	require.NoError(t, err)
+	assert.Len(t, iptables.rules, 3)
+
+	netlinkOps.MasterPorts = nil
+	netlinkOps.RemoveLinkCalls = nil
+	require.NoError(t, teardown())
+	assert.Equal(t, []string{tapName, bridgeName}, netlinkOps.RemoveLinkCalls)
+	assert.Empty(t, iptables.rules)
+}
+
+func TestSetupBridgeCreatedBySetupIsRemoved(t *testing.T) {
+	netlinkOps := &internal.MockNetlinkOps{
+		CreatedTap:    &internal.MockLink{LinkAttrs: netlink.LinkAttrs{Name: tapName}},
+		CreatedBridge: &internal.MockLink{LinkAttrs: netlink.LinkAttrs{Name: bridgeName}},
+		GetLinkErr:    &internal.LinkNotFoundError{},
+	}
+	iptables := &fakeIPTables{rules: make(map[string]struct{})}
+	h, cleanup := testHostNetwork(t, netlinkOps, iptables)
+	defer cleanup()
+
+	teardown, err := h.setup(Config{
+		TapName: tapName,
+		Bridge: &BridgeConfig{
+			Name:    bridgeName,
+			Address: &net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(24, 32)},
+			NAT:     true,
+		},
+	})
+	require.NoError(t, err)
+	assert.Len(t, iptables.rules, 3)
+
+	netlinkOps.GetLinkErr = nil
+	require.NoError(t, teardown())
+	assert.Equal(t, []string{tapName, bridgeName}, netlinkOps.RemoveLinkCalls)
+	assert.Empty(t, iptables.rules)
+}
+
+func TestSetupExistingBridgeIsKept(t *testing.T) {
+	netlinkOps := &internal.MockNetlinkOps{
+		CreatedTap: &internal.MockLink{LinkAttrs: netlink.LinkAttrs{Name: tapName}},
+		// an existing bridge, such as one managed by the host
+		RedirectIface: &internal.MockLink{LinkAttrs: netlink.LinkAttrs{Name: "br0"}},
+	}
+	iptables := &fakeIPTables{rules: make(map[string]struct{})}
+	h, cleanup := testHostNetwork(t, netlinkOps, iptables)
+	defer cleanup()
+
+	config := Config{
+		TapName: tapName,
+		Bridge:  &BridgeConfig{Name: "br0"},
+	}
+	teardown, err := h.setup(config)
+	require.NoError(t, err)
+	assert.Equal(t, []string{tapName}, netlinkOps.SetMasterCalls)
+
+	require.NoError(t, teardown())
+	assert.Equal(t, []string{tapName}, netlinkOps.RemoveLinkCalls, "the existing bridge should be kept")
+
+	// NAT rules added for an existing bridge are removed, the bridge is kept
+	config.Bridge = &BridgeConfig{
+		Name:    "br0",
+		Address: &net.IPNet{IP: net.IPv4(192, 168, 1, 1), Mask: net.CIDRMask(24, 32)},
+		NAT:     true,
+	}
+	netlinkOps.RemoveLinkCalls = nil
+	teardown, err = h.setup(config)
+	require.NoError(t, err)
+	assert.Len(t, iptables.rules, 3)
+
+	require.NoError(t, teardown())
+	assert.Equal(t, []string{tapName}, netlinkOps.RemoveLinkCalls)
+	assert.Empty(t, iptables.rules)
+}
+
+func TestTeardownWithoutSetup(t *testing.T) {
+	// a bridge and rules set up by another process, such as one that crashed
+	netlinkOps := &internal.MockNetlinkOps{
+		CreatedTap: &internal.MockLink{LinkAttrs: netlink.LinkAttrs{Name: tapName}},
+		CreatedBridge: &internal.MockLink{LinkAttrs: netlink.LinkAttrs{
+			Name:  bridgeName,
+			Alias: sdkMarker,
+		}},
+	}
+	iptables := &fakeIPTables{rules: make(map[string]struct{})}
+	h, cleanup := testHostNetwork(t, netlinkOps, iptables)
+	defer cleanup()
+
+	config := Config{
+		TapName: tapName,
+		Bridge: &BridgeConfig{
+			Name:    bridgeName,
+			Address: &net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(24, 32)},
+			NAT:     true,
+		},
+	}
+	for _, rule := range natRules(config.Bridge) {
+		require.NoError(t, iptables.run(rule.args("-A")...))
+	}
+	// an identical rule managed outside of hostnet
+	unmarkedRule := "-w -t nat POSTROUTING -s 10.0.0.0/24 ! -o fcbr0 -j MASQUERADE"
+	iptables.rules[unmarkedRule] = struct{}{}
+
+	require.NoError(t, h.teardown(config))
+	assert.Equal(t, []string{tapName, bridgeName}, netlinkOps.RemoveLinkCalls)
+	assert.Equal(t, map[string]struct{}{unmarkedRule: {}}, iptables.rules)
+}
+
+func TestSetupMarksCreatedBridge(t *testing.T) {
+	bridge := &internal.MockLink{LinkAttrs: netlink.LinkAttrs{Name: bridgeName}}
+	netlinkOps := &internal.MockNetlinkOps{
+		CreatedTap:    &internal.MockLink{LinkAttrs: netlink.LinkAttrs{Name: tapName}},
+		CreatedBridge: bridge,
+		GetLinkErr:    &internal.LinkNotFoundError{},
+	}
+	h, cleanup := testHostNetwork(t, netlinkOps, &fakeIPTables{})
+	defer cleanup()
+
+	_, err := h.setup(Config{
+		TapName: tapName,
+		Bridge:  &BridgeConfig{Name: bridgeName},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, sdkMarker, bridge.Alias)
+
+	// a bridge that can't be marked is removed right away
+	netlinkOps.SetAliasErr = errors.New("set alias failed")
+	_, err = h.setup(Config{
+		TapName: tapName,
+		Bridge:  &BridgeConfig{Name: bridgeName},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "set alias failed")
+	assert.Equal(t, []string{bridgeName}, netlinkOps.RemoveLinkCalls)
+}
+
+func TestSetupFailureTearsDown(t *testing.T) {
+	netlinkOps := &internal.MockNetlinkOps{
+		CreatedTap: &internal.MockLink{LinkAttrs: netlink.LinkAttrs{Name: tapName}},
+		CreatedBridge: &internal.MockLink{LinkAttrs: netlink.LinkAttrs{
+			Name:  bridgeName,
+			Alias: sdkMarker,
+		}},
+		SetMasterErr: errors.New("set master failed"),
+	}
+	h, cleanup := testHostNetwork(t, netlinkOps, &fakeIPTables{})
+	defer cleanup()
+
+	_, err := h.setup(Config{
+		TapName: tapName,
+		Bridge:  &BridgeConfig{Name: bridgeName},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "set master failed")
+	assert.Equal(t, []string{tapName, bridgeName}, netlinkOps.RemoveLinkCalls)
+
+	// a tap that could not be created, such as one used by another VM, is
+	// left alone
+	netlinkOps.SetMasterErr = nil
+	netlinkOps.CreateTapErr = errors.New("create tap failed")
+	netlinkOps.RemoveLinkCalls = nil
+	_, err = h.setup(Config{
+		TapName: tapName,
+		Bridge:  &BridgeConfig{Name: bridgeName},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "create tap failed")
+	assert.Equal(t, []string{bridgeName}, netlinkOps.RemoveLinkCalls)
+}
+
+func TestConfigValidate(t *testing.T) {
+	ipv4Address := &net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(24, 32)}
+	ipv6Address := &net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(64, 128)}
+
+	assert.NoError(t, Config{TapName: tapName}.Validate())
+	assert.NoError(t, Config{TapName: tapName, Bridge: &BridgeConfig{Name: bridgeName}}.Validate())
+	assert.NoError(t, Config{TapName: tapName, Bridge: &BridgeConfig{Name: bridgeName, Address: ipv4Address, NAT: true}}.Validate())
+
+	assert.Error(t, Config{}.Validate(), "expected a tap name to be required")
+	assert.Error(t, Config{TapName: tapName, MTU: -1}.Validate(), "expected negative MTU to be rejected")
+	assert.Error(t, Config{TapName: tapName, Bridge: &BridgeConfig{}}.Validate(), "expected a bridge name to be required")
+	assert.Error(t, Config{TapName: tapName, Bridge: &BridgeConfig{Name: bridgeName, NAT: true}}.Validate(),
+		"expected NAT without address to be rejected")
+	assert.Error(t, Config{TapName: tapName, Bridge: &BridgeConfig{Name: bridgeName, Address: ipv6Address, NAT: true}}.Validate(),
+		"expected NAT with an IPv6 address to be rejected")
+}
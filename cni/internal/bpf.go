@@ -0,0 +1,93 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+import (
+	"runtime"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// bpfProgLoad is the BPF_PROG_LOAD command of the bpf syscall
+	bpfProgLoad = 5
+
+	// bpfFuncRedirect is the id of the bpf_redirect helper
+	bpfFuncRedirect = 23
+
+	bpfLogSize = 4096
+)
+
+// bpfInstruction encodes an eBPF instruction
+func bpfInstruction(opcode uint8, dstReg uint8, srcReg uint8, offset int16, imm int32) uint64 {
+	return uint64(opcode) |
+		uint64(dstReg&0xf|srcReg<<4)<<8 |
+		uint64(uint16(offset))<<16 |
+		uint64(uint32(imm))<<32
+}
+
+// redirectProgram returns the instructions of a tc classifier redirecting every packet to the
+// egress queue of the device with the provided index. It is the equivalent of:
+//
+//	int redirect(struct __sk_buff *skb) { return bpf_redirect(ifindex, 0); }
+func redirectProgram(ifindex int) []uint64 {
+	return []uint64{
+		bpfInstruction(0xb7, 1, 0, 0, int32(ifindex)),  // r1 = ifindex
+		bpfInstruction(0xb7, 2, 0, 0, 0),               // r2 = 0 (egress)
+		bpfInstruction(0x85, 0, 0, 0, bpfFuncRedirect), // call bpf_redirect
+		bpfInstruction(0x95, 0, 0, 0, 0),               // exit
+	}
+}
+
+// loadRedirectProgram loads the program returned by redirectProgram into the kernel and returns
+// its file descriptor, which must be closed by the caller.
+func loadRedirectProgram(ifindex int) (int, error) {
+	insns := redirectProgram(ifindex)
+	license := []byte("Apache-2.0\x00")
+	logBuf := make([]byte, bpfLogSize)
+	attr := netlink.BPFAttr{
+		ProgType: uint32(netlink.BPF_PROG_TYPE_SCHED_CLS),
+		InsnCnt:  uint32(len(insns)),
+		Insns:    uintptr(unsafe.Pointer(&insns[0])),
+		License:  uintptr(unsafe.Pointer(&license[0])),
+		LogLevel: 1,
+		LogSize:  uint32(len(logBuf)),
+		LogBuf:   uintptr(unsafe.Pointer(&logBuf[0])),
+	}
+
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, bpfProgLoad,
+		uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(logBuf)
+	if errno != 0 {
+		return -1, errors.Wrapf(errno, "failed to load eBPF redirect program: %s",
+			string(logBuf[:clen(logBuf)]))
+	}
+
+	return int(fd), nil
+}
+
+// clen returns the length of a null terminated string
+func clen(b []byte) int {
+	for i := range b {
+		if b[i] == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
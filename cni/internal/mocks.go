@@ -14,6 +14,8 @@
 package internal
 
 import (
+	"net"
+
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/vishvananda/netlink"
 )
@@ -33,6 +35,10 @@ type MockNetlinkOps struct {
 	// GetIngressQdiscErr is an error that will be returned from all GetIngressQdisc calls
 	GetIngressQdiscErr error
 
+	// IngressQdiscs records the names of the devices provided to successful AddIngressQdisc
+	// calls. GetIngressQdisc returns a QdiscNotFoundError for other devices.
+	IngressQdiscs []string
+
 	// RemoveIngressQdiscErr is an error that will be returned from all RemoveIngressQdisc calls
 	RemoveIngressQdiscErr error
 	// RemoveIngressQdiscCalls records the args provided to each call to RemoveIngressQdisc
@@ -41,11 +47,27 @@ type MockNetlinkOps struct {
 	// AddRedirectFilterErr is an error that will be returned from all AddRedirectFilter calls
 	AddRedirectFilterErr error
 
+	// AddBPFRedirectFilterErr is an error that will be returned from all AddBPFRedirectFilter calls
+	AddBPFRedirectFilterErr error
+	// AddBPFRedirectFilterCalls records the names of the source devices provided to each call to
+	// AddBPFRedirectFilter
+	AddBPFRedirectFilterCalls []string
+
+	// GetBPFRedirectFilterErr is an error that will be returned from all GetBPFRedirectFilter calls
+	GetBPFRedirectFilterErr error
+
+	// SetNoMasterErr is an error that will be returned from all SetNoMaster calls
+	SetNoMasterErr error
+	// SetNoMasterCalls records the names of the devices provided to each call to SetNoMaster
+	SetNoMasterCalls []string
+
 	// GetRedirectFilterErr is an error that will be returned from all GetRedirectFilter calls
 	GetRedirectFilterErr error
 
 	// CreateTapErr is an error that will be returned from all CreateTap calls
 	CreateTapErr error
+	// CreateTapOptions records the options provided to the last call to CreateTap
+	CreateTapOptions TapOptions
 
 	// RemoveLinkErr is an error that will be returned from all RemoveLink calls
 	RemoveLinkErr error
@@ -54,18 +76,52 @@ type MockNetlinkOps struct {
 
 	// GetLinkErr is an error that will be returned from all GetLink calls
 	GetLinkErr error
+
+	// CreatedBridge is the mock bridge device object that will be returned by the mock methods
+	CreatedBridge netlink.Link
+
+	// CreateBridgeErr is an error that will be returned from all CreateBridge calls
+	CreateBridgeErr error
+
+	// SetMasterErr is an error that will be returned from all SetMaster calls
+	SetMasterErr error
+	// SetMasterCalls records the names of the links provided to each call to SetMaster
+	SetMasterCalls []string
+
+	// MasterPorts are the links that will be returned by all GetMasterPorts calls
+	MasterPorts []netlink.Link
+
+	// SetAliasErr is an error that will be returned from all SetAlias calls
+	SetAliasErr error
 }
 
 var _ NetlinkOps = &MockNetlinkOps{}
 
-// AddIngressQdisc does nothing and returns an error if configured to do so (otherwise nil)
+// AddIngressQdisc records the name of the provided link and returns an error if configured to do
+// so (otherwise nil)
 func (m *MockNetlinkOps) AddIngressQdisc(link netlink.Link) error {
-	return m.AddIngressQdiscErr
+	if m.AddIngressQdiscErr != nil {
+		return m.AddIngressQdiscErr
+	}
+
+	m.IngressQdiscs = append(m.IngressQdiscs, link.Attrs().Name)
+	return nil
 }
 
-// GetIngressQdisc does nothing and returns an error if configured to do so (otherwise nil)
+// GetIngressQdisc returns an error if configured to do so, or a QdiscNotFoundError if no ingress
+// qdisc was added to the provided link (otherwise nil)
 func (m *MockNetlinkOps) GetIngressQdisc(sourceLink netlink.Link) (netlink.Qdisc, error) {
-	return nil, m.GetIngressQdiscErr
+	if m.GetIngressQdiscErr != nil {
+		return nil, m.GetIngressQdiscErr
+	}
+
+	for _, name := range m.IngressQdiscs {
+		if name == sourceLink.Attrs().Name {
+			return nil, nil
+		}
+	}
+
+	return nil, &QdiscNotFoundError{device: sourceLink.Attrs().Name}
 }
 
 // RemoveIngressQdisc does nothing and returns an error if configured to do so (otherwise nil)
@@ -84,6 +140,18 @@ func (m *MockNetlinkOps) GetRedirectFilter(sourceLink netlink.Link, targetLink n
 	return nil, m.GetRedirectFilterErr
 }
 
+// AddBPFRedirectFilter records the name of the provided source link and returns an error if
+// configured to do so (otherwise nil)
+func (m *MockNetlinkOps) AddBPFRedirectFilter(sourceLink netlink.Link, targetLink netlink.Link) error {
+	m.AddBPFRedirectFilterCalls = append(m.AddBPFRedirectFilterCalls, sourceLink.Attrs().Name)
+	return m.AddBPFRedirectFilterErr
+}
+
+// GetBPFRedirectFilter does nothing and returns an error if configured to do so (otherwise nil)
+func (m *MockNetlinkOps) GetBPFRedirectFilter(sourceLink netlink.Link, targetLink netlink.Link) (netlink.Filter, error) {
+	return nil, m.GetBPFRedirectFilterErr
+}
+
 // GetLink returns CreatedTap if provided the name of CreatedTap, RedirectIface if provided the name
 // of RedirectIface or otherwise a netlink.LinkNotFoundError
 func (m *MockNetlinkOps) GetLink(name string) (netlink.Link, error) {
@@ -91,14 +159,13 @@ func (m *MockNetlinkOps) GetLink(name string) (netlink.Link, error) {
 		return nil, m.GetLinkErr
 	}
 
-	switch name {
-	case m.RedirectIface.Attrs().Name:
-		return m.RedirectIface, nil
-	case m.CreatedTap.Attrs().Name:
-		return m.CreatedTap, nil
-	default:
-		return nil, &LinkNotFoundError{}
+	for _, link := range []netlink.Link{m.RedirectIface, m.CreatedTap, m.CreatedBridge} {
+		if link != nil && link.Attrs().Name == name {
+			return link, nil
+		}
 	}
+
+	return nil, &LinkNotFoundError{}
 }
 
 // RemoveLink returns a nil error if provided the name of CreatedTap or RedirectIface. Otherwise
@@ -109,21 +176,58 @@ func (m *MockNetlinkOps) RemoveLink(name string) error {
 	}
 
 	m.RemoveLinkCalls = append(m.RemoveLinkCalls, name)
-	switch name {
-	case m.RedirectIface.Attrs().Name:
-		return nil
-	case m.CreatedTap.Attrs().Name:
-		return nil
-	default:
-		return &LinkNotFoundError{}
+	for _, link := range []netlink.Link{m.RedirectIface, m.CreatedTap, m.CreatedBridge} {
+		if link != nil && link.Attrs().Name == name {
+			return nil
+		}
 	}
+
+	return &LinkNotFoundError{}
 }
 
 // CreateTap returns the configured mock tap link and/or a configured error
-func (m *MockNetlinkOps) CreateTap(name string, mtu int, ownerUID, ownerGID int) (netlink.Link, error) {
+func (m *MockNetlinkOps) CreateTap(name string, opts TapOptions) (netlink.Link, error) {
+	m.CreateTapOptions = opts
 	return m.CreatedTap, m.CreateTapErr
 }
 
+// CreateBridge returns the configured mock bridge link and/or a configured error
+func (m *MockNetlinkOps) CreateBridge(name string, mtu int, addr *net.IPNet) (netlink.Link, error) {
+	return m.CreatedBridge, m.CreateBridgeErr
+}
+
+// SetMaster records the name of the provided link and returns an error if configured to do so
+// (otherwise nil)
+func (m *MockNetlinkOps) SetMaster(link netlink.Link, master netlink.Link) error {
+	m.SetMasterCalls = append(m.SetMasterCalls, link.Attrs().Name)
+	return m.SetMasterErr
+}
+
+// GetMasterPorts returns the configured MasterPorts
+func (m *MockNetlinkOps) GetMasterPorts(master netlink.Link) ([]netlink.Link, error) {
+	return m.MasterPorts, nil
+}
+
+// SetNoMaster records the name of the provided link and returns an error if configured to do so
+// (otherwise nil)
+func (m *MockNetlinkOps) SetNoMaster(link netlink.Link) error {
+	m.SetNoMasterCalls = append(m.SetNoMasterCalls, link.Attrs().Name)
+	return m.SetNoMasterErr
+}
+
+// SetAlias sets the alias of the provided link if it is a *MockLink, and returns an error if
+// configured to do so (otherwise nil)
+func (m *MockNetlinkOps) SetAlias(link netlink.Link, alias string) error {
+	if m.SetAliasErr != nil {
+		return m.SetAliasErr
+	}
+
+	if mockLink, ok := link.(*MockLink); ok {
+		mockLink.LinkAttrs.Alias = alias
+	}
+	return nil
+}
+
 // MockLink provides a mocked out netlink.Link implementation
 type MockLink struct {
 	netlink.Link
@@ -15,6 +15,7 @@ package internal
 
 import (
 	"fmt"
+	"net"
 
 	"github.com/pkg/errors"
 	"github.com/vishvananda/netlink"
@@ -40,8 +41,8 @@ func RootFilterHandle() uint32 {
 // * Using u32 redirects with taps: https://gist.github.com/mcastelino/7d85f4164ffdaf48242f9281bb1d0f9b
 type NetlinkOps interface {
 	// CreateTap will create a tap device configured as expected by the tc-redirect-tap plugin for
-	// use by a Firecracker VM. It sets the tap in the up state and with the provided MTU.
-	CreateTap(name string, mtu int, ownerUID int, ownerGID int) (netlink.Link, error)
+	// use by a Firecracker VM. It sets the tap in the up state and with the provided options.
+	CreateTap(name string, opts TapOptions) (netlink.Link, error)
 
 	// AddIngressQdisc adds a qdisc to the ingress queue of the provided device.
 	AddIngressQdisc(link netlink.Link) error
@@ -68,6 +69,26 @@ type NetlinkOps interface {
 	// RemoveLink deletes the link with the provided device name. It returns LinkNotFoundError if
 	// the link doesn't exist
 	RemoveLink(name string) error
+
+	// CreateBridge will create a bridge device with the provided MTU and, if not nil, address, and
+	// set it in the up state.
+	CreateBridge(name string, mtu int, addr *net.IPNet) (netlink.Link, error)
+	// SetMaster attaches the provided link to the provided master device, such as a bridge.
+	SetMaster(link netlink.Link, master netlink.Link) error
+	// GetMasterPorts returns the links attached to the provided master device.
+	GetMasterPorts(master netlink.Link) ([]netlink.Link, error)
+	// SetNoMaster detaches the provided link from its master device.
+	SetNoMaster(link netlink.Link) error
+	// SetAlias sets the alias of the provided link, which is returned in its attributes by GetLink.
+	SetAlias(link netlink.Link, alias string) error
+
+	// AddBPFRedirectFilter adds a direct-action eBPF filter to the provided sourceLink that
+	// redirects packets from its ingress queue to the egress queue of the provided targetLink.
+	// It requires that sourceLink have an ingress qdisc attached prior to the call.
+	AddBPFRedirectFilter(sourceLink netlink.Link, targetLink netlink.Link) error
+	// GetBPFRedirectFilter looks for an eBPF redirect filter matching the one added by
+	// AddBPFRedirectFilter, returning it if found. If not found, it returns a FilterNotFoundError
+	GetBPFRedirectFilter(sourceLink netlink.Link, targetLink netlink.Link) (netlink.Filter, error)
 }
 
 // DefaultNetlinkOps returns a standard implementation of NetlinkOps that performs the corresponding
@@ -174,6 +195,59 @@ func (ops defaultNetlinkOps) GetRedirectFilter(sourceLink netlink.Link, targetLi
 	return nil, &FilterNotFoundError{device: sourceLink.Attrs().Name}
 }
 
+func (ops defaultNetlinkOps) AddBPFRedirectFilter(sourceLink netlink.Link, targetLink netlink.Link) error {
+	fd, err := loadRedirectProgram(targetLink.Attrs().Index)
+	if err != nil {
+		return err
+	}
+	// the filter holds a reference to the program once added
+	defer unix.Close(fd)
+
+	err = netlink.FilterAdd(&netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: sourceLink.Attrs().Index,
+			Parent:    RootFilterHandle(),
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Fd:           fd,
+		Name:         bpfRedirectFilterName(targetLink),
+		DirectAction: true,
+	})
+	if err != nil {
+		err = errors.Wrapf(err,
+			"failed to add eBPF filter redirecting from device %q to device %q, does %q exist and have a qdisc attached to its ingress?",
+			sourceLink.Attrs().Name, targetLink.Attrs().Name, sourceLink.Attrs().Name)
+	}
+
+	return err
+}
+
+func (ops defaultNetlinkOps) GetBPFRedirectFilter(sourceLink netlink.Link, targetLink netlink.Link) (netlink.Filter, error) {
+	filters, err := netlink.FilterList(sourceLink, RootFilterHandle())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list filters for device %q", sourceLink.Attrs().Name)
+	}
+
+	for _, filter := range filters {
+		bpfFilter, ok := filter.(*netlink.BpfFilter)
+		if !ok {
+			continue
+		}
+
+		if bpfFilter.Name == bpfRedirectFilterName(targetLink) {
+			return bpfFilter, nil
+		}
+	}
+
+	return nil, &FilterNotFoundError{device: sourceLink.Attrs().Name}
+}
+
+// bpfRedirectFilterName returns the name of the eBPF filter redirecting to the provided device.
+// The filter doesn't expose its target otherwise.
+func bpfRedirectFilterName(targetLink netlink.Link) string {
+	return fmt.Sprintf("redirect-%d", targetLink.Attrs().Index)
+}
+
 func (defaultNetlinkOps) GetLink(name string) (netlink.Link, error) {
 	link, err := netlink.LinkByName(name)
 	if _, ok := err.(netlink.LinkNotFoundError); ok {
@@ -195,7 +269,25 @@ func (ops defaultNetlinkOps) RemoveLink(name string) error {
 	return err
 }
 
-func (defaultNetlinkOps) CreateTap(name string, mtu int, ownerUID, ownerGID int) (netlink.Link, error) {
+// TapOptions are the settings of a tap device created by CreateTap
+type TapOptions struct {
+	// MTU of the tap device
+	MTU int
+
+	// OwnerUID and OwnerGID are the user and group allowed to open the tap device
+	OwnerUID int
+	OwnerGID int
+
+	// Queues is the number of queues of the tap device. Values greater than 1 create a
+	// multi-queue tap device, 0 is treated as 1.
+	Queues int
+
+	// NoVNetHeader disables the parsing of the vnet headers added by the VM's virtio_net
+	// implementation, which is enabled by default
+	NoVNetHeader bool
+}
+
+func (defaultNetlinkOps) CreateTap(name string, opts TapOptions) (netlink.Link, error) {
 	tapLinkAttrs := netlink.NewLinkAttrs()
 	tapLinkAttrs.Name = name
 	tapLink := &netlink.Tuntap{
@@ -204,12 +296,21 @@ func (defaultNetlinkOps) CreateTap(name string, mtu int, ownerUID, ownerGID int)
 		// We want a tap device (L2) as opposed to a tun (L3)
 		Mode: netlink.TUNTAP_MODE_TAP,
 
-		// Firecracker does not support multiqueue tap devices at this time:
+		// Firecracker does not support multiqueue tap devices at this time, so
+		// a single queue is used unless more are explicitly requested:
 		// https://github.com/firecracker-microvm/firecracker/issues/750
 		Queues: 1,
+		Flags:  netlink.TUNTAP_ONE_QUEUE, // single queue tap device
+	}
 
-		Flags: netlink.TUNTAP_ONE_QUEUE | // single queue tap device
-			netlink.TUNTAP_VNET_HDR, // parse vnet headers added by the vm's virtio_net implementation
+	if opts.Queues > 1 {
+		tapLink.Queues = opts.Queues
+		tapLink.Flags = netlink.TUNTAP_MULTI_QUEUE_DEFAULTS
+	}
+
+	if !opts.NoVNetHeader {
+		// parse vnet headers added by the vm's virtio_net implementation
+		tapLink.Flags |= netlink.TUNTAP_VNET_HDR
 	}
 
 	err := netlink.LinkAdd(tapLink)
@@ -217,23 +318,34 @@ func (defaultNetlinkOps) CreateTap(name string, mtu int, ownerUID, ownerGID int)
 		return nil, errors.Wrap(err, "failed to create tap device")
 	}
 
+	// The tap is persistent, so the queue file descriptors netlink keeps open
+	// are only needed to set its owner. Keeping them open would leave this
+	// process attached to the tap and make Firecracker's TUNSETIFF fail with
+	// EBUSY.
+	defer func() {
+		for _, tapFd := range tapLink.Fds {
+			tapFd.Close()
+		}
+		tapLink.Fds = nil
+	}()
+
 	for _, tapFd := range tapLink.Fds {
-		err = unix.IoctlSetInt(int(tapFd.Fd()), unix.TUNSETOWNER, ownerUID)
+		err = unix.IoctlSetInt(int(tapFd.Fd()), unix.TUNSETOWNER, opts.OwnerUID)
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to set tap %s owner to uid %d",
-				name, ownerUID)
+				name, opts.OwnerUID)
 		}
 
-		err = unix.IoctlSetInt(int(tapFd.Fd()), unix.TUNSETGROUP, ownerGID)
+		err = unix.IoctlSetInt(int(tapFd.Fd()), unix.TUNSETGROUP, opts.OwnerGID)
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to set tap %s group to gid %d",
-				name, ownerGID)
+				name, opts.OwnerGID)
 		}
 	}
 
-	err = netlink.LinkSetMTU(tapLink, mtu)
+	err = netlink.LinkSetMTU(tapLink, opts.MTU)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to set tap device MTU to %d", mtu)
+		return nil, errors.Wrapf(err, "failed to set tap device MTU to %d", opts.MTU)
 	}
 
 	err = netlink.LinkSetUp(tapLink)
@@ -244,6 +356,76 @@ func (defaultNetlinkOps) CreateTap(name string, mtu int, ownerUID, ownerGID int)
 	return tapLink, nil
 }
 
+func (defaultNetlinkOps) CreateBridge(name string, mtu int, addr *net.IPNet) (netlink.Link, error) {
+	bridgeLinkAttrs := netlink.NewLinkAttrs()
+	bridgeLinkAttrs.Name = name
+	bridgeLinkAttrs.MTU = mtu
+	bridgeLink := &netlink.Bridge{LinkAttrs: bridgeLinkAttrs}
+
+	err := netlink.LinkAdd(bridgeLink)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create bridge device")
+	}
+
+	if addr != nil {
+		err = netlink.AddrAdd(bridgeLink, &netlink.Addr{IPNet: addr})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to add address %s to bridge %s", addr, name)
+		}
+	}
+
+	err = netlink.LinkSetUp(bridgeLink)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to set bridge up")
+	}
+
+	return bridgeLink, nil
+}
+
+func (defaultNetlinkOps) SetMaster(link netlink.Link, master netlink.Link) error {
+	err := netlink.LinkSetMaster(link, master)
+	if err != nil {
+		return errors.Wrapf(err, "failed to attach device %q to %q",
+			link.Attrs().Name, master.Attrs().Name)
+	}
+
+	return nil
+}
+
+func (defaultNetlinkOps) GetMasterPorts(master netlink.Link) ([]netlink.Link, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list devices")
+	}
+
+	var ports []netlink.Link
+	for _, link := range links {
+		if link.Attrs().MasterIndex == master.Attrs().Index {
+			ports = append(ports, link)
+		}
+	}
+
+	return ports, nil
+}
+
+func (defaultNetlinkOps) SetNoMaster(link netlink.Link) error {
+	err := netlink.LinkSetNoMaster(link)
+	if err != nil {
+		return errors.Wrapf(err, "failed to detach device %q from its master", link.Attrs().Name)
+	}
+
+	return nil
+}
+
+func (defaultNetlinkOps) SetAlias(link netlink.Link, alias string) error {
+	err := netlink.LinkSetAlias(link, alias)
+	if err != nil {
+		return errors.Wrapf(err, "failed to set alias of device %q", link.Attrs().Name)
+	}
+
+	return nil
+}
+
 type QdiscNotFoundError struct {
 	device string
 }
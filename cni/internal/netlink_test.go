@@ -0,0 +1,69 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+import (
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk/fctesting"
+)
+
+// openTap attaches to an existing tap device the way Firecracker does.
+func openTap(name string) (*os.File, error) {
+	tun, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var ifreq struct {
+		name  [unix.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifreq.name[:], name)
+	ifreq.flags = unix.IFF_TAP | unix.IFF_NO_PI | unix.IFF_VNET_HDR
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, tun.Fd(), uintptr(unix.TUNSETIFF), uintptr(unsafe.Pointer(&ifreq)))
+	if errno != 0 {
+		tun.Close()
+		return nil, errno
+	}
+
+	return tun, nil
+}
+
+func TestCreateTapCanBeOpened(t *testing.T) {
+	fctesting.RequiresRoot(t)
+
+	const tapName = "fctesttap0"
+	netlinkOps := DefaultNetlinkOps()
+
+	tap, err := netlinkOps.CreateTap(tapName, TapOptions{MTU: 1500, OwnerUID: 0, OwnerGID: 0})
+	require.NoError(t, err)
+	defer netlinkOps.RemoveLink(tapName)
+
+	require.IsType(t, &netlink.Tuntap{}, tap)
+	assert.Empty(t, tap.(*netlink.Tuntap).Fds, "the queue file descriptors should be closed")
+
+	tun, err := openTap(tapName)
+	require.NoError(t, err, "the tap should not be held open by its creator")
+	tun.Close()
+}
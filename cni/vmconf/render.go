@@ -0,0 +1,288 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package vmconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+)
+
+// The renderers below turn the StaticNetworkConf of each of a VM's network
+// interfaces into configuration files for the guest. Unlike the "ip=" boot
+// parameter, they apply all of the configuration: MAC address, MTU, every IPv4
+// and IPv6 address, routes, nameservers, search domains and resolver options.
+//
+// The confs passed to the renderers must be in the order of the VM's network
+// interfaces. Interfaces with a blank VMIfName are named after their position,
+// "eth0" for the first one, "eth1" for the second one and so on, which matches
+// the names given by the Linux kernel to Firecracker's network devices.
+
+// NetworkdUnits renders a systemd-networkd ".network" unit for each of the
+// provided confs. It returns a map from unit file names, such as
+// "10-eth0.network", to their contents, meant to be written to
+// /etc/systemd/network in the guest.
+//
+// Resolver options have no equivalent in systemd-networkd and are only
+// rendered by ResolvConf.
+func NetworkdUnits(confs ...StaticNetworkConf) map[string]string {
+	units := make(map[string]string, len(confs))
+	for i, c := range confs {
+		ifName := c.vmIfNameAt(i)
+
+		var b strings.Builder
+		b.WriteString("[Match]\n")
+		if c.VMMacAddr != "" {
+			fmt.Fprintf(&b, "MACAddress=%s\n", c.VMMacAddr)
+		}
+		if c.VMMacAddr == "" || c.VMIfName != "" {
+			fmt.Fprintf(&b, "Name=%s\n", ifName)
+		}
+
+		if c.VMMTU > 0 {
+			fmt.Fprintf(&b, "\n[Link]\nMTUBytes=%d\n", c.VMMTU)
+		}
+
+		b.WriteString("\n[Network]\n")
+		for _, ipConfig := range c.ipConfigs() {
+			fmt.Fprintf(&b, "Address=%s\n", ipConfig.Address.String())
+		}
+		for _, ipConfig := range c.ipConfigs() {
+			if ipConfig.Gateway != nil {
+				fmt.Fprintf(&b, "Gateway=%s\n", ipConfig.Gateway.String())
+			}
+		}
+		for _, nameserver := range c.VMNameservers {
+			fmt.Fprintf(&b, "DNS=%s\n", nameserver)
+		}
+		if domains := c.searchDomains(); len(domains) > 0 {
+			fmt.Fprintf(&b, "Domains=%s\n", strings.Join(domains, " "))
+		}
+
+		for _, route := range c.extraRoutes() {
+			fmt.Fprintf(&b, "\n[Route]\nDestination=%s\n", route.Dst.String())
+			if gateway := c.routeGateway(route); gateway != nil {
+				fmt.Fprintf(&b, "Gateway=%s\n", gateway.String())
+			}
+		}
+
+		units[fmt.Sprintf("10-%s.network", ifName)] = b.String()
+	}
+
+	return units
+}
+
+// ResolvConf renders an /etc/resolv.conf file combining the nameservers,
+// search domains and resolver options of all of the provided confs.
+func ResolvConf(confs ...StaticNetworkConf) string {
+	var nameservers, domains, options []string
+	for _, c := range confs {
+		nameservers = appendUnique(nameservers, c.VMNameservers...)
+		domains = appendUnique(domains, c.searchDomains()...)
+		options = appendUnique(options, c.VMResolverOptions...)
+	}
+
+	var b strings.Builder
+	for _, nameserver := range nameservers {
+		fmt.Fprintf(&b, "nameserver %s\n", nameserver)
+	}
+	if len(domains) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(domains, " "))
+	}
+	if len(options) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(options, " "))
+	}
+
+	return b.String()
+}
+
+// CloudInitNetworkConfig renders a cloud-init network configuration, version
+// 2, describing all of the provided confs. The document is encoded as JSON,
+// which cloud-init accepts as YAML.
+//
+// See https://cloudinit.readthedocs.io/en/latest/topics/network-config-format-v2.html
+func CloudInitNetworkConfig(confs ...StaticNetworkConf) ([]byte, error) {
+	doc := cloudInitNetworkConfig{
+		Version:   2,
+		Ethernets: make(map[string]cloudInitEthernet, len(confs)),
+	}
+
+	for i, c := range confs {
+		ifName := c.vmIfNameAt(i)
+
+		ethernet := cloudInitEthernet{
+			MTU: c.VMMTU,
+		}
+
+		if c.VMMacAddr != "" {
+			ethernet.Match = &cloudInitMatch{MACAddress: c.VMMacAddr}
+			ethernet.SetName = ifName
+		} else {
+			ethernet.Match = &cloudInitMatch{Name: ifName}
+		}
+
+		for _, ipConfig := range c.ipConfigs() {
+			ethernet.Addresses = append(ethernet.Addresses, ipConfig.Address.String())
+			if ipConfig.Gateway == nil {
+				continue
+			}
+
+			if isIPv6(ipConfig.Address.IP) {
+				ethernet.Gateway6 = ipConfig.Gateway.String()
+			} else {
+				ethernet.Gateway4 = ipConfig.Gateway.String()
+			}
+		}
+
+		if len(c.VMNameservers) > 0 || len(c.searchDomains()) > 0 {
+			ethernet.Nameservers = &cloudInitNameservers{
+				Addresses: c.VMNameservers,
+				Search:    c.searchDomains(),
+			}
+		}
+
+		for _, route := range c.extraRoutes() {
+			cloudInitRoute := cloudInitRoute{To: route.Dst.String()}
+			if gateway := c.routeGateway(route); gateway != nil {
+				cloudInitRoute.Via = gateway.String()
+			}
+			ethernet.Routes = append(ethernet.Routes, cloudInitRoute)
+		}
+
+		doc.Ethernets[ifName] = ethernet
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+type cloudInitNetworkConfig struct {
+	Version   int                          `json:"version"`
+	Ethernets map[string]cloudInitEthernet `json:"ethernets"`
+}
+
+type cloudInitEthernet struct {
+	Match       *cloudInitMatch       `json:"match,omitempty"`
+	SetName     string                `json:"set-name,omitempty"`
+	MTU         int                   `json:"mtu,omitempty"`
+	Addresses   []string              `json:"addresses,omitempty"`
+	Gateway4    string                `json:"gateway4,omitempty"`
+	Gateway6    string                `json:"gateway6,omitempty"`
+	Nameservers *cloudInitNameservers `json:"nameservers,omitempty"`
+	Routes      []cloudInitRoute      `json:"routes,omitempty"`
+}
+
+type cloudInitMatch struct {
+	MACAddress string `json:"macaddress,omitempty"`
+	Name       string `json:"name,omitempty"`
+}
+
+type cloudInitNameservers struct {
+	Addresses []string `json:"addresses,omitempty"`
+	Search    []string `json:"search,omitempty"`
+}
+
+type cloudInitRoute struct {
+	To  string `json:"to"`
+	Via string `json:"via,omitempty"`
+}
+
+// vmIfNameAt returns VMIfName or, if it is blank, the name the kernel gives to
+// the network interface at the provided position.
+func (c StaticNetworkConf) vmIfNameAt(index int) string {
+	if c.VMIfName != "" {
+		return c.VMIfName
+	}
+
+	return fmt.Sprintf("eth%d", index)
+}
+
+// ipConfigs returns every ip configuration of the conf.
+func (c StaticNetworkConf) ipConfigs() []*current.IPConfig {
+	if len(c.VMIPConfigs) > 0 {
+		return c.VMIPConfigs
+	}
+
+	if c.VMIPConfig != nil {
+		return []*current.IPConfig{c.VMIPConfig}
+	}
+
+	return nil
+}
+
+// searchDomains returns VMDomain, if any, followed by VMSearchDomains.
+func (c StaticNetworkConf) searchDomains() []string {
+	var domains []string
+	if c.VMDomain != "" {
+		domains = append(domains, c.VMDomain)
+	}
+
+	return appendUnique(domains, c.VMSearchDomains...)
+}
+
+// extraRoutes returns VMRoutes without the default routes that are already
+// created from the gateways of the ip configurations.
+func (c StaticNetworkConf) extraRoutes() []*types.Route {
+	var routes []*types.Route
+	for _, route := range c.VMRoutes {
+		if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+			if gateway := c.routeGateway(route); gateway != nil && gateway.Equal(c.gatewayOfFamily(isIPv6(route.Dst.IP))) {
+				continue
+			}
+		}
+
+		routes = append(routes, route)
+	}
+
+	return routes
+}
+
+// routeGateway returns the gateway of the route or, if it has none, the
+// gateway of the ip configuration of the same IP version, as specified by CNI.
+func (c StaticNetworkConf) routeGateway(route *types.Route) net.IP {
+	if route.GW != nil {
+		return route.GW
+	}
+
+	return c.gatewayOfFamily(isIPv6(route.Dst.IP))
+}
+
+func (c StaticNetworkConf) gatewayOfFamily(ipv6 bool) net.IP {
+	if ipConfig := c.ipConfigOfFamily(ipv6); ipConfig != nil {
+		return ipConfig.Gateway
+	}
+
+	return nil
+}
+
+func appendUnique(values []string, newValues ...string) []string {
+	for _, newValue := range newValues {
+		found := false
+		for _, value := range values {
+			if value == newValue {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			values = append(values, newValue)
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,149 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package vmconf
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRenderConfs() []StaticNetworkConf {
+	ipv4Config := &current.IPConfig{
+		Version: "4",
+		Address: net.IPNet{IP: net.IPv4(10, 0, 0, 2), Mask: net.CIDRMask(24, 32)},
+		Gateway: net.IPv4(10, 0, 0, 1),
+	}
+	ipv6Config := &current.IPConfig{
+		Version: "6",
+		Address: net.IPNet{IP: net.ParseIP("2001:db8::2"), Mask: net.CIDRMask(64, 128)},
+		Gateway: net.ParseIP("2001:db8::1"),
+	}
+
+	return []StaticNetworkConf{
+		{
+			VMMacAddr:   "02:00:00:00:00:01",
+			VMMTU:       1400,
+			VMIPConfig:  ipv4Config,
+			VMIPConfigs: []*current.IPConfig{ipv4Config, ipv6Config},
+			VMRoutes: []*types.Route{
+				// duplicates the default route from the gateway
+				{Dst: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}},
+				{Dst: net.IPNet{IP: net.IPv4(192, 168, 0, 0), Mask: net.CIDRMask(16, 32)}, GW: net.IPv4(10, 0, 0, 254)},
+			},
+			VMNameservers:     []string{"1.1.1.1", "2001:db8::53", "8.8.8.8"},
+			VMDomain:          "example.com",
+			VMSearchDomains:   []string{"svc.example.com"},
+			VMResolverOptions: []string{"ndots:2"},
+		},
+		{
+			VMIfName: "mgmt0",
+			VMIPConfig: &current.IPConfig{
+				Version: "4",
+				Address: net.IPNet{IP: net.IPv4(172, 16, 0, 2), Mask: net.CIDRMask(24, 32)},
+			},
+			VMNameservers:   []string{"1.1.1.1"},
+			VMSearchDomains: []string{"mgmt.example.com"},
+		},
+	}
+}
+
+func TestNetworkdUnits(t *testing.T) {
+	units := NetworkdUnits(testRenderConfs()...)
+
+	assert.Equal(t, map[string]string{
+		"10-eth0.network": `[Match]
+MACAddress=02:00:00:00:00:01
+
+[Link]
+MTUBytes=1400
+
+[Network]
+Address=10.0.0.2/24
+Address=2001:db8::2/64
+Gateway=10.0.0.1
+Gateway=2001:db8::1
+DNS=1.1.1.1
+DNS=2001:db8::53
+DNS=8.8.8.8
+Domains=example.com svc.example.com
+
+[Route]
+Destination=192.168.0.0/16
+Gateway=10.0.0.254
+`,
+		"10-mgmt0.network": `[Match]
+Name=mgmt0
+
+[Network]
+Address=172.16.0.2/24
+DNS=1.1.1.1
+Domains=mgmt.example.com
+`,
+	}, units)
+}
+
+func TestResolvConf(t *testing.T) {
+	assert.Equal(t, `nameserver 1.1.1.1
+nameserver 2001:db8::53
+nameserver 8.8.8.8
+search example.com svc.example.com mgmt.example.com
+options ndots:2
+`, ResolvConf(testRenderConfs()...))
+
+	assert.Empty(t, ResolvConf(StaticNetworkConf{}), "expected an empty resolv.conf without any resolver configuration")
+}
+
+func TestCloudInitNetworkConfig(t *testing.T) {
+	doc, err := CloudInitNetworkConfig(testRenderConfs()...)
+	require.NoError(t, err)
+
+	var actual map[string]interface{}
+	require.NoError(t, json.Unmarshal(doc, &actual))
+
+	var expected map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+  "version": 2,
+  "ethernets": {
+    "eth0": {
+      "match": {"macaddress": "02:00:00:00:00:01"},
+      "set-name": "eth0",
+      "mtu": 1400,
+      "addresses": ["10.0.0.2/24", "2001:db8::2/64"],
+      "gateway4": "10.0.0.1",
+      "gateway6": "2001:db8::1",
+      "nameservers": {
+        "addresses": ["1.1.1.1", "2001:db8::53", "8.8.8.8"],
+        "search": ["example.com", "svc.example.com"]
+      },
+      "routes": [{"to": "192.168.0.0/16", "via": "10.0.0.254"}]
+    },
+    "mgmt0": {
+      "match": {"name": "mgmt0"},
+      "addresses": ["172.16.0.2/24"],
+      "nameservers": {
+        "addresses": ["1.1.1.1"],
+        "search": ["mgmt.example.com"]
+      }
+    }
+  }
+}`), &expected))
+
+	assert.Equal(t, expected, actual)
+}
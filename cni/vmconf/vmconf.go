@@ -25,11 +25,14 @@
    the VM's internal network interface.
      * If the CNI results specify an IP associated with this interface, that IP
        should be used to statically configure the VM's internal network interface.
+       An IPv4 and an IPv6 address may both be associated with the interface for
+       dual-stack configurations.
 */
 package vmconf
 
 import (
 	"fmt"
+	"net"
 	"strings"
 
 	"github.com/containernetworking/cni/pkg/types"
@@ -62,8 +65,13 @@ type StaticNetworkConf struct {
 	// VMMTU is the MTU that callers should configure their VM to use internally.
 	VMMTU int
 	// VMIPConfig is the ip configuration that callers should configure their VM's internal
-	// primary interface to use.
+	// primary interface to use. If the interface has several addresses, it is the first IPv4
+	// one, or else the first IPv6 one.
 	VMIPConfig *current.IPConfig
+	// VMIPConfigs (optional) holds every ip configuration, IPv4 and IPv6, that callers should
+	// configure their VM's internal primary interface to use. If empty, VMIPConfig is the only
+	// ip configuration.
+	VMIPConfigs []*current.IPConfig
 	// VMRoutes are the routes that callers should configure their VM's internal route table
 	// to have
 	VMRoutes []*types.Route
@@ -91,31 +99,42 @@ type StaticNetworkConf struct {
 // applied automatically. In particular:
 // * The MacAddr and MTU cannot be applied
 // * The only routes created will match what's specified in VMIPConfig; VMRoutes will be ignored.
-// * Only up to two namesevers can be supplied. If VMNameservers is has more than 2 entries, only
-//   the first two in the slice will be applied in the VM.
+// * Only IPv4 is supported. An empty string is returned if there is no IPv4 configuration, and
+//   IPv6 nameservers are ignored. See IPv6BootParam for IPv6.
+// * Only the first IPv4 address is applied. The renderers such as NetworkdUnits apply all of
+//   the addresses in VMIPConfigs.
+// * Only up to two namesevers can be supplied. If VMNameservers is has more than 2 IPv4 entries,
+//   only the first two in the slice will be applied in the VM.
 // * VMDomain, VMSearchDomains and VMResolverOptions will be ignored
 // * Nameserver settings are also only set in /proc/net/pnp. Most applications will thus require
 //   /etc/resolv.conf to be a symlink to /proc/net/pnp in order to resolve names as expected.
 func (c StaticNetworkConf) IPBootParam() string {
 	// See "ip=" section of kernel linked above for details on each field listed below.
 
+	ipConfig := c.ipConfigOfFamily(false)
+	if ipConfig == nil {
+		return ""
+	}
+
 	// client-ip is really just the ip that will be assigned to the primary interface
-	clientIP := c.VMIPConfig.Address.IP.String()
+	clientIP := ipConfig.Address.IP.String()
 
 	// don't set nfs server IP
 	const serverIP = ""
 
 	// default gateway for the network; used to generate a corresponding route table entry
-	defaultGateway := c.VMIPConfig.Gateway.String()
+	var defaultGateway string
+	if ipConfig.Gateway != nil {
+		defaultGateway = ipConfig.Gateway.String()
+	}
 
 	// subnet mask used to generate a corresponding route table entry for the primary interface
 	// (must be provided in dotted decimal notation)
-	subnetMask := fmt.Sprintf("%d.%d.%d.%d",
-		c.VMIPConfig.Address.Mask[0],
-		c.VMIPConfig.Address.Mask[1],
-		c.VMIPConfig.Address.Mask[2],
-		c.VMIPConfig.Address.Mask[3],
-	)
+	mask := ipConfig.Address.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	subnetMask := fmt.Sprintf("%d.%d.%d.%d", mask[0], mask[1], mask[2], mask[3])
 
 	// the "hostname" field actually just configures a hostname value for DHCP requests, thus no need to set it
 	const dhcpHostname = ""
@@ -128,7 +147,7 @@ func (c StaticNetworkConf) IPBootParam() string {
 
 	// up to two nameservers (if any were provided)
 	var nameservers [2]string
-	copy(nameservers[:], c.VMNameservers)
+	copy(nameservers[:], c.nameserversOfFamily(false))
 
 	// TODO(sipsma) should we support configuring an NTP server?
 	const ntpServer = ""
@@ -147,6 +166,59 @@ func (c StaticNetworkConf) IPBootParam() string {
 	}, ":")
 }
 
+// IPv6BootParam provides a string describing the IPv6 configuration in StaticNetworkConf, in the
+// form "<address>/<prefix length>,<gateway>[,<nameserver>...]", where the gateway may be empty.
+// The Linux kernel cannot configure IPv6 from its boot parameters, so the string is meant to be
+// passed in a custom boot parameter and applied by the guest, for example by an init script
+// reading /proc/cmdline. An empty string is returned if there is no IPv6 configuration.
+//
+// Only the first IPv6 address, its default gateway and IPv6 nameservers are included; all other
+// configuration, including VMRoutes, is ignored.
+func (c StaticNetworkConf) IPv6BootParam() string {
+	ipConfig := c.ipConfigOfFamily(true)
+	if ipConfig == nil {
+		return ""
+	}
+
+	var gateway string
+	if ipConfig.Gateway != nil {
+		gateway = ipConfig.Gateway.String()
+	}
+
+	fields := []string{ipConfig.Address.String(), gateway}
+	fields = append(fields, c.nameserversOfFamily(true)...)
+
+	return strings.Join(fields, ",")
+}
+
+// ipConfigOfFamily returns the first IPv6 or IPv4 configuration, or nil if there is none.
+func (c StaticNetworkConf) ipConfigOfFamily(ipv6 bool) *current.IPConfig {
+	for _, ipConfig := range c.ipConfigs() {
+		if isIPv6(ipConfig.Address.IP) == ipv6 {
+			return ipConfig
+		}
+	}
+
+	return nil
+}
+
+// nameserversOfFamily returns the IPv6 or IPv4 nameservers.
+func (c StaticNetworkConf) nameserversOfFamily(ipv6 bool) []string {
+	var nameservers []string
+	for _, nameserver := range c.VMNameservers {
+		ip := net.ParseIP(nameserver)
+		if ip != nil && isIPv6(ip) == ipv6 {
+			nameservers = append(nameservers, nameserver)
+		}
+	}
+
+	return nameservers
+}
+
+func isIPv6(ip net.IP) bool {
+	return ip.To4() == nil
+}
+
 // StaticNetworkConfFrom takes the result of a CNI invocation that conforms to the specification
 // in this package's docstring and converts it to a StaticNetworkConf object that the caller
 // can use to configure their VM with.
@@ -167,13 +239,13 @@ func StaticNetworkConfFrom(result types.Result, containerID string) (*StaticNetw
 		return nil, err
 	}
 
-	// find the IP associated with the VM iface
+	// find the IPs associated with the VM iface, which may hold several addresses
+	// of each IP version
 	vmIPs := internal.InterfaceIPs(currentResult, vmIface.Name, vmIface.Sandbox)
-	if len(vmIPs) != 1 {
-		return nil, errors.Errorf("expected to find 1 IP for vm interface %q, but instead found %+v",
-			vmIface.Name, vmIPs)
+	vmIP, err := primaryIP(vmIPs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid IPs for vm interface %q", vmIface.Name)
 	}
-	vmIP := vmIPs[0]
 
 	netNS, err := ns.GetNS(tapIface.Sandbox)
 	if err != nil {
@@ -191,6 +263,7 @@ func StaticNetworkConfFrom(result types.Result, containerID string) (*StaticNetw
 		VMMacAddr:         vmIface.Mac,
 		VMMTU:             tapMTU,
 		VMIPConfig:        vmIP,
+		VMIPConfigs:       vmIPs,
 		VMRoutes:          currentResult.Routes,
 		VMNameservers:     currentResult.DNS.Nameservers,
 		VMDomain:          currentResult.DNS.Domain,
@@ -199,6 +272,27 @@ func StaticNetworkConfFrom(result types.Result, containerID string) (*StaticNetw
 	}, nil
 }
 
+// primaryIP checks that there is at least one IP configuration and returns
+// the first IPv4 one, or else the first IPv6 one.
+func primaryIP(ipConfigs []*current.IPConfig) (*current.IPConfig, error) {
+	var ipv6 *current.IPConfig
+	for _, ipConfig := range ipConfigs {
+		if !isIPv6(ipConfig.Address.IP) {
+			return ipConfig, nil
+		}
+
+		if ipv6 == nil {
+			ipv6 = ipConfig
+		}
+	}
+
+	if ipv6 != nil {
+		return ipv6, nil
+	}
+
+	return nil, errors.New("expected to find at least 1 IP, but found none")
+}
+
 func mtuOf(ifaceName string, netNS ns.NetNS, netlinkOps internal.NetlinkOps) (int, error) {
 	var mtu int
 	err := netNS.Do(func(_ ns.NetNS) error {
@@ -93,3 +93,60 @@ func TestIPBootParams(t *testing.T) {
 	actualIPBootParam := staticNetworkConf.IPBootParam()
 	assert.Equal(t, expectedIPBootParam, actualIPBootParam)
 }
+
+func TestIPBootParamsDualStack(t *testing.T) {
+	ipv4Config := &current.IPConfig{
+		Version: "4",
+		Address: net.IPNet{
+			IP:   net.IPv4(10, 0, 0, 2),
+			Mask: net.CIDRMask(24, 32),
+		},
+		Gateway: net.IPv4(10, 0, 0, 1),
+	}
+	ipv6Config := &current.IPConfig{
+		Version: "6",
+		Address: net.IPNet{
+			IP:   net.ParseIP("2001:db8::2"),
+			Mask: net.CIDRMask(64, 128),
+		},
+		Gateway: net.ParseIP("2001:db8::1"),
+	}
+
+	staticNetworkConf := &StaticNetworkConf{
+		VMIfName:      "eth0",
+		VMIPConfig:    ipv4Config,
+		VMIPConfigs:   []*current.IPConfig{ipv6Config, ipv4Config},
+		VMNameservers: []string{"2001:db8::53", "1.1.1.1", "2001:db8::54"},
+	}
+
+	assert.Equal(t, "10.0.0.2::10.0.0.1:255.255.255.0::eth0:off:1.1.1.1::", staticNetworkConf.IPBootParam())
+	assert.Equal(t, "2001:db8::2/64,2001:db8::1,2001:db8::53,2001:db8::54", staticNetworkConf.IPv6BootParam())
+
+	ipv6Only := &StaticNetworkConf{VMIPConfig: ipv6Config}
+	assert.Empty(t, ipv6Only.IPBootParam(), "expected no ip= param without an ipv4 address")
+	assert.Equal(t, "2001:db8::2/64,2001:db8::1", ipv6Only.IPv6BootParam())
+
+	ipv4Only := &StaticNetworkConf{VMIPConfig: ipv4Config}
+	assert.Empty(t, ipv4Only.IPv6BootParam(), "expected no ipv6 param without an ipv6 address")
+}
+
+func TestPrimaryIP(t *testing.T) {
+	ipv4 := &current.IPConfig{Address: net.IPNet{IP: net.IPv4(10, 0, 0, 2), Mask: net.CIDRMask(24, 32)}}
+	ipv6 := &current.IPConfig{Address: net.IPNet{IP: net.ParseIP("2001:db8::2"), Mask: net.CIDRMask(64, 128)}}
+
+	ip, err := primaryIP([]*current.IPConfig{ipv6, ipv4})
+	require.NoError(t, err)
+	assert.Equal(t, ipv4, ip, "expected the ipv4 address to be preferred")
+
+	ip, err = primaryIP([]*current.IPConfig{ipv6})
+	require.NoError(t, err)
+	assert.Equal(t, ipv6, ip)
+
+	_, err = primaryIP(nil)
+	assert.Error(t, err, "expected an error without any IP")
+
+	otherIPv4 := &current.IPConfig{Address: net.IPNet{IP: net.IPv4(10, 0, 1, 2), Mask: net.CIDRMask(24, 32)}}
+	ip, err = primaryIP([]*current.IPConfig{ipv6, ipv4, otherIPv4})
+	require.NoError(t, err)
+	assert.Equal(t, ipv4, ip, "expected the first ipv4 address to be preferred")
+}
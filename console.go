@@ -0,0 +1,479 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultConsoleBufferSize = 1024 * 1024
+
+	// consoleSubscriberBacklog is the number of chunks or lines queued for a
+	// subscriber before further output is dropped for it.
+	consoleSubscriberBacklog = 256
+)
+
+// ErrConsoleNotAttached is returned when input is sent to a Console that is
+// not attached to a running Firecracker process.
+var ErrConsoleNotAttached = errors.New("console is not attached to a firecracker process")
+
+// ErrConsoleClosed is returned when waiting on a Console whose Firecracker
+// process has exited.
+var ErrConsoleClosed = errors.New("console has been closed")
+
+// ConsoleConfig holds the settings of a Console.
+type ConsoleConfig struct {
+	// BufferSize is the number of bytes of the most recent guest output kept
+	// by the console. If zero, 1MiB is kept.
+	BufferSize int
+
+	// Output (optional) additionally receives all guest output as it is
+	// produced, for example os.Stdout.
+	Output io.Writer
+}
+
+// Console captures the serial console of a guest. The guest's serial console
+// is connected to the standard input and output of the Firecracker process,
+// so the guest kernel needs to be booted with "console=ttyS0" for output to
+// be captured.
+//
+// A Console is attached to a Machine with the WithConsole option. It keeps
+// the most recent output in a bounded buffer, delivers output to line
+// subscribers, supports expect-style scripting with WaitFor and Send, and can
+// expose the console on a PTY or a unix socket for interactive use.
+//
+// A Console cannot capture anything when the jailer is configured to
+// daemonize, as the jailer then redirects the standard streams to /dev/null.
+type Console struct {
+	cfg ConsoleConfig
+
+	mu sync.Mutex
+	// ring holds the most recent output, up to cfg.BufferSize bytes.
+	ring []byte
+	// pending holds the output not yet consumed by WaitFor.
+	pending []byte
+	// changed is closed and replaced whenever output is written or the
+	// console is closed.
+	changed     chan struct{}
+	closed      bool
+	subscribers map[chan []byte]struct{}
+	input       io.WriteCloser
+	closers     []io.Closer
+}
+
+// NewConsole returns a new Console with the provided configuration.
+func NewConsole(cfg ConsoleConfig) *Console {
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = defaultConsoleBufferSize
+	}
+
+	return &Console{
+		cfg:         cfg,
+		changed:     make(chan struct{}),
+		subscribers: make(map[chan []byte]struct{}),
+	}
+}
+
+// WithConsole will connect the given console to the serial console of the
+// Firecracker process. It replaces the process' standard input and output.
+func WithConsole(console *Console) Opt {
+	return func(machine *Machine) {
+		machine.console = console
+	}
+}
+
+// attach connects the console to the standard streams of cmd and arranges for
+// the console to be closed when the machine is cleaned up. It returns the read
+// end of the input pipe, which the caller closes once the process has been
+// started. The process gets the pipe itself rather than a copying goroutine,
+// so waiting on the process does not depend on the console being closed.
+func (c *Console) attach(m *Machine) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create console input pipe")
+	}
+
+	c.mu.Lock()
+	c.input = w
+	c.mu.Unlock()
+
+	m.cmd.Stdin = r
+	m.cmd.Stdout = c
+
+	m.cleanupFuncs = append(m.cleanupFuncs, c.close)
+	return r, nil
+}
+
+// Write records output from the guest. It is used as the standard output of
+// the Firecracker process and never fails.
+func (c *Console) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.ring = appendBounded(c.ring, p, c.cfg.BufferSize)
+	c.pending = appendBounded(c.pending, p, c.cfg.BufferSize)
+
+	for sub := range c.subscribers {
+		chunk := make([]byte, len(p))
+		copy(chunk, p)
+		select {
+		case sub <- chunk:
+		default:
+			// the subscriber is not keeping up, drop the output for it
+		}
+	}
+
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.mu.Unlock()
+
+	if c.cfg.Output != nil {
+		c.cfg.Output.Write(p)
+	}
+
+	return len(p), nil
+}
+
+// appendBounded appends p to buf, discarding the oldest bytes so that at most
+// limit bytes are kept.
+func appendBounded(buf, p []byte, limit int) []byte {
+	buf = append(buf, p...)
+	if overflow := len(buf) - limit; overflow > 0 {
+		buf = append(buf[:0], buf[overflow:]...)
+	}
+
+	return buf
+}
+
+// Bytes returns a copy of the most recent guest output.
+func (c *Console) Bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]byte(nil), c.ring...)
+}
+
+// String returns the most recent guest output.
+func (c *Console) String() string {
+	return string(c.Bytes())
+}
+
+// Send writes input to the guest's serial console.
+func (c *Console) Send(input string) error {
+	c.mu.Lock()
+	w := c.input
+	c.mu.Unlock()
+
+	if w == nil {
+		return ErrConsoleNotAttached
+	}
+
+	_, err := io.WriteString(w, input)
+	return err
+}
+
+// WaitFor waits until the guest produces output matching pattern and returns
+// the match. Only output produced after the previous match is considered, so
+// consecutive calls step through the output the way an expect script does.
+func (c *Console) WaitFor(ctx context.Context, pattern *regexp.Regexp) (string, error) {
+	for {
+		c.mu.Lock()
+		if loc := pattern.FindIndex(c.pending); loc != nil {
+			match := string(c.pending[loc[0]:loc[1]])
+			c.pending = append(c.pending[:0], c.pending[loc[1]:]...)
+			c.mu.Unlock()
+			return match, nil
+		}
+
+		changed := c.changed
+		closed := c.closed
+		c.mu.Unlock()
+
+		if closed {
+			return "", ErrConsoleClosed
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// WaitForString waits until the guest produces output containing s.
+func (c *Console) WaitForString(ctx context.Context, s string) error {
+	_, err := c.WaitFor(ctx, regexp.MustCompile(regexp.QuoteMeta(s)))
+	return err
+}
+
+// subscribe returns a channel receiving chunks of output as they are
+// produced, and a function that cancels the subscription.
+func (c *Console) subscribe() (chan []byte, func()) {
+	ch, _, cancel := c.subscribeWithBacklog()
+	return ch, cancel
+}
+
+// subscribeWithBacklog subscribes to the output like subscribe, and also
+// returns the output buffered at the time of subscribing.
+func (c *Console) subscribeWithBacklog() (chan []byte, []byte, func()) {
+	ch := make(chan []byte, consoleSubscriberBacklog)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	backlog := append([]byte(nil), c.ring...)
+	if c.closed {
+		close(ch)
+		return ch, backlog, func() {}
+	}
+
+	c.subscribers[ch] = struct{}{}
+
+	var once sync.Once
+	return ch, backlog, func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if _, ok := c.subscribers[ch]; ok {
+				delete(c.subscribers, ch)
+				close(ch)
+			}
+		})
+	}
+}
+
+// SubscribeLines returns a channel receiving each complete line of guest
+// output, without the trailing newline, and a function that cancels the
+// subscription. The channel is closed when the subscription is cancelled or
+// the console is closed. Lines are dropped for subscribers that do not keep
+// up with the guest's output.
+func (c *Console) SubscribeLines() (<-chan string, func()) {
+	chunks, cancel := c.subscribe()
+	lines := make(chan string, consoleSubscriberBacklog)
+
+	go func() {
+		defer close(lines)
+
+		var partial []byte
+		for chunk := range chunks {
+			partial = append(partial, chunk...)
+			for {
+				i := bytes.IndexByte(partial, '\n')
+				if i < 0 {
+					break
+				}
+
+				line := string(bytes.TrimSuffix(partial[:i], []byte("\r")))
+				partial = partial[i+1:]
+
+				select {
+				case lines <- line:
+				default:
+				}
+			}
+		}
+	}()
+
+	return lines, cancel
+}
+
+// ServeUnix exposes the console on a unix socket at path. Every client that
+// connects first receives the buffered output and then the live output of
+// the guest, and anything it writes is sent to the guest. The socket is
+// removed when the returned io.Closer is closed or the console is closed.
+func (c *Console) ServeUnix(path string) (io.Closer, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen on console socket %q", path)
+	}
+
+	c.addCloser(listener)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go c.serve(conn)
+		}
+	}()
+
+	return listener, nil
+}
+
+// OpenPTY exposes the console on a new pseudo-terminal and returns the path
+// of its device, such as "/dev/pts/3", which can be opened with a terminal
+// program like screen. The PTY is closed when the returned io.Closer is
+// closed or the console is closed.
+func (c *Console) OpenPTY() (string, io.Closer, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to open /dev/ptmx")
+	}
+
+	ptsPath, err := setupPTY(master)
+	if err != nil {
+		master.Close()
+		return "", nil, err
+	}
+
+	c.addCloser(master)
+	go c.serve(master)
+
+	return ptsPath, master, nil
+}
+
+// setupPTY unlocks the slave side of the PTY, puts it in raw mode and returns
+// its path.
+func setupPTY(master *os.File) (string, error) {
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		return "", errors.Wrap(err, "failed to unlock pty")
+	}
+
+	ptyNumber, err := unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get pty number")
+	}
+	ptsPath := fmt.Sprintf("/dev/pts/%d", ptyNumber)
+
+	slave, err := os.OpenFile(ptsPath, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to open %q", ptsPath)
+	}
+	defer slave.Close()
+
+	termios, err := unix.IoctlGetTermios(int(slave.Fd()), unix.TCGETS)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get pty attributes")
+	}
+
+	// equivalent of cfmakeraw(3)
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+
+	if err := unix.IoctlSetTermios(int(slave.Fd()), unix.TCSETS, termios); err != nil {
+		return "", errors.Wrap(err, "failed to set pty attributes")
+	}
+
+	return ptsPath, nil
+}
+
+// serve connects rw to the console, replaying the buffered output first.
+func (c *Console) serve(rw io.ReadWriteCloser) {
+	defer rw.Close()
+
+	chunks, backlog, cancel := c.subscribeWithBacklog()
+	defer cancel()
+
+	if _, err := rw.Write(backlog); err != nil {
+		return
+	}
+
+	go func() {
+		defer cancel()
+
+		buf := make([]byte, 1024)
+		for {
+			n, err := rw.Read(buf)
+			if n > 0 {
+				if sendErr := c.Send(string(buf[:n])); sendErr != nil {
+					return
+				}
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for chunk := range chunks {
+		if _, err := rw.Write(chunk); err != nil {
+			return
+		}
+	}
+}
+
+func (c *Console) addCloser(closer io.Closer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closers = append(c.closers, closer)
+}
+
+// close detaches the console from the Firecracker process, ends all
+// subscriptions and stops serving the console on sockets and PTYs.
+func (c *Console) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	var err *multierror.Error
+	if c.input != nil {
+		err = multierror.Append(err, c.input.Close())
+	}
+
+	for _, closer := range c.closers {
+		closeErr := closer.Close()
+		if closeErr != nil && !isClosedError(closeErr) {
+			err = multierror.Append(err, closeErr)
+		}
+	}
+
+	for sub := range c.subscribers {
+		delete(c.subscribers, sub)
+		close(sub)
+	}
+
+	close(c.changed)
+	c.changed = make(chan struct{})
+
+	return err.ErrorOrNil()
+}
+
+func isClosedError(err error) bool {
+	if err == os.ErrClosed {
+		return true
+	}
+
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == os.ErrClosed {
+		return true
+	}
+
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Err != nil && opErr.Err.Error() == "use of closed network connection"
+}
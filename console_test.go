@@ -0,0 +1,158 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsoleBuffer(t *testing.T) {
+	console := NewConsole(ConsoleConfig{BufferSize: 8})
+
+	console.Write([]byte("0123"))
+	console.Write([]byte("456789"))
+	assert.Equal(t, "23456789", console.String())
+}
+
+func TestConsoleWaitFor(t *testing.T) {
+	console := NewConsole(ConsoleConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		console.Write([]byte("Booting...\nlocalhost login: "))
+		console.Write([]byte("\nPassword: "))
+	}()
+
+	match, err := console.WaitFor(ctx, regexp.MustCompile(`\w+ login: `))
+	require.NoError(t, err)
+	assert.Equal(t, "localhost login: ", match)
+
+	require.NoError(t, console.WaitForString(ctx, "Password: "))
+
+	// the output before the previous match has already been consumed
+	shortCtx, shortCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer shortCancel()
+	_, err = console.WaitFor(shortCtx, regexp.MustCompile("login"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	console.close()
+	_, err = console.WaitFor(ctx, regexp.MustCompile("login"))
+	assert.Equal(t, ErrConsoleClosed, err)
+}
+
+func TestConsoleSubscribeLines(t *testing.T) {
+	console := NewConsole(ConsoleConfig{})
+	lines, cancel := console.SubscribeLines()
+	defer cancel()
+
+	console.Write([]byte("first li"))
+	console.Write([]byte("ne\r\nsecond line\nthird"))
+
+	assert.Equal(t, "first line", <-lines)
+	assert.Equal(t, "second line", <-lines)
+
+	console.close()
+	_, ok := <-lines
+	assert.False(t, ok, "expected lines channel to be closed")
+}
+
+func TestConsoleAttach(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestConsoleAttach")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	console := NewConsole(ConsoleConfig{})
+	assert.Equal(t, ErrConsoleNotAttached, console.Send("too early"))
+
+	m := &Machine{cmd: exec.Command("cat")}
+	consoleInput, err := console.attach(m)
+	require.NoError(t, err)
+	require.NoError(t, m.cmd.Start())
+	require.NoError(t, consoleInput.Close())
+	defer m.cmd.Process.Kill()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.NoError(t, console.Send("hello guest\n"))
+	require.NoError(t, console.WaitForString(ctx, "hello guest\n"))
+
+	socketPath := filepath.Join(dir, "console.sock")
+	_, err = console.ServeUnix(socketPath)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("unix", socketPath)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "hello guest\n", line, "expected buffered output to be replayed")
+
+	_, err = conn.Write([]byte("from the socket\n"))
+	require.NoError(t, err)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "from the socket\n", line)
+
+	// like startVMM, wait for the process to exit before cleaning up
+	require.NoError(t, m.cmd.Process.Kill())
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- m.cmd.Wait()
+	}()
+	select {
+	case <-waitErr:
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting for the process should not depend on the console being closed")
+	}
+
+	require.NoError(t, m.doCleanup())
+	_, err = os.Stat(socketPath)
+	assert.True(t, os.IsNotExist(err), "expected console socket to be removed, got %v", err)
+	assert.Equal(t, ErrConsoleClosed, console.WaitForString(ctx, "more output"))
+}
+
+func TestConsoleOpenPTY(t *testing.T) {
+	console := NewConsole(ConsoleConfig{})
+	console.Write([]byte("buffered\n"))
+
+	ptsPath, closer, err := console.OpenPTY()
+	if err != nil {
+		t.Skipf("unable to open a pty: %v", err)
+	}
+	defer closer.Close()
+
+	pts, err := os.OpenFile(ptsPath, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer pts.Close()
+
+	line, err := bufio.NewReader(pts).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "buffered\n", line)
+}
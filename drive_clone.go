@@ -0,0 +1,472 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// DriveCloneMethod is a way of cloning the image of a drive.
+type DriveCloneMethod string
+
+const (
+	// DriveCloneReflink clones images by sharing their blocks until they are
+	// written to, which is instant but requires a filesystem supporting
+	// reflinks, such as XFS or Btrfs, holding both the image and its clone.
+	DriveCloneReflink DriveCloneMethod = "reflink"
+
+	// DriveCloneSparseCopy copies the data of images, leaving holes where
+	// they have holes or zeroed blocks.
+	DriveCloneSparseCopy DriveCloneMethod = "sparse-copy"
+
+	// DriveCloneDMSnapshot clones images with a device-mapper snapshot of a
+	// read-only loop device of the image, storing the writes in a sparse file
+	// at the clone path. The drive is backed by the snapshot device, which
+	// requires root, the losetup and dmsetup tools, and cannot be linked into
+	// jails.
+	DriveCloneDMSnapshot DriveCloneMethod = "dm-snapshot"
+)
+
+const (
+	// ficlone is the FICLONE ioctl request, _IOW(0x94, 9, int), making a file
+	// share the blocks of another.
+	ficlone = 0x40049409
+
+	// seekData and seekHole are the whence values of lseek finding the next
+	// data region and hole of a file.
+	seekData = 3
+	seekHole = 4
+
+	// sparseCopyChunkSize is the granularity at which zeroed blocks are
+	// detected when copying images.
+	sparseCopyChunkSize = 64 * 1024
+
+	// dmSectorSize is the unit of device-mapper tables.
+	dmSectorSize = 512
+	// dmSnapshotChunkSectors is the chunk size of snapshots, in sectors.
+	dmSnapshotChunkSectors = 8
+	// dmDevicePrefix starts the names of the snapshot devices.
+	dmDevicePrefix = "fc-clone-"
+)
+
+var defaultDriveCloneMethods = []DriveCloneMethod{DriveCloneReflink, DriveCloneSparseCopy}
+
+// DriveClone is a writable clone of the image of a drive.
+type DriveClone struct {
+	// Path is the path of the clone to use as the drive's PathOnHost, which
+	// is the device of snapshot clones.
+	Path string
+
+	// Method is the way the image was cloned.
+	Method DriveCloneMethod
+
+	removeOnce sync.Once
+	removeErr  error
+	remove     func() error
+}
+
+// Remove removes the clone, and the devices backing snapshot clones.
+func (c *DriveClone) Remove() error {
+	c.removeOnce.Do(func() {
+		c.removeErr = c.remove()
+	})
+	return c.removeErr
+}
+
+// DriveCloneOpt configures how drives are cloned.
+type DriveCloneOpt func(*driveCloneOptions)
+
+type driveCloneOptions struct {
+	methods []DriveCloneMethod
+}
+
+// WithDriveCloneMethods sets the methods tried in turn to clone images,
+// which are DriveCloneReflink and then DriveCloneSparseCopy by default.
+func WithDriveCloneMethods(methods ...DriveCloneMethod) DriveCloneOpt {
+	return func(opts *driveCloneOptions) {
+		opts.methods = methods
+	}
+}
+
+// CloneDrive creates a writable clone of the drive image at basePath at
+// clonePath, which must not exist, trying each clone method in turn until
+// one succeeds. The image must not be written to while clones of it are
+// used.
+func CloneDrive(ctx context.Context, basePath, clonePath string, opts ...DriveCloneOpt) (*DriveClone, error) {
+	options := driveCloneOptions{methods: defaultDriveCloneMethods}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if len(options.methods) == 0 {
+		return nil, errors.New("no drive clone method provided")
+	}
+
+	var errs *multierror.Error
+	for _, method := range options.methods {
+		var clone *DriveClone
+		var err error
+		switch method {
+		case DriveCloneReflink:
+			clone, err = cloneFile(basePath, clonePath, method, reflinkFile)
+		case DriveCloneSparseCopy:
+			clone, err = cloneFile(basePath, clonePath, method, func(dst, src *os.File) error {
+				return sparseCopyFile(ctx, dst, src)
+			})
+		case DriveCloneDMSnapshot:
+			clone, err = dmSnapshotClone(ctx, basePath, clonePath)
+		default:
+			err = errors.Errorf("unknown drive clone method %q", method)
+		}
+
+		if err == nil {
+			return clone, nil
+		}
+
+		errs = multierror.Append(errs, errors.Wrapf(err, "%s", method))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Wrapf(errs, "failed to clone drive %q", basePath)
+}
+
+// cloneFile creates clonePath, with the mode of the image, and fills it with
+// the contents of the image with fill. The clone is removed on failure.
+func cloneFile(basePath, clonePath string, method DriveCloneMethod, fill func(dst, src *os.File) error) (*DriveClone, error) {
+	src, err := os.Open(basePath)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil, errors.Errorf("%q is not a regular file", basePath)
+	}
+
+	dst, err := os.OpenFile(clonePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return nil, err
+	}
+
+	err = fill(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(clonePath)
+		return nil, err
+	}
+
+	return &DriveClone{
+		Path:   clonePath,
+		Method: method,
+		remove: func() error {
+			if err := os.Remove(clonePath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		},
+	}, nil
+}
+
+// reflinkFile makes dst share the blocks of src.
+func reflinkFile(dst, src *os.File) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return os.NewSyscallError("ioctl FICLONE", errno)
+	}
+
+	return nil
+}
+
+// sparseCopyFile copies the data regions of src to dst, as reported by
+// SEEK_DATA and SEEK_HOLE, leaving holes for the chunks of zeroes.
+func sparseCopyFile(ctx context.Context, dst, src *os.File) error {
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	if err := dst.Truncate(size); err != nil {
+		return err
+	}
+
+	buf := make([]byte, sparseCopyChunkSize)
+	fd := int(src.Fd())
+	for offset := int64(0); offset < size; {
+		dataStart, err := unix.Seek(fd, offset, seekData)
+		if err == unix.ENXIO {
+			// only a hole is left
+			return nil
+		} else if err != nil {
+			// without SEEK_DATA, the remaining contents are all data
+			dataStart = offset
+		}
+
+		dataEnd, err := unix.Seek(fd, dataStart, seekHole)
+		if err != nil {
+			dataEnd = size
+		}
+
+		if err := copyDataRegion(ctx, dst, src, dataStart, dataEnd, buf); err != nil {
+			return err
+		}
+		offset = dataEnd
+	}
+
+	return nil
+}
+
+func copyDataRegion(ctx context.Context, dst, src *os.File, start, end int64, buf []byte) error {
+	for offset := start; offset < end; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		chunk := buf
+		if remaining := end - offset; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+
+		n, err := src.ReadAt(chunk, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			return errors.Errorf("image shrank while copying it, at offset %d", offset)
+		}
+		chunk = chunk[:n]
+
+		if !isZero(chunk) {
+			if _, err := dst.WriteAt(chunk, offset); err != nil {
+				return err
+			}
+		}
+		offset += int64(n)
+	}
+
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// dmSnapshotClone creates a device-mapper snapshot of the image, storing the
+// writes to the snapshot in a sparse file at clonePath.
+func dmSnapshotClone(ctx context.Context, basePath, clonePath string) (clone *DriveClone, err error) {
+	info, err := os.Stat(basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	size := info.Size()
+	if size == 0 || size%dmSectorSize != 0 {
+		return nil, errors.Errorf("image size %d is not a multiple of %d bytes", size, dmSectorSize)
+	}
+
+	absClonePath, err := filepath.Abs(clonePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// the teardown steps of the clone, run in reverse order on removal or
+	// failure
+	var cleanupFuncs []func() error
+	teardown := func() error {
+		var errs *multierror.Error
+		for i := len(cleanupFuncs) - 1; i >= 0; i-- {
+			errs = multierror.Append(errs, cleanupFuncs[i]())
+		}
+		return errs.ErrorOrNil()
+	}
+	defer func() {
+		if err != nil {
+			teardown()
+		}
+	}()
+
+	// the snapshot stores its metadata along with the written chunks
+	cow, err := os.OpenFile(clonePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	cleanupFuncs = append(cleanupFuncs, func() error {
+		if err := os.Remove(clonePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+
+	err = cow.Truncate(size + size/64 + 1<<20)
+	if closeErr := cow.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to size snapshot store")
+	}
+
+	baseLoop, err := attachLoopDevice(ctx, basePath, true)
+	if err != nil {
+		return nil, err
+	}
+	cleanupFuncs = append(cleanupFuncs, func() error {
+		return detachLoopDevice(baseLoop)
+	})
+
+	cowLoop, err := attachLoopDevice(ctx, clonePath, false)
+	if err != nil {
+		return nil, err
+	}
+	cleanupFuncs = append(cleanupFuncs, func() error {
+		return detachLoopDevice(cowLoop)
+	})
+
+	// device-mapper names are unique on the host, and so are clone paths
+	sum := sha256.Sum256([]byte(absClonePath))
+	name := dmDevicePrefix + hex.EncodeToString(sum[:8])
+	table := fmt.Sprintf("0 %d snapshot %s %s P %d", size/dmSectorSize, baseLoop, cowLoop, dmSnapshotChunkSectors)
+	if _, err := runTool(ctx, "dmsetup", "create", name, "--table", table); err != nil {
+		return nil, err
+	}
+	cleanupFuncs = append(cleanupFuncs, func() error {
+		_, err := runTool(context.Background(), "dmsetup", "remove", name)
+		return err
+	})
+
+	return &DriveClone{
+		Path:   filepath.Join("/dev/mapper", name),
+		Method: DriveCloneDMSnapshot,
+		remove: teardown,
+	}, nil
+}
+
+// attachLoopDevice attaches a loop device to the file at path and returns
+// the path of the device.
+func attachLoopDevice(ctx context.Context, path string, readOnly bool) (string, error) {
+	args := []string{"--find", "--show"}
+	if readOnly {
+		args = append(args, "--read-only")
+	}
+
+	output, err := runTool(ctx, "losetup", append(args, path)...)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(output), nil
+}
+
+func detachLoopDevice(device string) error {
+	_, err := runTool(context.Background(), "losetup", "--detach", device)
+	return err
+}
+
+// runTool runs a command line tool, returning its output or an error
+// including it.
+func runTool(ctx context.Context, name string, args ...string) (string, error) {
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "%s %s failed: %s", name, strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+
+	return string(output), nil
+}
+
+// NewCloneDriveHandler returns a handler that replaces the image of the drive
+// with the given ID by a writable clone at clonePath, created by CloneDrive,
+// so that several machines can boot from the same image. The clone is removed
+// when the machine is cleaned up, such as once the VMM exits. With the
+// jailer, file clones are owned by the jailer's UID and GID, and the handler
+// fails if DriveCloneDMSnapshot is among the clone methods.
+//
+// The handler must run before the drives are attached, or linked into the
+// jail, for example:
+//
+//	m.Handlers.FcInit = m.Handlers.FcInit.Prepend(
+//		firecracker.NewCloneDriveHandler("root_drive", "/var/lib/vms/vm-1.ext4"),
+//	)
+func NewCloneDriveHandler(driveID, clonePath string, opts ...DriveCloneOpt) Handler {
+	return Handler{
+		Name: CloneDriveHandlerName,
+		Fn: func(ctx context.Context, m *Machine) error {
+			if m.Cfg.JailerCfg != nil {
+				options := driveCloneOptions{methods: defaultDriveCloneMethods}
+				for _, opt := range opts {
+					opt(&options)
+				}
+
+				for _, method := range options.methods {
+					if method == DriveCloneDMSnapshot {
+						return errors.Errorf("drive %q cannot be cloned with %s for a jailed machine", driveID, method)
+					}
+				}
+			}
+
+			index := -1
+			for i, drive := range m.Cfg.Drives {
+				if StringValue(drive.DriveID) == driveID {
+					index = i
+				}
+			}
+			if index < 0 {
+				return errors.Errorf("no drive with ID %q to clone", driveID)
+			}
+
+			clone, err := CloneDrive(ctx, StringValue(m.Cfg.Drives[index].PathOnHost), clonePath, opts...)
+			if err != nil {
+				return err
+			}
+			m.cleanupFuncs = append(m.cleanupFuncs, clone.Remove)
+			m.logger.Debugf("cloned drive %q to %s with %s", driveID, clone.Path, clone.Method)
+
+			if jailerCfg := m.Cfg.JailerCfg; jailerCfg != nil && jailerCfg.UID != nil && jailerCfg.GID != nil {
+				if err := os.Chown(clone.Path, *jailerCfg.UID, *jailerCfg.GID); err != nil {
+					return errors.Wrapf(err, "failed to change owner of drive clone %q", clone.Path)
+				}
+			}
+
+			m.Cfg.Drives[index].PathOnHost = String(clone.Path)
+			return nil
+		},
+	}
+}
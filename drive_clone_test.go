@@ -0,0 +1,251 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk/fctesting"
+)
+
+const testBaseImageSize = 16 << 20
+
+// writeTestBaseImage writes a sparse image with data at its start, zeroes
+// written in the middle and data at its end.
+func writeTestBaseImage(t *testing.T, path string) []byte {
+	t.Helper()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	require.NoError(t, err)
+	defer f.Close()
+
+	require.NoError(t, f.Truncate(testBaseImageSize))
+
+	_, err = f.WriteAt(bytes.Repeat([]byte("start"), 1000), 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt(make([]byte, 4<<20), 4<<20)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("end"), testBaseImageSize-3)
+	require.NoError(t, err)
+
+	contents, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	return contents
+}
+
+func allocatedBytes(t *testing.T, path string) int64 {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	return info.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestCloneDriveSparseCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCloneDriveSparseCopy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	basePath := filepath.Join(dir, "base.img")
+	contents := writeTestBaseImage(t, basePath)
+
+	clonePath := filepath.Join(dir, "clone.img")
+	clone, err := CloneDrive(context.Background(), basePath, clonePath, WithDriveCloneMethods(DriveCloneSparseCopy))
+	require.NoError(t, err)
+	assert.Equal(t, clonePath, clone.Path)
+	assert.Equal(t, DriveCloneSparseCopy, clone.Method)
+
+	cloned, err := ioutil.ReadFile(clonePath)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(contents, cloned), "clone should have the contents of the image")
+
+	info, err := os.Stat(clonePath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode())
+	assert.True(t, allocatedBytes(t, clonePath) < 1<<20, "zeroes and holes should not be allocated, got %d bytes", allocatedBytes(t, clonePath))
+
+	// clones are independent of their image
+	require.NoError(t, ioutil.WriteFile(clonePath, []byte("written"), 0640))
+	unchanged, err := ioutil.ReadFile(basePath)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(contents, unchanged), "image should be unchanged")
+
+	_, err = CloneDrive(context.Background(), basePath, clonePath)
+	assert.Error(t, err, "existing clone paths should not be overwritten")
+
+	require.NoError(t, clone.Remove())
+	_, err = os.Stat(clonePath)
+	assert.True(t, os.IsNotExist(err), "expected clone to be removed, got %v", err)
+	assert.NoError(t, clone.Remove())
+}
+
+func TestCloneDriveDefaultMethods(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCloneDriveDefaultMethods")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	basePath := filepath.Join(dir, "base.img")
+	contents := writeTestBaseImage(t, basePath)
+
+	// the method depends on the filesystem of the temporary directory
+	clone, err := CloneDrive(context.Background(), basePath, filepath.Join(dir, "clone.img"))
+	require.NoError(t, err)
+	defer clone.Remove()
+	assert.Contains(t, defaultDriveCloneMethods, clone.Method)
+
+	cloned, err := ioutil.ReadFile(clone.Path)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(contents, cloned), "clone should have the contents of the image")
+}
+
+func TestCloneDriveFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCloneDriveFails")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	basePath := filepath.Join(dir, "base.img")
+	writeTestBaseImage(t, basePath)
+
+	for _, c := range []struct {
+		name     string
+		basePath string
+		opts     []DriveCloneOpt
+	}{
+		{name: "missing image", basePath: filepath.Join(dir, "missing.img")},
+		{name: "directory", basePath: dir},
+		{name: "unknown method", basePath: basePath, opts: []DriveCloneOpt{WithDriveCloneMethods("copy")}},
+		{name: "no method", basePath: basePath, opts: []DriveCloneOpt{WithDriveCloneMethods()}},
+	} {
+		clonePath := filepath.Join(dir, "clone.img")
+		_, err := CloneDrive(context.Background(), c.basePath, clonePath, c.opts...)
+		assert.Error(t, err, c.name)
+
+		_, err = os.Stat(clonePath)
+		assert.True(t, os.IsNotExist(err), "%s: expected no clone to be left behind, got %v", c.name, err)
+	}
+}
+
+func TestCloneDriveDMSnapshot(t *testing.T) {
+	fctesting.RequiresRoot(t)
+	for _, tool := range []string{"losetup", "dmsetup"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is required", tool)
+		}
+	}
+	if _, err := os.Stat("/sys/class/misc/device-mapper"); err != nil {
+		t.Skip("device-mapper is required")
+	}
+
+	dir, err := ioutil.TempDir("", "TestCloneDriveDMSnapshot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	basePath := filepath.Join(dir, "base.img")
+	contents := writeTestBaseImage(t, basePath)
+
+	clonePath := filepath.Join(dir, "clone.cow")
+	clone, err := CloneDrive(context.Background(), basePath, clonePath, WithDriveCloneMethods(DriveCloneDMSnapshot))
+	require.NoError(t, err)
+	defer clone.Remove()
+	assert.Equal(t, DriveCloneDMSnapshot, clone.Method)
+
+	device, err := os.OpenFile(clone.Path, os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = device.WriteAt([]byte("written"), 0)
+	require.NoError(t, err)
+	require.NoError(t, device.Close())
+
+	unchanged, err := ioutil.ReadFile(basePath)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(contents, unchanged), "image should be unchanged")
+
+	require.NoError(t, clone.Remove())
+	_, err = os.Stat(clone.Path)
+	assert.True(t, os.IsNotExist(err), "expected snapshot device to be removed, got %v", err)
+	_, err = os.Stat(clonePath)
+	assert.True(t, os.IsNotExist(err), "expected snapshot store to be removed, got %v", err)
+}
+
+func TestNewCloneDriveHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestNewCloneDriveHandler")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	basePath := filepath.Join(dir, "base.img")
+	writeTestBaseImage(t, basePath)
+
+	m := &Machine{
+		Cfg: Config{
+			Drives: NewDrivesBuilder(basePath).AddDrive(basePath, true).Build(),
+		},
+		logger: fctesting.NewLogEntry(t),
+	}
+
+	clonePath := filepath.Join(dir, "vm-1.img")
+	require.NoError(t, NewCloneDriveHandler(rootDriveName, clonePath).Fn(context.Background(), m))
+	assert.Equal(t, basePath, StringValue(m.Cfg.Drives[0].PathOnHost), "other drives should be left alone")
+	assert.Equal(t, clonePath, StringValue(m.Cfg.Drives[1].PathOnHost))
+	assert.FileExists(t, clonePath)
+
+	err = NewCloneDriveHandler("missing", filepath.Join(dir, "vm-2.img")).Fn(context.Background(), m)
+	assert.Error(t, err)
+
+	require.NoError(t, m.doCleanup())
+	_, err = os.Stat(clonePath)
+	assert.True(t, os.IsNotExist(err), "expected clone to be removed, got %v", err)
+	assert.FileExists(t, basePath)
+}
+
+func TestNewCloneDriveHandlerJailedDMSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestNewCloneDriveHandlerJailedDMSnapshot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	basePath := filepath.Join(dir, "base.img")
+	writeTestBaseImage(t, basePath)
+
+	m := &Machine{
+		Cfg: Config{
+			Drives: NewDrivesBuilder(basePath).Build(),
+			JailerCfg: &JailerConfig{
+				UID: Int(os.Getuid()),
+				GID: Int(os.Getgid()),
+			},
+		},
+		logger: fctesting.NewLogEntry(t),
+	}
+
+	clonePath := filepath.Join(dir, "vm-1.img")
+	handler := NewCloneDriveHandler(rootDriveName, clonePath,
+		WithDriveCloneMethods(DriveCloneSparseCopy, DriveCloneDMSnapshot))
+	assert.Error(t, handler.Fn(context.Background(), m), "snapshot devices cannot be linked into jails")
+	assert.Equal(t, basePath, StringValue(m.Cfg.Drives[0].PathOnHost))
+	assert.Empty(t, m.cleanupFuncs)
+	_, err = os.Stat(clonePath)
+	assert.True(t, os.IsNotExist(err), "expected no clone to be created, got %v", err)
+
+	require.NoError(t, NewCloneDriveHandler(rootDriveName, clonePath).Fn(context.Background(), m))
+	assert.Equal(t, clonePath, StringValue(m.Cfg.Drives[0].PathOnHost))
+	require.NoError(t, m.doCleanup())
+}
@@ -3,6 +3,8 @@ package firecracker
 import (
 	"strconv"
 
+	"github.com/pkg/errors"
+
 	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
 )
 
@@ -42,6 +44,39 @@ func (b DrivesBuilder) WithRootDrive(rootDrivePath string, opts ...DriveOpt) Dri
 	return b
 }
 
+// WithRootPartition sets the Partuuid of the root drive to the unique ID of
+// the partition numbered number, such as 1 for /dev/vda1, of the GPT or MBR
+// partition table of its image.
+func (b DrivesBuilder) WithRootPartition(number int) (DrivesBuilder, error) {
+	return b.withRootPartition(func(pt *PartitionTable) (*Partition, error) {
+		return pt.Partition(number)
+	})
+}
+
+// WithRootPartitionLabel sets the Partuuid of the root drive to the unique ID
+// of the partition named label of the GUID partition table of its image.
+func (b DrivesBuilder) WithRootPartitionLabel(label string) (DrivesBuilder, error) {
+	return b.withRootPartition(func(pt *PartitionTable) (*Partition, error) {
+		return pt.PartitionByLabel(label)
+	})
+}
+
+func (b DrivesBuilder) withRootPartition(selectPartition func(*PartitionTable) (*Partition, error)) (DrivesBuilder, error) {
+	rootDrivePath := StringValue(b.rootDrive.PathOnHost)
+	pt, err := ReadPartitionTable(rootDrivePath)
+	if err != nil {
+		return b, errors.Wrapf(err, "failed to read partition table of root drive %q", rootDrivePath)
+	}
+
+	partition, err := selectPartition(pt)
+	if err != nil {
+		return b, errors.Wrapf(err, "failed to select root partition of %q", rootDrivePath)
+	}
+
+	b.rootDrive.Partuuid = partition.PartUUID
+	return b, nil
+}
+
 // AddDrive will add a new drive to the given builder.
 func (b DrivesBuilder) AddDrive(path string, readOnly bool, opts ...DriveOpt) DrivesBuilder {
 	drive := models.Drive{
@@ -305,7 +305,7 @@ func (f *Client) PatchGuestDriveByID(ctx context.Context, driveID, pathOnHost st
 
 	partialDrive := models.PartialDrive{
 		DriveID:    &driveID,
-		PathOnHost: &pathOnHost,
+		PathOnHost: pathOnHost,
 	}
 	params.SetBody(&partialDrive)
 	params.DriveID = driveID
@@ -316,3 +316,23 @@ func (f *Client) PatchGuestDriveByID(ctx context.Context, driveID, pathOnHost st
 
 	return f.client.Operations.PatchGuestDriveByID(params)
 }
+
+// PatchGuestDriveRateLimitByID is a wrapper for the swagger generated client
+// to update the rate limiter of a drive without changing its backing file.
+func (f *Client) PatchGuestDriveRateLimitByID(ctx context.Context, driveID string, rateLimiter *models.RateLimiter, opts ...PatchGuestDriveByIDOpt) (*ops.PatchGuestDriveByIDNoContent, error) {
+	timeout, cancel := context.WithTimeout(ctx, time.Duration(f.firecrackerRequestTimeout)*time.Millisecond)
+	defer cancel()
+
+	params := ops.NewPatchGuestDriveByIDParamsWithContext(timeout)
+	params.SetDriveID(driveID)
+	params.SetBody(&models.PartialDrive{
+		DriveID:     &driveID,
+		RateLimiter: rateLimiter,
+	})
+
+	for _, opt := range opts {
+		opt(params)
+	}
+
+	return f.client.Operations.PatchGuestDriveByID(params)
+}
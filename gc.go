@@ -0,0 +1,928 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// GCResourceKind is the kind of a resource found by the GarbageCollector.
+type GCResourceKind string
+
+// The kinds of resources found by the GarbageCollector, in the order they are
+// collected.
+const (
+	// GCCNIResult is a CNI result cached in the CNI cache directory of a VM.
+	// Collecting it calls CNI DEL with the cached network configuration.
+	GCCNIResult GCResourceKind = "cni"
+	// GCNetNS is a network namespace bind-mounted in the netns directory.
+	GCNetNS GCResourceKind = "netns"
+	// GCIPAMAllocation is an IP address allocated by an IPAM store.
+	GCIPAMAllocation GCResourceKind = "ipam"
+	// GCTap is a tap device.
+	GCTap GCResourceKind = "tap"
+	// GCSocket is a Firecracker API socket.
+	GCSocket GCResourceKind = "socket"
+	// GCFifo is a Firecracker log or metrics fifo.
+	GCFifo GCResourceKind = "fifo"
+	// GCJailDir is the chroot directory of a jailed Firecracker process.
+	GCJailDir GCResourceKind = "jail"
+)
+
+// defaultGCMinAge is the default minimum age of the resources collected by
+// the GarbageCollector.
+const defaultGCMinAge = time.Minute
+
+var gcResourceKindOrder = []GCResourceKind{
+	GCCNIResult, GCNetNS, GCIPAMAllocation, GCTap, GCSocket, GCFifo, GCJailDir,
+}
+
+// GCResource is a resource left behind by the SDK.
+type GCResource struct {
+	Kind GCResourceKind
+
+	// VMID is the ID of the VM the resource belongs to. It is empty when it
+	// can't be determined, as for fifos, and for sockets and tap devices not
+	// recorded by an IPAM allocation.
+	VMID string
+
+	// Path is the path of the file or directory, the path of the store of an
+	// IPAM allocation, or the name of a tap device.
+	Path string
+
+	// IP is the allocated address of an IPAM allocation.
+	IP string `json:",omitempty"`
+
+	// InUse is true if the resource belongs to a running Firecracker process,
+	// or if it's too recent to tell.
+	InUse bool
+}
+
+// GCConfig specifies where the GarbageCollector looks for resources. Only the
+// SDK's default locations are inventoried unless configured otherwise.
+type GCConfig struct {
+	// ExecNames are the names of the Firecracker binaries, used to find
+	// running Firecracker processes. Defaults to "firecracker".
+	ExecNames []string
+
+	// ChrootBaseDir is the chroot base directory of the jailer. Defaults to
+	// "/srv/jailer".
+	ChrootBaseDir string
+
+	// CNICacheDir is the directory in which the CNI cache directory of each VM
+	// is created. Defaults to "/var/lib/cni".
+	CNICacheDir string
+
+	// CNIBinPath is the list of directories in which CNI plugin binaries are
+	// sought to call CNI DEL. Defaults to "/opt/cni/bin".
+	CNIBinPath []string
+
+	// NetNSDir is the directory in which network namespaces of VMs are
+	// mounted. Defaults to "/var/run/netns". Only network namespaces named
+	// after the VMID of another resource are inventoried.
+	NetNSDir string
+
+	// FileGlobs (optional) are glob patterns matching the API sockets and the
+	// log and metrics fifos of VMs, such as "/tmp/firecracker-*.sock".
+	FileGlobs []string
+
+	// TapGlobs (optional) are glob patterns matching the names of the tap
+	// devices of VMs, such as "fc-tap-*".
+	TapGlobs []string
+
+	// IPAMStorePaths (optional) are the store paths of the IPAMs allocating
+	// the addresses of VMs.
+	IPAMStorePaths []string
+
+	// MinAge is the minimum age of resources, and of any other resource of
+	// their VM, to be collected. It avoids collecting the resources of VMs
+	// that are being started. IPAM allocations are only collected when the
+	// store hasn't been modified for MinAge. Defaults to one minute, and a
+	// negative value collects resources regardless of their age.
+	MinAge time.Duration
+
+	// Logger (optional) logs the collected resources.
+	Logger *log.Entry
+}
+
+// GarbageCollector finds resources left behind by SDK processes that exited
+// without cleaning up, such as after a crash, and cleans them up.
+//
+// Resources are associated with a VMID from their location: jail directories
+// are named after the jailer ID, the CNI cache directory and network
+// namespace of a VM are named after its VMID, and IPAM allocations are keyed
+// by it. IPAM allocations also record the tap device, network namespace and
+// API socket of their VM. A VM is running if a Firecracker process was
+// started with its VMID as jailer ID, runs in its network namespace, or uses
+// the tap device or API socket recorded by its allocation. A VM none of whose
+// resources can tell whether it runs is assumed to be running.
+type GarbageCollector struct {
+	cfg GCConfig
+
+	procDir   string
+	listTaps  func() ([]string, error)
+	tapAge    func(name string) time.Time
+	removeTap func(name string) error
+	cniDel    func(ctx context.Context, cniBinPath []string, cacheDir string,
+		list *libcni.NetworkConfigList, rt *libcni.RuntimeConf) error
+	unmount func(path string) error
+}
+
+// NewGarbageCollector returns a GarbageCollector using the provided
+// configuration.
+func NewGarbageCollector(cfg GCConfig) *GarbageCollector {
+	if len(cfg.ExecNames) == 0 {
+		cfg.ExecNames = []string{defaultFcBin}
+	}
+
+	if cfg.ChrootBaseDir == "" {
+		cfg.ChrootBaseDir = defaultJailerPath
+	}
+
+	if cfg.CNICacheDir == "" {
+		cfg.CNICacheDir = defaultCNICacheDir
+	}
+
+	if len(cfg.CNIBinPath) == 0 {
+		cfg.CNIBinPath = []string{defaultCNIBinDir}
+	}
+
+	if cfg.NetNSDir == "" {
+		cfg.NetNSDir = defaultNetNSDir
+	}
+
+	if cfg.MinAge == 0 {
+		cfg.MinAge = defaultGCMinAge
+	}
+
+	if cfg.Logger == nil {
+		cfg.Logger = log.NewEntry(log.New())
+	}
+
+	return &GarbageCollector{
+		cfg:       cfg,
+		procDir:   "/proc",
+		listTaps:  listTaps,
+		tapAge:    tapModTime,
+		removeTap: removeTap,
+		cniDel:    cniDel,
+		unmount: func(path string) error {
+			return unix.Unmount(path, unix.MNT_DETACH)
+		},
+	}
+}
+
+// Inventory returns the resources found by the GarbageCollector, marking
+// those which are in use.
+func (gc *GarbageCollector) Inventory(ctx context.Context) ([]GCResource, error) {
+	running, err := gc.runningProcesses()
+	if err != nil {
+		return nil, err
+	}
+
+	var resources []gcResource
+	var result *multierror.Error
+	for _, find := range []func() ([]gcResource, error){
+		gc.jailDirs,
+		gc.cniResults,
+		gc.ipamAllocations,
+		gc.files,
+		gc.taps,
+	} {
+		found, err := find()
+		resources = append(resources, found...)
+		result = multierror.Append(result, err)
+	}
+
+	// tap devices and sockets are attributed to the VM whose IPAM allocation
+	// recorded them
+	owners := make(map[GCResourceKind]map[string]string)
+	owners[GCTap] = make(map[string]string)
+	owners[GCSocket] = make(map[string]string)
+	for _, resource := range resources {
+		if resource.owner.TapName != "" {
+			owners[GCTap][resource.owner.TapName] = resource.VMID
+		}
+		if resource.owner.SocketPath != "" {
+			owners[GCSocket][resource.owner.SocketPath] = resource.VMID
+		}
+	}
+	for i := range resources {
+		if vmID, ok := owners[resources[i].Kind][resources[i].Path]; ok && resources[i].VMID == "" {
+			resources[i].VMID = vmID
+		}
+	}
+
+	// the network namespace of a VM is found from its VMID
+	vmIDs := make(map[string]struct{})
+	for _, resource := range resources {
+		if resource.VMID != "" {
+			vmIDs[resource.VMID] = struct{}{}
+		}
+	}
+	netNSes, err := gc.netNSes(vmIDs)
+	resources = append(resources, netNSes...)
+	result = multierror.Append(result, err)
+
+	// a VM is in use if any of its resources is, or if none of its resources
+	// can tell whether it runs
+	now := time.Now()
+	runningVMIDs := make(map[string]struct{})
+	checkedVMIDs := make(map[string]struct{})
+	for _, resource := range resources {
+		if resource.VMID == "" {
+			continue
+		}
+
+		if resource.usedBy != nil {
+			checkedVMIDs[resource.VMID] = struct{}{}
+		}
+
+		if resource.inUse(running, now, gc.cfg.MinAge) {
+			runningVMIDs[resource.VMID] = struct{}{}
+		}
+	}
+
+	inventory := make([]GCResource, 0, len(resources))
+	for _, resource := range resources {
+		_, vmRunning := runningVMIDs[resource.VMID]
+		_, vmChecked := checkedVMIDs[resource.VMID]
+		resource.InUse = vmRunning || resource.inUse(running, now, gc.cfg.MinAge) ||
+			(resource.VMID != "" && !vmChecked)
+		inventory = append(inventory, resource.GCResource)
+	}
+
+	sortGCResources(inventory)
+	return inventory, result.ErrorOrNil()
+}
+
+// Collect cleans up the resources found by the GarbageCollector which are not
+// in use, and returns those it cleaned up. It keeps going when a resource
+// can't be cleaned up, and returns all of the errors.
+func (gc *GarbageCollector) Collect(ctx context.Context) ([]GCResource, error) {
+	inventory, err := gc.Inventory(ctx)
+	result := multierror.Append(nil, err)
+
+	var collected []GCResource
+	for _, resource := range inventory {
+		if resource.InUse {
+			continue
+		}
+
+		if err := gc.collect(ctx, resource); err != nil {
+			result = multierror.Append(result, errors.Wrapf(err,
+				"failed to collect %s %q of VM %q", resource.Kind, resource.Path, resource.VMID))
+			continue
+		}
+
+		gc.cfg.Logger.Infof("collected %s %q of VM %q", resource.Kind, resource.Path, resource.VMID)
+		collected = append(collected, resource)
+	}
+
+	return collected, result.ErrorOrNil()
+}
+
+func (gc *GarbageCollector) collect(ctx context.Context, resource GCResource) error {
+	switch resource.Kind {
+	case GCCNIResult:
+		return gc.collectCNIResult(ctx, resource)
+
+	case GCNetNS:
+		// the path is not a mount point anymore if the netns was unmounted
+		// without removing it
+		err := gc.unmount(resource.Path)
+		if err != nil && err != unix.EINVAL && err != unix.ENOENT {
+			return errors.Wrap(err, "failed to unmount netns")
+		}
+		return removeIfExists(resource.Path)
+
+	case GCIPAMAllocation:
+		ipam := &IPAM{storePath: resource.Path}
+		return ipam.withStore(func(store *ipamStore) error {
+			// the address may have been allocated again since the inventory
+			if id := store.Allocations[resource.IP]; ipamAllocationVMID(id) == resource.VMID {
+				delete(store.Allocations, resource.IP)
+				delete(store.Owners, id)
+			}
+			return nil
+		})
+
+	case GCTap:
+		return gc.removeTap(resource.Path)
+
+	case GCSocket, GCFifo:
+		return removeIfExists(resource.Path)
+
+	case GCJailDir:
+		return os.RemoveAll(resource.Path)
+
+	default:
+		return errors.Errorf("unknown resource kind %q", resource.Kind)
+	}
+}
+
+// gcResource is a GCResource along with the information needed to tell
+// whether it's in use.
+type gcResource struct {
+	GCResource
+
+	// modTime is the time the resource was last modified, if known
+	modTime time.Time
+
+	// usedBy returns whether the resource is used by the running processes.
+	// It is nil for resources which can't tell, such as CNI results.
+	usedBy func(running *runningProcesses) bool
+
+	// owner holds the resources of the VM recorded by its IPAM allocation
+	owner ipamOwner
+}
+
+func (r gcResource) inUse(running *runningProcesses, now time.Time, minAge time.Duration) bool {
+	if !r.modTime.IsZero() && now.Sub(r.modTime) < minAge {
+		return true
+	}
+
+	return r.usedBy != nil && r.usedBy(running)
+}
+
+func sortGCResources(resources []GCResource) {
+	kindIndex := make(map[GCResourceKind]int)
+	for i, kind := range gcResourceKindOrder {
+		kindIndex[kind] = i
+	}
+
+	sort.SliceStable(resources, func(i, j int) bool {
+		if resources[i].Kind != resources[j].Kind {
+			return kindIndex[resources[i].Kind] < kindIndex[resources[j].Kind]
+		}
+		if resources[i].VMID != resources[j].VMID {
+			return resources[i].VMID < resources[j].VMID
+		}
+		if resources[i].Path != resources[j].Path {
+			return resources[i].Path < resources[j].Path
+		}
+		return resources[i].IP < resources[j].IP
+	})
+}
+
+// fileID identifies a file regardless of its path
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+func statFileID(path string) (fileID, bool) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return fileID{}, false
+	}
+
+	return fileID{dev: uint64(stat.Dev), ino: stat.Ino}, true
+}
+
+// runningProcesses describes the resources used by running Firecracker
+// processes.
+type runningProcesses struct {
+	// ids are the jailer IDs of the processes
+	ids map[string]struct{}
+	// netNSes identifies the network namespaces of the processes
+	netNSes map[fileID]struct{}
+	// files are the paths of the API sockets and open files of the processes
+	files map[string]struct{}
+	// taps are the names of the tap devices opened by the processes in the
+	// network namespace of the GarbageCollector
+	taps map[string]struct{}
+}
+
+func (gc *GarbageCollector) runningProcesses() (*runningProcesses, error) {
+	running := &runningProcesses{
+		ids:     make(map[string]struct{}),
+		netNSes: make(map[fileID]struct{}),
+		files:   make(map[string]struct{}),
+		taps:    make(map[string]struct{}),
+	}
+
+	entries, err := ioutil.ReadDir(gc.procDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list processes")
+	}
+
+	ownNetNS, _ := statFileID(filepath.Join(gc.procDir, "self", "ns", "net"))
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+
+		// processes can exit at any time, so errors reading them are ignored
+		pidDir := filepath.Join(gc.procDir, entry.Name())
+		cmdline, err := ioutil.ReadFile(filepath.Join(pidDir, "cmdline"))
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+
+		args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+		if !gc.isFirecracker(args[0]) {
+			continue
+		}
+
+		root, err := os.Readlink(filepath.Join(pidDir, "root"))
+		if err != nil {
+			root = "/"
+		}
+
+		for i := 1; i < len(args)-1; i++ {
+			switch args[i] {
+			case "--id":
+				running.ids[args[i+1]] = struct{}{}
+			case "--api-sock":
+				running.files[filepath.Join(root, args[i+1])] = struct{}{}
+			}
+		}
+
+		netNS, ok := statFileID(filepath.Join(pidDir, "ns", "net"))
+		if ok {
+			running.netNSes[netNS] = struct{}{}
+		}
+
+		fds, _ := ioutil.ReadDir(filepath.Join(pidDir, "fd"))
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(pidDir, "fd", fd.Name()))
+			if err == nil && filepath.IsAbs(target) {
+				running.files[target] = struct{}{}
+			}
+
+			// tap devices of other network namespaces can have the same names
+			if netNS != ownNetNS {
+				continue
+			}
+
+			if tap := fdTapName(filepath.Join(pidDir, "fdinfo", fd.Name())); tap != "" {
+				running.taps[tap] = struct{}{}
+			}
+		}
+	}
+
+	return running, nil
+}
+
+func (gc *GarbageCollector) isFirecracker(arg0 string) bool {
+	for _, name := range gc.cfg.ExecNames {
+		if filepath.Base(arg0) == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fdTapName returns the name of the tap device opened by a file descriptor,
+// which is found in the "iff" field of its fdinfo.
+func fdTapName(fdInfoPath string) string {
+	f, err := os.Open(fdInfoPath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "iff:" {
+			return fields[1]
+		}
+	}
+
+	return ""
+}
+
+// jailDirs returns the jail directories of the Firecracker binaries, which
+// are named after the jailer ID.
+func (gc *GarbageCollector) jailDirs() ([]gcResource, error) {
+	var resources []gcResource
+	for _, execName := range gc.cfg.ExecNames {
+		execDir := filepath.Join(gc.cfg.ChrootBaseDir, execName)
+		entries, err := ioutil.ReadDir(execDir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return resources, errors.Wrapf(err, "failed to list jail directories in %q", execDir)
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+
+			vmID := entry.Name()
+			resources = append(resources, gcResource{
+				GCResource: GCResource{
+					Kind: GCJailDir,
+					VMID: vmID,
+					Path: filepath.Join(execDir, vmID),
+				},
+				modTime: entry.ModTime(),
+				usedBy: func(running *runningProcesses) bool {
+					_, ok := running.ids[vmID]
+					return ok
+				},
+			})
+		}
+	}
+
+	return resources, nil
+}
+
+// cniResults returns the results cached in the CNI cache directories of VMs.
+// Following CNIConfiguration's defaults, they are found in
+// <CNICacheDir>/<VMID>/results/<network name>-<VMID>-<IfName>.
+func (gc *GarbageCollector) cniResults() ([]gcResource, error) {
+	entries, err := ioutil.ReadDir(gc.cfg.CNICacheDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to list CNI cache directory %q", gc.cfg.CNICacheDir)
+	}
+
+	var resources []gcResource
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		// other directories, such as the "results" directory of the default
+		// CNI cache or the "networks" directory of host-local, don't have
+		// results named after them
+		vmID := entry.Name()
+		resultsDir := filepath.Join(gc.cfg.CNICacheDir, vmID, "results")
+		results, err := ioutil.ReadDir(resultsDir)
+		if err != nil {
+			continue
+		}
+
+		for _, result := range results {
+			if !strings.Contains(result.Name(), "-"+vmID+"-") {
+				continue
+			}
+
+			resources = append(resources, gcResource{
+				GCResource: GCResource{
+					Kind: GCCNIResult,
+					VMID: vmID,
+					Path: filepath.Join(resultsDir, result.Name()),
+				},
+				modTime: result.ModTime(),
+			})
+		}
+	}
+
+	return resources, nil
+}
+
+// ipamAllocationVMID returns the VMID of an allocation ID of allocateIPs
+func ipamAllocationVMID(id string) string {
+	i := strings.LastIndex(id, "/")
+	if i < 0 {
+		return ""
+	}
+
+	if _, err := strconv.Atoi(id[i+1:]); err != nil {
+		return ""
+	}
+
+	return id[:i]
+}
+
+func (gc *GarbageCollector) ipamAllocations() ([]gcResource, error) {
+	var resources []gcResource
+	for _, storePath := range gc.cfg.IPAMStorePaths {
+		info, err := os.Stat(storePath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return resources, errors.Wrapf(err, "failed to stat IPAM store %q", storePath)
+		}
+
+		data, err := ioutil.ReadFile(storePath)
+		if err != nil {
+			return resources, errors.Wrapf(err, "failed to read IPAM store %q", storePath)
+		}
+
+		var store ipamStore
+		if err := json.Unmarshal(data, &store); err != nil {
+			return resources, errors.Wrapf(err, "failed to parse IPAM store %q", storePath)
+		}
+
+		for ip, id := range store.Allocations {
+			vmID := ipamAllocationVMID(id)
+			if vmID == "" {
+				// not allocated by the SDK for a VM
+				continue
+			}
+
+			owner := store.Owners[id]
+			resources = append(resources, gcResource{
+				GCResource: GCResource{
+					Kind: GCIPAMAllocation,
+					VMID: vmID,
+					Path: storePath,
+					IP:   ip,
+				},
+				modTime: info.ModTime(),
+				usedBy:  owner.usedBy(),
+				owner:   owner,
+			})
+		}
+	}
+
+	return resources, nil
+}
+
+// usedBy returns whether the recorded resources of the VM are used by the
+// running processes, or nil if none were recorded.
+func (owner ipamOwner) usedBy() func(running *runningProcesses) bool {
+	if owner == (ipamOwner{}) {
+		return nil
+	}
+
+	return func(running *runningProcesses) bool {
+		if _, ok := running.files[owner.SocketPath]; ok && owner.SocketPath != "" {
+			return true
+		}
+
+		if _, ok := running.taps[owner.TapName]; ok && owner.TapName != "" {
+			return true
+		}
+
+		if owner.NetNS != "" {
+			if netNS, ok := statFileID(owner.NetNS); ok {
+				if _, ok := running.netNSes[netNS]; ok {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+}
+
+// files returns the sockets and fifos matching FileGlobs
+func (gc *GarbageCollector) files() ([]gcResource, error) {
+	var resources []gcResource
+	for _, glob := range gc.cfg.FileGlobs {
+		paths, err := filepath.Glob(glob)
+		if err != nil {
+			return resources, errors.Wrapf(err, "invalid file glob %q", glob)
+		}
+
+		for _, path := range paths {
+			info, err := os.Lstat(path)
+			if err != nil {
+				continue
+			}
+
+			var kind GCResourceKind
+			switch {
+			case info.Mode()&os.ModeSocket != 0:
+				kind = GCSocket
+			case info.Mode()&os.ModeNamedPipe != 0:
+				kind = GCFifo
+			default:
+				continue
+			}
+
+			path := path
+			resources = append(resources, gcResource{
+				GCResource: GCResource{
+					Kind: kind,
+					Path: path,
+				},
+				modTime: info.ModTime(),
+				usedBy: func(running *runningProcesses) bool {
+					_, ok := running.files[path]
+					return ok
+				},
+			})
+		}
+	}
+
+	return resources, nil
+}
+
+// taps returns the tap devices matching TapGlobs
+func (gc *GarbageCollector) taps() ([]gcResource, error) {
+	if len(gc.cfg.TapGlobs) == 0 {
+		return nil, nil
+	}
+
+	names, err := gc.listTaps()
+	if err != nil {
+		return nil, err
+	}
+
+	var resources []gcResource
+	for _, name := range names {
+		matched := false
+		for _, glob := range gc.cfg.TapGlobs {
+			ok, err := filepath.Match(glob, name)
+			if err != nil {
+				return resources, errors.Wrapf(err, "invalid tap glob %q", glob)
+			}
+			matched = matched || ok
+		}
+		if !matched {
+			continue
+		}
+
+		name := name
+		resources = append(resources, gcResource{
+			GCResource: GCResource{
+				Kind: GCTap,
+				Path: name,
+			},
+			modTime: gc.tapAge(name),
+			usedBy: func(running *runningProcesses) bool {
+				_, ok := running.taps[name]
+				return ok
+			},
+		})
+	}
+
+	return resources, nil
+}
+
+// netNSes returns the network namespaces named after the provided VMIDs
+func (gc *GarbageCollector) netNSes(vmIDs map[string]struct{}) ([]gcResource, error) {
+	var resources []gcResource
+	for vmID := range vmIDs {
+		path := filepath.Join(gc.cfg.NetNSDir, vmID)
+		if _, err := os.Lstat(path); err != nil {
+			continue
+		}
+
+		resources = append(resources, gcResource{
+			GCResource: GCResource{
+				Kind: GCNetNS,
+				VMID: vmID,
+				Path: path,
+			},
+			usedBy: func(running *runningProcesses) bool {
+				netNS, ok := statFileID(path)
+				if !ok {
+					return false
+				}
+				_, ok = running.netNSes[netNS]
+				return ok
+			},
+		})
+	}
+
+	return resources, nil
+}
+
+// collectCNIResult calls CNI DEL with the cached network configuration, which
+// removes the cached result, and removes the CNI cache directory of the VM
+// once empty.
+func (gc *GarbageCollector) collectCNIResult(ctx context.Context, resource GCResource) error {
+	data, err := ioutil.ReadFile(resource.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to read cached CNI result")
+	}
+
+	var cached struct {
+		Config  []byte      `json:"config"`
+		CNIArgs [][2]string `json:"cniArgs,omitempty"`
+	}
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return errors.Wrap(err, "failed to parse cached CNI result")
+	}
+
+	if len(cached.Config) == 0 {
+		return errors.New("cached CNI result does not include the network configuration")
+	}
+
+	list, err := libcni.ConfListFromBytes(cached.Config)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse cached CNI network configuration")
+	}
+
+	prefix := list.Name + "-" + resource.VMID + "-"
+	fileName := filepath.Base(resource.Path)
+	if !strings.HasPrefix(fileName, prefix) {
+		return errors.Errorf("cached CNI result is not named after network %q", list.Name)
+	}
+
+	// plugins are expected to clean up what they can when the netns is gone
+	netNSPath := filepath.Join(gc.cfg.NetNSDir, resource.VMID)
+	if _, err := os.Stat(netNSPath); err != nil {
+		netNSPath = ""
+	}
+
+	cacheDir := filepath.Dir(filepath.Dir(resource.Path))
+	err = gc.cniDel(ctx, gc.cfg.CNIBinPath, cacheDir, list, &libcni.RuntimeConf{
+		ContainerID: resource.VMID,
+		NetNS:       netNSPath,
+		IfName:      strings.TrimPrefix(fileName, prefix),
+		Args:        cached.CNIArgs,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete CNI network list %q", list.Name)
+	}
+
+	if err := removeIfExists(resource.Path); err != nil {
+		return err
+	}
+
+	// remove the cache directory of the VM once its last result is removed
+	for _, dir := range []string{filepath.Dir(resource.Path), cacheDir} {
+		if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func cniDel(ctx context.Context, cniBinPath []string, cacheDir string,
+	list *libcni.NetworkConfigList, rt *libcni.RuntimeConf,
+) error {
+	return libcni.NewCNIConfigWithCacheDir(cniBinPath, cacheDir, nil).DelNetworkList(ctx, list, rt)
+}
+
+func listTaps() ([]string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list devices")
+	}
+
+	var names []string
+	for _, link := range links {
+		if tuntap, ok := link.(*netlink.Tuntap); ok && tuntap.Mode == netlink.TUNTAP_MODE_TAP {
+			names = append(names, link.Attrs().Name)
+		}
+	}
+
+	return names, nil
+}
+
+// tapModTime returns the change time of the sysfs directory of a tap device.
+// Sysfs sets it when the directory is first looked up, which is when the
+// device is created or later, so the age of the device is never
+// overestimated.
+func tapModTime(name string) time.Time {
+	var stat unix.Stat_t
+	if err := unix.Stat(filepath.Join("/sys/class/net", name), &stat); err != nil {
+		// a device being created or removed is considered recent
+		return time.Now()
+	}
+
+	return time.Unix(stat.Ctim.Unix())
+}
+
+func removeTap(name string) error {
+	link, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to find tap device %q", name)
+	}
+
+	return netlink.LinkDel(link)
+}
+
+func removeIfExists(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,398 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk/fctesting"
+)
+
+// gcTestEnv is a fake host with:
+// * a jailed Firecracker process of "live-vm"
+// * a Firecracker process running in the netns of "netns-vm"
+// * the leftovers of "dead-vm"
+type gcTestEnv struct {
+	dir string
+	cfg GCConfig
+
+	tapModTimes map[string]time.Time
+	removedTaps []string
+	unmounted   []string
+	cniDels     []libcni.RuntimeConf
+}
+
+func newGCTestEnv(t *testing.T) (*gcTestEnv, func()) {
+	dir, err := ioutil.TempDir("", "TestGarbageCollector")
+	require.NoError(t, err)
+
+	env := &gcTestEnv{
+		dir: dir,
+		cfg: GCConfig{
+			ChrootBaseDir:  filepath.Join(dir, "jailer"),
+			CNICacheDir:    filepath.Join(dir, "cni"),
+			NetNSDir:       filepath.Join(dir, "netns"),
+			FileGlobs:      []string{filepath.Join(dir, "run", "*")},
+			TapGlobs:       []string{"fc-tap-*"},
+			IPAMStorePaths: []string{filepath.Join(dir, "ipam.json")},
+			// the resources of the tests are collected regardless of their age
+			MinAge: -1,
+			Logger: fctesting.NewLogEntry(t),
+		},
+	}
+
+	mkdir := func(path ...string) string {
+		p := filepath.Join(append([]string{dir}, path...)...)
+		require.NoError(t, os.MkdirAll(p, 0700))
+		return p
+	}
+	writeFile := func(data string, path ...string) string {
+		p := filepath.Join(append([]string{dir}, path...)...)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0700))
+		require.NoError(t, ioutil.WriteFile(p, []byte(data), 0600))
+		return p
+	}
+	symlink := func(target string, path ...string) {
+		p := filepath.Join(append([]string{dir}, path...)...)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0700))
+		require.NoError(t, os.Symlink(target, p))
+	}
+
+	// sockets and fifos
+	mkdir("run")
+	for _, name := range []string{"live.sock", "dead.sock"} {
+		listener, err := net.Listen("unix", filepath.Join(dir, "run", name))
+		require.NoError(t, err)
+		// keep the socket file around
+		listener.(*net.UnixListener).SetUnlinkOnClose(false)
+		listener.Close()
+	}
+	for _, name := range []string{"live.fifo", "dead.fifo"} {
+		require.NoError(t, unix.Mkfifo(filepath.Join(dir, "run", name), 0600))
+	}
+	writeFile("", "run", "not-a-socket")
+
+	// network namespaces, faked with regular files
+	hostNetNS := writeFile("", "host-netns")
+	writeFile("", "netns", "dead-vm")
+	vmNetNS := writeFile("", "netns", "netns-vm")
+
+	// processes
+	symlink(hostNetNS, "proc", "self", "ns", "net")
+
+	writeFile("firecracker\x00--id\x00live-vm\x00--api-sock\x00/run/firecracker.socket\x00", "proc", "100", "cmdline")
+	jailRoot := mkdir("jailer", "firecracker", "live-vm", "root")
+	symlink(jailRoot, "proc", "100", "root")
+	symlink(hostNetNS, "proc", "100", "ns", "net")
+	symlink("/dev/net/tun", "proc", "100", "fd", "3")
+	writeFile("pos:\t0\nflags:\t02\niff:\tfc-tap-live\n", "proc", "100", "fdinfo", "3")
+
+	writeFile("/usr/bin/firecracker\x00--api-sock\x00"+filepath.Join(dir, "run", "live.sock")+"\x00", "proc", "101", "cmdline")
+	symlink(vmNetNS, "proc", "101", "ns", "net")
+	symlink(filepath.Join(dir, "run", "live.fifo"), "proc", "101", "fd", "4")
+
+	writeFile("bash\x00", "proc", "102", "cmdline")
+	symlink(filepath.Join(dir, "run", "dead.fifo"), "proc", "102", "fd", "4")
+
+	// jail directories
+	mkdir("jailer", "firecracker", "dead-vm", "root")
+	// directories of other binaries are ignored
+	mkdir("jailer", "jailer", "some-id")
+
+	// CNI cache
+	cachedResult := func(vmID string) string {
+		data, err := json.Marshal(map[string]interface{}{
+			"kind":    "cniCacheV1",
+			"config":  []byte(`{"name":"fcnet","cniVersion":"0.3.1","plugins":[{"type":"ptp"},{"type":"tc-redirect-tap"}]}`),
+			"cniArgs": [][2]string{{"IgnoreUnknown", "true"}},
+			"results": map[string]interface{}{"cniVersion": "0.3.1"},
+		})
+		require.NoError(t, err)
+		return string(data)
+	}
+	writeFile(cachedResult("dead-vm"), "cni", "dead-vm", "results", "fcnet-dead-vm-veth0")
+	writeFile(cachedResult("netns-vm"), "cni", "netns-vm", "results", "fcnet-netns-vm-veth0")
+	writeFile("{}", "cni", "results", "fcnet-container-eth0")
+	writeFile("10.0.0.2", "cni", "networks", "fcnet", "last_reserved_ip.0")
+
+	// IPAM allocations
+	ipamStore := writeFile(`{"allocations":{`+
+		`"192.0.2.2":"dead-vm/0","192.0.2.3":"live-vm/0","192.0.2.4":"netns-vm/1","192.0.2.5":"not-a-vm"}}`,
+		"ipam.json")
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(ipamStore, old, old))
+
+	return env, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func (env *gcTestEnv) garbageCollector() *GarbageCollector {
+	gc := NewGarbageCollector(env.cfg)
+	gc.procDir = filepath.Join(env.dir, "proc")
+	gc.listTaps = func() ([]string, error) {
+		return []string{"fc-tap-live", "fc-tap-dead", "eth0"}, nil
+	}
+	gc.tapAge = func(name string) time.Time {
+		return env.tapModTimes[name]
+	}
+	gc.removeTap = func(name string) error {
+		env.removedTaps = append(env.removedTaps, name)
+		return nil
+	}
+	gc.cniDel = func(ctx context.Context, cniBinPath []string, cacheDir string,
+		list *libcni.NetworkConfigList, rt *libcni.RuntimeConf,
+	) error {
+		env.cniDels = append(env.cniDels, *rt)
+		return nil
+	}
+	gc.unmount = func(path string) error {
+		env.unmounted = append(env.unmounted, path)
+		return unix.EINVAL
+	}
+
+	return gc
+}
+
+func (env *gcTestEnv) path(path ...string) string {
+	return filepath.Join(append([]string{env.dir}, path...)...)
+}
+
+func TestGarbageCollectorInventory(t *testing.T) {
+	env, cleanup := newGCTestEnv(t)
+	defer cleanup()
+
+	inventory, err := env.garbageCollector().Inventory(context.Background())
+	require.NoError(t, err)
+
+	ipamStore := env.path("ipam.json")
+	assert.Equal(t, []GCResource{
+		{Kind: GCCNIResult, VMID: "dead-vm", Path: env.path("cni", "dead-vm", "results", "fcnet-dead-vm-veth0")},
+		{Kind: GCCNIResult, VMID: "netns-vm", Path: env.path("cni", "netns-vm", "results", "fcnet-netns-vm-veth0"), InUse: true},
+		{Kind: GCNetNS, VMID: "dead-vm", Path: env.path("netns", "dead-vm")},
+		{Kind: GCNetNS, VMID: "netns-vm", Path: env.path("netns", "netns-vm"), InUse: true},
+		{Kind: GCIPAMAllocation, VMID: "dead-vm", Path: ipamStore, IP: "192.0.2.2"},
+		{Kind: GCIPAMAllocation, VMID: "live-vm", Path: ipamStore, IP: "192.0.2.3", InUse: true},
+		{Kind: GCIPAMAllocation, VMID: "netns-vm", Path: ipamStore, IP: "192.0.2.4", InUse: true},
+		{Kind: GCTap, Path: "fc-tap-dead"},
+		{Kind: GCTap, Path: "fc-tap-live", InUse: true},
+		{Kind: GCSocket, Path: env.path("run", "dead.sock")},
+		{Kind: GCSocket, Path: env.path("run", "live.sock"), InUse: true},
+		{Kind: GCFifo, Path: env.path("run", "dead.fifo")},
+		{Kind: GCFifo, Path: env.path("run", "live.fifo"), InUse: true},
+		{Kind: GCJailDir, VMID: "dead-vm", Path: env.path("jailer", "firecracker", "dead-vm")},
+		{Kind: GCJailDir, VMID: "live-vm", Path: env.path("jailer", "firecracker", "live-vm"), InUse: true},
+	}, inventory)
+}
+
+func TestGarbageCollectorCollect(t *testing.T) {
+	env, cleanup := newGCTestEnv(t)
+	defer cleanup()
+
+	collected, err := env.garbageCollector().Collect(context.Background())
+	require.NoError(t, err)
+
+	for _, resource := range collected {
+		assert.False(t, resource.InUse)
+		assert.NotEqual(t, "live-vm", resource.VMID)
+		assert.NotEqual(t, "netns-vm", resource.VMID)
+	}
+	assert.Len(t, collected, 7)
+
+	require.Len(t, env.cniDels, 1, "expected CNI DEL to be called for the dead VM")
+	assert.Equal(t, libcni.RuntimeConf{
+		ContainerID: "dead-vm",
+		NetNS:       env.path("netns", "dead-vm"),
+		IfName:      "veth0",
+		Args:        [][2]string{{"IgnoreUnknown", "true"}},
+	}, env.cniDels[0])
+	assert.Equal(t, []string{env.path("netns", "dead-vm")}, env.unmounted)
+	assert.Equal(t, []string{"fc-tap-dead"}, env.removedTaps)
+
+	for _, path := range []string{
+		env.path("cni", "dead-vm"),
+		env.path("netns", "dead-vm"),
+		env.path("run", "dead.sock"),
+		env.path("run", "dead.fifo"),
+		env.path("jailer", "firecracker", "dead-vm"),
+	} {
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err), "expected %q to be removed, got %v", path, err)
+	}
+
+	for _, path := range []string{
+		env.path("cni", "netns-vm", "results", "fcnet-netns-vm-veth0"),
+		env.path("cni", "results", "fcnet-container-eth0"),
+		env.path("cni", "networks", "fcnet", "last_reserved_ip.0"),
+		env.path("netns", "netns-vm"),
+		env.path("run", "live.sock"),
+		env.path("run", "live.fifo"),
+		env.path("run", "not-a-socket"),
+		env.path("jailer", "firecracker", "live-vm"),
+	} {
+		_, err := os.Stat(path)
+		assert.NoError(t, err, "expected %q to be kept", path)
+	}
+
+	data, err := ioutil.ReadFile(env.path("ipam.json"))
+	require.NoError(t, err)
+	var store ipamStore
+	require.NoError(t, json.Unmarshal(data, &store))
+	assert.Equal(t, map[string]string{
+		"192.0.2.3": "live-vm/0",
+		"192.0.2.4": "netns-vm/1",
+		"192.0.2.5": "not-a-vm",
+	}, store.Allocations)
+}
+
+func TestGarbageCollectorIPAMAllocationOwners(t *testing.T) {
+	env, cleanup := newGCTestEnv(t)
+	defer cleanup()
+
+	// "tap-vm" runs without the jailer nor a network namespace, its tap and
+	// socket recorded by its allocation are the only signs it runs
+	for _, dir := range []string{"ns", "fd", "fdinfo"} {
+		require.NoError(t, os.MkdirAll(env.path("proc", "103", dir), 0700))
+	}
+	require.NoError(t, ioutil.WriteFile(
+		env.path("proc", "103", "cmdline"),
+		[]byte("firecracker\x00--api-sock\x00"+env.path("run", "vm.sock")+"\x00"), 0600))
+	require.NoError(t, os.Symlink(env.path("host-netns"), env.path("proc", "103", "ns", "net")))
+	require.NoError(t, os.Symlink("/dev/net/tun", env.path("proc", "103", "fd", "3")))
+	require.NoError(t, ioutil.WriteFile(env.path("proc", "103", "fdinfo", "3"), []byte("iff:\tfc-tap-vm\n"), 0600))
+
+	data, err := json.Marshal(ipamStore{
+		Allocations: map[string]string{
+			"192.0.2.6": "tap-vm/0",
+			"192.0.2.7": "unknown-vm/0",
+			"192.0.2.8": "gone-vm/0",
+		},
+		Owners: map[string]ipamOwner{
+			"tap-vm/0":  {TapName: "fc-tap-vm", SocketPath: env.path("run", "vm.sock")},
+			"gone-vm/0": {TapName: "fc-tap-gone", SocketPath: env.path("run", "gone.sock")},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(env.path("ipam.json"), data, 0600))
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(env.path("ipam.json"), old, old))
+
+	gc := env.garbageCollector()
+	gc.listTaps = func() ([]string, error) {
+		return []string{"fc-tap-vm", "fc-tap-gone"}, nil
+	}
+
+	inventory, err := gc.Inventory(context.Background())
+	require.NoError(t, err)
+
+	var allocations, taps []GCResource
+	for _, resource := range inventory {
+		switch resource.Kind {
+		case GCIPAMAllocation:
+			allocations = append(allocations, resource)
+		case GCTap:
+			taps = append(taps, resource)
+		}
+	}
+
+	ipamStorePath := env.path("ipam.json")
+	assert.Equal(t, []GCResource{
+		{Kind: GCIPAMAllocation, VMID: "gone-vm", Path: ipamStorePath, IP: "192.0.2.8"},
+		{Kind: GCIPAMAllocation, VMID: "tap-vm", Path: ipamStorePath, IP: "192.0.2.6", InUse: true},
+		// nothing tells whether the VM runs
+		{Kind: GCIPAMAllocation, VMID: "unknown-vm", Path: ipamStorePath, IP: "192.0.2.7", InUse: true},
+	}, allocations)
+	assert.Equal(t, []GCResource{
+		{Kind: GCTap, VMID: "gone-vm", Path: "fc-tap-gone"},
+		{Kind: GCTap, VMID: "tap-vm", Path: "fc-tap-vm", InUse: true},
+	}, taps, "expected taps to be attributed to the VM of their allocation")
+
+	collected, err := gc.Collect(context.Background())
+	require.NoError(t, err)
+	for _, resource := range collected {
+		assert.NotEqual(t, "tap-vm", resource.VMID)
+		assert.NotEqual(t, "unknown-vm", resource.VMID)
+	}
+
+	data, err = ioutil.ReadFile(ipamStorePath)
+	require.NoError(t, err)
+	var store ipamStore
+	require.NoError(t, json.Unmarshal(data, &store))
+	assert.Equal(t, map[string]string{
+		"192.0.2.6": "tap-vm/0",
+		"192.0.2.7": "unknown-vm/0",
+	}, store.Allocations)
+	assert.Equal(t, []string{"tap-vm/0"}, ownerIDs(store))
+}
+
+func ownerIDs(store ipamStore) []string {
+	var ids []string
+	for id := range store.Owners {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestGarbageCollectorMinAge(t *testing.T) {
+	env, cleanup := newGCTestEnv(t)
+	defer cleanup()
+
+	env.cfg.MinAge = time.Minute
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(env.path("run", "dead.sock"), old, old))
+
+	// a tap just created for a VM being started is not open yet
+	env.tapModTimes = map[string]time.Time{
+		"fc-tap-live": old,
+		"fc-tap-dead": old,
+		"fc-tap-new":  time.Now(),
+	}
+	gc := env.garbageCollector()
+	gc.listTaps = func() ([]string, error) {
+		return []string{"fc-tap-live", "fc-tap-dead", "fc-tap-new"}, nil
+	}
+
+	inventory, err := gc.Inventory(context.Background())
+	require.NoError(t, err)
+
+	for _, resource := range inventory {
+		switch {
+		case resource.Path == env.path("run", "dead.sock"),
+			resource.Kind == GCTap && resource.Path == "fc-tap-dead":
+			assert.False(t, resource.InUse, "expected %s %q to be orphaned", resource.Kind, resource.Path)
+		default:
+			// the recent jail directory and CNI result of the dead VM keep all
+			// of its resources from being collected
+			assert.True(t, resource.InUse, "expected %s %q to be in use", resource.Kind, resource.Path)
+		}
+	}
+}
+
+func TestNewGarbageCollectorDefaultMinAge(t *testing.T) {
+	assert.Equal(t, time.Minute, NewGarbageCollector(GCConfig{}).cfg.MinAge,
+		"VMs being started should be protected by default")
+	assert.Equal(t, -time.Second, NewGarbageCollector(GCConfig{MinAge: -time.Second}).cfg.MinAge)
+}
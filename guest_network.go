@@ -0,0 +1,184 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/firecracker-microvm/firecracker-go-sdk/cni/vmconf"
+)
+
+// GuestNetworkConfig holds configuration files for the guest, rendered from
+// the configuration of all of a machine's network interfaces. Unlike the
+// "ip=" boot parameter, these files carry the complete configuration,
+// including MTU, routes, IPv6, search domains and resolver options.
+type GuestNetworkConfig struct {
+	// NetworkdUnits maps systemd-networkd unit file names to their contents,
+	// meant to be written to /etc/systemd/network.
+	NetworkdUnits map[string]string `json:"networkd_units"`
+
+	// ResolvConf is the contents of /etc/resolv.conf.
+	ResolvConf string `json:"resolv_conf"`
+
+	// CloudInitNetworkConfig is a cloud-init network configuration, version 2.
+	CloudInitNetworkConfig string `json:"cloud_init_network_config"`
+}
+
+// GuestNetworkConfig renders the guest network configuration of the machine.
+// Interfaces configured with CNI only have their configuration once CNI was
+// invoked during Start, so for them it must be called from a handler running
+// after the SetupNetworkHandler, or after Start.
+func (m *Machine) GuestNetworkConfig() (*GuestNetworkConfig, error) {
+	confs := m.Cfg.NetworkInterfaces.staticNetworkConfs()
+
+	cloudInitNetworkConfig, err := vmconf.CloudInitNetworkConfig(confs...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to render cloud-init network config")
+	}
+
+	return &GuestNetworkConfig{
+		NetworkdUnits:          vmconf.NetworkdUnits(confs...),
+		ResolvConf:             vmconf.ResolvConf(confs...),
+		CloudInitNetworkConfig: string(cloudInitNetworkConfig),
+	}, nil
+}
+
+// staticNetworkConfs returns the VM network configuration of each network
+// interface, in order.
+func (networkInterfaces NetworkInterfaces) staticNetworkConfs() []vmconf.StaticNetworkConf {
+	confs := make([]vmconf.StaticNetworkConf, 0, len(networkInterfaces))
+	for _, iface := range networkInterfaces {
+		var conf vmconf.StaticNetworkConf
+		switch {
+		case iface.vmNetConf != nil:
+			conf = *iface.vmNetConf
+		case iface.StaticConfiguration != nil:
+			if iface.StaticConfiguration.IPConfiguration != nil {
+				conf = iface.StaticConfiguration.IPConfiguration.vmConf()
+			}
+			conf.TapName = iface.StaticConfiguration.HostDevName
+			conf.VMMacAddr = iface.StaticConfiguration.MacAddress
+		}
+
+		// keep one conf per interface, even if CNI was not invoked yet, so that
+		// interfaces without a name are named after their position
+		confs = append(confs, conf)
+	}
+
+	return confs
+}
+
+// NewSetGuestNetworkMetadataHandler returns a handler that publishes the
+// machine's GuestNetworkConfig in MMDS under the provided key, preserving any
+// other metadata. It must run after the SetupNetworkHandler and, since
+// SetMetadata replaces the whole MMDS contents, after any handler created by
+// NewSetMetadataHandler, for example:
+//
+//	m.Handlers.FcInit = m.Handlers.FcInit.Append(
+//		firecracker.NewSetMetadataHandler(metadata),
+//		firecracker.NewSetGuestNetworkMetadataHandler("network"),
+//	)
+func NewSetGuestNetworkMetadataHandler(key string) Handler {
+	return Handler{
+		Name: SetGuestNetworkMetadataHandlerName,
+		Fn: func(ctx context.Context, m *Machine) error {
+			guestNetworkConfig, err := m.GuestNetworkConfig()
+			if err != nil {
+				return err
+			}
+
+			var metadata map[string]interface{}
+			if err := m.GetMetadata(ctx, &metadata); err != nil {
+				return errors.Wrap(err, "failed to get metadata")
+			}
+
+			if metadata == nil {
+				metadata = make(map[string]interface{})
+			}
+			metadata[key] = guestNetworkConfig
+
+			return m.SetMetadata(ctx, metadata)
+		},
+	}
+}
+
+// ConfigDriveID is the ID of the drive attached by the handler returned by
+// NewCreateConfigDriveHandler.
+const ConfigDriveID = "config-drive"
+
+// NewCreateConfigDriveHandler returns a handler that writes a cloud-init
+// NoCloud config drive to the provided path and attaches it to the machine as
+// a read-only drive with the ConfigDriveID. The drive is an ISO 9660 image
+// labelled "cidata" holding the "meta-data", "user-data" and "network-config"
+// files cloud-init looks for, along with "resolv.conf" and the
+// systemd-networkd units for guests without cloud-init. It is removed when
+// the machine is cleaned up.
+//
+// The handler must run after the SetupNetworkHandler and before the
+// AttachDrivesHandler, for example:
+//
+//	m.Handlers.FcInit = m.Handlers.FcInit.AppendAfter(
+//		firecracker.SetupNetworkHandlerName,
+//		firecracker.NewCreateConfigDriveHandler("/var/lib/vms/config-drive.iso"),
+//	)
+func NewCreateConfigDriveHandler(path string) Handler {
+	return Handler{
+		Name: CreateConfigDriveHandlerName,
+		Fn: func(ctx context.Context, m *Machine) error {
+			guestNetworkConfig, err := m.GuestNetworkConfig()
+			if err != nil {
+				return err
+			}
+
+			files := map[string][]byte{
+				"meta-data":      []byte(fmt.Sprintf("instance-id: %s\n", m.Cfg.VMID)),
+				"user-data":      []byte("#cloud-config\n"),
+				"network-config": []byte(guestNetworkConfig.CloudInitNetworkConfig),
+				"resolv.conf":    []byte(guestNetworkConfig.ResolvConf),
+			}
+			for name, unit := range guestNetworkConfig.NetworkdUnits {
+				files[name] = []byte(unit)
+			}
+
+			if err := writeISO9660(path, configDriveLabel, files); err != nil {
+				return errors.Wrapf(err, "failed to write config drive %q", path)
+			}
+
+			m.cleanupFuncs = append(m.cleanupFuncs, func() error {
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					return errors.Wrapf(err, "failed to remove config drive %q", path)
+				}
+				return nil
+			})
+
+			m.Cfg.Drives = append(m.Cfg.Drives, models.Drive{
+				DriveID:      String(ConfigDriveID),
+				PathOnHost:   String(path),
+				IsRootDevice: Bool(false),
+				IsReadOnly:   Bool(true),
+			})
+
+			return nil
+		},
+	}
+}
+
+// configDriveLabel is the volume label cloud-init's NoCloud data source
+// looks for.
+const configDriveLabel = "cidata"
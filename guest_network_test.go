@@ -0,0 +1,199 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ops "github.com/firecracker-microvm/firecracker-go-sdk/client/operations"
+	"github.com/firecracker-microvm/firecracker-go-sdk/fctesting"
+)
+
+func guestNetworkTestMachine(t *testing.T, opClient *fctesting.MockClient) *Machine {
+	ipConfiguration := *validIPConfiguration
+	ipConfiguration.IfName = "eth0"
+
+	return &Machine{
+		Cfg: Config{
+			VMID: "guest-network-vm",
+			NetworkInterfaces: NetworkInterfaces{
+				{
+					StaticConfiguration: &StaticNetworkConfiguration{
+						MacAddress:      mockMacAddrString,
+						HostDevName:     tapName,
+						IPConfiguration: &ipConfiguration,
+					},
+				},
+				{
+					StaticConfiguration: &StaticNetworkConfiguration{
+						HostDevName: "tap1",
+					},
+				},
+			},
+		},
+		client: NewClient("socket-path", fctesting.NewLogEntry(t), true, WithOpsClient(opClient)),
+		logger: fctesting.NewLogEntry(t),
+	}
+}
+
+func TestGuestNetworkConfig(t *testing.T) {
+	m := guestNetworkTestMachine(t, &fctesting.MockClient{})
+
+	config, err := m.GuestNetworkConfig()
+	require.NoError(t, err)
+
+	require.Contains(t, config.NetworkdUnits, "10-eth0.network")
+	assert.Contains(t, config.NetworkdUnits["10-eth0.network"], "MACAddress="+mockMacAddrString)
+	assert.Contains(t, config.NetworkdUnits["10-eth0.network"], "Address=198.51.100.2/24")
+	assert.Contains(t, config.NetworkdUnits, "10-eth1.network",
+		"expected the interface without IP configuration to be named after its position")
+
+	assert.Equal(t, "nameserver 192.0.2.1\nnameserver 192.0.2.2\n", config.ResolvConf)
+	assert.Contains(t, config.CloudInitNetworkConfig, `"198.51.100.2/24"`)
+}
+
+func TestSetGuestNetworkMetadataHandler(t *testing.T) {
+	var putMetadata interface{}
+	opClient := &fctesting.MockClient{
+		GetMmdsFn: func(params *ops.GetMmdsParams) (*ops.GetMmdsOK, error) {
+			return &ops.GetMmdsOK{Payload: map[string]interface{}{"user": "data"}}, nil
+		},
+		PutMmdsFn: func(params *ops.PutMmdsParams) (*ops.PutMmdsNoContent, error) {
+			putMetadata = params.Body
+			return &ops.PutMmdsNoContent{}, nil
+		},
+	}
+	m := guestNetworkTestMachine(t, opClient)
+
+	err := NewSetGuestNetworkMetadataHandler("network").Fn(context.Background(), m)
+	require.NoError(t, err)
+
+	metadata, ok := putMetadata.(map[string]interface{})
+	require.True(t, ok, "expected metadata to be an object, got %#v", putMetadata)
+	assert.Equal(t, "data", metadata["user"], "expected existing metadata to be preserved")
+	require.IsType(t, &GuestNetworkConfig{}, metadata["network"])
+	assert.Contains(t, metadata["network"].(*GuestNetworkConfig).NetworkdUnits, "10-eth0.network")
+}
+
+func TestCreateConfigDriveHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCreateConfigDriveHandler")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m := guestNetworkTestMachine(t, &fctesting.MockClient{})
+	path := filepath.Join(dir, "config-drive.iso")
+
+	err = NewCreateConfigDriveHandler(path).Fn(context.Background(), m)
+	require.NoError(t, err)
+
+	require.Len(t, m.Cfg.Drives, 1)
+	assert.Equal(t, ConfigDriveID, StringValue(m.Cfg.Drives[0].DriveID))
+	assert.Equal(t, path, StringValue(m.Cfg.Drives[0].PathOnHost))
+	assert.True(t, BoolValue(m.Cfg.Drives[0].IsReadOnly))
+
+	image, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	label, files := readJolietRoot(t, image)
+	assert.Equal(t, "cidata", label)
+	assert.Equal(t, "instance-id: guest-network-vm\n", files["meta-data"])
+	assert.Equal(t, "#cloud-config\n", files["user-data"])
+	assert.Contains(t, files["network-config"], `"version": 2`)
+	assert.Contains(t, files["10-eth0.network"], "Address=198.51.100.2/24")
+	assert.Contains(t, files, "resolv.conf")
+
+	require.NoError(t, m.doCleanup())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "expected config drive to be removed, got %v", err)
+}
+
+func TestBuildISO9660(t *testing.T) {
+	files := map[string][]byte{
+		"long-file-name.network":  []byte(strings.Repeat("x", 3*isoSectorSize+1)),
+		"long-file-names.network": []byte("other"),
+		"empty":                   nil,
+	}
+
+	image, err := buildISO9660("testvol", files, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Equal(t, (isoFirstFileSector+4+1)*isoSectorSize, len(image))
+
+	label, actual := readJolietRoot(t, image)
+	assert.Equal(t, "testvol", label)
+	assert.Equal(t, map[string]string{
+		"long-file-name.network":  string(files["long-file-name.network"]),
+		"long-file-names.network": "other",
+		"empty":                   "",
+	}, actual)
+
+	// the primary volume holds unique 8.3 names
+	primaryRoot := image[isoPrimaryRootSector*isoSectorSize:][:isoSectorSize]
+	assert.Contains(t, string(primaryRoot), "LONG_FIL.NET;1")
+	assert.Contains(t, string(primaryRoot), "LONG_FI1.NET;1")
+
+	_, err = buildISO9660("testvol", map[string][]byte{"dir/file": nil}, time.Now())
+	assert.Error(t, err, "expected files in subdirectories to be rejected")
+}
+
+// readJolietRoot returns the volume label and the files in the root directory
+// of the Joliet volume of an ISO 9660 image.
+func readJolietRoot(t *testing.T, image []byte) (string, map[string]string) {
+	t.Helper()
+
+	ucs2 := func(b []byte) string {
+		chars := make([]uint16, len(b)/2)
+		for i := range chars {
+			chars[i] = binary.BigEndian.Uint16(b[2*i:])
+		}
+		return string(utf16.Decode(chars))
+	}
+
+	descriptor := image[isoJolietDescriptorSector*isoSectorSize:]
+	require.Equal(t, byte(2), descriptor[0], "expected a supplementary volume descriptor")
+	require.Equal(t, "CD001", string(descriptor[1:6]))
+	require.Equal(t, "%/E", string(descriptor[88:91]))
+	label := strings.TrimRight(ucs2(descriptor[40:72]), " ")
+
+	rootSector := binary.LittleEndian.Uint32(descriptor[158:])
+	rootSize := binary.LittleEndian.Uint32(descriptor[166:])
+	root := image[int(rootSector)*isoSectorSize:][:rootSize]
+
+	files := make(map[string]string)
+	for offset := 0; offset < len(root) && root[offset] != 0; offset += int(root[offset]) {
+		record := root[offset:]
+		nameLength := int(record[32])
+		if record[25]&2 != 0 {
+			// skip the "." and ".." entries
+			continue
+		}
+
+		sector := binary.LittleEndian.Uint32(record[2:])
+		size := binary.LittleEndian.Uint32(record[10:])
+		name := ucs2(record[33 : 33+nameLength])
+		files[name] = string(image[int(sector)*isoSectorSize:][:size])
+	}
+
+	return label, files
+}
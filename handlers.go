@@ -15,7 +15,6 @@ package firecracker
 
 import (
 	"context"
-	"fmt"
 	"os"
 )
 
@@ -33,6 +32,9 @@ const (
 	LinkFilesToRootFSHandlerName       = "fcinit.LinkFilesToRootFS"
 	SetupNetworkHandlerName            = "fcinit.SetupNetwork"
 	SetupKernelArgsHandlerName         = "fcinit.SetupKernelArgs"
+	SetGuestNetworkMetadataHandlerName = "fcinit.SetGuestNetworkMetadata"
+	CreateConfigDriveHandlerName       = "fcinit.CreateConfigDrive"
+	CloneDriveHandlerName              = "fcinit.CloneDrive"
 
 	ValidateCfgHandlerName        = "validate.Cfg"
 	ValidateJailerCfgHandlerName  = "validate.JailerCfg"
@@ -59,47 +61,7 @@ var ConfigValidationHandler = Handler{
 var JailerConfigValidationHandler = Handler{
 	Name: ValidateJailerCfgHandlerName,
 	Fn: func(ctx context.Context, m *Machine) error {
-		if m.Cfg.JailerCfg == nil {
-			return nil
-		}
-
-		hasRoot := false
-		for _, drive := range m.Cfg.Drives {
-			if BoolValue(drive.IsRootDevice) {
-				hasRoot = true
-				break
-			}
-		}
-
-		if !hasRoot {
-			return fmt.Errorf("A root drive must be present in the drive list")
-		}
-
-		if m.Cfg.JailerCfg.ChrootStrategy == nil {
-			return fmt.Errorf("ChrootStrategy cannot be nil")
-		}
-
-		if len(m.Cfg.JailerCfg.ExecFile) == 0 {
-			return fmt.Errorf("exec file must be specified when using jailer mode")
-		}
-
-		if len(m.Cfg.JailerCfg.ID) == 0 {
-			return fmt.Errorf("id must be specified when using jailer mode")
-		}
-
-		if m.Cfg.JailerCfg.GID == nil {
-			return fmt.Errorf("GID must be specified when using jailer mode")
-		}
-
-		if m.Cfg.JailerCfg.UID == nil {
-			return fmt.Errorf("UID must be specified when using jailer mode")
-		}
-
-		if m.Cfg.JailerCfg.NumaNode == nil {
-			return fmt.Errorf("ID must be specified when using jailer mode")
-		}
-
-		return nil
+		return m.Cfg.ValidateJailer()
 	},
 }
 
@@ -0,0 +1,220 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package initramfs
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	newcMagic = "070701"
+
+	// newcHeaderLength is the length of the magic number followed by the 13
+	// fields of 8 hexadecimal digits of a newc header.
+	newcHeaderLength = 6 + 13*8
+
+	// newcAlignment is the alignment of the names and data of entries.
+	newcAlignment = 4
+
+	// trailerName is the name of the entry terminating the archive.
+	trailerName = "TRAILER!!!"
+
+	// blockSize is the size the archive is padded to, as done by cpio.
+	blockSize = 512
+)
+
+// Unix file type and permission bits, as found in the mode field of newc
+// headers.
+const (
+	modeSocket    = 0140000
+	modeSymlink   = 0120000
+	modeRegular   = 0100000
+	modeBlock     = 0060000
+	modeDir       = 0040000
+	modeCharacter = 0020000
+	modeFIFO      = 0010000
+
+	modeSetuid = 04000
+	modeSetgid = 02000
+	modeSticky = 01000
+)
+
+// Writer writes entries to a cpio archive in the "newc" format, which is the
+// format the kernel unpacks initramfs from.
+type Writer struct {
+	w       io.Writer
+	written int64
+	ino     uint32
+	closed  bool
+}
+
+// NewWriter returns a Writer writing a cpio archive to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteEntry writes a single entry to the archive. Its parent directory must
+// have been written before.
+func (cw *Writer) WriteEntry(e Entry) error {
+	if cw.closed {
+		return errors.New("cpio archive is already closed")
+	}
+
+	mode, err := newcMode(e.Mode)
+	if err != nil {
+		return errors.Wrapf(err, "invalid mode of %q", e.Path)
+	}
+
+	var data io.Reader
+	var size int64
+	switch mode &^ 07777 {
+	case modeRegular:
+		data, size, err = e.contents()
+		if err != nil {
+			return err
+		}
+		if closer, ok := data.(io.Closer); ok {
+			defer closer.Close()
+		}
+	case modeSymlink:
+		data, size = strings.NewReader(e.LinkTarget), int64(len(e.LinkTarget))
+	}
+
+	if size > math.MaxUint32 {
+		return errors.Errorf("%q is larger than the 4GiB supported by cpio", e.Path)
+	}
+
+	nlink := uint32(1)
+	if e.Mode.IsDir() {
+		nlink = 2
+	}
+
+	var mtime uint32
+	if !e.ModTime.IsZero() {
+		mtime = uint32(e.ModTime.Unix())
+	}
+
+	cw.ino++
+	if err := cw.writeHeader(e.Path, newcHeader{
+		ino:       cw.ino,
+		mode:      mode,
+		uid:       uint32(e.UID),
+		gid:       uint32(e.GID),
+		nlink:     nlink,
+		mtime:     mtime,
+		size:      uint32(size),
+		rdevMajor: e.Major,
+		rdevMinor: e.Minor,
+	}); err != nil {
+		return errors.Wrapf(err, "failed to write header of %q", e.Path)
+	}
+
+	if data != nil {
+		copied, err := io.Copy(cw, io.LimitReader(data, size))
+		if err != nil {
+			return errors.Wrapf(err, "failed to write contents of %q", e.Path)
+		}
+		if copied != size {
+			return errors.Errorf("%q changed size while writing it", e.Path)
+		}
+	}
+
+	return cw.pad(newcAlignment)
+}
+
+// Close terminates the archive, but does not close the underlying writer.
+func (cw *Writer) Close() error {
+	if cw.closed {
+		return nil
+	}
+
+	if err := cw.writeHeader(trailerName, newcHeader{nlink: 1}); err != nil {
+		return errors.Wrap(err, "failed to write cpio trailer")
+	}
+	cw.closed = true
+
+	return cw.pad(blockSize)
+}
+
+func (cw *Writer) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.written += int64(n)
+	return n, err
+}
+
+type newcHeader struct {
+	ino, mode, uid, gid, nlink, mtime, size uint32
+	rdevMajor, rdevMinor                    uint32
+}
+
+func (cw *Writer) writeHeader(name string, h newcHeader) error {
+	// the name size includes the trailing NUL byte
+	_, err := fmt.Fprintf(cw, "%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%s\x00",
+		newcMagic, h.ino, h.mode, h.uid, h.gid, h.nlink, h.mtime, h.size,
+		0, 0, h.rdevMajor, h.rdevMinor, len(name)+1, 0, name)
+	if err != nil {
+		return err
+	}
+
+	return cw.pad(newcAlignment)
+}
+
+// pad writes NUL bytes until the archive is aligned to alignment.
+func (cw *Writer) pad(alignment int64) error {
+	if rem := cw.written % alignment; rem != 0 {
+		_, err := cw.Write(make([]byte, alignment-rem))
+		return err
+	}
+
+	return nil
+}
+
+// newcMode converts mode to the type and permission bits of a newc header.
+func newcMode(mode os.FileMode) (uint32, error) {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= modeSetuid
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= modeSetgid
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= modeSticky
+	}
+
+	switch mode & os.ModeType {
+	case 0:
+		return bits | modeRegular, nil
+	case os.ModeDir:
+		return bits | modeDir, nil
+	case os.ModeSymlink:
+		return bits | modeSymlink, nil
+	case os.ModeDevice:
+		return bits | modeBlock, nil
+	case os.ModeDevice | os.ModeCharDevice:
+		return bits | modeCharacter, nil
+	case os.ModeNamedPipe:
+		return bits | modeFIFO, nil
+	case os.ModeSocket:
+		return bits | modeSocket, nil
+	default:
+		return 0, errors.Errorf("unsupported file type %v", mode&os.ModeType)
+	}
+}
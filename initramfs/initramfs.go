@@ -0,0 +1,388 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+/*
+Package initramfs builds initramfs images, which are cpio archives in the
+"newc" format, optionally compressed, that the kernel unpacks into its root
+filesystem at boot. The images can be used as a Firecracker VM's initrd
+through Config.InitrdPath, without requiring the cpio tool on the host.
+
+Entries are added to a Builder either from a host directory or one by one,
+after which the image is written with Builder.WriteFile:
+
+	b := initramfs.NewBuilder()
+	if err := b.AddHostDir("/path/to/rootfs", ""); err != nil {
+		return err
+	}
+	if err := b.Add(initramfs.CharDevice("dev/console", 0600, 5, 1)); err != nil {
+		return err
+	}
+	if err := b.WriteFile("/path/to/initrd.img", initramfs.CompressionGzip); err != nil {
+		return err
+	}
+*/
+package initramfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Compression is the compression format of an initramfs image.
+type Compression string
+
+const (
+	// CompressionNone writes uncompressed images.
+	CompressionNone Compression = ""
+	// CompressionGzip writes gzip compressed images.
+	CompressionGzip Compression = "gzip"
+)
+
+// defaultDirMode is the mode of the parent directories added implicitly.
+const defaultDirMode = os.ModeDir | 0755
+
+// Entry is a file, directory, symbolic link or special file of an initramfs.
+type Entry struct {
+	// Path is the path of the entry in the root filesystem, such as
+	// "bin/sh". Leading slashes are ignored.
+	Path string
+
+	// Mode holds the file type and permission bits of the entry, such as
+	// os.ModeDir|0755 for a directory. Regular files have no type bits and
+	// device nodes have os.ModeDevice, along with os.ModeCharDevice for
+	// character devices.
+	Mode os.FileMode
+
+	// UID and GID own the entry.
+	UID int
+	GID int
+
+	// ModTime is the modification time of the entry. If not provided, the
+	// Unix epoch is used, which makes images reproducible.
+	ModTime time.Time
+
+	// Data holds the contents of a regular file.
+	Data []byte
+
+	// HostPath (optional) is the host file the contents of a regular file
+	// are read from when the image is written, instead of Data.
+	HostPath string
+
+	// LinkTarget is the target of a symbolic link.
+	LinkTarget string
+
+	// Major and Minor are the device numbers of a device node.
+	Major uint32
+	Minor uint32
+}
+
+// File returns the entry of a regular file with the given contents, owned by
+// root.
+func File(path string, data []byte, perm os.FileMode) Entry {
+	return Entry{Path: path, Mode: permBits(perm), Data: data}
+}
+
+// Dir returns the entry of a directory, owned by root.
+func Dir(path string, perm os.FileMode) Entry {
+	return Entry{Path: path, Mode: os.ModeDir | permBits(perm)}
+}
+
+// Symlink returns the entry of a symbolic link to target, owned by root.
+func Symlink(path, target string) Entry {
+	return Entry{Path: path, Mode: os.ModeSymlink | 0777, LinkTarget: target}
+}
+
+// CharDevice returns the entry of a character device node, owned by root.
+func CharDevice(path string, perm os.FileMode, major, minor uint32) Entry {
+	return Entry{Path: path, Mode: os.ModeDevice | os.ModeCharDevice | permBits(perm), Major: major, Minor: minor}
+}
+
+// BlockDevice returns the entry of a block device node, owned by root.
+func BlockDevice(path string, perm os.FileMode, major, minor uint32) Entry {
+	return Entry{Path: path, Mode: os.ModeDevice | permBits(perm), Major: major, Minor: minor}
+}
+
+// permBits returns the permission bits of perm, including the setuid, setgid
+// and sticky bits.
+func permBits(perm os.FileMode) os.FileMode {
+	return perm & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+// contents returns the contents of a regular file entry and their size.
+func (e Entry) contents() (io.Reader, int64, error) {
+	if e.HostPath == "" {
+		return bytes.NewReader(e.Data), int64(len(e.Data)), nil
+	}
+
+	f, err := os.Open(e.HostPath)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to open contents of %q", e.Path)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, errors.Wrapf(err, "failed to stat contents of %q", e.Path)
+	}
+
+	return f, info.Size(), nil
+}
+
+// Builder collects the entries of an initramfs image.
+type Builder struct {
+	entries map[string]Entry
+}
+
+// NewBuilder returns a Builder of an empty image.
+func NewBuilder() *Builder {
+	return &Builder{
+		entries: make(map[string]Entry),
+	}
+}
+
+// Add adds an entry, replacing any previous one with the same path. Missing
+// parent directories are added, owned by root with mode 0755.
+func (b *Builder) Add(e Entry) error {
+	cleanPath, err := cleanEntryPath(e.Path)
+	if err != nil {
+		return err
+	}
+	e.Path = cleanPath
+
+	if _, err := newcMode(e.Mode); err != nil {
+		return errors.Wrapf(err, "invalid mode of %q", e.Path)
+	}
+
+	if e.Mode&os.ModeType != os.ModeSymlink && e.LinkTarget != "" {
+		return errors.Errorf("%q has a link target but is not a symbolic link", e.Path)
+	}
+
+	if e.Mode&os.ModeType != 0 && (e.Data != nil || e.HostPath != "") {
+		return errors.Errorf("%q has contents but is not a regular file", e.Path)
+	}
+
+	for dir := path.Dir(e.Path); dir != "."; dir = path.Dir(dir) {
+		parent, ok := b.entries[dir]
+		if !ok {
+			b.entries[dir] = Entry{Path: dir, Mode: defaultDirMode}
+		} else if !parent.Mode.IsDir() {
+			return errors.Errorf("parent %q of %q is not a directory", dir, e.Path)
+		}
+	}
+
+	if previous, ok := b.entries[e.Path]; ok && previous.Mode.IsDir() && !e.Mode.IsDir() {
+		for entryPath := range b.entries {
+			if strings.HasPrefix(entryPath, e.Path+"/") {
+				return errors.Errorf("%q cannot replace a directory that is not empty", e.Path)
+			}
+		}
+	}
+
+	b.entries[e.Path] = e
+	return nil
+}
+
+// HostDirOpt configures how the files of a host directory are added.
+type HostDirOpt func(*hostDirOptions)
+
+type hostDirOptions struct {
+	preserveOwnership bool
+	uid, gid          int
+	entryFunc         func(*Entry) bool
+}
+
+// WithOwner makes the given user and group own the entries added from the
+// host directory, instead of root.
+func WithOwner(uid, gid int) HostDirOpt {
+	return func(opts *hostDirOptions) {
+		opts.uid, opts.gid = uid, gid
+	}
+}
+
+// PreserveOwnership keeps the host owners of the files added from the host
+// directory, instead of making root own them.
+func PreserveOwnership() HostDirOpt {
+	return func(opts *hostDirOptions) {
+		opts.preserveOwnership = true
+	}
+}
+
+// WithEntryFunc calls fn with each entry created from a file of the host
+// directory before it is added. fn may modify the entry, such as its mode or
+// owners, and skips it by returning false. Skipping a directory does not skip
+// its contents.
+func WithEntryFunc(fn func(e *Entry) bool) HostDirOpt {
+	return func(opts *hostDirOptions) {
+		opts.entryFunc = fn
+	}
+}
+
+// AddHostDir adds the contents of the host directory hostDir under dest, or
+// at the root of the image if dest is blank. Regular files, directories,
+// symbolic links, device nodes, FIFOs and sockets are added with their host
+// mode and modification time, owned by root unless specified otherwise. The
+// contents of regular files are read when the image is written.
+func (b *Builder) AddHostDir(hostDir, dest string, opts ...HostDirOpt) error {
+	var options hostDirOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return filepath.Walk(hostDir, func(hostPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.Wrapf(err, "failed to walk %q", hostPath)
+		}
+
+		relPath, err := filepath.Rel(hostDir, hostPath)
+		if err != nil {
+			return err
+		}
+
+		entryPath := path.Join(dest, filepath.ToSlash(relPath))
+		if entryPath == "." {
+			// the root directory of the image is implicit
+			return nil
+		}
+
+		e := Entry{
+			Path:    entryPath,
+			Mode:    info.Mode(),
+			UID:     options.uid,
+			GID:     options.gid,
+			ModTime: info.ModTime(),
+		}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			if options.preserveOwnership {
+				e.UID, e.GID = int(stat.Uid), int(stat.Gid)
+			}
+
+			if info.Mode()&os.ModeDevice != 0 {
+				e.Major, e.Minor = unix.Major(uint64(stat.Rdev)), unix.Minor(uint64(stat.Rdev))
+			}
+		}
+
+		switch info.Mode() & os.ModeType {
+		case 0:
+			e.HostPath = hostPath
+		case os.ModeSymlink:
+			e.LinkTarget, err = os.Readlink(hostPath)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read symbolic link %q", hostPath)
+			}
+		}
+
+		if options.entryFunc != nil && !options.entryFunc(&e) {
+			return nil
+		}
+
+		return b.Add(e)
+	})
+}
+
+// Entries returns the entries of the image, in the order they are written.
+func (b *Builder) Entries() []Entry {
+	paths := make([]string, 0, len(b.entries))
+	for entryPath := range b.entries {
+		paths = append(paths, entryPath)
+	}
+
+	// directories sort before their contents
+	sort.Strings(paths)
+
+	entries := make([]Entry, 0, len(paths))
+	for _, entryPath := range paths {
+		entries = append(entries, b.entries[entryPath])
+	}
+
+	return entries
+}
+
+// Write writes the image to w with the given compression.
+func (b *Builder) Write(w io.Writer, compression Compression) error {
+	var compressor io.WriteCloser
+	switch compression {
+	case CompressionNone:
+	case CompressionGzip:
+		compressor = gzip.NewWriter(w)
+		w = compressor
+	default:
+		return errors.Errorf("unsupported compression %q", compression)
+	}
+
+	cw := NewWriter(w)
+	for _, e := range b.Entries() {
+		if err := cw.WriteEntry(e); err != nil {
+			return err
+		}
+	}
+
+	if err := cw.Close(); err != nil {
+		return err
+	}
+
+	if compressor != nil {
+		return errors.Wrapf(compressor.Close(), "failed to compress image")
+	}
+
+	return nil
+}
+
+// WriteFile writes the image to the file at path with the given compression.
+// The file is replaced once the image has been written completely.
+func (b *Builder) WriteFile(path string, compression Compression) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return errors.Wrap(err, "failed to create image file")
+	}
+	defer os.Remove(f.Name())
+
+	if err := b.Write(f, compression); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to chmod image file")
+	}
+
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "failed to close image file")
+	}
+
+	return errors.Wrap(os.Rename(f.Name(), path), "failed to rename image file")
+}
+
+// cleanEntryPath returns the canonical form of an entry path, without leading
+// slashes.
+func cleanEntryPath(entryPath string) (string, error) {
+	cleanPath := strings.TrimLeft(path.Clean("/"+entryPath), "/")
+	if cleanPath == "" {
+		return "", errors.Errorf("invalid entry path %q", entryPath)
+	}
+
+	return cleanPath, nil
+}
@@ -0,0 +1,239 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package initramfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// archivedEntry is an entry read back from a newc archive.
+type archivedEntry struct {
+	name      string
+	mode      uint32
+	uid, gid  uint32
+	mtime     uint32
+	rdevMajor uint32
+	rdevMinor uint32
+	data      string
+}
+
+// readArchive parses a newc archive up to its trailer.
+func readArchive(t *testing.T, archive []byte) []archivedEntry {
+	t.Helper()
+
+	var entries []archivedEntry
+	offset := 0
+	align := func() {
+		offset = (offset + newcAlignment - 1) &^ (newcAlignment - 1)
+	}
+
+	for {
+		require.True(t, len(archive) >= offset+newcHeaderLength, "truncated archive")
+		header := string(archive[offset : offset+newcHeaderLength])
+		require.Equal(t, newcMagic, header[:6])
+
+		field := func(i int) uint32 {
+			v, err := strconv.ParseUint(header[6+i*8:6+(i+1)*8], 16, 32)
+			require.NoError(t, err)
+			return uint32(v)
+		}
+		offset += newcHeaderLength
+
+		nameSize, size := int(field(11)), int(field(6))
+		name := string(archive[offset : offset+nameSize-1])
+		offset += nameSize
+		align()
+
+		if name == trailerName {
+			offset = (offset + blockSize - 1) &^ (blockSize - 1)
+			assert.Equal(t, len(archive), offset, "archive should be padded to a block")
+			return entries
+		}
+
+		entries = append(entries, archivedEntry{
+			name:      name,
+			mode:      field(1),
+			uid:       field(2),
+			gid:       field(3),
+			mtime:     field(5),
+			rdevMajor: field(9),
+			rdevMinor: field(10),
+			data:      string(archive[offset : offset+size]),
+		})
+		offset += size
+		align()
+	}
+}
+
+func TestBuilderWrite(t *testing.T) {
+	b := NewBuilder()
+	require.NoError(t, b.Add(File("/etc/hostname", []byte("vm\n"), 0644)))
+	require.NoError(t, b.Add(Symlink("init", "bin/busybox")))
+	require.NoError(t, b.Add(CharDevice("dev/console", 0600, 5, 1)))
+	require.NoError(t, b.Add(BlockDevice("dev/vda", 0660, 254, 0)))
+	require.NoError(t, b.Add(Entry{
+		Path:    "bin/busybox",
+		Mode:    os.ModeSetuid | 0755,
+		UID:     1000,
+		GID:     1001,
+		ModTime: time.Unix(1500000000, 0),
+		Data:    []byte("#!busybox"),
+	}))
+	require.NoError(t, b.Add(Dir("tmp", os.ModeSticky|0777)))
+
+	var buf bytes.Buffer
+	require.NoError(t, b.Write(&buf, CompressionNone))
+
+	assert.Equal(t, []archivedEntry{
+		{name: "bin", mode: modeDir | 0755},
+		{name: "bin/busybox", mode: modeRegular | modeSetuid | 0755, uid: 1000, gid: 1001, mtime: 1500000000, data: "#!busybox"},
+		{name: "dev", mode: modeDir | 0755},
+		{name: "dev/console", mode: modeCharacter | 0600, rdevMajor: 5, rdevMinor: 1},
+		{name: "dev/vda", mode: modeBlock | 0660, rdevMajor: 254},
+		{name: "etc", mode: modeDir | 0755},
+		{name: "etc/hostname", mode: modeRegular | 0644, data: "vm\n"},
+		{name: "init", mode: modeSymlink | 0777, data: "bin/busybox"},
+		{name: "tmp", mode: modeDir | modeSticky | 0777},
+	}, readArchive(t, buf.Bytes()))
+}
+
+func TestBuilderWriteGzip(t *testing.T) {
+	b := NewBuilder()
+	require.NoError(t, b.Add(File("init", []byte("#!/bin/sh\n"), 0755)))
+
+	var buf bytes.Buffer
+	require.NoError(t, b.Write(&buf, CompressionGzip))
+
+	r, err := gzip.NewReader(&buf)
+	require.NoError(t, err)
+	archive, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	assert.Equal(t, []archivedEntry{
+		{name: "init", mode: modeRegular | 0755, data: "#!/bin/sh\n"},
+	}, readArchive(t, archive))
+
+	assert.Error(t, b.Write(ioutil.Discard, Compression("zip")))
+}
+
+func TestBuilderAddFails(t *testing.T) {
+	b := NewBuilder()
+	require.NoError(t, b.Add(File("etc/hostname", nil, 0644)))
+
+	for _, e := range []Entry{
+		{Path: "/", Mode: os.ModeDir | 0755},
+		{Path: "etc/hostname/nested"},
+		{Path: "etc", Mode: 0644},
+		{Path: "link", Mode: os.ModeDir | 0755, LinkTarget: "target"},
+		{Path: "dir", Mode: os.ModeDir | 0755, Data: []byte("data")},
+		{Path: "irregular", Mode: os.ModeIrregular},
+	} {
+		assert.Error(t, b.Add(e), "adding %+v should fail", e)
+	}
+}
+
+func TestBuilderAddHostDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestBuilderAddHostDir")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "bin"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "bin", "app"), []byte("app"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0600))
+	require.NoError(t, os.Symlink("bin/app", filepath.Join(dir, "init")))
+	require.NoError(t, os.Chmod(dir, 0700))
+
+	modTime := time.Unix(1500000000, 0)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "bin", "app"), modTime, modTime))
+
+	b := NewBuilder()
+	require.NoError(t, b.AddHostDir(dir, "opt", WithOwner(1000, 1000), WithEntryFunc(func(e *Entry) bool {
+		if e.Path == "opt/bin/app" {
+			e.Mode = 0500
+		}
+		return e.Path != "opt/secret"
+	})))
+
+	var buf bytes.Buffer
+	require.NoError(t, b.Write(&buf, CompressionNone))
+
+	entries := readArchive(t, buf.Bytes())
+	require.Len(t, entries, 4)
+
+	assert.Equal(t, "opt", entries[0].name)
+	assert.Equal(t, uint32(modeDir|0700), entries[0].mode)
+
+	assert.Equal(t, "opt/bin", entries[1].name)
+
+	assert.Equal(t, archivedEntry{
+		name: "opt/bin/app", mode: modeRegular | 0500, uid: 1000, gid: 1000, mtime: 1500000000, data: "app",
+	}, entries[2])
+
+	assert.Equal(t, "opt/init", entries[3].name)
+	assert.Equal(t, uint32(modeSymlink|0777), entries[3].mode)
+	assert.Equal(t, "bin/app", entries[3].data)
+}
+
+func TestBuilderWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestBuilderWriteFile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	contentsPath := filepath.Join(dir, "contents")
+	require.NoError(t, ioutil.WriteFile(contentsPath, []byte("from the host"), 0600))
+
+	b := NewBuilder()
+	require.NoError(t, b.Add(Entry{Path: "data", Mode: 0644, HostPath: contentsPath}))
+
+	imagePath := filepath.Join(dir, "initrd.img")
+	require.NoError(t, b.WriteFile(imagePath, CompressionNone))
+
+	archive, err := ioutil.ReadFile(imagePath)
+	require.NoError(t, err)
+	assert.Equal(t, []archivedEntry{
+		{name: "data", mode: modeRegular | 0644, data: "from the host"},
+	}, readArchive(t, archive))
+
+	// a failed write leaves the previous image in place
+	require.NoError(t, b.Add(Entry{Path: "missing", Mode: 0644, HostPath: filepath.Join(dir, "missing")}))
+	assert.Error(t, b.WriteFile(imagePath, CompressionNone))
+
+	unchanged, err := ioutil.ReadFile(imagePath)
+	require.NoError(t, err)
+	assert.Equal(t, archive, unchanged)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 2, "no temporary file should be left behind")
+}
+
+func TestWriterClosed(t *testing.T) {
+	cw := NewWriter(ioutil.Discard)
+	require.NoError(t, cw.Close())
+	assert.Error(t, cw.WriteEntry(File("late", nil, 0644)))
+	assert.NoError(t, cw.Close())
+
+	var _ io.Writer = cw
+}
@@ -0,0 +1,316 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// IPAM allocates IP addresses of VMs from a list of subnets. Allocations are
+// kept in a JSON file protected by a lock file, so several processes on a host
+// can allocate addresses from the same store without conflicts.
+//
+// An IPAM is generally used through the IPAMConfiguration of network
+// interfaces, which allocates their IPConfiguration when the VM starts and
+// releases it when the VM exits.
+type IPAM struct {
+	storePath string
+	subnets   []IPAMSubnet
+}
+
+// IPAMSubnet is a subnet IP addresses are allocated from.
+type IPAMSubnet struct {
+	// Subnet the addresses are allocated from. Its network address and, for
+	// IPv4 subnets, its broadcast address are never allocated.
+	Subnet net.IPNet
+
+	// Gateway of the VMs, which is never allocated. It is required for IPv4
+	// subnets.
+	Gateway net.IP
+
+	// Nameservers (optional) of the VMs.
+	Nameservers []string
+}
+
+// NewIPAM returns an IPAM allocating addresses from the provided subnets, in
+// order, and keeping its allocations in the file at storePath.
+func NewIPAM(storePath string, subnets ...IPAMSubnet) (*IPAM, error) {
+	if storePath == "" {
+		return nil, errors.New("IPAM store path must be provided")
+	}
+
+	if len(subnets) == 0 {
+		return nil, errors.New("at least one IPAM subnet must be provided")
+	}
+
+	for _, subnet := range subnets {
+		ipConf := IPConfiguration{
+			IPAddr:      subnet.Subnet,
+			Gateway:     subnet.Gateway,
+			Nameservers: subnet.Nameservers,
+		}
+		if err := ipConf.validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid IPAM subnet %s", subnet.Subnet.String())
+		}
+	}
+
+	return &IPAM{
+		storePath: storePath,
+		subnets:   subnets,
+	}, nil
+}
+
+// ipamStore is the contents of the store file.
+type ipamStore struct {
+	// Allocations maps allocated IP addresses to the ID of their allocation.
+	Allocations map[string]string `json:"allocations"`
+
+	// Owners maps the IDs of allocations made for VMs to the resources of
+	// the VM, which tell the GarbageCollector whether the VM is running.
+	Owners map[string]ipamOwner `json:"owners,omitempty"`
+}
+
+// ipamOwner records the resources of the VM an address is allocated for.
+type ipamOwner struct {
+	// TapName is the tap device of the VM, when it is in the network
+	// namespace of the SDK.
+	TapName string `json:"tapName,omitempty"`
+
+	// NetNS is the path of the network namespace of the VM, if any.
+	NetNS string `json:"netNS,omitempty"`
+
+	// SocketPath is the absolute path of the API socket of the VM.
+	SocketPath string `json:"socketPath,omitempty"`
+}
+
+// Allocate allocates an IP address for the provided ID, such as a VM ID, and
+// returns its IPConfiguration. Allocating an ID that is already allocated
+// returns its existing IPConfiguration.
+func (ipam *IPAM) Allocate(id string) (*IPConfiguration, error) {
+	return ipam.allocate(id, ipamOwner{})
+}
+
+// allocate allocates an IP address like Allocate, recording the resources of
+// the VM it is allocated for.
+func (ipam *IPAM) allocate(id string, owner ipamOwner) (*IPConfiguration, error) {
+	var ipConf *IPConfiguration
+	err := ipam.withStore(func(store *ipamStore) error {
+		if owner != (ipamOwner{}) {
+			store.Owners[id] = owner
+		}
+
+		if ip, subnet := ipam.allocated(store, id); ip != nil {
+			ipConf = subnet.ipConfiguration(ip)
+			return nil
+		}
+
+		for i := range ipam.subnets {
+			subnet := &ipam.subnets[i]
+			if ip := subnet.freeIP(store); ip != nil {
+				store.Allocations[ip.String()] = id
+				ipConf = subnet.ipConfiguration(ip)
+				return nil
+			}
+		}
+
+		delete(store.Owners, id)
+
+		return errors.Errorf("no IP address available for %q", id)
+	})
+
+	return ipConf, err
+}
+
+// Release releases the IP address allocated for the provided ID. It is not an
+// error to release an ID without any allocation.
+func (ipam *IPAM) Release(id string) error {
+	return ipam.withStore(func(store *ipamStore) error {
+		for ip, allocationID := range store.Allocations {
+			if allocationID == id {
+				delete(store.Allocations, ip)
+			}
+		}
+		delete(store.Owners, id)
+		return nil
+	})
+}
+
+// allocated returns the IP address allocated for the provided ID, along with
+// its subnet, if any.
+func (ipam *IPAM) allocated(store *ipamStore, id string) (net.IP, *IPAMSubnet) {
+	for ipString, allocationID := range store.Allocations {
+		if allocationID != id {
+			continue
+		}
+
+		ip := net.ParseIP(ipString)
+		if ip.To4() != nil {
+			ip = ip.To4()
+		}
+
+		for i := range ipam.subnets {
+			if ipam.subnets[i].Subnet.Contains(ip) {
+				return ip, &ipam.subnets[i]
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// withStore calls fn with the contents of the store while holding its lock,
+// and then saves them unless fn fails.
+func (ipam *IPAM) withStore(fn func(*ipamStore) error) error {
+	lockFile, err := os.OpenFile(ipam.storePath+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to open IPAM lock file")
+	}
+	defer lockFile.Close()
+
+	if err := unix.Flock(int(lockFile.Fd()), unix.LOCK_EX); err != nil {
+		return errors.Wrap(err, "failed to lock IPAM store")
+	}
+	defer unix.Flock(int(lockFile.Fd()), unix.LOCK_UN)
+
+	store := ipamStore{
+		Allocations: make(map[string]string),
+		Owners:      make(map[string]ipamOwner),
+	}
+	data, err := ioutil.ReadFile(ipam.storePath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to read IPAM store")
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &store); err != nil {
+			return errors.Wrapf(err, "failed to parse IPAM store %q", ipam.storePath)
+		}
+		if store.Allocations == nil {
+			store.Allocations = make(map[string]string)
+		}
+		if store.Owners == nil {
+			store.Owners = make(map[string]ipamOwner)
+		}
+	}
+
+	if err := fn(&store); err != nil {
+		return err
+	}
+
+	data, err = json.Marshal(store)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode IPAM store")
+	}
+
+	// replace the store atomically, so it is never left half written
+	tmpFile, err := ioutil.TempFile(filepath.Dir(ipam.storePath), filepath.Base(ipam.storePath))
+	if err != nil {
+		return errors.Wrap(err, "failed to create IPAM store")
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write IPAM store")
+	}
+
+	if err := os.Rename(tmpFile.Name(), ipam.storePath); err != nil {
+		return errors.Wrap(err, "failed to save IPAM store")
+	}
+
+	return nil
+}
+
+// freeIP returns the first address of the subnet that can be allocated, or
+// nil if the subnet is full. Only the addresses that are allocated or the
+// gateway are skipped, so the scan is bounded by the number of allocations
+// rather than the size of the subnet, such as an IPv6 /64.
+func (subnet IPAMSubnet) freeIP(store *ipamStore) net.IP {
+	network := subnet.Subnet.IP.Mask(subnet.Subnet.Mask)
+	if network.To4() != nil {
+		network = network.To4()
+	}
+
+	broadcast := make(net.IP, len(network))
+	for i := range network {
+		broadcast[i] = network[i] | ^subnet.Subnet.Mask[len(subnet.Subnet.Mask)-len(network)+i]
+	}
+
+	maxScanned := len(store.Allocations) + 1
+	scanned := 0
+	for ip := nextIP(network); subnet.Subnet.Contains(ip) && scanned <= maxScanned; ip = nextIP(ip) {
+		scanned++
+
+		if !isIPv6(ip) && ip.Equal(broadcast) {
+			break
+		}
+
+		if ip.Equal(subnet.Gateway) {
+			continue
+		}
+
+		if _, ok := store.Allocations[ip.String()]; !ok {
+			return ip
+		}
+	}
+
+	return nil
+}
+
+func (subnet IPAMSubnet) ipConfiguration(ip net.IP) *IPConfiguration {
+	return &IPConfiguration{
+		IPAddr: net.IPNet{
+			IP:   ip,
+			Mask: subnet.Subnet.Mask,
+		},
+		Gateway:     subnet.Gateway,
+		Nameservers: subnet.Nameservers,
+	}
+}
+
+// nextIP returns the address following the provided one.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+
+	return next
+}
+
+// StableMACAddress returns a locally administered unicast MAC address derived
+// from the provided VM ID and network interface index, so that a VM keeps its
+// MAC addresses across restarts.
+func StableMACAddress(vmID string, index int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d", vmID, index)))
+
+	// set the locally administered bit and clear the multicast bit
+	mac := net.HardwareAddr{sum[0]&0xfe | 0x02, sum[1], sum[2], sum[3], sum[4], sum[5]}
+	return mac.String()
+}
@@ -0,0 +1,264 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testIPAMSubnets() []IPAMSubnet {
+	return []IPAMSubnet{
+		{
+			// 192.0.2.1 to 192.0.2.6 can be allocated, except for the gateway
+			Subnet:      net.IPNet{IP: net.IPv4(192, 0, 2, 0), Mask: net.CIDRMask(29, 32)},
+			Gateway:     net.IPv4(192, 0, 2, 3),
+			Nameservers: []string{"192.0.2.53"},
+		},
+		{
+			Subnet:  net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(64, 128)},
+			Gateway: net.ParseIP("2001:db8::1"),
+		},
+	}
+}
+
+func TestIPAMAllocate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestIPAMAllocate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	storePath := filepath.Join(dir, "ipam.json")
+	ipam, err := NewIPAM(storePath, testIPAMSubnets()...)
+	require.NoError(t, err)
+
+	ipConf, err := ipam.Allocate("vm-1")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1/29", ipConf.IPAddr.String())
+	assert.Equal(t, "192.0.2.3", ipConf.Gateway.String())
+	assert.Equal(t, []string{"192.0.2.53"}, ipConf.Nameservers)
+	require.NoError(t, ipConf.validate())
+
+	ipConf, err = ipam.Allocate("vm-1")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1/29", ipConf.IPAddr.String(), "expected allocations to be idempotent")
+
+	// the gateway is skipped
+	ipConf, err = ipam.Allocate("vm-2")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.2/29", ipConf.IPAddr.String())
+
+	ipConf, err = ipam.Allocate("vm-3")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.4/29", ipConf.IPAddr.String())
+
+	ipConf, err = ipam.Allocate("vm-4")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.5/29", ipConf.IPAddr.String())
+
+	ipConf, err = ipam.Allocate("vm-5")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.6/29", ipConf.IPAddr.String())
+
+	// the first subnet is full, the broadcast address is never allocated
+	ipConf, err = ipam.Allocate("vm-6")
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::2/64", ipConf.IPAddr.String())
+	require.NoError(t, ipConf.validate())
+
+	// allocations are shared with other IPAMs using the same store
+	otherIPAM, err := NewIPAM(storePath, testIPAMSubnets()...)
+	require.NoError(t, err)
+
+	require.NoError(t, otherIPAM.Release("vm-2"))
+	require.NoError(t, otherIPAM.Release("unknown-vm"))
+
+	ipConf, err = ipam.Allocate("vm-7")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.2/29", ipConf.IPAddr.String(), "expected released address to be allocated again")
+}
+
+func TestIPAMSubnetFreeIPScansAllocationsOnly(t *testing.T) {
+	subnet := IPAMSubnet{
+		Subnet:  net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(64, 128)},
+		Gateway: net.ParseIP("2001:db8::1"),
+	}
+
+	store := &ipamStore{Allocations: make(map[string]string)}
+	for i := 0; i < 1000; i++ {
+		ip := subnet.freeIP(store)
+		require.NotNil(t, ip)
+		store.Allocations[ip.String()] = fmt.Sprintf("vm-%d", i)
+	}
+	assert.Equal(t, "2001:db8::3ea", subnet.freeIP(store).String(),
+		"expected the address following the allocated ones and the gateway")
+
+	// a full subnet is reported as such
+	subnet = IPAMSubnet{
+		Subnet:  net.IPNet{IP: net.IPv4(192, 0, 2, 0), Mask: net.CIDRMask(30, 32)},
+		Gateway: net.IPv4(192, 0, 2, 1),
+	}
+	store = &ipamStore{Allocations: map[string]string{"192.0.2.2": "vm-0"}}
+	assert.Nil(t, subnet.freeIP(store))
+}
+
+func TestIPAMAllocateConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestIPAMAllocateConcurrently")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	storePath := filepath.Join(dir, "ipam.json")
+	subnet := IPAMSubnet{
+		Subnet:  net.IPNet{IP: net.IPv4(198, 51, 100, 0), Mask: net.CIDRMask(24, 32)},
+		Gateway: net.IPv4(198, 51, 100, 1),
+	}
+
+	const count = 20
+	var wg sync.WaitGroup
+	ips := make([]string, count)
+	errs := make([]error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// each IPAM opens the store on its own, like separate processes
+			ipam, err := NewIPAM(storePath, subnet)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			ipConf, err := ipam.Allocate(fmt.Sprintf("vm-%d", i))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			ips[i] = ipConf.IPAddr.IP.String()
+		}(i)
+	}
+	wg.Wait()
+
+	allocated := make(map[string]struct{})
+	for i := 0; i < count; i++ {
+		require.NoError(t, errs[i])
+		allocated[ips[i]] = struct{}{}
+	}
+	assert.Len(t, allocated, count, "expected every allocation to get a distinct address")
+}
+
+func TestNewIPAMFails(t *testing.T) {
+	_, err := NewIPAM("", testIPAMSubnets()...)
+	assert.Error(t, err, "expected a store path to be required")
+
+	_, err = NewIPAM("/tmp/ipam.json")
+	assert.Error(t, err, "expected a subnet to be required")
+
+	_, err = NewIPAM("/tmp/ipam.json", IPAMSubnet{
+		Subnet: net.IPNet{IP: net.IPv4(192, 0, 2, 0), Mask: net.CIDRMask(24, 32)},
+	})
+	assert.Error(t, err, "expected a gateway to be required for ipv4 subnets")
+}
+
+func TestStableMACAddress(t *testing.T) {
+	mac := StableMACAddress("vm-1", 0)
+	assert.Equal(t, mac, StableMACAddress("vm-1", 0), "expected MAC address to be stable")
+	assert.NotEqual(t, mac, StableMACAddress("vm-1", 1))
+	assert.NotEqual(t, mac, StableMACAddress("vm-2", 0))
+
+	hwAddr, err := net.ParseMAC(mac)
+	require.NoError(t, err)
+	assert.Equal(t, byte(0x02), hwAddr[0]&0x03, "expected a locally administered unicast address")
+}
+
+func TestNetworkInterfacesAllocateIPs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestNetworkInterfacesAllocateIPs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ipam, err := NewIPAM(filepath.Join(dir, "ipam.json"), testIPAMSubnets()...)
+	require.NoError(t, err)
+
+	ipConfiguration := *validIPConfiguration
+	ipConfiguration.IfName = "eth0"
+
+	ipamConf := &StaticNetworkConfiguration{
+		HostDevName: "tap1",
+		IPAM:        &IPAMConfiguration{Allocator: ipam, IfName: "eth1"},
+	}
+	networkInterfaces := NetworkInterfaces{
+		{
+			StaticConfiguration: &StaticNetworkConfiguration{
+				HostDevName:     tapName,
+				MacAddress:      mockMacAddrString,
+				IPConfiguration: &ipConfiguration,
+			},
+		},
+		{
+			StaticConfiguration: ipamConf,
+		},
+	}
+	require.NoError(t, networkInterfaces.validate(KernelArgs{}))
+
+	err, cleanupFuncs := networkInterfaces.allocateIPs("vm-1", "", filepath.Join(dir, "vm-1.sock"))
+	require.NoError(t, err)
+	require.Len(t, cleanupFuncs, 1)
+
+	var store ipamStore
+	require.NoError(t, ipam.withStore(func(s *ipamStore) error {
+		store = *s
+		return nil
+	}))
+	assert.Equal(t, map[string]ipamOwner{
+		"vm-1/1": {TapName: "tap1", SocketPath: filepath.Join(dir, "vm-1.sock")},
+	}, store.Owners, "expected the allocation to record the resources of the VM")
+
+	staticConf := networkInterfaces[1].StaticConfiguration
+	require.NotNil(t, staticConf.IPConfiguration)
+	assert.Equal(t, "192.0.2.1/29", staticConf.IPConfiguration.IPAddr.String())
+	assert.Equal(t, "eth1", staticConf.IPConfiguration.IfName)
+	assert.Equal(t, StableMACAddress("vm-1", 1), staticConf.MacAddress)
+	assert.Nil(t, ipamConf.IPConfiguration, "expected the provided configuration to be left untouched")
+	assert.Equal(t, mockMacAddrString, networkInterfaces[0].StaticConfiguration.MacAddress)
+
+	assert.Contains(t, networkInterfaces.ipBootParams(), ipBootParamPrefix+"eth1")
+
+	require.NoError(t, cleanupFuncs[0]())
+	require.NoError(t, ipam.withStore(func(s *ipamStore) error {
+		assert.Empty(t, s.Owners)
+		return nil
+	}))
+	ipConf, err := ipam.Allocate("vm-2")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1/29", ipConf.IPAddr.String(), "expected the allocation to be released")
+}
+
+func TestNetworkStaticValidationFails_IPAM(t *testing.T) {
+	staticNetworkConfig := StaticNetworkConfiguration{
+		HostDevName: tapName,
+		IPAM:        &IPAMConfiguration{},
+	}
+	assert.Error(t, staticNetworkConfig.validate(), "expected an allocator to be required")
+
+	staticNetworkConfig.IPAM.Allocator = &IPAM{}
+	staticNetworkConfig.IPConfiguration = validIPConfiguration
+	assert.Error(t, staticNetworkConfig.validate(), "expected IPAM and IPConfiguration to be mutually exclusive")
+}
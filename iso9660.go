@@ -0,0 +1,358 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+)
+
+// The functions below write minimal ISO 9660 images holding a few small files
+// in their root directory, such as cloud-init config drives. Besides the
+// primary volume descriptor, which only allows 8.3 uppercase file names, the
+// images have a Joliet supplementary volume descriptor preserving the
+// original file names, which Linux uses by default when mounting.
+//
+// The image layout is fixed:
+//
+//	sectors 0-15   system area, unused
+//	sector  16     primary volume descriptor
+//	sector  17     Joliet supplementary volume descriptor
+//	sector  18     volume descriptor set terminator
+//	sectors 19-20  little and big endian path tables of the primary volume
+//	sectors 21-22  little and big endian path tables of the Joliet volume
+//	sector  23     root directory of the primary volume
+//	sector  24     root directory of the Joliet volume
+//	sectors 25-    file contents, each starting on a new sector
+
+const (
+	isoSectorSize = 2048
+
+	isoPrimaryDescriptorSector = 16
+	isoJolietDescriptorSector  = 17
+	isoTerminatorSector        = 18
+	isoPrimaryPathTableSector  = 19
+	isoJolietPathTableSector   = 21
+	isoPrimaryRootSector       = 23
+	isoJolietRootSector        = 24
+	isoFirstFileSector         = 25
+
+	// isoPathTableSize is the size of a path table holding only the root
+	// directory
+	isoPathTableSize = 10
+
+	// maxJolietNameLength is the maximum number of UCS-2 characters of a
+	// Joliet file name
+	maxJolietNameLength = 64
+)
+
+type isoFile struct {
+	name       string
+	data       []byte
+	sector     uint32
+	primaryID  []byte
+	jolietName []byte
+}
+
+// writeISO9660 writes an ISO 9660 image with the provided volume label and
+// files to path.
+func writeISO9660(path, label string, files map[string][]byte) error {
+	image, err := buildISO9660(label, files, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, image, 0644)
+}
+
+func buildISO9660(label string, files map[string][]byte, modTime time.Time) ([]byte, error) {
+	isoFiles, err := isoFilesFrom(files)
+	if err != nil {
+		return nil, err
+	}
+
+	// allocate the sectors of the file contents
+	sector := uint32(isoFirstFileSector)
+	for _, f := range isoFiles {
+		if len(f.data) == 0 {
+			continue
+		}
+
+		f.sector = sector
+		sector += uint32((len(f.data) + isoSectorSize - 1) / isoSectorSize)
+	}
+	totalSectors := sector
+
+	primaryRoot, err := isoRootDirectory(isoFiles, isoPrimaryRootSector, modTime, func(f *isoFile) []byte {
+		return f.primaryID
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	jolietRoot, err := isoRootDirectory(isoFiles, isoJolietRootSector, modTime, func(f *isoFile) []byte {
+		return f.jolietName
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	image := make([]byte, int(totalSectors)*isoSectorSize)
+	sectorAt := func(n int) []byte {
+		return image[n*isoSectorSize : (n+1)*isoSectorSize]
+	}
+
+	copy(sectorAt(isoPrimaryDescriptorSector),
+		isoVolumeDescriptor(false, label, totalSectors, isoPrimaryPathTableSector, isoPrimaryRootSector, modTime))
+	copy(sectorAt(isoJolietDescriptorSector),
+		isoVolumeDescriptor(true, label, totalSectors, isoJolietPathTableSector, isoJolietRootSector, modTime))
+
+	terminator := sectorAt(isoTerminatorSector)
+	terminator[0] = 255
+	copy(terminator[1:], "CD001")
+	terminator[6] = 1
+
+	copy(sectorAt(isoPrimaryPathTableSector), isoPathTable(binary.LittleEndian, isoPrimaryRootSector))
+	copy(sectorAt(isoPrimaryPathTableSector+1), isoPathTable(binary.BigEndian, isoPrimaryRootSector))
+	copy(sectorAt(isoJolietPathTableSector), isoPathTable(binary.LittleEndian, isoJolietRootSector))
+	copy(sectorAt(isoJolietPathTableSector+1), isoPathTable(binary.BigEndian, isoJolietRootSector))
+
+	copy(sectorAt(isoPrimaryRootSector), primaryRoot)
+	copy(sectorAt(isoJolietRootSector), jolietRoot)
+
+	for _, f := range isoFiles {
+		copy(image[int(f.sector)*isoSectorSize:], f.data)
+	}
+
+	return image, nil
+}
+
+// isoFilesFrom computes the primary and Joliet names of the files.
+func isoFilesFrom(files map[string][]byte) ([]*isoFile, error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var isoFiles []*isoFile
+	primaryIDs := make(map[string]struct{})
+	for _, name := range names {
+		if name == "" || strings.Contains(name, "/") {
+			return nil, errors.Errorf("invalid file name %q, only files in the root directory are supported", name)
+		}
+
+		jolietName := utf16.Encode([]rune(name))
+		if len(jolietName) > maxJolietNameLength {
+			return nil, errors.Errorf("file name %q is longer than %d characters", name, maxJolietNameLength)
+		}
+
+		f := &isoFile{
+			name:       name,
+			data:       files[name],
+			primaryID:  []byte(isoPrimaryID(name, primaryIDs)),
+			jolietName: make([]byte, 2*len(jolietName)),
+		}
+		for i, c := range jolietName {
+			binary.BigEndian.PutUint16(f.jolietName[2*i:], c)
+		}
+
+		isoFiles = append(isoFiles, f)
+	}
+
+	return isoFiles, nil
+}
+
+// isoPrimaryID returns a unique 8.3 file identifier made of d-characters
+// (uppercase letters, digits and underscores) for the provided name.
+func isoPrimaryID(name string, used map[string]struct{}) string {
+	dChars := func(s string, length int) string {
+		var b strings.Builder
+		for _, c := range strings.ToUpper(s) {
+			if (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+				b.WriteRune(c)
+			} else {
+				b.WriteRune('_')
+			}
+		}
+
+		if b.Len() > length {
+			return b.String()[:length]
+		}
+		return b.String()
+	}
+
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	base, ext = dChars(base, 8), dChars(ext, 3)
+
+	id := base + "." + ext + ";1"
+	for n := 1; ; n++ {
+		if _, ok := used[id]; !ok {
+			break
+		}
+
+		// replace the end of the base name with a counter until it is unique
+		suffix := fmt.Sprintf("%d", n)
+		prefix := base
+		if len(prefix)+len(suffix) > 8 {
+			prefix = prefix[:8-len(suffix)]
+		}
+		id = prefix + suffix + "." + ext + ";1"
+	}
+	used[id] = struct{}{}
+
+	return id
+}
+
+// isoRootDirectory returns the records of the root directory, which must fit
+// in a single sector.
+func isoRootDirectory(files []*isoFile, sector uint32, modTime time.Time, nameOf func(*isoFile) []byte) ([]byte, error) {
+	sorted := make([]*isoFile, len(files))
+	copy(sorted, files)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(nameOf(sorted[i]), nameOf(sorted[j])) < 0
+	})
+
+	var dir bytes.Buffer
+	dir.Write(isoDirectoryRecord([]byte{0}, sector, isoSectorSize, true, modTime))
+	dir.Write(isoDirectoryRecord([]byte{1}, sector, isoSectorSize, true, modTime))
+	for _, f := range sorted {
+		dir.Write(isoDirectoryRecord(nameOf(f), f.sector, uint32(len(f.data)), false, modTime))
+	}
+
+	if dir.Len() > isoSectorSize {
+		return nil, errors.Errorf("too many files, the root directory must fit in %d bytes", isoSectorSize)
+	}
+
+	return dir.Bytes(), nil
+}
+
+func isoDirectoryRecord(id []byte, sector, size uint32, isDir bool, modTime time.Time) []byte {
+	length := 33 + len(id)
+	if length%2 == 1 {
+		length++
+	}
+
+	record := make([]byte, length)
+	record[0] = byte(length)
+	putBothEndian32(record[2:], sector)
+	putBothEndian32(record[10:], size)
+
+	record[18] = byte(modTime.Year() - 1900)
+	record[19] = byte(modTime.Month())
+	record[20] = byte(modTime.Day())
+	record[21] = byte(modTime.Hour())
+	record[22] = byte(modTime.Minute())
+	record[23] = byte(modTime.Second())
+
+	if isDir {
+		record[25] = 2
+	}
+	putBothEndian16(record[28:], 1)
+	record[32] = byte(len(id))
+	copy(record[33:], id)
+
+	return record
+}
+
+func isoVolumeDescriptor(joliet bool, label string, totalSectors, pathTableSector, rootSector uint32, modTime time.Time) []byte {
+	descriptor := make([]byte, isoSectorSize)
+	descriptor[0] = 1
+	if joliet {
+		descriptor[0] = 2
+	}
+	copy(descriptor[1:], "CD001")
+	descriptor[6] = 1
+
+	putString := func(offset, length int, s string) {
+		field := descriptor[offset : offset+length]
+		if !joliet {
+			copy(field, strings.Repeat(" ", length))
+			copy(field, s)
+			return
+		}
+
+		ucs2 := utf16.Encode([]rune(s))
+		for i := 0; i+1 < length; i += 2 {
+			c := uint16(' ')
+			if i/2 < len(ucs2) {
+				c = ucs2[i/2]
+			}
+			binary.BigEndian.PutUint16(field[i:], c)
+		}
+	}
+
+	putString(8, 32, "")
+	putString(40, 32, label)
+	putBothEndian32(descriptor[80:], totalSectors)
+	if joliet {
+		// UCS-2 level 3 escape sequence
+		copy(descriptor[88:], "%/E")
+	}
+	putBothEndian16(descriptor[120:], 1)
+	putBothEndian16(descriptor[124:], 1)
+	putBothEndian16(descriptor[128:], isoSectorSize)
+	putBothEndian32(descriptor[132:], isoPathTableSize)
+	binary.LittleEndian.PutUint32(descriptor[140:], pathTableSector)
+	binary.BigEndian.PutUint32(descriptor[148:], pathTableSector+1)
+	copy(descriptor[156:190], isoDirectoryRecord([]byte{0}, rootSector, isoSectorSize, true, modTime))
+
+	putString(190, 128, "")
+	putString(318, 128, "")
+	putString(446, 128, "")
+	putString(574, 128, userAgent)
+	putString(702, 37, "")
+	putString(739, 37, "")
+	putString(776, 37, "")
+
+	timestamp := modTime.Format("20060102150405") + "00"
+	copy(descriptor[813:], timestamp)
+	copy(descriptor[830:], timestamp)
+	copy(descriptor[847:], strings.Repeat("0", 16))
+	copy(descriptor[864:], strings.Repeat("0", 16))
+	descriptor[881] = 1
+
+	return descriptor
+}
+
+// isoPathTable returns a path table holding only the root directory.
+func isoPathTable(order binary.ByteOrder, rootSector uint32) []byte {
+	table := make([]byte, isoPathTableSize)
+	table[0] = 1
+	order.PutUint32(table[2:], rootSector)
+	order.PutUint16(table[6:], 1)
+
+	return table
+}
+
+func putBothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func putBothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
@@ -283,12 +283,7 @@ func (b JailerCommandBuilder) Build(ctx context.Context) *exec.Cmd {
 // Jail will set up proper handlers and remove configuration validation due to
 // stating of files
 func jail(ctx context.Context, m *Machine, cfg *Config) error {
-	jailerWorkspaceDir := ""
-	if len(cfg.JailerCfg.ChrootBaseDir) > 0 {
-		jailerWorkspaceDir = filepath.Join(cfg.JailerCfg.ChrootBaseDir, filepath.Base(cfg.JailerCfg.ExecFile), cfg.JailerCfg.ID, rootfsFolderName)
-	} else {
-		jailerWorkspaceDir = filepath.Join(defaultJailerPath, filepath.Base(cfg.JailerCfg.ExecFile), cfg.JailerCfg.ID, rootfsFolderName)
-	}
+	jailerWorkspaceDir := jailerRootDir(cfg.JailerCfg)
 
 	var machineSocketPath string
 	if cfg.SocketPath != "" {
@@ -345,6 +340,28 @@ func jail(ctx context.Context, m *Machine, cfg *Config) error {
 	return nil
 }
 
+// jailerRootDir returns the host path of the directory the jailer will chroot
+// the Firecracker process into.
+func jailerRootDir(cfg *JailerConfig) string {
+	chrootBaseDir := defaultJailerPath
+	if len(cfg.ChrootBaseDir) > 0 {
+		chrootBaseDir = cfg.ChrootBaseDir
+	}
+
+	return filepath.Join(chrootBaseDir, filepath.Base(cfg.ExecFile), cfg.ID, rootfsFolderName)
+}
+
+// hostPath translates a path as seen by the Firecracker process into a path on
+// the host. When the jailer is used, Firecracker resolves paths relative to its
+// chroot.
+func (m *Machine) hostPath(path string) string {
+	if m.Cfg.JailerCfg == nil {
+		return path
+	}
+
+	return filepath.Join(jailerRootDir(m.Cfg.JailerCfg), path)
+}
+
 func linkFileToRootFS(cfg *JailerConfig, dst, src string) error {
 	if err := os.Link(src, dst); err != nil {
 		return err
@@ -353,6 +370,54 @@ func linkFileToRootFS(cfg *JailerConfig, dst, src string) error {
 	return nil
 }
 
+// linkDriveToRootFS links the drive at hostPath into rootfs, owned by the
+// jailer's UID and GID, and returns its file name within rootfs. A drive that
+// is already linked is reused, and a different file with the same name gets a
+// numbered suffix so drives from different directories do not collide.
+func linkDriveToRootFS(cfg *JailerConfig, rootfs, hostPath string) (string, error) {
+	baseName := filepath.Base(hostPath)
+	driveFileName := baseName
+	for i := 1; ; i++ {
+		dst := filepath.Join(rootfs, driveFileName)
+		err := linkFileToRootFS(cfg, dst, hostPath)
+		if err == nil {
+			break
+		}
+
+		if !os.IsExist(err) {
+			return "", err
+		}
+
+		if linked, err := sameFile(dst, hostPath); err != nil {
+			return "", err
+		} else if linked {
+			break
+		}
+
+		driveFileName = fmt.Sprintf("%s.%d", baseName, i)
+	}
+
+	if err := os.Chown(filepath.Join(rootfs, driveFileName), *cfg.UID, *cfg.GID); err != nil {
+		return "", err
+	}
+
+	return driveFileName, nil
+}
+
+func sameFile(a, b string) (bool, error) {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+
+	return os.SameFile(aInfo, bInfo), nil
+}
+
 // LinkFilesHandler creates a new link files handler that will link files to
 // the rootfs
 func LinkFilesHandler(rootfs, kernelImageFileName string) Handler {
@@ -387,14 +452,8 @@ func LinkFilesHandler(rootfs, kernelImageFileName string) Handler {
 
 			// copy all drives to the root fs
 			for i, drive := range m.Cfg.Drives {
-				hostPath := StringValue(drive.PathOnHost)
-				driveFileName := filepath.Base(hostPath)
-
-				if err := linkFileToRootFS(
-					m.Cfg.JailerCfg,
-					filepath.Join(rootfs, driveFileName),
-					hostPath,
-				); err != nil {
+				driveFileName, err := linkDriveToRootFS(m.Cfg.JailerCfg, rootfs, StringValue(drive.PathOnHost))
+				if err != nil {
 					return err
 				}
 
@@ -448,6 +507,18 @@ func NewNaiveChrootStrategy(rootfs, kernelImagePath string) NaiveChrootStrategy
 	}
 }
 
+// DriveLinker is implemented by chroot strategies that can transfer drives
+// into the jail of a running VM. Machine.UpdateGuestDrive uses it so that
+// drives can be swapped without knowing how the strategy lays out the jail.
+type DriveLinker interface {
+	// LinkDrive makes the drive at hostPath available in the jail of the
+	// machine and returns its path relative to the jail.
+	LinkDrive(m *Machine, hostPath string) (string, error)
+
+	// UnlinkDrive removes a drive path previously returned by LinkDrive.
+	UnlinkDrive(m *Machine, path string) error
+}
+
 // ErrRequiredHandlerMissing occurs when a required handler is not present in
 // the handler list.
 var ErrRequiredHandlerMissing = fmt.Errorf("required handler is missing from FcInit's list")
@@ -465,3 +536,21 @@ func (s NaiveChrootStrategy) AdaptHandlers(handlers *Handlers) error {
 
 	return nil
 }
+
+// LinkDrive will hard link the drive at hostPath to the root drive.
+func (s NaiveChrootStrategy) LinkDrive(m *Machine, hostPath string) (string, error) {
+	if m.Cfg.JailerCfg == nil {
+		return "", ErrMissingJailerConfig
+	}
+
+	return linkDriveToRootFS(m.Cfg.JailerCfg, filepath.Join(s.Rootfs, rootfsFolderName), hostPath)
+}
+
+// UnlinkDrive will remove the link of a drive from the root drive.
+func (s NaiveChrootStrategy) UnlinkDrive(m *Machine, path string) error {
+	if err := os.Remove(filepath.Join(s.Rootfs, rootfsFolderName, path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
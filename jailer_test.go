@@ -2,9 +2,18 @@ package firecracker
 
 import (
 	"context"
+	"errors"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"reflect"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ops "github.com/firecracker-microvm/firecracker-go-sdk/client/operations"
+	"github.com/firecracker-microvm/firecracker-go-sdk/fctesting"
 )
 
 func TestJailerBuilder(t *testing.T) {
@@ -348,3 +357,106 @@ func TestJail(t *testing.T) {
 		})
 	}
 }
+
+func newTestJailedMachine(t *testing.T, dir string) *Machine {
+	t.Helper()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, rootfsFolderName), 0755))
+	return &Machine{
+		Cfg: Config{
+			JailerCfg: &JailerConfig{
+				UID:            Int(os.Getuid()),
+				GID:            Int(os.Getgid()),
+				ChrootStrategy: NewNaiveChrootStrategy(dir, "vmlinux"),
+			},
+		},
+		logger: fctesting.NewLogEntry(t),
+	}
+}
+
+func TestNaiveChrootStrategyLinkDrive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestNaiveChrootStrategyLinkDrive")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m := newTestJailedMachine(t, filepath.Join(dir, "jail"))
+	strategy := m.Cfg.JailerCfg.ChrootStrategy.(NaiveChrootStrategy)
+
+	for _, name := range []string{"a", "b"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name, "data.img"), []byte(name), 0600))
+	}
+
+	path, err := strategy.LinkDrive(m, filepath.Join(dir, "a", "data.img"))
+	require.NoError(t, err)
+	assert.Equal(t, "data.img", path)
+
+	path, err = strategy.LinkDrive(m, filepath.Join(dir, "a", "data.img"))
+	require.NoError(t, err)
+	assert.Equal(t, "data.img", path, "linked drives should be reused")
+
+	path, err = strategy.LinkDrive(m, filepath.Join(dir, "b", "data.img"))
+	require.NoError(t, err)
+	assert.Equal(t, "data.img.1", path, "drives with the same name should not collide")
+
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "jail", rootfsFolderName, path))
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(contents))
+
+	_, err = strategy.LinkDrive(m, filepath.Join(dir, "missing.img"))
+	assert.Error(t, err)
+
+	require.NoError(t, strategy.UnlinkDrive(m, path))
+	_, err = os.Stat(filepath.Join(dir, "jail", rootfsFolderName, path))
+	assert.True(t, os.IsNotExist(err), "expected link to be removed, got %v", err)
+	assert.FileExists(t, filepath.Join(dir, "b", "data.img"))
+	assert.NoError(t, strategy.UnlinkDrive(m, path))
+}
+
+func TestUpdateGuestDriveJailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestUpdateGuestDriveJailed")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	jailRoot := filepath.Join(dir, "jail", rootfsFolderName)
+	m := newTestJailedMachine(t, filepath.Join(dir, "jail"))
+	for _, name := range []string{"vmlinux", "root.img", "data-1.img", "data-2.img", "data-3.img"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), nil, 0600))
+	}
+	m.Cfg.Drives = NewDrivesBuilder(filepath.Join(dir, "root.img")).
+		AddDrive(filepath.Join(dir, "data-1.img"), false).
+		Build()
+	require.NoError(t, LinkFilesHandler(jailRoot, "vmlinux").Fn(context.Background(), &Machine{
+		Cfg: Config{
+			KernelImagePath: filepath.Join(dir, "vmlinux"),
+			Drives:          m.Cfg.Drives,
+			JailerCfg:       m.Cfg.JailerCfg,
+		},
+	}))
+	assert.Equal(t, "data-1.img", StringValue(m.Cfg.Drives[0].PathOnHost))
+
+	var patched []string
+	var patchErr error
+	m.client = NewClient("socket-path", fctesting.NewLogEntry(t), true, WithOpsClient(&fctesting.MockClient{
+		PatchGuestDriveByIDFn: func(params *ops.PatchGuestDriveByIDParams) (*ops.PatchGuestDriveByIDNoContent, error) {
+			patched = append(patched, params.Body.PathOnHost)
+			return &ops.PatchGuestDriveByIDNoContent{}, patchErr
+		},
+	}))
+
+	driveID := StringValue(m.Cfg.Drives[0].DriveID)
+	require.NoError(t, m.UpdateGuestDrive(context.Background(), driveID, filepath.Join(dir, "data-2.img")))
+	assert.Equal(t, []string{"data-2.img"}, patched, "drives should be patched with their path in the jail")
+	assert.Equal(t, "data-2.img", StringValue(m.Cfg.Drives[0].PathOnHost))
+	assert.FileExists(t, filepath.Join(jailRoot, "data-2.img"))
+	_, err = os.Stat(filepath.Join(jailRoot, "data-1.img"))
+	assert.True(t, os.IsNotExist(err), "expected the replaced drive to be removed from the jail, got %v", err)
+	assert.FileExists(t, filepath.Join(dir, "data-1.img"))
+
+	patchErr = errors.New("patch failed")
+	assert.Error(t, m.UpdateGuestDrive(context.Background(), driveID, filepath.Join(dir, "data-3.img")))
+	assert.Equal(t, "data-2.img", StringValue(m.Cfg.Drives[0].PathOnHost))
+	assert.FileExists(t, filepath.Join(jailRoot, "data-2.img"))
+	_, err = os.Stat(filepath.Join(jailRoot, "data-3.img"))
+	assert.True(t, os.IsNotExist(err), "expected the failed drive to be removed from the jail, got %v", err)
+}
@@ -13,46 +13,235 @@
 
 package firecracker
 
-import "strings"
+import (
+	"strconv"
+	"strings"
+)
 
-// kernelArgs serializes+deserializes kernel boot parameters from/into a map.
-// Kernel docs: https://www.kernel.org/doc/Documentation/admin-guide/kernel-parameters.txt
+// kernelArgsSeparator separates the kernel parameters from the arguments
+// passed to init.
+const kernelArgsSeparator = "--"
+
+// KernelArg is a single kernel boot parameter.
 //
-// "key=value" will result in map["key"] = &"value"
-// "key=" will result in map["key"] = &""
-// "key" will result in map["key"] = nil
-type kernelArgs map[string]*string
-
-// serialize the kernelArgs back to a string that can be provided
-// to the kernel
-func (kargs kernelArgs) String() string {
-	var fields []string
-	for key, value := range kargs {
-		field := key
-		if value != nil {
-			field += "=" + *value
-		}
-		fields = append(fields, field)
+// "key=value" is represented as KernelArg{Key: "key", Value: &"value"}
+// "key=" is represented as KernelArg{Key: "key", Value: &""}
+// "key" is represented as KernelArg{Key: "key", Value: nil}
+type KernelArg struct {
+	Key   string
+	Value *string
+}
+
+// String returns the parameter as it appears on the kernel command line,
+// quoting its value if it contains spaces.
+func (arg KernelArg) String() string {
+	if arg.Value == nil {
+		return arg.Key
 	}
-	return strings.Join(fields, " ")
+
+	return arg.Key + "=" + quoteKernelArg(*arg.Value)
 }
 
-// deserialize the provided string to a kernelArgs map
-func parseKernelArgs(rawString string) kernelArgs {
-	argMap := make(map[string]*string)
-	for _, kv := range strings.Fields(rawString) {
-		// only split into up to 2 fields (before and after the first "=")
-		kvSplit := strings.SplitN(kv, "=", 2)
+// KernelArgs is a kernel command line. Unlike a map of parameters, it keeps
+// the parameters in order, including any duplicates such as several
+// "console=" parameters, along with the arguments passed to init after "--".
+// Kernel docs: https://www.kernel.org/doc/Documentation/admin-guide/kernel-parameters.txt
+type KernelArgs struct {
+	// Args are the kernel parameters, in order.
+	Args []KernelArg
+
+	// InitArgs are the arguments passed to init, which follow "--" on the
+	// command line.
+	InitArgs []string
+}
 
-		key := kvSplit[0]
+// ParseKernelArgs parses a kernel command line. As done by the kernel, double
+// quotes allow values to contain spaces and are removed, and everything after
+// "--" is an argument to init.
+func ParseKernelArgs(rawString string) KernelArgs {
+	var kargs KernelArgs
+
+	fields := splitKernelArgs(rawString)
+	for i, field := range fields {
+		if field == kernelArgsSeparator {
+			kargs.InitArgs = append(kargs.InitArgs, fields[i+1:]...)
+			break
+		}
+
+		// only split into up to 2 fields (before and after the first "=")
+		kvSplit := strings.SplitN(field, "=", 2)
 
 		var value *string
 		if len(kvSplit) == 2 {
 			value = &kvSplit[1]
 		}
 
-		argMap[key] = value
+		kargs.Args = append(kargs.Args, KernelArg{Key: kvSplit[0], Value: value})
+	}
+
+	return kargs
+}
+
+// String serializes the kernel command line so that it can be provided to the
+// kernel.
+func (kargs KernelArgs) String() string {
+	fields := make([]string, 0, len(kargs.Args)+len(kargs.InitArgs)+1)
+	for _, arg := range kargs.Args {
+		fields = append(fields, arg.String())
+	}
+
+	if len(kargs.InitArgs) > 0 {
+		fields = append(fields, kernelArgsSeparator)
+		for _, initArg := range kargs.InitArgs {
+			if initArg == "" {
+				initArg = `""`
+			}
+			fields = append(fields, quoteKernelArg(initArg))
+		}
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// Get returns the value of the last parameter with the given key, which is the
+// one that takes effect for most parameters, and whether there is any. The
+// value is nil for parameters without one.
+func (kargs KernelArgs) Get(key string) (*string, bool) {
+	for i := len(kargs.Args) - 1; i >= 0; i-- {
+		if kargs.Args[i].Key == key {
+			return kargs.Args[i].Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// Has returns whether there is any parameter with the given key.
+func (kargs KernelArgs) Has(key string) bool {
+	_, ok := kargs.Get(key)
+	return ok
+}
+
+// Add appends a parameter, keeping any others with the same key.
+func (kargs *KernelArgs) Add(key string, value *string) {
+	kargs.Args = append(kargs.Args, KernelArg{Key: key, Value: value})
+}
+
+// Set sets the value of the parameter with the given key, replacing the first
+// parameter with that key and removing the others, or else appending it.
+func (kargs *KernelArgs) Set(key string, value *string) {
+	args := make([]KernelArg, 0, len(kargs.Args))
+	found := false
+	for _, arg := range kargs.Args {
+		if arg.Key != key {
+			args = append(args, arg)
+			continue
+		}
+
+		if !found {
+			args = append(args, KernelArg{Key: key, Value: value})
+			found = true
+		}
+	}
+	kargs.Args = args
+
+	if !found {
+		kargs.Add(key, value)
+	}
+}
+
+// Delete removes all the parameters with the given key.
+func (kargs *KernelArgs) Delete(key string) {
+	args := make([]KernelArg, 0, len(kargs.Args))
+	for _, arg := range kargs.Args {
+		if arg.Key != key {
+			args = append(args, arg)
+		}
+	}
+	kargs.Args = args
+}
+
+// AddConsole adds a "console=" parameter. The kernel writes its messages to
+// all the consoles provided, and uses the last one as /dev/console.
+func (kargs *KernelArgs) AddConsole(console string) {
+	kargs.Add("console", String(console))
+}
+
+// SetReboot sets the "reboot=" parameter, such as "k" to reboot through the
+// keyboard controller, which is how Firecracker VMs shut down.
+func (kargs *KernelArgs) SetReboot(mode string) {
+	kargs.Set("reboot", String(mode))
+}
+
+// SetPanic sets the "panic=" parameter, the number of seconds after which
+// the kernel reboots on a panic. 0 waits forever and a negative value reboots
+// immediately.
+func (kargs *KernelArgs) SetPanic(timeout int) {
+	kargs.Set("panic", String(strconv.Itoa(timeout)))
+}
+
+// SetInit sets the "init=" parameter to the given program and replaces the
+// arguments passed to it.
+func (kargs *KernelArgs) SetInit(path string, args ...string) {
+	kargs.Set("init", String(path))
+	kargs.InitArgs = args
+}
+
+// SetRoot sets the "root=" parameter to the given device, and whether it is
+// mounted read-only with the "ro" or "rw" parameter.
+func (kargs *KernelArgs) SetRoot(device string, readOnly bool) {
+	kargs.Set("root", String(device))
+
+	mode, other := "rw", "ro"
+	if readOnly {
+		mode, other = other, mode
+	}
+	kargs.Delete(other)
+	kargs.Set(mode, nil)
+}
+
+// SetIP sets the "ip=" parameter, which configures the IP configuration of an
+// interface at boot, in the format of
+// https://www.kernel.org/doc/Documentation/filesystems/nfs/nfsroot.txt
+func (kargs *KernelArgs) SetIP(value string) {
+	kargs.Set("ip", String(value))
+}
+
+// splitKernelArgs splits a kernel command line into its fields, handling
+// double quotes as the kernel does.
+func splitKernelArgs(rawString string) []string {
+	var fields []string
+	var field strings.Builder
+	inField, inQuote := false, false
+	for _, c := range rawString {
+		switch {
+		case c == '"':
+			inField = true
+			inQuote = !inQuote
+		case !inQuote && (c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			inField = true
+			field.WriteRune(c)
+		}
+	}
+
+	if inField {
+		fields = append(fields, field.String())
+	}
+
+	return fields
+}
+
+// quoteKernelArg quotes s if it contains whitespace.
+func quoteKernelArg(s string) string {
+	if strings.IndexAny(s, " \t\n\r\v\f") < 0 {
+		return s
 	}
 
-	return argMap
+	return `"` + s + `"`
 }
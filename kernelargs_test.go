@@ -17,6 +17,7 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -34,19 +35,76 @@ func TestKernelArgsSerder(t *testing.T) {
 		booVal,
 	)
 
-	expectedParsedArgs := kernelArgs(map[string]*string{
-		"foo":  &fooVal,
-		"doo":  &dooVal,
-		"blah": nil,
-		"huh":  &emptyVal,
-		"bleh": nil,
-		"duh":  &emptyVal,
-		"boo":  &booVal,
-	})
-
-	actualParsedArgs := parseKernelArgs(argsString)
+	expectedParsedArgs := KernelArgs{
+		Args: []KernelArg{
+			{Key: "foo", Value: &fooVal},
+			{Key: "blah", Value: nil},
+			{Key: "doo", Value: &dooVal},
+			{Key: "huh", Value: &emptyVal},
+			{Key: "bleh", Value: nil},
+			{Key: "duh", Value: &emptyVal},
+			{Key: "boo", Value: &booVal},
+		},
+	}
+
+	actualParsedArgs := ParseKernelArgs(argsString)
 	require.Equal(t, expectedParsedArgs, actualParsedArgs, "kernel args parsed to unexpected values")
+	require.Equal(t, argsString, actualParsedArgs.String(), "serializing kernel args did not preserve their order")
 
-	reparsedArgs := parseKernelArgs(actualParsedArgs.String())
+	reparsedArgs := ParseKernelArgs(actualParsedArgs.String())
 	require.Equal(t, expectedParsedArgs, reparsedArgs, "serializing and deserializing kernel args did not result in same value")
 }
+
+func TestKernelArgsDuplicatesAndInitArgs(t *testing.T) {
+	argsString := `console=tty0 console=ttyS0 dyndbg="file foo.c +p" init=/sbin/init -- --verbose "two words" ""`
+
+	kargs := ParseKernelArgs(argsString)
+	assert.Equal(t, []KernelArg{
+		{Key: "console", Value: String("tty0")},
+		{Key: "console", Value: String("ttyS0")},
+		{Key: "dyndbg", Value: String("file foo.c +p")},
+		{Key: "init", Value: String("/sbin/init")},
+	}, kargs.Args)
+	assert.Equal(t, []string{"--verbose", "two words", ""}, kargs.InitArgs)
+	assert.Equal(t, argsString, kargs.String())
+
+	console, ok := kargs.Get("console")
+	require.True(t, ok)
+	assert.Equal(t, "ttyS0", StringValue(console), "the last parameter should take effect")
+
+	_, ok = kargs.Get("ip")
+	assert.False(t, ok)
+}
+
+func TestKernelArgsHelpers(t *testing.T) {
+	kargs := ParseKernelArgs("console=ttyS0 reboot=t panic=0 ro ip=dhcp")
+
+	kargs.AddConsole("tty0")
+	kargs.SetReboot("k")
+	kargs.SetPanic(1)
+	kargs.SetRoot("/dev/vda", false)
+	kargs.SetIP("off")
+	kargs.SetInit("/init", "arg1", "arg2")
+	kargs.Add("pci", String("off"))
+
+	assert.Equal(t,
+		"console=ttyS0 reboot=k panic=1 ip=off console=tty0 root=/dev/vda rw init=/init pci=off -- arg1 arg2",
+		kargs.String())
+
+	kargs.SetRoot("/dev/vdb", true)
+	kargs.Delete("console")
+	assert.Equal(t,
+		"reboot=k panic=1 ip=off root=/dev/vdb init=/init pci=off ro -- arg1 arg2",
+		kargs.String())
+	assert.True(t, kargs.Has("ro"))
+	assert.False(t, kargs.Has("rw"))
+}
+
+func TestKernelArgsSetDoesNotAlias(t *testing.T) {
+	kargs := ParseKernelArgs("a=1 b=2 a=3")
+	kargsCopy := kargs
+
+	kargs.Set("a", String("4"))
+	assert.Equal(t, "a=4 b=2", kargs.String())
+	assert.Equal(t, "a=1 b=2 a=3", kargsCopy.String())
+}
@@ -22,6 +22,7 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -100,7 +101,8 @@ type Config struct {
 	InitrdPath string
 
 	// KernelArgs defines the command-line arguments that should be passed to
-	// the kernel.
+	// the kernel. It can be built with KernelArgs.String to keep the order of
+	// the arguments, which is preserved when the SDK adds its own.
 	KernelArgs string
 
 	// Drives specifies BlockDevices that should be made available to the
@@ -157,50 +159,46 @@ type Config struct {
 }
 
 // Validate will ensure that the required fields are set and that
-// the fields are valid values.
+// the fields are valid values. All problems found are returned together as
+// ValidationErrors.
 func (cfg *Config) Validate() error {
 	if cfg.DisableValidation {
 		return nil
 	}
 
-	if _, err := os.Stat(cfg.KernelImagePath); err != nil {
-		return fmt.Errorf("failed to stat kernel image path, %q: %v", cfg.KernelImagePath, err)
-	}
-
-	if cfg.InitrdPath != "" {
-		if _, err := os.Stat(cfg.InitrdPath); err != nil {
-			return fmt.Errorf("failed to stat initrd image path, %q: %v", cfg.InitrdPath, err)
-		}
-	}
+	var errs ValidationErrors
+	cfg.validateFiles(&errs)
+	cfg.validateDrives(&errs)
+	cfg.validateVsocks(&errs)
+	cfg.validateNetworkInterfaceFields(&errs)
+	cfg.validateMachineCfg(&errs)
 
-	for _, drive := range cfg.Drives {
-		if BoolValue(drive.IsRootDevice) {
-			rootPath := StringValue(drive.PathOnHost)
-			if _, err := os.Stat(rootPath); err != nil {
-				return fmt.Errorf("failed to stat host path, %q: %v", rootPath, err)
-			}
+	return errs.ErrorOrNil()
+}
 
-			break
-		}
+// ValidateJailer will ensure that the fields required by the jailer are set
+// and that the remaining fields are valid values. Host files are not checked
+// as they are linked into the jail later on. The jailer configuration is
+// checked even when DisableValidation is set. All problems found are returned
+// together as ValidationErrors.
+func (cfg *Config) ValidateJailer() error {
+	if cfg.JailerCfg == nil {
+		return nil
 	}
 
-	// Check the non-existence of some files:
-	if _, err := os.Stat(cfg.SocketPath); err == nil {
-		return fmt.Errorf("socket %s already exists", cfg.SocketPath)
+	var errs ValidationErrors
+	if cfg.DisableValidation {
+		cfg.validateJailerCfg(&errs)
+		return errs.ErrorOrNil()
 	}
 
-	if cfg.MachineCfg.VcpuCount == nil ||
-		Int64Value(cfg.MachineCfg.VcpuCount) < 1 {
-		return fmt.Errorf("machine needs a nonzero VcpuCount")
-	}
-	if cfg.MachineCfg.MemSizeMib == nil ||
-		Int64Value(cfg.MachineCfg.MemSizeMib) < 1 {
-		return fmt.Errorf("machine needs a nonzero amount of memory")
-	}
-	if cfg.MachineCfg.HtEnabled == nil {
-		return fmt.Errorf("machine needs a setting for ht_enabled")
-	}
-	return nil
+	cfg.validateDrives(&errs)
+	cfg.validateVsocks(&errs)
+	cfg.validateNetworkInterfaceFields(&errs)
+	cfg.validateMachineCfg(&errs)
+	cfg.validateJailerCfg(&errs)
+
+	return errs.ErrorOrNil()
 }
 
 func (cfg *Config) ValidateNetwork() error {
@@ -208,7 +206,7 @@ func (cfg *Config) ValidateNetwork() error {
 		return nil
 	}
 
-	return cfg.NetworkInterfaces.validate(parseKernelArgs(cfg.KernelArgs))
+	return cfg.NetworkInterfaces.validate(ParseKernelArgs(cfg.KernelArgs))
 }
 
 // Machine is the main object for manipulating Firecracker microVMs
@@ -231,6 +229,12 @@ type Machine struct {
 	// callbacks that should be run when the machine is being torn down
 	cleanupOnce  sync.Once
 	cleanupFuncs []func() error
+
+	// console captures the serial console of the guest, if configured
+	console *Console
+
+	// instanceStartTime records when the InstanceStart action succeeded
+	instanceStartTime time.Time
 }
 
 // Logger returns a logrus logger appropriate for logging hypervisor messages
@@ -238,6 +242,12 @@ func (m *Machine) Logger() *log.Entry {
 	return m.logger.WithField("subsystem", userAgent)
 }
 
+// Console returns the console attached to the machine with the WithConsole
+// option, or nil if there is none.
+func (m *Machine) Console() *Console {
+	return m.console
+}
+
 // PID returns the machine's running process PID or an error if not running
 func (m *Machine) PID() (int, error) {
 	if m.cmd == nil || m.cmd.Process == nil {
@@ -309,6 +319,12 @@ func NewMachine(ctx context.Context, cfg Config, opts ...Opt) (*Machine, error)
 	m.Handlers = defaultHandlers
 
 	if cfg.JailerCfg != nil {
+		// jail dereferences the jailer configuration, so it is validated
+		// first, even when validation is disabled
+		if err := cfg.ValidateJailer(); err != nil {
+			return nil, err
+		}
+
 		m.Handlers.Validation = m.Handlers.Validation.Append(JailerConfigValidationHandler)
 		if err := jail(ctx, m, &cfg); err != nil {
 			return nil, err
@@ -359,7 +375,7 @@ func NewMachine(ctx context.Context, cfg Config, opts ...Opt) (*Machine, error)
 	m.machineConfig = cfg.MachineCfg
 	m.Cfg = cfg
 
-	if cfg.NetNS == "" && cfg.NetworkInterfaces.cniInterface() != nil {
+	if cfg.NetNS == "" && len(cfg.NetworkInterfaces.cniInterfaces()) > 0 {
 		m.Cfg.NetNS = m.defaultNetNSPath()
 	}
 
@@ -426,17 +442,91 @@ func (m *Machine) Wait(ctx context.Context) error {
 func (m *Machine) setupNetwork(ctx context.Context) error {
 	err, cleanupFuncs := m.Cfg.NetworkInterfaces.setupNetwork(ctx, m.Cfg.VMID, m.Cfg.NetNS, m.logger)
 	m.cleanupFuncs = append(m.cleanupFuncs, cleanupFuncs...)
+	if err != nil {
+		return err
+	}
+
+	err, cleanupFuncs = m.Cfg.NetworkInterfaces.allocateIPs(m.Cfg.VMID, m.Cfg.NetNS, m.Cfg.SocketPath)
+	m.cleanupFuncs = append(m.cleanupFuncs, cleanupFuncs...)
+	if err != nil {
+		return err
+	}
+
+	// managed taps are owned by the user firecracker runs as by default
+	ownerUID, ownerGID := os.Getuid(), os.Getgid()
+	if m.Cfg.JailerCfg != nil {
+		ownerUID, ownerGID = IntValue(m.Cfg.JailerCfg.UID), IntValue(m.Cfg.JailerCfg.GID)
+	}
+
+	err, cleanupFuncs = m.Cfg.NetworkInterfaces.setupManagedTaps(m.Cfg.NetNS, ownerUID, ownerGID)
+	m.cleanupFuncs = append(m.cleanupFuncs, cleanupFuncs...)
 	return err
 }
 
+// RestoreNetwork restores the network state of a VM that is already running,
+// such as one started by a process that has since crashed or been restarted,
+// for a machine created with the same Config. The results cached by CNI when
+// the VM's networks were set up are read back from each CNI interface's
+// CacheDir, and the static configuration of the interfaces is filled out from
+// them as Start would. The IP configurations allocated from an IPAM for the VM
+// are looked up again from the IPAM's store. The teardown of the networks, of
+// the IPAM allocations, of the managed tap devices and of the network
+// namespace when it was created by the SDK, is registered on the machine to be
+// run by Cleanup.
+func (m *Machine) RestoreNetwork(ctx context.Context) error {
+	if err := m.Cfg.NetworkInterfaces.validate(ParseKernelArgs(m.Cfg.KernelArgs)); err != nil {
+		return err
+	}
+
+	// the netns at the default path is created by setupNetwork, so it's
+	// owned by the VM's networks
+	if len(m.Cfg.NetworkInterfaces.cniInterfaces()) > 0 && m.Cfg.NetNS == m.defaultNetNSPath() {
+		netNSPath := m.Cfg.NetNS
+		m.cleanupFuncs = append(m.cleanupFuncs, func() error {
+			return removeNetNS(netNSPath)
+		})
+	}
+
+	err, cleanupFuncs := m.Cfg.NetworkInterfaces.restoreNetwork(ctx, m.Cfg.VMID, m.Cfg.NetNS, m.logger)
+	m.cleanupFuncs = append(m.cleanupFuncs, cleanupFuncs...)
+	if err != nil {
+		return err
+	}
+
+	// allocations are keyed by the VM ID, so the VM gets back the IP
+	// configurations it was started with
+	err, cleanupFuncs = m.Cfg.NetworkInterfaces.allocateIPs(m.Cfg.VMID, m.Cfg.NetNS, m.Cfg.SocketPath)
+	m.cleanupFuncs = append(m.cleanupFuncs, cleanupFuncs...)
+	if err != nil {
+		return err
+	}
+
+	m.cleanupFuncs = append(m.cleanupFuncs, m.Cfg.NetworkInterfaces.restoreManagedTaps(m.Cfg.NetNS)...)
+	return nil
+}
+
+// Cleanup runs the teardown registered on the machine, such as deleting its
+// CNI networks, in reverse order. It is run once the VMM started by Start
+// exits, so it only needs to be called for machines whose VMM was started
+// elsewhere, such as those restored with RestoreNetwork. Only the first call
+// has any effect.
+func (m *Machine) Cleanup() error {
+	return m.doCleanup()
+}
+
 func (m *Machine) setupKernelArgs(ctx context.Context) error {
-	kernelArgs := parseKernelArgs(m.Cfg.KernelArgs)
+	kernelArgs := ParseKernelArgs(m.Cfg.KernelArgs)
 
 	// If any network interfaces have a static IP configured, we need to set the "ip=" boot param.
 	// Validation that we are not overriding an existing "ip=" setting happens in the network validation
-	if staticIPInterface := m.Cfg.NetworkInterfaces.staticIPInterface(); staticIPInterface != nil {
-		ipBootParam := staticIPInterface.StaticConfiguration.IPConfiguration.ipBootParam()
-		kernelArgs["ip"] = &ipBootParam
+	ipBootParams := m.Cfg.NetworkInterfaces.ipBootParams()
+	keys := make([]string, 0, len(ipBootParams))
+	for key := range ipBootParams {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		kernelArgs.Set(key, String(ipBootParams[key]))
 	}
 
 	m.Cfg.KernelArgs = kernelArgs.String()
@@ -481,6 +571,19 @@ func (m *Machine) defaultNetNSPath() string {
 // startVMM starts the firecracker vmm process and configures logging.
 func (m *Machine) startVMM(ctx context.Context) error {
 	m.logger.Printf("Called startVMM(), setting up a VMM on %s", m.Cfg.SocketPath)
+	var consoleInput *os.File
+	if m.console != nil {
+		var err error
+		if consoleInput, err = m.console.attach(m); err != nil {
+			m.logger.Errorf("Failed to attach console: %s", err)
+
+			m.fatalErr = err
+			close(m.exitCh)
+
+			return err
+		}
+	}
+
 	startCmd := m.cmd.Start
 
 	var err error
@@ -496,6 +599,11 @@ func (m *Machine) startVMM(ctx context.Context) error {
 		err = startCmd()
 	}
 
+	if consoleInput != nil {
+		// the Firecracker process holds its own copy of the console input
+		consoleInput.Close()
+	}
+
 	if err != nil {
 		m.logger.Errorf("Failed to start VMM: %s", err)
 
@@ -820,6 +928,7 @@ func (m *Machine) startInstance(ctx context.Context) error {
 
 	resp, err := m.client.CreateSyncAction(ctx, &info)
 	if err == nil {
+		m.instanceStartTime = time.Now()
 		m.logger.Printf("startInstance successful: %s", resp.Error())
 	} else {
 		m.logger.Errorf("Starting instance: %s", err)
@@ -889,16 +998,84 @@ func (m *Machine) GetMetadata(ctx context.Context, v interface{}) error {
 
 // UpdateGuestDrive will modify the current guest drive of ID index with the new
 // parameters of the partialDrive.
+//
+// When the jailer is used and its ChrootStrategy is a DriveLinker, the drive at
+// pathOnHost is linked into the jail before the update and the link of the
+// drive it replaces is removed afterwards.
 func (m *Machine) UpdateGuestDrive(ctx context.Context, driveID, pathOnHost string, opts ...PatchGuestDriveByIDOpt) error {
-	if _, err := m.client.PatchGuestDriveByID(ctx, driveID, pathOnHost, opts...); err != nil {
+	var linker DriveLinker
+	if m.Cfg.JailerCfg != nil {
+		linker, _ = m.Cfg.JailerCfg.ChrootStrategy.(DriveLinker)
+	}
+
+	drivePath := pathOnHost
+	if linker != nil {
+		var err error
+		if drivePath, err = linker.LinkDrive(m, pathOnHost); err != nil {
+			m.logger.Errorf("Linking drive %s into the jail failed: %v", pathOnHost, err)
+			return err
+		}
+	}
+
+	if _, err := m.client.PatchGuestDriveByID(ctx, driveID, drivePath, opts...); err != nil {
 		m.logger.Errorf("PatchGuestDrive failed: %v", err)
+		if linker != nil && !m.drivePathInUse(drivePath, "") {
+			if err := linker.UnlinkDrive(m, drivePath); err != nil {
+				m.logger.Warnf("Failed to remove drive %s from the jail: %v", drivePath, err)
+			}
+		}
 		return err
 	}
 
+	for i, drive := range m.Cfg.Drives {
+		if StringValue(drive.DriveID) != driveID {
+			continue
+		}
+
+		previousPath := StringValue(drive.PathOnHost)
+		m.Cfg.Drives[i].PathOnHost = String(drivePath)
+		if linker != nil && previousPath != drivePath && !m.drivePathInUse(previousPath, driveID) {
+			if err := linker.UnlinkDrive(m, previousPath); err != nil {
+				m.logger.Warnf("Failed to remove drive %s from the jail: %v", previousPath, err)
+			}
+		}
+		break
+	}
+
 	m.logger.Printf("PatchGuestDrive successful")
 	return nil
 }
 
+// drivePathInUse reports whether a drive other than exceptDriveID is backed by
+// path.
+func (m *Machine) drivePathInUse(path, exceptDriveID string) bool {
+	for _, drive := range m.Cfg.Drives {
+		if StringValue(drive.DriveID) != exceptDriveID && StringValue(drive.PathOnHost) == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UpdateGuestDriveRateLimit modifies the specified drive's rate limiter
+func (m *Machine) UpdateGuestDriveRateLimit(ctx context.Context, driveID string, rateLimiter *models.RateLimiter, opts ...PatchGuestDriveByIDOpt) error {
+	if _, err := m.client.PatchGuestDriveRateLimitByID(ctx, driveID, rateLimiter, opts...); err != nil {
+		m.logger.Errorf("Update drive rate limiter failed: %s: %v", driveID, err)
+		return err
+	}
+
+	for i, drive := range m.Cfg.Drives {
+		if StringValue(drive.DriveID) == driveID {
+			m.Cfg.Drives[i].RateLimiter = rateLimiter
+			break
+		}
+	}
+
+	m.logger.Infof("Updated drive rate limiter: %s", driveID)
+	return nil
+}
+
 // refreshMachineConfiguration synchronizes our cached representation of the machine configuration
 // with that reported by the Firecracker API
 func (m *Machine) refreshMachineConfiguration() error {
@@ -106,6 +106,23 @@ func TestNewMachine(t *testing.T) {
 	}
 }
 
+func TestNewMachineIncompleteJailerConfig(t *testing.T) {
+	_, err := NewMachine(
+		context.Background(),
+		Config{
+			DisableValidation: true,
+			Drives:            NewDrivesBuilder("root.img").Build(),
+			JailerCfg: &JailerConfig{
+				ID:             "my-vm-1",
+				ExecFile:       "/usr/bin/firecracker",
+				ChrootStrategy: NewNaiveChrootStrategy("/srv/jailer", "vmlinux"),
+			},
+		},
+		WithLogger(fctesting.NewLogEntry(t)))
+	require.Error(t, err, "an incomplete jailer configuration should be rejected even when validation is disabled")
+	assert.Equal(t, []string{"JailerCfg.GID", "JailerCfg.UID", "JailerCfg.NumaNode"}, fieldsOf(t, err))
+}
+
 func TestJailerMicroVMExecution(t *testing.T) {
 	if testing.Short() {
 		t.Skip()
@@ -1390,3 +1407,40 @@ func TestSignalForwarding(t *testing.T) {
 
 	assert.ElementsMatch(t, forwardedSignals, receivedSignals)
 }
+
+func TestUpdateGuestDriveRateLimit(t *testing.T) {
+	var body *models.PartialDrive
+	var patchErr error
+	m := &Machine{
+		Cfg: Config{
+			Drives: NewDrivesBuilder("/path/to/rootfs").Build(),
+		},
+		logger: fctesting.NewLogEntry(t),
+	}
+	m.client = NewClient("socket-path", fctesting.NewLogEntry(t), true, WithOpsClient(&fctesting.MockClient{
+		PatchGuestDriveByIDFn: func(params *ops.PatchGuestDriveByIDParams) (*ops.PatchGuestDriveByIDNoContent, error) {
+			assert.Equal(t, rootDriveName, params.DriveID)
+			body = params.Body
+			return &ops.PatchGuestDriveByIDNoContent{}, patchErr
+		},
+	}))
+
+	rateLimiter := NewRateLimiter(
+		TokenBucketBuilder{}.WithBucketSize(1<<20).WithRefillDuration(1000).Build(),
+		TokenBucketBuilder{}.WithBucketSize(100).WithRefillDuration(1000).Build(),
+	)
+	require.NoError(t, m.UpdateGuestDriveRateLimit(context.Background(), rootDriveName, rateLimiter))
+	require.NotNil(t, body)
+	assert.Equal(t, rootDriveName, StringValue(body.DriveID))
+	assert.Empty(t, body.PathOnHost, "the backing file should be left alone")
+	assert.Equal(t, rateLimiter, body.RateLimiter)
+	assert.Equal(t, rateLimiter, m.Cfg.Drives[0].RateLimiter)
+
+	payload, err := body.MarshalBinary()
+	require.NoError(t, err)
+	assert.NotContains(t, string(payload), "path_on_host")
+
+	patchErr = errors.New("patch failed")
+	assert.Error(t, m.UpdateGuestDriveRateLimit(context.Background(), rootDriveName, nil))
+	assert.Equal(t, rateLimiter, m.Cfg.Drives[0].RateLimiter)
+}
@@ -20,6 +20,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	"github.com/containernetworking/cni/libcni"
 	"github.com/containernetworking/cni/pkg/types"
@@ -30,6 +31,7 @@ import (
 	"golang.org/x/sys/unix"
 
 	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/firecracker-microvm/firecracker-go-sdk/cni/hostnet"
 	"github.com/firecracker-microvm/firecracker-go-sdk/cni/vmconf"
 )
 
@@ -41,13 +43,25 @@ const (
 
 // NetworkInterfaces is a slice of NetworkInterface objects that a VM will be
 // configured to use.
+//
+// The IPv4 configuration of the first interface that has any is applied by
+// the guest kernel through the "ip=" boot parameter. Since the kernel supports
+// a single such interface and no IPv6 configuration, the IPv4 configuration of
+// every further interface is passed in a "firecracker.ip.<VM interface name>="
+// boot parameter using the same format, and IPv6 configuration in a
+// "firecracker.ip6.<VM interface name>=" boot parameter, to be applied by the
+// guest.
 type NetworkInterfaces []NetworkInterface
 
-func (networkInterfaces NetworkInterfaces) validate(kernelArgs kernelArgs) error {
+func (networkInterfaces NetworkInterfaces) validate(kernelArgs KernelArgs) error {
+	vmIfNames := make(map[string]struct{})
+	cniIfNames := make(map[string]struct{})
+
 	for _, iface := range networkInterfaces {
 		hasCNI := iface.CNIConfiguration != nil
 		hasStaticInterface := iface.StaticConfiguration != nil
-		hasStaticIP := hasStaticInterface && iface.StaticConfiguration.IPConfiguration != nil
+		hasStaticIP := hasStaticInterface &&
+			(iface.StaticConfiguration.IPConfiguration != nil || iface.StaticConfiguration.IPAM != nil)
 
 		if !hasCNI && !hasStaticInterface {
 			return errors.Errorf(
@@ -65,16 +79,24 @@ func (networkInterfaces NetworkInterfaces) validate(kernelArgs kernelArgs) error
 		}
 
 		if hasCNI || hasStaticIP {
-			// due to limitations of using "ip=" kernel boot param, currently only one network interface can be provided
-			// when a static IP is going to be configured.
-			if len(networkInterfaces) > 1 {
+			if argVal, ok := kernelArgs.Get("ip"); ok {
 				return errors.Errorf(
-					"cannot specify CNIConfiguration or IPConfiguration when multiple network interfaces are provided: %+v", networkInterfaces)
+					`CNIConfiguration or IPConfiguration cannot be specified when "ip=" provided in kernel boot args, value found: "%v"`, StringValue(argVal))
 			}
 
-			if argVal, ok := kernelArgs["ip"]; ok {
-				return errors.Errorf(
-					`CNIConfiguration or IPConfiguration cannot be specified when "ip=" provided in kernel boot args, value found: "%v"`, argVal)
+			// When the VM has several interfaces, IP configuration must name the
+			// interface inside the VM it applies to.
+			if len(networkInterfaces) > 1 {
+				vmIfName := iface.vmIfName()
+				if vmIfName == "" {
+					return errors.Errorf(
+						"VMIfName (CNI) or IPConfiguration.IfName or IPAM.IfName (static) must be set for IP configuration when multiple network interfaces are provided: %+v", iface)
+				}
+
+				if _, ok := vmIfNames[vmIfName]; ok {
+					return errors.Errorf("VM interface name %q is used by more than one network interface", vmIfName)
+				}
+				vmIfNames[vmIfName] = struct{}{}
 			}
 		}
 
@@ -83,6 +105,14 @@ func (networkInterfaces NetworkInterfaces) validate(kernelArgs kernelArgs) error
 			if err != nil {
 				return err
 			}
+
+			// all CNI interfaces are created in the same netns, so they must
+			// not share an IfName
+			if _, ok := cniIfNames[iface.CNIConfiguration.IfName]; ok {
+				return errors.Errorf(
+					"CNI IfName %q is used by more than one network interface", iface.CNIConfiguration.IfName)
+			}
+			cniIfNames[iface.CNIConfiguration.IfName] = struct{}{}
 		}
 
 		if hasStaticInterface {
@@ -96,7 +126,10 @@ func (networkInterfaces NetworkInterfaces) validate(kernelArgs kernelArgs) error
 	return nil
 }
 
-// setupNetwork will invoke CNI if needed for any interfaces
+// setupNetwork will invoke CNI if needed for any interfaces. CNI is invoked
+// for each interface with CNI configuration, in order. If any invocation
+// fails, the returned cleanup functions tear down all of the networks that
+// were set up so far.
 func (networkInterfaces NetworkInterfaces) setupNetwork(
 	ctx context.Context,
 	vmID string,
@@ -105,97 +138,366 @@ func (networkInterfaces NetworkInterfaces) setupNetwork(
 ) (error, []func() error) {
 	var cleanupFuncs []func() error
 
-	// Get the network interface with CNI configuration or, if there is none,
+	// Get the network interfaces with CNI configuration or, if there are none,
 	// just return right away.
-	cniNetworkInterface := networkInterfaces.cniInterface()
-	if cniNetworkInterface == nil {
+	cniNetworkInterfaces := networkInterfaces.cniInterfaces()
+	if len(cniNetworkInterfaces) == 0 {
 		return nil, cleanupFuncs
 	}
 
-	cniNetworkInterface.CNIConfiguration.containerID = vmID
-	cniNetworkInterface.CNIConfiguration.netNSPath = netNSPath
-	cniNetworkInterface.CNIConfiguration.setDefaults()
+	for i, cniNetworkInterface := range cniNetworkInterfaces {
+		cniNetworkInterface.CNIConfiguration.containerID = vmID
+		cniNetworkInterface.CNIConfiguration.netNSPath = netNSPath
+		cniNetworkInterface.CNIConfiguration.setDefaults()
+
+		// Make sure the netns is setup. If the path doesn't yet exist, it will be
+		// initialized with a new empty netns. All interfaces share the netns, so
+		// this only needs to happen once.
+		if i == 0 {
+			err, netnsCleanupFuncs := cniNetworkInterface.CNIConfiguration.initializeNetNS()
+			cleanupFuncs = append(cleanupFuncs, netnsCleanupFuncs...)
+			if err != nil {
+				return errors.Wrap(err, "failed to initialize netns"), cleanupFuncs
+			}
+		}
+
+		err, cniCleanupFuncs := cniNetworkInterface.setupCNI(ctx, logger)
+		cleanupFuncs = append(cleanupFuncs, cniCleanupFuncs...)
+		if err != nil {
+			return err, cleanupFuncs
+		}
+	}
+
+	return nil, cleanupFuncs
+}
+
+// restoreNetwork restores the state of the networks that setupNetwork set up
+// for an already running VM from the results cached by CNI, filling out the
+// static configuration of the network interfaces with CNI configuration in the
+// same way. The returned cleanup functions tear down the restored networks.
+func (networkInterfaces NetworkInterfaces) restoreNetwork(
+	ctx context.Context,
+	vmID string,
+	netNSPath string,
+	logger *log.Entry,
+) (error, []func() error) {
+	var cleanupFuncs []func() error
+
+	for _, cniNetworkInterface := range networkInterfaces.cniInterfaces() {
+		cniNetworkInterface.CNIConfiguration.containerID = vmID
+		cniNetworkInterface.CNIConfiguration.netNSPath = netNSPath
+		cniNetworkInterface.CNIConfiguration.setDefaults()
+
+		err, cniCleanupFuncs := cniNetworkInterface.restoreCNI(ctx, logger)
+		cleanupFuncs = append(cleanupFuncs, cniCleanupFuncs...)
+		if err != nil {
+			return err, cleanupFuncs
+		}
+	}
+
+	return nil, cleanupFuncs
+}
+
+// allocateIPs allocates the IP configuration of the network interfaces with an
+// IPAM configuration, and derives their MAC address from the VM ID unless one
+// is provided. The allocations record the tap device, network namespace and
+// API socket of the VM, so the GarbageCollector can tell whether it runs. The
+// returned cleanup functions release the allocations.
+func (networkInterfaces NetworkInterfaces) allocateIPs(vmID, netNSPath, socketPath string) (error, []func() error) {
+	var cleanupFuncs []func() error
+
+	owner := ipamOwner{NetNS: netNSPath}
+	if socketPath != "" {
+		if absPath, err := filepath.Abs(socketPath); err == nil {
+			owner.SocketPath = absPath
+		}
+	}
+
+	for i := range networkInterfaces {
+		if networkInterfaces[i].StaticConfiguration == nil || networkInterfaces[i].StaticConfiguration.IPAM == nil {
+			continue
+		}
+
+		// fill out a copy, leaving the provided configuration untouched
+		staticConf := *networkInterfaces[i].StaticConfiguration
+		networkInterfaces[i].StaticConfiguration = &staticConf
+
+		allocator := staticConf.IPAM.Allocator
+		allocationID := fmt.Sprintf("%s/%d", vmID, i)
+		// taps in other network namespaces can't be told apart by name
+		ifaceOwner := owner
+		if netNSPath == "" {
+			ifaceOwner.TapName = staticConf.HostDevName
+		}
+
+		ipConf, err := allocator.allocate(allocationID, ifaceOwner)
+		if err != nil {
+			return errors.Wrapf(err, "failed to allocate IP configuration for tap device %q",
+				staticConf.HostDevName), cleanupFuncs
+		}
+
+		cleanupFuncs = append(cleanupFuncs, func() error {
+			return allocator.Release(allocationID)
+		})
+
+		ipConf.IfName = staticConf.IPAM.IfName
+		staticConf.IPConfiguration = ipConf
+		staticConf.IPAM = nil
+
+		if staticConf.MacAddress == "" {
+			staticConf.MacAddress = StableMACAddress(vmID, i)
+		}
+	}
+
+	return nil, cleanupFuncs
+}
+
+// setupManagedTaps creates the tap devices of the network interfaces with a
+// ManagedTap configuration in the network namespace at netNSPath or, if it is
+// blank, in the current one. The provided owner is used for the taps that do
+// not specify one.
+func (networkInterfaces NetworkInterfaces) setupManagedTaps(
+	netNSPath string,
+	ownerUID, ownerGID int,
+) (error, []func() error) {
+	var cleanupFuncs []func() error
+
+	for _, iface := range networkInterfaces {
+		if iface.StaticConfiguration == nil || iface.StaticConfiguration.ManagedTap == nil {
+			continue
+		}
+
+		hostnetConf := iface.StaticConfiguration.ManagedTap.hostnetConfig(
+			iface.StaticConfiguration.HostDevName, ownerUID, ownerGID)
+
+		var teardown func() error
+		err := withNetNSPath(netNSPath, func() error {
+			var err error
+			teardown, err = hostnet.Setup(hostnetConf)
+			return err
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to set up tap device %q", hostnetConf.TapName), cleanupFuncs
+		}
+
+		cleanupFuncs = append(cleanupFuncs, func() error {
+			return withNetNSPath(netNSPath, teardown)
+		})
+	}
+
+	return nil, cleanupFuncs
+}
+
+// restoreManagedTaps returns the cleanup functions tearing down the tap
+// devices of the network interfaces with a ManagedTap configuration, which
+// were set up by setupManagedTaps in the network namespace at netNSPath or, if
+// it is blank, in the current one.
+func (networkInterfaces NetworkInterfaces) restoreManagedTaps(netNSPath string) []func() error {
+	var cleanupFuncs []func() error
+
+	for _, iface := range networkInterfaces {
+		if iface.StaticConfiguration == nil || iface.StaticConfiguration.ManagedTap == nil {
+			continue
+		}
+
+		// the owner of the taps is irrelevant to their teardown
+		hostnetConf := iface.StaticConfiguration.ManagedTap.hostnetConfig(
+			iface.StaticConfiguration.HostDevName, 0, 0)
+
+		cleanupFuncs = append(cleanupFuncs, func() error {
+			return withNetNSPath(netNSPath, func() error {
+				return hostnet.Teardown(hostnetConf)
+			})
+		})
+	}
+
+	return cleanupFuncs
+}
+
+// withNetNSPath calls fn in the network namespace at netNSPath or, if it is
+// blank, in the current one.
+func withNetNSPath(netNSPath string, fn func() error) error {
+	if netNSPath == "" {
+		return fn()
+	}
+
+	return ns.WithNetNSPath(netNSPath, func(_ ns.NetNS) error {
+		return fn()
+	})
+}
 
-	// Make sure the netns is setup. If the path doesn't yet exist, it will be
-	// initialized with a new empty netns.
-	err, netnsCleanupFuncs := cniNetworkInterface.CNIConfiguration.initializeNetNS()
-	cleanupFuncs = append(cleanupFuncs, netnsCleanupFuncs...)
+// setupCNI invokes CNI for the network interface and, unless its static
+// configuration is already set, fills it out from the CNI result.
+func (iface *NetworkInterface) setupCNI(ctx context.Context, logger *log.Entry) (error, []func() error) {
+	cniResult, err, cleanupFuncs := iface.CNIConfiguration.invokeCNI(ctx, logger)
 	if err != nil {
-		return errors.Wrap(err, "failed to initialize netns"), cleanupFuncs
+		return errors.Wrapf(err, "failure when invoking CNI for interface %q", iface.CNIConfiguration.IfName), cleanupFuncs
 	}
 
-	cniResult, err, cniCleanupFuncs := cniNetworkInterface.CNIConfiguration.invokeCNI(ctx, logger)
-	cleanupFuncs = append(cleanupFuncs, cniCleanupFuncs...)
+	return iface.applyCNIResult(*cniResult, logger), cleanupFuncs
+}
+
+// restoreCNI reads back the result cached by CNI when it was invoked for the
+// network interface and, unless its static configuration is already set,
+// fills it out from that result. The returned cleanup functions delete the
+// network.
+func (iface *NetworkInterface) restoreCNI(ctx context.Context, logger *log.Entry) (error, []func() error) {
+	cniResult, err, cleanupFuncs := iface.CNIConfiguration.cachedCNIResult(ctx)
 	if err != nil {
-		return errors.Wrap(err, "failure when invoking CNI"), cleanupFuncs
+		return errors.Wrapf(err, "failed to restore CNI state of interface %q", iface.CNIConfiguration.IfName), cleanupFuncs
 	}
 
+	return iface.applyCNIResult(cniResult, logger), cleanupFuncs
+}
+
+// applyCNIResult fills out the static configuration of the network interface
+// from its CNI result, unless it is already set.
+func (iface *NetworkInterface) applyCNIResult(cniResult types.Result, logger *log.Entry) error {
 	// If static configuration is not already set for the network device, fill it out
 	// by parsing the CNI result object according to the specifications detailed in the
 	// vmconf package docs.
-	if cniNetworkInterface.StaticConfiguration == nil {
-		vmNetConf, err := vmconf.StaticNetworkConfFrom(*cniResult, cniNetworkInterface.CNIConfiguration.containerID)
+	if iface.StaticConfiguration == nil {
+		vmNetConf, err := vmconf.StaticNetworkConfFrom(cniResult, iface.CNIConfiguration.containerID)
 		if err != nil {
 			return errors.Wrap(err,
 				"failed to parse VM network configuration from CNI output, ensure CNI is configured with a plugin "+
 					"that supports automatic VM network configuration such as tc-redirect-tap",
-			), cleanupFuncs
+			)
 		}
 
-		cniNetworkInterface.StaticConfiguration = &StaticNetworkConfiguration{
+		vmNetConf.VMIfName = iface.CNIConfiguration.VMIfName
+		iface.vmNetConf = vmNetConf
+
+		iface.StaticConfiguration = &StaticNetworkConfiguration{
 			HostDevName: vmNetConf.TapName,
 			MacAddress:  vmNetConf.VMMacAddr,
 		}
 
 		if vmNetConf.VMIPConfig != nil {
-			if len(vmNetConf.VMNameservers) > 2 {
-				logger.Warnf("more than 2 nameservers provided from CNI result, only the first 2 %+v will be applied",
-					vmNetConf.VMNameservers[:2])
-				vmNetConf.VMNameservers = vmNetConf.VMNameservers[:2]
-			}
-
-			cniNetworkInterface.StaticConfiguration.IPConfiguration = &IPConfiguration{
+			iface.StaticConfiguration.IPConfiguration = &IPConfiguration{
 				IPAddr:      vmNetConf.VMIPConfig.Address,
 				Gateway:     vmNetConf.VMIPConfig.Gateway,
-				Nameservers: vmNetConf.VMNameservers,
-				IfName:      cniNetworkInterface.CNIConfiguration.VMIfName,
+				Nameservers: limitIPv4Nameservers(vmNetConf.VMNameservers, logger),
+				IfName:      iface.CNIConfiguration.VMIfName,
+			}
+
+			// VMIPConfig is the first IPv4 configuration of dual-stack interfaces,
+			// complemented by their first IPv6 one. The other addresses are only
+			// applied through GuestNetworkConfig.
+			for _, ipConfig := range vmNetConf.VMIPConfigs {
+				if isIPv6(ipConfig.Address.IP) && !isIPv6(vmNetConf.VMIPConfig.Address.IP) {
+					ipv6Addr := ipConfig.Address
+					iface.StaticConfiguration.IPConfiguration.IPv6Addr = &ipv6Addr
+					iface.StaticConfiguration.IPConfiguration.IPv6Gateway = ipConfig.Gateway
+					break
+				}
 			}
 		}
 	}
 
-	return nil, cleanupFuncs
+	return nil
 }
 
-// return the network interface that has CNI configuration, or nil if there is no such interface
-func (networkInterfaces NetworkInterfaces) cniInterface() *NetworkInterface {
-	// Validation that there is at most one CNI interface is done as part of the
-	// NetworkConfigValidationHandler, can safely just use the first result
-	// here and assume it's the only one.
+// limitIPv4Nameservers drops all but the first 2 IPv4 nameservers, the most
+// that can be applied by the kernel.
+func limitIPv4Nameservers(nameservers []string, logger *log.Entry) []string {
+	var limited []string
+	ipv4Count := 0
+	for _, nameserver := range nameservers {
+		if ip := net.ParseIP(nameserver); ip != nil && !isIPv6(ip) {
+			ipv4Count++
+			if ipv4Count > 2 {
+				continue
+			}
+		}
+
+		limited = append(limited, nameserver)
+	}
+
+	if ipv4Count > 2 {
+		logger.Warnf("more than 2 ipv4 nameservers provided from CNI result, only %+v will be applied", limited)
+	}
+
+	return limited
+}
+
+// return the network interfaces that have CNI configuration, in order
+func (networkInterfaces NetworkInterfaces) cniInterfaces() []*NetworkInterface {
+	var ifaces []*NetworkInterface
 	for i, iface := range networkInterfaces {
 		if iface.CNIConfiguration != nil {
-			return &networkInterfaces[i]
+			ifaces = append(ifaces, &networkInterfaces[i])
 		}
 	}
 
-	return nil
+	return ifaces
 }
 
-// return the network interface that has static IP configuration, or nil if there is no such interface
-func (networkInterfaces NetworkInterfaces) staticIPInterface() *NetworkInterface {
-	// Validation that there is at most one interface with StaticIPConfiguration
-	// is done as part of the NetworkConfigValidationHandler, can safely just use
-	// the first result here and assume it's the only one.
-	for i, iface := range networkInterfaces {
-		if iface.StaticConfiguration == nil {
+// ipBootParams returns the kernel boot parameters that configure the IP
+// configuration of the network interfaces inside the VM.
+//
+// The kernel's "ip=" parameter can only configure IPv4 on a single interface,
+// so it is used for the first interface with IPv4 configuration. The IPv4
+// configuration of each further interface is provided in the same format in a
+// "firecracker.ip.<VM interface name>=" parameter. The IPv6 configuration of
+// each interface is provided in a "firecracker.ip6.<VM interface name>="
+// parameter, or "firecracker.ip6=" if the interface name is blank, in the
+// format of vmconf.StaticNetworkConf.IPv6BootParam. The kernel ignores these
+// parameters and leaves them for the guest to apply, for example from an init
+// script reading /proc/cmdline.
+func (networkInterfaces NetworkInterfaces) ipBootParams() map[string]string {
+	params := make(map[string]string)
+	for _, iface := range networkInterfaces {
+		if iface.StaticConfiguration == nil || iface.StaticConfiguration.IPConfiguration == nil {
 			continue
 		}
 
-		if iface.StaticConfiguration.IPConfiguration != nil {
-			return &networkInterfaces[i]
+		ipConf := iface.StaticConfiguration.IPConfiguration
+		if ipBootParam := ipConf.ipBootParam(); ipBootParam != "" {
+			if _, ok := params["ip"]; !ok {
+				params["ip"] = ipBootParam
+			} else {
+				params[ipBootParamPrefix+ipConf.IfName] = ipBootParam
+			}
+		}
+
+		if ipv6BootParam := ipConf.ipv6BootParam(); ipv6BootParam != "" {
+			key := strings.TrimSuffix(ipv6BootParamPrefix, ".")
+			if ipConf.IfName != "" {
+				key = ipv6BootParamPrefix + ipConf.IfName
+			}
+			params[key] = ipv6BootParam
 		}
 	}
 
-	return nil
+	return params
+}
+
+const (
+	// ipBootParamPrefix prefixes the kernel boot parameters holding the IPv4
+	// configuration of the network interfaces beyond the first one.
+	ipBootParamPrefix = "firecracker.ip."
+	// ipv6BootParamPrefix prefixes the kernel boot parameters holding the IPv6
+	// configuration of the network interfaces.
+	ipv6BootParamPrefix = "firecracker.ip6."
+)
+
+// vmIfName returns the name of the interface inside the VM that the network
+// interface's IP configuration applies to, if it is known.
+func (iface NetworkInterface) vmIfName() string {
+	if iface.CNIConfiguration != nil {
+		return iface.CNIConfiguration.VMIfName
+	}
+
+	if iface.StaticConfiguration != nil && iface.StaticConfiguration.IPConfiguration != nil {
+		return iface.StaticConfiguration.IPConfiguration.IfName
+	}
+
+	if iface.StaticConfiguration != nil && iface.StaticConfiguration.IPAM != nil {
+		return iface.StaticConfiguration.IPAM.IfName
+	}
+
+	return ""
 }
 
 // NetworkInterface represents a Firecracker microVM's network interface.
@@ -219,13 +521,21 @@ type NetworkInterface struct {
 
 	// OutRateLimiter limits the outgoing bytes.
 	OutRateLimiter *models.RateLimiter
+
+	// vmNetConf is the VM network configuration parsed from the CNI result. It
+	// holds more than StaticConfiguration can express, such as routes and
+	// search domains.
+	vmNetConf *vmconf.StaticNetworkConf
 }
 
 // CNIConfiguration specifies the CNI parameters that will be used to generate
 // the network namespace and tap device used by a Firecracker interface.
 //
-// Currently, CNIConfiguration can only be specified for VMs that have a
-// single network interface.
+// A VM may have several network interfaces with CNIConfiguration, for
+// example to attach it to separate data and management networks. CNI is
+// invoked for each of them in order, within the same network namespace, so
+// each interface must use a distinct IfName and, to tell apart the interfaces
+// the IP configuration applies to inside the VM, a distinct VMIfName.
 type CNIConfiguration struct {
 	// NetworkName (either NetworkName or NetworkConfig are required)
 	// corresponds to the "name" parameter in the CNI spec's
@@ -251,7 +561,8 @@ type CNIConfiguration struct {
 
 	// VMIfName (optional) sets the interface name in the VM. It is used
 	// to correctly pass IP configuration obtained from the CNI to the VM kernel.
-	// It can be left blank for VMs with single network interface.
+	// It can be left blank for VMs with a single network interface with IP
+	// configuration, and is required for VMs with several network interfaces.
 	VMIfName string
 
 	// Args (optional) corresponds to the CNI_ARGS parameter as specified in
@@ -328,16 +639,9 @@ func (cniConf CNIConfiguration) invokeCNI(ctx context.Context, logger *log.Entry
 
 	cniPlugin := libcni.NewCNIConfigWithCacheDir(cniConf.BinPath, cniConf.CacheDir, nil)
 
-	networkConf := cniConf.NetworkConfig
-
-	var err error
-
-	if networkConf == nil {
-		networkConf, err = libcni.LoadConfList(cniConf.ConfDir, cniConf.NetworkName)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to load CNI configuration from dir %q for network %q",
-				cniConf.ConfDir, cniConf.NetworkName), cleanupFuncs
-		}
+	networkConf, err := cniConf.networkConfList()
+	if err != nil {
+		return nil, err, cleanupFuncs
 	}
 
 	runtimeConf := cniConf.asCNIRuntimeConf()
@@ -381,6 +685,97 @@ func (cniConf CNIConfiguration) invokeCNI(ctx context.Context, logger *log.Entry
 	return &cniResult, nil, cleanupFuncs
 }
 
+// cachedCNIResult returns the result cached by CNI when the network was
+// added. The network is deleted with the configuration and arguments it was
+// added with, when they are cached too, by the returned cleanup functions.
+func (cniConf CNIConfiguration) cachedCNIResult(ctx context.Context) (types.Result, error, []func() error) {
+	var cleanupFuncs []func() error
+
+	cniPlugin := libcni.NewCNIConfigWithCacheDir(cniConf.BinPath, cniConf.CacheDir, nil)
+
+	networkName := cniConf.NetworkName
+	if cniConf.NetworkConfig != nil {
+		networkName = cniConf.NetworkConfig.Name
+	}
+
+	// Prefer the configuration the network was added with, as the one in
+	// ConfDir may have changed since.
+	cachedConf, runtimeConf, err := cniPlugin.GetNetworkListCachedConfig(
+		&libcni.NetworkConfigList{Name: networkName}, cniConf.asCNIRuntimeConf())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read cached CNI configuration of network %q", networkName), cleanupFuncs
+	}
+
+	var networkConf *libcni.NetworkConfigList
+	if cachedConf != nil {
+		networkConf, err = libcni.ConfListFromBytes(cachedConf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse cached CNI configuration of network %q", networkName), cleanupFuncs
+		}
+	} else {
+		// results cached by older versions of CNI hold no configuration
+		networkConf, err = cniConf.networkConfList()
+		if err != nil {
+			return nil, err, cleanupFuncs
+		}
+		runtimeConf = cniConf.asCNIRuntimeConf()
+	}
+
+	cniResult, err := cniPlugin.GetNetworkListCachedResult(networkConf, runtimeConf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read cached CNI result of network %q", networkName), cleanupFuncs
+	}
+
+	if cniResult == nil {
+		return nil, errors.Errorf("no cached CNI result of network %q found in %q for container %q and interface %q",
+			networkName, cniConf.CacheDir, cniConf.containerID, cniConf.IfName), cleanupFuncs
+	}
+
+	cleanupFuncs = append(cleanupFuncs, func() error {
+		// the network is deleted by Cleanup, long after the context used to
+		// restore it may have been cancelled
+		err := cniPlugin.DelNetworkList(context.Background(), networkConf, runtimeConf)
+		if err != nil {
+			return errors.Wrapf(err, "failed to delete CNI network list %q", networkName)
+		}
+		return nil
+	})
+
+	return cniResult, nil, cleanupFuncs
+}
+
+// networkConfList returns the configured network configuration list, loading
+// it from ConfDir if it was specified by name.
+func (cniConf CNIConfiguration) networkConfList() (*libcni.NetworkConfigList, error) {
+	if cniConf.NetworkConfig != nil {
+		return cniConf.NetworkConfig, nil
+	}
+
+	networkConf, err := libcni.LoadConfList(cniConf.ConfDir, cniConf.NetworkName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load CNI configuration from dir %q for network %q",
+			cniConf.ConfDir, cniConf.NetworkName)
+	}
+
+	return networkConf, nil
+}
+
+// removeNetNS unmounts and removes the network namespace mounted at
+// netNSPath by initializeNetNS.
+func removeNetNS(netNSPath string) error {
+	err := unix.Unmount(netNSPath, unix.MNT_DETACH)
+	if err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return errors.Wrapf(err, "failed to unmount netns at %q", netNSPath)
+	}
+
+	err = os.Remove(netNSPath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove netns path %q", netNSPath)
+	}
+
+	return nil
+}
+
 // initializeNetNS checks to see if the netNSPath already exists, if it doesn't it will create
 // a new one mounted at that path.
 func (cniConf CNIConfiguration) initializeNetNS() (error, []func() error) {
@@ -492,6 +887,26 @@ type StaticNetworkConfiguration struct {
 	// IPConfiguration (optional) allows a static IP, gateway and up to 2 DNS nameservers
 	// to be automatically configured within the VM upon startup.
 	IPConfiguration *IPConfiguration
+
+	// ManagedTap (optional) makes the SDK create the tap device named HostDevName when
+	// the VM starts, instead of expecting it to already exist.
+	ManagedTap *ManagedTapConfiguration
+
+	// IPAM (optional) allocates the IPConfiguration when the VM starts, instead of
+	// providing it, and releases it when the VM exits. If MacAddress is blank, a MAC
+	// address derived from the VMID is used.
+	IPAM *IPAMConfiguration
+}
+
+// IPAMConfiguration specifies how the IP configuration of a network interface is
+// allocated.
+type IPAMConfiguration struct {
+	// Allocator the IP configuration is allocated from.
+	Allocator *IPAM
+
+	// IfName (optional) is the name of the interface inside the VM the IP
+	// configuration applies to, as in IPConfiguration.
+	IfName string
 }
 
 func (staticConf StaticNetworkConfiguration) validate() error {
@@ -500,6 +915,23 @@ func (staticConf StaticNetworkConfiguration) validate() error {
 			"HostDevName must be provided if StaticNetworkConfiguration is provided: %+v", staticConf)
 	}
 
+	if staticConf.IPAM != nil {
+		if staticConf.IPAM.Allocator == nil {
+			return errors.Errorf("IPAM Allocator must be provided if IPAM is provided: %+v", staticConf)
+		}
+
+		if staticConf.IPConfiguration != nil {
+			return errors.Errorf("cannot provide both IPConfiguration and IPAM for a network interface: %+v", staticConf)
+		}
+	}
+
+	if staticConf.ManagedTap != nil {
+		err := staticConf.ManagedTap.hostnetConfig(staticConf.HostDevName, 0, 0).Validate()
+		if err != nil {
+			return errors.Wrapf(err, "invalid ManagedTap for tap device %q", staticConf.HostDevName)
+		}
+	}
+
 	if staticConf.IPConfiguration != nil {
 		err := staticConf.IPConfiguration.validate()
 		if err != nil {
@@ -510,51 +942,206 @@ func (staticConf StaticNetworkConfiguration) validate() error {
 	return nil
 }
 
+// ManagedTapConfiguration specifies a tap device created by the SDK in the
+// network namespace of the VM, if any, when the VM starts. The tap can be
+// attached to a bridge, also created by the SDK unless it already exists, with
+// masquerade NAT giving the VM egress connectivity, which requires the iptables
+// command. The tap is removed when the VM exits. The bridges and NAT rules
+// created by the SDK are removed by the VM whose tap was the last one attached
+// to the bridge, while an existing bridge is left in place.
+type ManagedTapConfiguration struct {
+	// MTU (optional) of the tap device and, when it is created, of the bridge.
+	// Defaults to 1500.
+	MTU int
+
+	// OwnerUID (optional) is the user allowed to open the tap device. Defaults
+	// to the UID of the jailer configuration if there is one, or else to the UID
+	// of the current process.
+	OwnerUID *int
+
+	// OwnerGID (optional) is the group allowed to open the tap device. Defaults
+	// to the GID of the jailer configuration if there is one, or else to the GID
+	// of the current process.
+	OwnerGID *int
+
+	// Bridge (optional) attaches the tap device to a bridge.
+	Bridge *ManagedBridgeConfiguration
+}
+
+// ManagedBridgeConfiguration specifies a bridge that managed tap devices are
+// attached to. The same bridge can be shared by several VMs.
+type ManagedBridgeConfiguration struct {
+	// Name of the bridge device.
+	Name string
+
+	// Address (optional) is assigned to the bridge when it is created. It is
+	// generally the gateway of the IPConfiguration of the VMs attached to the
+	// bridge.
+	Address *net.IPNet
+
+	// NAT masquerades the traffic from the subnet of Address leaving the host
+	// through any other device. Address must be an IPv4 address. It enables
+	// IPv4 forwarding on the host, which is left enabled when the VM exits.
+	NAT bool
+}
+
+func (tapConf ManagedTapConfiguration) hostnetConfig(tapName string, ownerUID, ownerGID int) hostnet.Config {
+	if tapConf.OwnerUID != nil {
+		ownerUID = *tapConf.OwnerUID
+	}
+
+	if tapConf.OwnerGID != nil {
+		ownerGID = *tapConf.OwnerGID
+	}
+
+	c := hostnet.Config{
+		TapName:  tapName,
+		MTU:      tapConf.MTU,
+		OwnerUID: ownerUID,
+		OwnerGID: ownerGID,
+	}
+
+	if tapConf.Bridge != nil {
+		c.Bridge = &hostnet.BridgeConfig{
+			Name:    tapConf.Bridge.Name,
+			Address: tapConf.Bridge.Address,
+			NAT:     tapConf.Bridge.NAT,
+		}
+	}
+
+	return c
+}
+
 // IPConfiguration specifies an IP, a gateway and DNS Nameservers that should be configured
-// automatically within the VM upon boot. It currently only supports IPv4 addresses.
+// automatically within the VM upon boot. IPAddr and Gateway may be either IPv4 or IPv6, and
+// an IPv4 configuration can be complemented with an IPv6 address and gateway for dual-stack
+// interfaces.
 //
 // IPConfiguration can specify interface name, in that case config will be applied to the
 // specified interface, if IfName is left blank, config applies to VM with a single network interface.
+// IfName is required for VMs with several network interfaces. Only the IPv4 configuration of the
+// first interface that has one is applied by the kernel; see NetworkInterfaces for how the rest is
+// passed to the VM.
 // The IPAddr and Gateway will be used to assign an IP a a default route for the VM's internal
 // interface.
 //
-// The first 2 nameservers will be configured in the /proc/net/pnp file in a format
+// The first 2 IPv4 nameservers will be configured in the /proc/net/pnp file in a format
 // compatible with /etc/resolv.conf (any further nameservers are currently ignored). VMs that
 // wish to use the nameserver settings here will thus typically need to make /etc/resolv.conf
-// a symlink to /proc/net/pnp
+// a symlink to /proc/net/pnp. IPv6 nameservers are passed to the VM along with the IPv6
+// configuration.
 type IPConfiguration struct {
 	IPAddr      net.IPNet
 	Gateway     net.IP
 	Nameservers []string
 	IfName      string
+
+	// IPv6Addr (optional) is an IPv6 address to assign in addition to an IPv4 IPAddr.
+	IPv6Addr *net.IPNet
+	// IPv6Gateway (optional) is the IPv6 default gateway used along with IPv6Addr.
+	IPv6Gateway net.IP
 }
 
 func (ipConf IPConfiguration) validate() error {
-	// Make sure only ipv4 is being provided (for now).
-	for _, ip := range []net.IP{ipConf.IPAddr.IP, ipConf.Gateway} {
-		if ip.To4() == nil {
-			return errors.Errorf("invalid ip, only ipv4 addresses are supported: %+v", ip)
+	if ipConf.IPAddr.IP == nil {
+		return errors.Errorf("an ip address must be provided: %+v", ipConf)
+	}
+
+	// The gateway must be of the same IP version as the address. IPv6
+	// addresses may go without one, as they can learn routes from router
+	// advertisements.
+	if ipConf.Gateway == nil {
+		if !isIPv6(ipConf.IPAddr.IP) {
+			return errors.Errorf("a gateway must be provided for ipv4 address %+v", ipConf.IPAddr.IP)
 		}
+	} else if isIPv6(ipConf.IPAddr.IP) != isIPv6(ipConf.Gateway) {
+		return errors.Errorf("invalid gateway %+v, it must be of the same IP version as address %+v",
+			ipConf.Gateway, ipConf.IPAddr.IP)
 	}
 
-	if len(ipConf.Nameservers) > 2 {
-		return errors.Errorf("cannot specify more than 2 nameservers: %+v", ipConf.Nameservers)
+	if ipConf.IPv6Addr != nil {
+		if isIPv6(ipConf.IPAddr.IP) {
+			return errors.Errorf("IPv6Addr can only be provided along with an ipv4 IPAddr: %+v", ipConf)
+		}
+
+		if !isIPv6(ipConf.IPv6Addr.IP) {
+			return errors.Errorf("invalid IPv6Addr, only ipv6 addresses are supported: %+v", ipConf.IPv6Addr.IP)
+		}
+	}
+
+	if ipConf.IPv6Gateway != nil {
+		if ipConf.IPv6Addr == nil {
+			return errors.Errorf("IPv6Gateway can only be provided along with IPv6Addr: %+v", ipConf)
+		}
+
+		if !isIPv6(ipConf.IPv6Gateway) {
+			return errors.Errorf("invalid IPv6Gateway, only ipv6 addresses are supported: %+v", ipConf.IPv6Gateway)
+		}
+	}
+
+	var ipv4Nameservers []string
+	for _, nameserver := range ipConf.Nameservers {
+		ip := net.ParseIP(nameserver)
+		if ip == nil {
+			return errors.Errorf("invalid nameserver %q", nameserver)
+		}
+
+		if !isIPv6(ip) {
+			ipv4Nameservers = append(ipv4Nameservers, nameserver)
+		}
+	}
+
+	if len(ipv4Nameservers) > 2 {
+		return errors.Errorf("cannot specify more than 2 ipv4 nameservers: %+v", ipConf.Nameservers)
 	}
 
 	return nil
 }
 
-func (conf IPConfiguration) ipBootParam() string {
-	// the vmconf package already has a function for doing this, just re-use it
-	vmConf := vmconf.StaticNetworkConf{
+// isIPv6 reports whether ip is an IPv6 address. A nil IP is neither IPv4 nor
+// IPv6, so callers accepting one must handle it explicitly.
+func isIPv6(ip net.IP) bool {
+	return ip != nil && ip.To4() == nil
+}
+
+// vmConf converts the IP configuration to the vmconf representation, so its
+// boot parameter helpers can be re-used.
+func (conf IPConfiguration) vmConf() vmconf.StaticNetworkConf {
+	ipConfigs := []*current.IPConfig{ipConfigFor(conf.IPAddr, conf.Gateway)}
+	if conf.IPv6Addr != nil {
+		ipConfigs = append(ipConfigs, ipConfigFor(*conf.IPv6Addr, conf.IPv6Gateway))
+	}
+
+	return vmconf.StaticNetworkConf{
 		VMNameservers: conf.Nameservers,
-		VMIPConfig: &current.IPConfig{
-			Version: "4",
-			Address: conf.IPAddr,
-			Gateway: conf.Gateway,
-		},
-		VMIfName: conf.IfName,
+		VMIPConfig:    ipConfigs[0],
+		VMIPConfigs:   ipConfigs,
+		VMIfName:      conf.IfName,
+	}
+}
+
+func ipConfigFor(addr net.IPNet, gateway net.IP) *current.IPConfig {
+	version := "4"
+	if isIPv6(addr.IP) {
+		version = "6"
 	}
 
-	return vmConf.IPBootParam()
+	return &current.IPConfig{
+		Version: version,
+		Address: addr,
+		Gateway: gateway,
+	}
+}
+
+// ipBootParam returns the "ip=" boot parameter value for the IPv4
+// configuration, or an empty string if there is none.
+func (conf IPConfiguration) ipBootParam() string {
+	// the vmconf package already has a function for doing this, just re-use it
+	return conf.vmConf().IPBootParam()
+}
+
+// ipv6BootParam returns the IPv6 configuration in the format of
+// vmconf.StaticNetworkConf.IPv6BootParam, or an empty string if there is none.
+func (conf IPConfiguration) ipv6BootParam() string {
+	return conf.vmConf().IPv6BootParam()
 }
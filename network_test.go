@@ -15,6 +15,7 @@ package firecracker
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -39,8 +40,8 @@ var (
 	cniNetworkName = "phony-network"
 	mockNetNSPath  = "/my/phony/netns"
 
-	kernelArgsNoIP   = parseKernelArgs("foo=bar this=phony")
-	kernelArgsWithIP = parseKernelArgs("foo=bar this=phony ip=whatevz")
+	kernelArgsNoIP   = ParseKernelArgs("foo=bar this=phony")
+	kernelArgsWithIP = ParseKernelArgs("foo=bar this=phony ip=whatevz")
 
 	// These RFC 5737 IPs are reserved for documentation, they are not usable
 	validIPConfiguration = &IPConfiguration{
@@ -52,14 +53,23 @@ var (
 		Nameservers: []string{"192.0.2.1", "192.0.2.2"},
 	}
 
-	// IPv6 is currently invalid
+	// An IPv6 address with an IPv4 gateway is invalid
 	// These RFC 3849 IPs are reserved for documentation, they are not usable
 	invalidIPConfiguration = &IPConfiguration{
 		IPAddr: net.IPNet{
 			IP:   net.ParseIP("2001:db8:a0b:12f0::2"),
-			Mask: net.CIDRMask(24, 128),
+			Mask: net.CIDRMask(64, 128),
 		},
-		Gateway: net.ParseIP("2001:db8:a0b:12f0::1"),
+		Gateway: net.IPv4(198, 51, 100, 1),
+	}
+
+	validIPv6Configuration = &IPConfiguration{
+		IPAddr: net.IPNet{
+			IP:   net.ParseIP("2001:db8:a0b:12f0::2"),
+			Mask: net.CIDRMask(64, 128),
+		},
+		Gateway:     net.ParseIP("2001:db8:a0b:12f0::1"),
+		Nameservers: []string{"2001:db8::53"},
 	}
 
 	validStaticNetworkInterface = NetworkInterface{
@@ -94,6 +104,51 @@ func TestNetworkStaticValidationFails_HostDevName(t *testing.T) {
 	assert.Error(t, err, "invalid network config hostdevname did not result in validation error")
 }
 
+func TestNetworkStaticValidation_ManagedTap(t *testing.T) {
+	staticNetworkConfig := StaticNetworkConfiguration{
+		MacAddress:      mockMacAddrString,
+		HostDevName:     tapName,
+		IPConfiguration: validIPConfiguration,
+		ManagedTap: &ManagedTapConfiguration{
+			MTU: 9000,
+			Bridge: &ManagedBridgeConfiguration{
+				Name:    "fcbr0",
+				Address: &net.IPNet{IP: net.IPv4(198, 51, 100, 1), Mask: net.CIDRMask(24, 32)},
+				NAT:     true,
+			},
+		},
+	}
+
+	err := staticNetworkConfig.validate()
+	assert.NoError(t, err, "valid managed tap config unexpectedly returned validation error")
+
+	staticNetworkConfig.ManagedTap.Bridge.Address = nil
+	err = staticNetworkConfig.validate()
+	assert.Error(t, err, "NAT without a bridge address did not result in validation error")
+
+	staticNetworkConfig.ManagedTap.Bridge = &ManagedBridgeConfiguration{}
+	err = staticNetworkConfig.validate()
+	assert.Error(t, err, "bridge without a name did not result in validation error")
+}
+
+func TestManagedTapHostnetConfig(t *testing.T) {
+	tapConf := ManagedTapConfiguration{
+		Bridge: &ManagedBridgeConfiguration{Name: "fcbr0"},
+	}
+
+	hostnetConf := tapConf.hostnetConfig(tapName, 123, 456)
+	assert.Equal(t, tapName, hostnetConf.TapName)
+	assert.Equal(t, 123, hostnetConf.OwnerUID, "expected the default owner to be used")
+	assert.Equal(t, 456, hostnetConf.OwnerGID, "expected the default group to be used")
+	assert.Equal(t, "fcbr0", hostnetConf.Bridge.Name)
+
+	tapConf.OwnerUID = Int(1000)
+	tapConf.OwnerGID = Int(1001)
+	hostnetConf = tapConf.hostnetConfig(tapName, 123, 456)
+	assert.Equal(t, 1000, hostnetConf.OwnerUID)
+	assert.Equal(t, 1001, hostnetConf.OwnerGID)
+}
+
 func TestNetworkStaticValidationFails_TooManyNameservers(t *testing.T) {
 	staticNetworkConfig := StaticNetworkConfiguration{
 		MacAddress:  mockMacAddrString,
@@ -123,6 +178,42 @@ func TestNetworkStaticValidationFails_IPConfiguration(t *testing.T) {
 	assert.Error(t, err, "invalid network config hostdevname did not result in validation error")
 }
 
+func TestNetworkStaticValidation_IPv6(t *testing.T) {
+	dualStackIPConfiguration := *validIPConfiguration
+	dualStackIPConfiguration.IPv6Addr = &validIPv6Configuration.IPAddr
+	dualStackIPConfiguration.IPv6Gateway = validIPv6Configuration.Gateway
+	dualStackIPConfiguration.Nameservers = []string{"192.0.2.1", "192.0.2.2", "2001:db8::53"}
+
+	for _, ipConf := range []*IPConfiguration{validIPv6Configuration, &dualStackIPConfiguration} {
+		err := ipConf.validate()
+		assert.NoError(t, err, "valid ipv6 config %+v unexpectedly returned validation error", ipConf)
+	}
+
+	ipv6WithIPv6Addr := *validIPv6Configuration
+	ipv6WithIPv6Addr.IPv6Addr = &validIPv6Configuration.IPAddr
+	assert.Error(t, ipv6WithIPv6Addr.validate(), "IPv6Addr along with ipv6 IPAddr should return validation error")
+
+	ipv4AsIPv6Addr := *validIPConfiguration
+	ipv4AsIPv6Addr.IPv6Addr = &validIPConfiguration.IPAddr
+	assert.Error(t, ipv4AsIPv6Addr.validate(), "ipv4 IPv6Addr should return validation error")
+
+	invalidNameserver := *validIPv6Configuration
+	invalidNameserver.Nameservers = []string{"not-an-ip"}
+	assert.Error(t, invalidNameserver.validate(), "invalid nameserver should return validation error")
+
+	ipv6WithoutGateway := *validIPv6Configuration
+	ipv6WithoutGateway.Gateway = nil
+	assert.NoError(t, ipv6WithoutGateway.validate(), "ipv6 IPAddr without gateway should be valid")
+
+	ipv4WithoutGateway := *validIPConfiguration
+	ipv4WithoutGateway.Gateway = nil
+	assert.Error(t, ipv4WithoutGateway.validate(), "ipv4 IPAddr without gateway should return validation error")
+
+	nilIPv6Addr := *validIPConfiguration
+	nilIPv6Addr.IPv6Addr = &net.IPNet{Mask: net.CIDRMask(64, 128)}
+	assert.Error(t, nilIPv6Addr.validate(), "IPv6Addr without an address should return validation error")
+}
+
 func TestNetworkCNIValidation(t *testing.T) {
 	err := validCNIInterface.CNIConfiguration.validate()
 	assert.NoError(t, err, "valid cni network config unexpectedly returned validation error")
@@ -223,6 +314,130 @@ func TestNetworkInterfacesValidationFails_CNIWithKernelArg(t *testing.T) {
 	assert.Error(t, err, "network interface list with CNI config and IP kernel arg should return validation error")
 }
 
+func TestNetworkInterfacesValidation_MultipleCNIWithNames(t *testing.T) {
+	err := NetworkInterfaces([]NetworkInterface{
+		{
+			CNIConfiguration: &CNIConfiguration{
+				NetworkName: "data",
+				IfName:      "veth0",
+				VMIfName:    "eth0",
+			},
+		},
+		{
+			CNIConfiguration: &CNIConfiguration{
+				NetworkName: "management",
+				IfName:      "veth1",
+				VMIfName:    "eth1",
+			},
+		},
+	}).validate(kernelArgsNoIP)
+	assert.NoError(t, err, "network interface list with multiple named CNI interfaces unexpectedly resulted in validation error")
+}
+
+func TestNetworkInterfacesValidationFails_DuplicateNames(t *testing.T) {
+	namedCNIInterface := func(ifName, vmIfName string) NetworkInterface {
+		return NetworkInterface{
+			CNIConfiguration: &CNIConfiguration{
+				NetworkName: cniNetworkName,
+				IfName:      ifName,
+				VMIfName:    vmIfName,
+			},
+		}
+	}
+
+	err := NetworkInterfaces([]NetworkInterface{
+		namedCNIInterface("veth0", "eth0"),
+		namedCNIInterface("veth1", "eth0"),
+	}).validate(kernelArgsNoIP)
+	assert.Error(t, err, "network interface list with duplicate VMIfName should return validation error")
+
+	err = NetworkInterfaces([]NetworkInterface{
+		namedCNIInterface("veth0", "eth0"),
+		namedCNIInterface("veth0", "eth1"),
+	}).validate(kernelArgsNoIP)
+	assert.Error(t, err, "network interface list with duplicate CNI IfName should return validation error")
+}
+
+func TestNetworkInterfacesIPBootParams(t *testing.T) {
+	secondIPConfiguration := *validIPConfiguration
+	secondIPConfiguration.IPAddr.IP = net.IPv4(203, 0, 113, 2)
+	secondIPConfiguration.Gateway = net.IPv4(203, 0, 113, 1)
+	secondIPConfiguration.Nameservers = nil
+	secondIPConfiguration.IfName = "eth2"
+
+	firstIPConfiguration := *validIPConfiguration
+	firstIPConfiguration.IfName = "eth0"
+
+	params := NetworkInterfaces([]NetworkInterface{
+		{
+			StaticConfiguration: &StaticNetworkConfiguration{
+				HostDevName:     "tap0",
+				IPConfiguration: &firstIPConfiguration,
+			},
+		},
+		{
+			StaticConfiguration: &StaticNetworkConfiguration{
+				HostDevName: "tap1",
+			},
+		},
+		{
+			StaticConfiguration: &StaticNetworkConfiguration{
+				HostDevName:     "tap2",
+				IPConfiguration: &secondIPConfiguration,
+			},
+		},
+	}).ipBootParams()
+
+	assert.Equal(t, map[string]string{
+		"ip":                  "198.51.100.2::198.51.100.1:255.255.255.0::eth0:off:192.0.2.1:192.0.2.2:",
+		"firecracker.ip.eth2": "203.0.113.2::203.0.113.1:255.255.255.0::eth2:off:::",
+	}, params)
+}
+
+func TestNetworkInterfacesIPv6BootParams(t *testing.T) {
+	dualStackIPConfiguration := *validIPConfiguration
+	dualStackIPConfiguration.IfName = "eth1"
+	dualStackIPConfiguration.IPv6Addr = &net.IPNet{
+		IP:   net.ParseIP("2001:db8:1::2"),
+		Mask: net.CIDRMask(64, 128),
+	}
+	dualStackIPConfiguration.IPv6Gateway = net.ParseIP("2001:db8:1::1")
+
+	ipv6IPConfiguration := *validIPv6Configuration
+	ipv6IPConfiguration.IfName = "eth0"
+
+	params := NetworkInterfaces([]NetworkInterface{
+		{
+			StaticConfiguration: &StaticNetworkConfiguration{
+				HostDevName:     "tap0",
+				IPConfiguration: &ipv6IPConfiguration,
+			},
+		},
+		{
+			StaticConfiguration: &StaticNetworkConfiguration{
+				HostDevName:     "tap1",
+				IPConfiguration: &dualStackIPConfiguration,
+			},
+		},
+	}).ipBootParams()
+
+	assert.Equal(t, map[string]string{
+		"ip":                   "198.51.100.2::198.51.100.1:255.255.255.0::eth1:off:192.0.2.1:192.0.2.2:",
+		"firecracker.ip6.eth0": "2001:db8:a0b:12f0::2/64,2001:db8:a0b:12f0::1,2001:db8::53",
+		"firecracker.ip6.eth1": "2001:db8:1::2/64,2001:db8:1::1",
+	}, params)
+
+	params = NetworkInterfaces([]NetworkInterface{{
+		StaticConfiguration: &StaticNetworkConfiguration{
+			HostDevName:     "tap0",
+			IPConfiguration: validIPv6Configuration,
+		},
+	}}).ipBootParams()
+	assert.Equal(t, map[string]string{
+		"firecracker.ip6": "2001:db8:a0b:12f0::2/64,2001:db8:a0b:12f0::1,2001:db8::53",
+	}, params)
+}
+
 func TestNetworkInterfacesValidationFails_NeitherSpecified(t *testing.T) {
 	err := NetworkInterfaces([]NetworkInterface{{}}).validate(kernelArgsNoIP)
 	assert.Error(t, err, "invalid network config with neither static nor cni configuration did not result in validation error")
@@ -239,6 +454,173 @@ func TestNetworkInterfacesValidationFails_BothSpecified(t *testing.T) {
 	assert.Error(t, err, "invalid network config with both static and cni configuration did not result in validation error")
 }
 
+func TestMachineRestoreNetwork(t *testing.T) {
+	fctesting.RequiresRoot(t)
+
+	dir, err := ioutil.TempDir("", "TestMachineRestoreNetwork")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	const vmID = "restored-vm"
+	const ifName = "veth0"
+
+	// the phony plugin records the commands it is invoked with
+	binDir := filepath.Join(dir, "bin")
+	require.NoError(t, os.Mkdir(binDir, 0755))
+	invocationsPath := filepath.Join(dir, "invocations")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(binDir, "phony"), []byte(fmt.Sprintf(
+		"#!/bin/sh\necho \"$CNI_COMMAND $CNI_CONTAINERID $CNI_IFNAME $CNI_ARGS\" >> %s\n", invocationsPath)), 0755))
+
+	networkConf, err := libcni.ConfListFromBytes([]byte(fmt.Sprintf(`{
+  "cniVersion": "0.3.1",
+  "name": "%s",
+  "plugins": [{"type": "phony"}]
+}`, cniNetworkName)))
+	require.NoError(t, err)
+
+	// the result names the tap in the current netns after the loopback device,
+	// which always exists, as the SDK looks up its MTU
+	cacheDir := filepath.Join(dir, "cache")
+	cachePath := filepath.Join(cacheDir, "results", fmt.Sprintf("%s-%s-%s", cniNetworkName, vmID, ifName))
+	require.NoError(t, os.MkdirAll(filepath.Dir(cachePath), 0700))
+	cached, err := json.Marshal(map[string]interface{}{
+		"kind":    "cniCacheV1",
+		"config":  networkConf.Bytes,
+		"cniArgs": [][2]string{{"IgnoreUnknown", "1"}},
+		"results": map[string]interface{}{
+			"cniVersion": "0.3.1",
+			"interfaces": []map[string]interface{}{
+				{"name": "lo", "sandbox": "/proc/self/ns/net"},
+				{"name": "lo", "mac": mockMacAddrString, "sandbox": vmID},
+			},
+			"ips": []map[string]interface{}{
+				{"version": "4", "address": "198.51.100.2/24", "gateway": "198.51.100.1", "interface": 1},
+			},
+			"dns": map[string]interface{}{"nameservers": []string{"192.0.2.1"}},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(cachePath, cached, 0600))
+
+	netNSPath := filepath.Join(dir, "netns")
+	require.NoError(t, ioutil.WriteFile(netNSPath, nil, 0600))
+
+	m, err := NewMachine(context.Background(), Config{
+		VMID:  vmID,
+		NetNS: netNSPath,
+		NetworkInterfaces: NetworkInterfaces{{
+			CNIConfiguration: &CNIConfiguration{
+				NetworkConfig: networkConf,
+				IfName:        ifName,
+				BinPath:       []string{binDir},
+				CacheDir:      cacheDir,
+			},
+		}},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, m.RestoreNetwork(context.Background()))
+
+	staticConf := m.Cfg.NetworkInterfaces[0].StaticConfiguration
+	require.NotNil(t, staticConf)
+	assert.Equal(t, "lo", staticConf.HostDevName)
+	assert.Equal(t, mockMacAddrString, staticConf.MacAddress)
+	require.NotNil(t, staticConf.IPConfiguration)
+	assert.Equal(t, "198.51.100.2/24", staticConf.IPConfiguration.IPAddr.String())
+	assert.Equal(t, "198.51.100.1", staticConf.IPConfiguration.Gateway.String())
+	assert.Equal(t, []string{"192.0.2.1"}, staticConf.IPConfiguration.Nameservers)
+
+	_, err = os.Stat(invocationsPath)
+	assert.True(t, os.IsNotExist(err), "restoring the network must not invoke CNI")
+
+	require.NoError(t, m.Cleanup())
+
+	invocations, err := ioutil.ReadFile(invocationsPath)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("DEL %s %s IgnoreUnknown=1\n", vmID, ifName), string(invocations))
+
+	_, err = os.Stat(cachePath)
+	assert.True(t, os.IsNotExist(err), "the cached result should be removed")
+
+	_, err = os.Stat(netNSPath)
+	assert.NoError(t, err, "a netns that was not created by the SDK should be left in place")
+}
+
+func TestMachineRestoreNetworkFails_NoCachedResult(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMachineRestoreNetworkFails_NoCachedResult")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, cniNetworkName+".conflist"), []byte(fmt.Sprintf(`{
+  "cniVersion": "0.3.1",
+  "name": "%s",
+  "plugins": [{"type": "phony"}]
+}`, cniNetworkName)), 0600))
+
+	m, err := NewMachine(context.Background(), Config{
+		VMID:  "restored-vm",
+		NetNS: mockNetNSPath,
+		NetworkInterfaces: NetworkInterfaces{{
+			CNIConfiguration: &CNIConfiguration{
+				NetworkName: cniNetworkName,
+				IfName:      "veth0",
+				ConfDir:     dir,
+				CacheDir:    dir,
+			},
+		}},
+	})
+	require.NoError(t, err)
+
+	err = m.RestoreNetwork(context.Background())
+	require.Error(t, err, "restoring a network without a cached result should fail")
+	assert.Contains(t, err.Error(), "no cached CNI result")
+	assert.NoError(t, m.Cleanup())
+}
+
+func TestMachineRestoreNetwork_IPAM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMachineRestoreNetwork_IPAM")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ipam, err := NewIPAM(filepath.Join(dir, "ipam.json"), testIPAMSubnets()...)
+	require.NoError(t, err)
+
+	// the allocations made when the VM was started, the first address being
+	// taken by another VM
+	_, err = ipam.Allocate("other-vm/0")
+	require.NoError(t, err)
+	ipConf, err := ipam.Allocate("restored-vm/0")
+	require.NoError(t, err)
+
+	m, err := NewMachine(context.Background(), Config{
+		VMID:       "restored-vm",
+		SocketPath: filepath.Join(dir, "restored-vm.sock"),
+		NetworkInterfaces: NetworkInterfaces{{
+			StaticConfiguration: &StaticNetworkConfiguration{
+				// a tap that does not exist anymore
+				HostDevName: "fc-restored-tap",
+				IPAM:        &IPAMConfiguration{Allocator: ipam},
+				ManagedTap:  &ManagedTapConfiguration{},
+			},
+		}},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, m.RestoreNetwork(context.Background()))
+
+	staticConf := m.Cfg.NetworkInterfaces[0].StaticConfiguration
+	require.NotNil(t, staticConf.IPConfiguration)
+	assert.Equal(t, ipConf.IPAddr.String(), staticConf.IPConfiguration.IPAddr.String(),
+		"expected the VM to get back the IP configuration it was started with")
+	assert.Len(t, m.cleanupFuncs, 2, "expected the allocation and the tap to be torn down by Cleanup")
+
+	require.NoError(t, m.Cleanup())
+	require.NoError(t, ipam.withStore(func(store *ipamStore) error {
+		assert.Equal(t, map[string]string{"192.0.2.1": "other-vm/0"}, store.Allocations)
+		return nil
+	}))
+}
+
 func TestNetworkMachineCNIWithConfFile(t *testing.T) {
 	testNetworkMachineCNI(t, true)
 }
@@ -0,0 +1,363 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// PartitionSchemeGPT is the scheme of GUID partition tables.
+	PartitionSchemeGPT = "gpt"
+	// PartitionSchemeMBR is the scheme of MBR, or DOS, partition tables.
+	PartitionSchemeMBR = "mbr"
+)
+
+const (
+	mbrSectorSize         = 512
+	mbrDiskSignatureStart = 440
+	mbrEntriesStart       = 446
+	mbrEntrySize          = 16
+	mbrEntryCount         = 4
+	mbrBootSignature      = 0xaa55
+
+	// mbrTypeGPTProtective marks the MBR of disks partitioned with GPT.
+	mbrTypeGPTProtective = 0xee
+
+	// mbrFirstLogicalPartition is the number the kernel gives to the first
+	// logical partition of an extended partition.
+	mbrFirstLogicalPartition = 5
+	// maxLogicalPartitions bounds the chain of extended boot records.
+	maxLogicalPartitions = 128
+
+	gptSignature     = "EFI PART"
+	gptMinHeaderSize = 92
+	gptMinEntrySize  = 128
+	// maxGPTEntries bounds the partition entries read, as done by the kernel.
+	maxGPTEntries = 1024
+	gptNameLength = 36
+)
+
+// gptSectorSizes are the logical sector sizes GUID partition tables are
+// looked up with, as images do not record theirs.
+var gptSectorSizes = []int64{512, 4096}
+
+// mbrExtendedTypes are the MBR partition types of extended partitions.
+var mbrExtendedTypes = map[byte]bool{0x05: true, 0x0f: true, 0x85: true}
+
+// ErrNoPartitionTable is returned when a disk image has no partition table.
+var ErrNoPartitionTable = errors.New("no partition table found")
+
+// Partition describes a partition of a disk image.
+type Partition struct {
+	// Number is the number of the partition, as found in the name of its
+	// device in the guest, such as 2 for /dev/vda2.
+	Number int
+
+	// PartUUID is the unique ID the kernel gives to the partition, which is
+	// the unique partition GUID of GPT partitions and made of the disk
+	// signature and the partition number for MBR partitions. It is the value
+	// expected by WithPartuuid and by the root=PARTUUID= kernel argument.
+	PartUUID string
+
+	// Label is the name of GPT partitions.
+	Label string
+
+	// Type is the partition type GUID of GPT partitions, or the
+	// hexadecimal partition type of MBR partitions, such as "0x83".
+	Type string
+
+	// Start and Size are the offset and size of the partition in bytes.
+	Start int64
+	Size  int64
+}
+
+// PartitionTable is the partition table of a disk image.
+type PartitionTable struct {
+	// Scheme is PartitionSchemeGPT or PartitionSchemeMBR.
+	Scheme string
+
+	// Partitions lists the partitions by number.
+	Partitions []Partition
+}
+
+// ReadPartitionTable reads the GPT or MBR partition table of the disk image
+// at path. ErrNoPartitionTable is returned for images which are not
+// partitioned, such as filesystem images.
+func ReadPartitionTable(path string) (*PartitionTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open disk image")
+	}
+	defer f.Close()
+
+	mbr := make([]byte, mbrSectorSize)
+	if _, err := f.ReadAt(mbr, 0); err == io.EOF {
+		return nil, ErrNoPartitionTable
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read MBR")
+	}
+
+	if binary.LittleEndian.Uint16(mbr[mbrSectorSize-2:]) != mbrBootSignature {
+		return nil, ErrNoPartitionTable
+	}
+
+	entries := parseMBREntries(mbr)
+	for _, entry := range entries {
+		if entry.partType == mbrTypeGPTProtective {
+			return readGPT(f)
+		}
+	}
+
+	// filesystems such as FAT have a boot signature too, but their boot
+	// sector has no partition entries
+	if len(entries) == 0 {
+		return nil, ErrNoPartitionTable
+	}
+
+	return readMBR(f, mbr, entries)
+}
+
+// Partition returns the partition numbered number.
+func (pt *PartitionTable) Partition(number int) (*Partition, error) {
+	for i := range pt.Partitions {
+		if pt.Partitions[i].Number == number {
+			return &pt.Partitions[i], nil
+		}
+	}
+
+	return nil, errors.Errorf("no partition numbered %d", number)
+}
+
+// PartitionByLabel returns the partition named label, which must be unique.
+// Only GPT partitions have labels.
+func (pt *PartitionTable) PartitionByLabel(label string) (*Partition, error) {
+	var found *Partition
+	for i := range pt.Partitions {
+		if pt.Partitions[i].Label != label {
+			continue
+		}
+
+		if found != nil {
+			return nil, errors.Errorf("partitions %d and %d are both labelled %q", found.Number, pt.Partitions[i].Number, label)
+		}
+		found = &pt.Partitions[i]
+	}
+
+	if found == nil {
+		return nil, errors.Errorf("no partition labelled %q", label)
+	}
+
+	return found, nil
+}
+
+// PartitionByPartUUID returns the partition with the given unique ID, which
+// is compared regardless of case.
+func (pt *PartitionTable) PartitionByPartUUID(partUUID string) (*Partition, error) {
+	for i := range pt.Partitions {
+		if strings.EqualFold(pt.Partitions[i].PartUUID, partUUID) {
+			return &pt.Partitions[i], nil
+		}
+	}
+
+	return nil, errors.Errorf("no partition with PARTUUID %q", partUUID)
+}
+
+type mbrEntry struct {
+	partType byte
+	startLBA uint32
+	sectors  uint32
+}
+
+// parseMBREntries returns the used primary partition entries of an MBR, or
+// an extended boot record, by slot.
+func parseMBREntries(sector []byte) map[int]mbrEntry {
+	entries := make(map[int]mbrEntry)
+	for i := 0; i < mbrEntryCount; i++ {
+		raw := sector[mbrEntriesStart+i*mbrEntrySize : mbrEntriesStart+(i+1)*mbrEntrySize]
+		entry := mbrEntry{
+			partType: raw[4],
+			startLBA: binary.LittleEndian.Uint32(raw[8:12]),
+			sectors:  binary.LittleEndian.Uint32(raw[12:16]),
+		}
+
+		if entry.partType != 0 && entry.sectors != 0 {
+			entries[i] = entry
+		}
+	}
+
+	return entries
+}
+
+func readMBR(f io.ReaderAt, mbr []byte, entries map[int]mbrEntry) (*PartitionTable, error) {
+	signature := binary.LittleEndian.Uint32(mbr[mbrDiskSignatureStart:])
+	pt := &PartitionTable{Scheme: PartitionSchemeMBR}
+
+	add := func(number int, entry mbrEntry, base uint32) {
+		pt.Partitions = append(pt.Partitions, Partition{
+			Number:   number,
+			PartUUID: fmt.Sprintf("%08x-%02x", signature, number),
+			Type:     fmt.Sprintf("0x%02x", entry.partType),
+			Start:    int64(base+entry.startLBA) * mbrSectorSize,
+			Size:     int64(entry.sectors) * mbrSectorSize,
+		})
+	}
+
+	var extended *mbrEntry
+	for slot := 0; slot < mbrEntryCount; slot++ {
+		entry, ok := entries[slot]
+		if !ok {
+			continue
+		}
+
+		// extended partitions are listed, as the kernel does, but hold
+		// the logical partitions
+		add(slot+1, entry, 0)
+		if mbrExtendedTypes[entry.partType] && extended == nil {
+			extended = &entry
+		}
+	}
+
+	if extended == nil {
+		return pt, nil
+	}
+
+	// each extended boot record holds a logical partition, relative to the
+	// record, and the next record, relative to the extended partition
+	ebr := make([]byte, mbrSectorSize)
+	ebrLBA := extended.startLBA
+	for number := mbrFirstLogicalPartition; number < mbrFirstLogicalPartition+maxLogicalPartitions; number++ {
+		if _, err := f.ReadAt(ebr, int64(ebrLBA)*mbrSectorSize); err != nil {
+			return nil, errors.Wrapf(err, "failed to read extended boot record of partition %d", number)
+		}
+
+		if binary.LittleEndian.Uint16(ebr[mbrSectorSize-2:]) != mbrBootSignature {
+			return nil, errors.Errorf("invalid extended boot record of partition %d", number)
+		}
+
+		ebrEntries := parseMBREntries(ebr)
+		if logical, ok := ebrEntries[0]; ok {
+			add(number, logical, ebrLBA)
+		}
+
+		next, ok := ebrEntries[1]
+		if !ok || !mbrExtendedTypes[next.partType] {
+			return pt, nil
+		}
+		ebrLBA = extended.startLBA + next.startLBA
+	}
+
+	return nil, errors.New("too many logical partitions")
+}
+
+// readGPT reads the primary GUID partition table of a disk image, checking
+// the checksums of its header and entries.
+func readGPT(f io.ReaderAt) (*PartitionTable, error) {
+	for _, sectorSize := range gptSectorSizes {
+		header := make([]byte, sectorSize)
+		if _, err := f.ReadAt(header, sectorSize); err != nil && err != io.EOF {
+			return nil, errors.Wrap(err, "failed to read GPT header")
+		}
+
+		if string(header[:len(gptSignature)]) != gptSignature {
+			continue
+		}
+
+		headerSize := binary.LittleEndian.Uint32(header[12:16])
+		if headerSize < gptMinHeaderSize || int64(headerSize) > sectorSize {
+			return nil, errors.Errorf("invalid GPT header size %d", headerSize)
+		}
+
+		checked := make([]byte, headerSize)
+		copy(checked, header)
+		binary.LittleEndian.PutUint32(checked[16:20], 0)
+		if crc32.ChecksumIEEE(checked) != binary.LittleEndian.Uint32(header[16:20]) {
+			return nil, errors.New("GPT header checksum mismatch")
+		}
+
+		entriesLBA := int64(binary.LittleEndian.Uint64(header[72:80]))
+		entryCount := binary.LittleEndian.Uint32(header[80:84])
+		entrySize := binary.LittleEndian.Uint32(header[84:88])
+		if entryCount > maxGPTEntries || entrySize < gptMinEntrySize || entrySize%8 != 0 {
+			return nil, errors.Errorf("invalid GPT with %d entries of %d bytes", entryCount, entrySize)
+		}
+
+		entries := make([]byte, int(entryCount)*int(entrySize))
+		if _, err := f.ReadAt(entries, entriesLBA*sectorSize); err != nil {
+			return nil, errors.Wrap(err, "failed to read GPT entries")
+		}
+
+		if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(header[88:92]) {
+			return nil, errors.New("GPT entries checksum mismatch")
+		}
+
+		pt := &PartitionTable{Scheme: PartitionSchemeGPT}
+		for i := 0; i < int(entryCount); i++ {
+			entry := entries[i*int(entrySize) : (i+1)*int(entrySize)]
+			if bytes.Equal(entry[:16], make([]byte, 16)) {
+				// unused entry
+				continue
+			}
+
+			firstLBA := int64(binary.LittleEndian.Uint64(entry[32:40]))
+			lastLBA := int64(binary.LittleEndian.Uint64(entry[40:48]))
+			pt.Partitions = append(pt.Partitions, Partition{
+				Number:   i + 1,
+				PartUUID: formatGUID(entry[16:32]),
+				Label:    decodeGPTName(entry[56 : 56+2*gptNameLength]),
+				Type:     formatGUID(entry[:16]),
+				Start:    firstLBA * sectorSize,
+				Size:     (lastLBA - firstLBA + 1) * sectorSize,
+			})
+		}
+
+		return pt, nil
+	}
+
+	return nil, errors.New("protective MBR found but no GPT header")
+}
+
+// formatGUID formats a GUID stored in the mixed endian layout of GPT, as the
+// kernel does.
+func formatGUID(b []byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8:10], b[10:16])
+}
+
+// decodeGPTName decodes the UTF-16LE name of a GPT partition, which is NUL
+// terminated unless it takes the whole field.
+func decodeGPTName(b []byte) string {
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		unit := binary.LittleEndian.Uint16(b[i:])
+		if unit == 0 {
+			break
+		}
+		units = append(units, unit)
+	}
+
+	return string(utf16.Decode(units))
+}
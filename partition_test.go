@@ -0,0 +1,288 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+)
+
+// linuxFilesystemGUID is the "Linux filesystem" partition type GUID
+// 0fc63daf-8483-4772-8e79-3d69d8477de4, in the mixed endian layout of GPT.
+var linuxFilesystemGUID = []byte{
+	0xaf, 0x3d, 0xc6, 0x0f, 0x83, 0x84, 0x72, 0x47,
+	0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4,
+}
+
+type testGPTPartition struct {
+	slot              int
+	uniqueGUID        byte
+	firstLBA, lastLBA uint64
+	name              string
+}
+
+// testGPTImage returns a disk image with a protective MBR and a GUID
+// partition table of 128 entries. The unique GUID of each partition is made
+// of its uniqueGUID byte.
+func testGPTImage(sectorSize int, partitions ...testGPTPartition) []byte {
+	const entryCount, entrySize = 128, 128
+	entriesLBA := 2
+	image := make([]byte, sectorSize*(entriesLBA+entryCount*entrySize/sectorSize+1))
+
+	mbr := image[:mbrSectorSize]
+	mbr[mbrEntriesStart+4] = mbrTypeGPTProtective
+	binary.LittleEndian.PutUint32(mbr[mbrEntriesStart+8:], 1)
+	binary.LittleEndian.PutUint32(mbr[mbrEntriesStart+12:], 0xffffffff)
+	binary.LittleEndian.PutUint16(mbr[mbrSectorSize-2:], mbrBootSignature)
+
+	entries := image[entriesLBA*sectorSize : entriesLBA*sectorSize+entryCount*entrySize]
+	for _, p := range partitions {
+		entry := entries[p.slot*entrySize : (p.slot+1)*entrySize]
+		copy(entry, linuxFilesystemGUID)
+		for i := 16; i < 32; i++ {
+			entry[i] = p.uniqueGUID
+		}
+		binary.LittleEndian.PutUint64(entry[32:], p.firstLBA)
+		binary.LittleEndian.PutUint64(entry[40:], p.lastLBA)
+		for i, unit := range utf16.Encode([]rune(p.name)) {
+			binary.LittleEndian.PutUint16(entry[56+2*i:], unit)
+		}
+	}
+
+	header := image[sectorSize : sectorSize+gptMinHeaderSize]
+	copy(header, gptSignature)
+	binary.LittleEndian.PutUint32(header[8:], 0x00010000)
+	binary.LittleEndian.PutUint32(header[12:], gptMinHeaderSize)
+	binary.LittleEndian.PutUint64(header[24:], 1)
+	binary.LittleEndian.PutUint64(header[72:], uint64(entriesLBA))
+	binary.LittleEndian.PutUint32(header[80:], entryCount)
+	binary.LittleEndian.PutUint32(header[84:], entrySize)
+	binary.LittleEndian.PutUint32(header[88:], crc32.ChecksumIEEE(entries))
+	binary.LittleEndian.PutUint32(header[16:], crc32.ChecksumIEEE(header))
+
+	return image
+}
+
+// testMBRImage returns a disk image with two primary partitions, the second
+// being an extended partition holding two logical partitions.
+func testMBRImage() []byte {
+	image := make([]byte, 64*mbrSectorSize)
+
+	putEntry := func(sector []byte, slot int, partType byte, startLBA, sectors uint32) {
+		entry := sector[mbrEntriesStart+slot*mbrEntrySize:]
+		entry[4] = partType
+		binary.LittleEndian.PutUint32(entry[8:], startLBA)
+		binary.LittleEndian.PutUint32(entry[12:], sectors)
+		binary.LittleEndian.PutUint16(sector[mbrSectorSize-2:], mbrBootSignature)
+	}
+	sector := func(lba int) []byte {
+		return image[lba*mbrSectorSize : (lba+1)*mbrSectorSize]
+	}
+
+	binary.LittleEndian.PutUint32(image[mbrDiskSignatureStart:], 0x1234abcd)
+	putEntry(sector(0), 0, 0x83, 2, 8)
+	putEntry(sector(0), 1, 0x05, 16, 48)
+
+	// logical partitions are relative to their extended boot record, while
+	// the next records are relative to the extended partition
+	putEntry(sector(16), 0, 0x83, 1, 8)
+	putEntry(sector(16), 1, 0x05, 16, 16)
+	putEntry(sector(32), 0, 0x82, 2, 4)
+
+	return image
+}
+
+func writeTestImage(t *testing.T, dir, name string, image []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, image, 0600))
+	return path
+}
+
+func TestReadPartitionTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestReadPartitionTable")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, sectorSize := range []int{512, 4096} {
+		path := writeTestImage(t, dir, "gpt.img", testGPTImage(sectorSize,
+			testGPTPartition{slot: 0, uniqueGUID: 0x11, firstLBA: 34, lastLBA: 2081, name: "EFI"},
+			testGPTPartition{slot: 2, uniqueGUID: 0xab, firstLBA: 2082, lastLBA: 4129, name: "cloudimg-rootfs"},
+		))
+
+		pt, err := ReadPartitionTable(path)
+		require.NoError(t, err)
+		assert.Equal(t, &PartitionTable{
+			Scheme: PartitionSchemeGPT,
+			Partitions: []Partition{
+				{
+					Number:   1,
+					PartUUID: "11111111-1111-1111-1111-111111111111",
+					Label:    "EFI",
+					Type:     "0fc63daf-8483-4772-8e79-3d69d8477de4",
+					Start:    34 * int64(sectorSize),
+					Size:     2048 * int64(sectorSize),
+				},
+				{
+					Number:   3,
+					PartUUID: "abababab-abab-abab-abab-abababababab",
+					Label:    "cloudimg-rootfs",
+					Type:     "0fc63daf-8483-4772-8e79-3d69d8477de4",
+					Start:    2082 * int64(sectorSize),
+					Size:     2048 * int64(sectorSize),
+				},
+			},
+		}, pt, "sector size %d", sectorSize)
+	}
+
+	pt, err := ReadPartitionTable(writeTestImage(t, dir, "mbr.img", testMBRImage()))
+	require.NoError(t, err)
+	assert.Equal(t, &PartitionTable{
+		Scheme: PartitionSchemeMBR,
+		Partitions: []Partition{
+			{Number: 1, PartUUID: "1234abcd-01", Type: "0x83", Start: 2 * 512, Size: 8 * 512},
+			{Number: 2, PartUUID: "1234abcd-02", Type: "0x05", Start: 16 * 512, Size: 48 * 512},
+			{Number: 5, PartUUID: "1234abcd-05", Type: "0x83", Start: 17 * 512, Size: 8 * 512},
+			{Number: 6, PartUUID: "1234abcd-06", Type: "0x82", Start: 34 * 512, Size: 4 * 512},
+		},
+	}, pt)
+
+	corrupted := testGPTImage(512, testGPTPartition{slot: 0, uniqueGUID: 0x11, firstLBA: 34, lastLBA: 2081})
+	corrupted[2*512+56] = 'x'
+
+	bootSector := make([]byte, mbrSectorSize)
+	binary.LittleEndian.PutUint16(bootSector[mbrSectorSize-2:], mbrBootSignature)
+
+	for _, c := range []struct {
+		name        string
+		image       []byte
+		expectedErr string
+	}{
+		{name: "empty", image: nil, expectedErr: ErrNoPartitionTable.Error()},
+		{name: "filesystem", image: make([]byte, 4096), expectedErr: ErrNoPartitionTable.Error()},
+		{name: "boot sector", image: bootSector, expectedErr: ErrNoPartitionTable.Error()},
+		{name: "corrupted", image: corrupted, expectedErr: "checksum mismatch"},
+	} {
+		_, err := ReadPartitionTable(writeTestImage(t, dir, c.name, c.image))
+		require.Error(t, err, c.name)
+		assert.Contains(t, err.Error(), c.expectedErr, c.name)
+	}
+}
+
+func TestPartitionTableLookups(t *testing.T) {
+	pt := &PartitionTable{
+		Scheme: PartitionSchemeGPT,
+		Partitions: []Partition{
+			{Number: 1, PartUUID: "11111111-1111-1111-1111-111111111111", Label: "EFI"},
+			{Number: 2, PartUUID: "22222222-2222-2222-2222-222222222222", Label: "data"},
+			{Number: 3, PartUUID: "abababab-abab-abab-abab-abababababab", Label: "data"},
+		},
+	}
+
+	partition, err := pt.Partition(3)
+	require.NoError(t, err)
+	assert.Equal(t, "data", partition.Label)
+
+	partition, err = pt.PartitionByLabel("EFI")
+	require.NoError(t, err)
+	assert.Equal(t, 1, partition.Number)
+
+	partition, err = pt.PartitionByPartUUID("ABABABAB-ABAB-ABAB-ABAB-ABABABABABAB")
+	require.NoError(t, err)
+	assert.Equal(t, 3, partition.Number)
+
+	_, err = pt.Partition(4)
+	assert.Error(t, err)
+	_, err = pt.PartitionByLabel("data")
+	assert.Error(t, err, "labels must be unique")
+	_, err = pt.PartitionByLabel("missing")
+	assert.Error(t, err)
+	_, err = pt.PartitionByPartUUID("missing")
+	assert.Error(t, err)
+}
+
+func TestDrivesBuilderWithRootPartition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestDrivesBuilderWithRootPartition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := writeTestImage(t, dir, "gpt.img", testGPTImage(512,
+		testGPTPartition{slot: 0, uniqueGUID: 0x11, firstLBA: 34, lastLBA: 2081, name: "EFI"},
+		testGPTPartition{slot: 1, uniqueGUID: 0xab, firstLBA: 2082, lastLBA: 4129, name: "cloudimg-rootfs"},
+	))
+
+	b, err := NewDrivesBuilder(path).WithRootPartition(1)
+	require.NoError(t, err)
+	assert.Equal(t, "11111111-1111-1111-1111-111111111111", b.Build()[0].Partuuid)
+
+	b, err = NewDrivesBuilder(path).WithRootPartitionLabel("cloudimg-rootfs")
+	require.NoError(t, err)
+	assert.Equal(t, "abababab-abab-abab-abab-abababababab", b.Build()[0].Partuuid)
+
+	_, err = NewDrivesBuilder(path).WithRootPartition(3)
+	assert.Error(t, err)
+
+	_, err = NewDrivesBuilder(writeTestImage(t, dir, "rootfs.ext4", make([]byte, 4096))).WithRootPartition(1)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), ErrNoPartitionTable.Error())
+}
+
+func TestConfigValidatePartuuid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestConfigValidatePartuuid")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	kernelPath := filepath.Join(dir, "vmlinux")
+	writeTestKernel(t, kernelPath)
+
+	mbrPath := writeTestImage(t, dir, "mbr.img", testMBRImage())
+	ext4Path := writeTestImage(t, dir, "rootfs.ext4", make([]byte, 4096))
+
+	cfg := Config{
+		SocketPath:      filepath.Join(dir, "fc.sock"),
+		KernelImagePath: kernelPath,
+		MachineCfg: models.MachineConfiguration{
+			VcpuCount:  Int64(1),
+			MemSizeMib: Int64(256),
+			HtEnabled:  Bool(false),
+		},
+	}
+
+	cfg.Drives = NewDrivesBuilder(mbrPath).WithRootDrive(mbrPath, WithPartuuid("1234abcd-05")).Build()
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Drives = NewDrivesBuilder(mbrPath).WithRootDrive(mbrPath, WithPartuuid("1234abcd-03")).Build()
+	err = cfg.Validate()
+	require.Error(t, err)
+	assert.Equal(t, []string{"Drives[0].Partuuid"}, fieldsOf(t, err))
+
+	cfg.Drives = NewDrivesBuilder(ext4Path).WithRootDrive(ext4Path, WithPartuuid("1234abcd-01")).Build()
+	err = cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "has no partition table")
+
+	// only root drives are booted from a partition
+	cfg.Drives = NewDrivesBuilder(ext4Path).AddDrive(ext4Path, true, WithPartuuid("1234abcd-01")).Build()
+	assert.NoError(t, cfg.Validate())
+}
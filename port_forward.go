@@ -0,0 +1,427 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultUDPForwardIdleTimeout = time.Minute
+
+	// maxUDPDatagramSize is the largest UDP payload that can be forwarded.
+	maxUDPDatagramSize = 65535
+)
+
+// PortForward describes how a host port is forwarded to a port inside the VM.
+type PortForward struct {
+	// Network is the protocol of the forwarded port, either "tcp" or "udp".
+	// If blank, "tcp" is used.
+	Network string
+
+	// HostAddr is the host address to listen on, such as "127.0.0.1:8080". If
+	// its port is 0, a free port is picked, which is returned by
+	// PortForwarder.Addr.
+	HostAddr string
+
+	// GuestPort is the port inside the VM the host port is forwarded to. It is
+	// a vsock port when Vsock is set.
+	GuestPort uint32
+
+	// GuestIP (optional) is the IP address of the VM the host port is
+	// forwarded to over the VM's network. If not provided, defaults to the
+	// first IPv4 address, or else IPv6 address, of the VM's network
+	// interfaces.
+	GuestIP net.IP
+
+	// Vsock forwards the host port over the machine's vsock device rather
+	// than the VM's network, for VMs without networking. The service in the
+	// VM must accept connections on the GuestPort vsock port. As vsock only
+	// provides stream sockets, only TCP can be forwarded this way.
+	Vsock bool
+
+	// UDPIdleTimeout (optional) is how long the forwarding of UDP datagrams
+	// between a host peer and the VM is kept without any traffic. If not
+	// provided, defaults to 1 minute.
+	UDPIdleTimeout time.Duration
+}
+
+func (fwd PortForward) validate() error {
+	switch fwd.Network {
+	case "tcp":
+	case "udp":
+		if fwd.Vsock {
+			return errors.New("udp ports cannot be forwarded over vsock")
+		}
+	default:
+		return errors.Errorf("unsupported port forwarding network %q", fwd.Network)
+	}
+
+	if fwd.GuestPort == 0 {
+		return errors.New("a guest port must be provided to forward ports")
+	}
+
+	if !fwd.Vsock && fwd.GuestPort > 65535 {
+		return errors.Errorf("invalid guest port %d", fwd.GuestPort)
+	}
+
+	return nil
+}
+
+// PortForwarder forwards the connections, or datagrams, received on a host
+// port to a port inside the VM. It is returned by Machine.ForwardPort.
+type PortForwarder struct {
+	addr   net.Addr
+	closer io.Closer
+	cancel context.CancelFunc
+
+	// done is closed once the forwarder is closed
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	wg        sync.WaitGroup
+
+	dial   func(context.Context) (net.Conn, error)
+	ctx    context.Context
+	logger *log.Entry
+}
+
+// Addr returns the host address the forwarder listens on.
+func (f *PortForwarder) Addr() net.Addr {
+	return f.addr
+}
+
+// Close stops listening on the host port and closes the forwarded
+// connections.
+func (f *PortForwarder) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.done)
+		f.cancel()
+		f.closeErr = f.closer.Close()
+		f.wg.Wait()
+	})
+	return f.closeErr
+}
+
+// ForwardPort listens on a host port and forwards the connections it accepts,
+// or the datagrams it receives, to a port inside the VM. The VM is reached
+// over its network from the network namespace of the machine, so that VMs
+// isolated in their own namespace, such as those set up with CNI, are
+// reachable from the host too, or over the machine's vsock device. Forwarding
+// stops when the returned forwarder is closed, when ctx is done or when the
+// VMM exits.
+func (m *Machine) ForwardPort(ctx context.Context, fwd PortForward) (*PortForwarder, error) {
+	if fwd.Network == "" {
+		fwd.Network = "tcp"
+	}
+
+	if fwd.UDPIdleTimeout == 0 {
+		fwd.UDPIdleTimeout = defaultUDPForwardIdleTimeout
+	}
+
+	if err := fwd.validate(); err != nil {
+		return nil, err
+	}
+
+	dial, target, err := m.portForwardDialer(fwd)
+	if err != nil {
+		return nil, err
+	}
+
+	fwdCtx, cancel := context.WithCancel(ctx)
+	f := &PortForwarder{
+		cancel: cancel,
+		done:   make(chan struct{}),
+		dial:   dial,
+		ctx:    fwdCtx,
+		logger: m.logger.WithField("forward", fwd.HostAddr+"->"+target),
+	}
+
+	switch fwd.Network {
+	case "tcp":
+		listener, err := net.Listen(fwd.Network, fwd.HostAddr)
+		if err != nil {
+			cancel()
+			return nil, errors.Wrapf(err, "failed to listen on %q", fwd.HostAddr)
+		}
+
+		f.addr, f.closer = listener.Addr(), listener
+		f.wg.Add(1)
+		go f.serveTCP(listener)
+	case "udp":
+		packetConn, err := net.ListenPacket(fwd.Network, fwd.HostAddr)
+		if err != nil {
+			cancel()
+			return nil, errors.Wrapf(err, "failed to listen on %q", fwd.HostAddr)
+		}
+
+		f.addr, f.closer = packetConn.LocalAddr(), packetConn
+		f.wg.Add(1)
+		go f.serveUDP(packetConn, fwd.UDPIdleTimeout)
+	}
+
+	go func() {
+		select {
+		case <-m.exitCh:
+		case <-fwdCtx.Done():
+		case <-f.done:
+			return
+		}
+
+		if err := f.Close(); err != nil {
+			f.logger.WithError(err).Debug("failed to close port forwarder")
+		}
+	}()
+
+	m.logger.Debugf("Forwarding %s %s to %s", fwd.Network, f.addr, target)
+	return f, nil
+}
+
+// portForwardDialer returns the function connecting to the target of the
+// port forward, and a description of the target.
+func (m *Machine) portForwardDialer(fwd PortForward) (func(context.Context) (net.Conn, error), string, error) {
+	if fwd.Vsock {
+		vsockDialer, err := m.VsockDialer()
+		if err != nil {
+			return nil, "", err
+		}
+
+		dial := func(ctx context.Context) (net.Conn, error) {
+			return vsockDialer.DialPort(ctx, fwd.GuestPort)
+		}
+		return dial, "vsock:" + strconv.FormatUint(uint64(fwd.GuestPort), 10), nil
+	}
+
+	guestIP := fwd.GuestIP
+	if guestIP == nil {
+		guestIP = m.Cfg.NetworkInterfaces.guestIP()
+		if guestIP == nil {
+			return nil, "", errors.New("no IP address is configured for the VM, a guest IP must be provided to forward ports")
+		}
+	}
+
+	address := net.JoinHostPort(guestIP.String(), strconv.FormatUint(uint64(fwd.GuestPort), 10))
+	netNSPath := m.Cfg.NetNS
+	dial := func(ctx context.Context) (net.Conn, error) {
+		var conn net.Conn
+		// the socket stays in the netns it's created in
+		err := withNetNSPath(netNSPath, func() error {
+			var dialer net.Dialer
+			var err error
+			conn, err = dialer.DialContext(ctx, fwd.Network, address)
+			return err
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to dial %s %s", fwd.Network, address)
+		}
+		return conn, nil
+	}
+	return dial, address, nil
+}
+
+// guestIP returns the first IPv4 address, or else IPv6 address, configured on
+// the network interfaces, if any.
+func (networkInterfaces NetworkInterfaces) guestIP() net.IP {
+	var ipv6 net.IP
+	for _, iface := range networkInterfaces {
+		if iface.StaticConfiguration == nil || iface.StaticConfiguration.IPConfiguration == nil {
+			continue
+		}
+
+		ipConf := iface.StaticConfiguration.IPConfiguration
+		if ip := ipConf.IPAddr.IP; ip != nil {
+			if !isIPv6(ip) {
+				return ip
+			}
+			if ipv6 == nil {
+				ipv6 = ip
+			}
+		}
+
+		if ipConf.IPv6Addr != nil && ipv6 == nil {
+			ipv6 = ipConf.IPv6Addr.IP
+		}
+	}
+
+	return ipv6
+}
+
+func (f *PortForwarder) serveTCP(listener net.Listener) {
+	defer f.wg.Done()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-f.done:
+			default:
+				f.logger.WithError(err).Error("failed to accept connection, stopping port forwarding")
+			}
+			return
+		}
+
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			f.forwardConn(conn)
+		}()
+	}
+}
+
+// forwardConn copies data in both directions between conn and a new
+// connection to the target until both directions are done or the forwarder
+// is closed.
+func (f *PortForwarder) forwardConn(conn net.Conn) {
+	targetConn, err := f.dial(f.ctx)
+	if err != nil {
+		f.logger.WithError(err).Warnf("failed to forward connection from %s", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-f.done:
+		case <-finished:
+		}
+		conn.Close()
+		targetConn.Close()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyStream := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		// let the peer know that no more data is coming while still reading
+		// its response
+		if halfCloser, ok := dst.(interface{ CloseWrite() error }); ok {
+			halfCloser.CloseWrite()
+		}
+	}
+	go copyStream(targetConn, conn)
+	go copyStream(conn, targetConn)
+	wg.Wait()
+	close(finished)
+}
+
+// udpSession forwards the datagrams of a single host peer.
+type udpSession struct {
+	conn net.Conn
+
+	mu         sync.Mutex
+	lastActive time.Time
+}
+
+func (s *udpSession) touch() {
+	s.mu.Lock()
+	s.lastActive = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *udpSession) idleSince() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastActive
+}
+
+func (f *PortForwarder) serveUDP(packetConn net.PacketConn, idleTimeout time.Duration) {
+	defer f.wg.Done()
+
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, session := range sessions {
+			session.conn.Close()
+		}
+	}()
+
+	buf := make([]byte, maxUDPDatagramSize)
+	for {
+		n, peer, err := packetConn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-f.done:
+			default:
+				f.logger.WithError(err).Error("failed to read datagram, stopping port forwarding")
+			}
+			return
+		}
+
+		mu.Lock()
+		session, ok := sessions[peer.String()]
+		if !ok {
+			conn, err := f.dial(f.ctx)
+			if err != nil {
+				mu.Unlock()
+				f.logger.WithError(err).Warnf("failed to forward datagrams from %s", peer)
+				continue
+			}
+
+			session = &udpSession{conn: conn, lastActive: time.Now()}
+			sessions[peer.String()] = session
+
+			f.wg.Add(1)
+			go func() {
+				defer f.wg.Done()
+				f.forwardReplies(packetConn, peer, session, idleTimeout)
+
+				mu.Lock()
+				delete(sessions, peer.String())
+				mu.Unlock()
+				session.conn.Close()
+			}()
+		}
+		mu.Unlock()
+
+		session.touch()
+		if _, err := session.conn.Write(buf[:n]); err != nil {
+			f.logger.WithError(err).Debugf("failed to forward datagram from %s", peer)
+		}
+	}
+}
+
+// forwardReplies sends the datagrams received from the target of a session
+// back to its host peer until the session has been idle for idleTimeout.
+func (f *PortForwarder) forwardReplies(packetConn net.PacketConn, peer net.Addr, session *udpSession, idleTimeout time.Duration) {
+	buf := make([]byte, maxUDPDatagramSize)
+	for {
+		session.conn.SetReadDeadline(session.idleSince().Add(idleTimeout))
+		n, err := session.conn.Read(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() &&
+				time.Since(session.idleSince()) < idleTimeout {
+				// datagrams were sent by the peer in the meantime
+				continue
+			}
+			return
+		}
+
+		session.touch()
+		if _, err := packetConn.WriteTo(buf[:n], peer); err != nil {
+			f.logger.WithError(err).Debugf("failed to forward datagram to %s", peer)
+		}
+	}
+}
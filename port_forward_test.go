@@ -0,0 +1,227 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoTCP echoes back each line it reads from conn.
+func echoTCP(conn net.Conn) {
+	defer conn.Close()
+	io.Copy(conn, conn)
+}
+
+func assertEchoes(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+
+	_, err := conn.Write([]byte(msg + "\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, msg+"\n", line)
+}
+
+func TestForwardPortTCP(t *testing.T) {
+	guestListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer guestListener.Close()
+	go func() {
+		for {
+			conn, err := guestListener.Accept()
+			if err != nil {
+				return
+			}
+			go echoTCP(conn)
+		}
+	}()
+
+	m, err := NewMachine(context.Background(), Config{DisableValidation: true})
+	require.NoError(t, err)
+
+	fwd, err := m.ForwardPort(context.Background(), PortForward{
+		HostAddr:  "127.0.0.1:0",
+		GuestIP:   net.IPv4(127, 0, 0, 1),
+		GuestPort: uint32(guestListener.Addr().(*net.TCPAddr).Port),
+	})
+	require.NoError(t, err)
+	defer fwd.Close()
+
+	conn, err := net.Dial("tcp", fwd.Addr().String())
+	require.NoError(t, err)
+	assertEchoes(t, conn, "hello")
+
+	// simulate the VMM exiting
+	close(m.exitCh)
+	assert.Eventually(t, func() bool {
+		_, err := conn.Read(make([]byte, 1))
+		return err != nil
+	}, time.Second, 10*time.Millisecond, "expected forwarded connection to be closed after the VMM exited")
+
+	_, err = net.Dial("tcp", fwd.Addr().String())
+	assert.Error(t, err, "expected forwarder to stop listening after the VMM exited")
+}
+
+func TestForwardPortUDP(t *testing.T) {
+	guestConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer guestConn.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := guestConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			guestConn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	m, err := NewMachine(context.Background(), Config{
+		DisableValidation: true,
+		NetworkInterfaces: NetworkInterfaces{{
+			StaticConfiguration: &StaticNetworkConfiguration{
+				HostDevName: tapName,
+				IPConfiguration: &IPConfiguration{
+					IPAddr: net.IPNet{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(8, 32)},
+				},
+			},
+		}},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fwd, err := m.ForwardPort(ctx, PortForward{
+		Network:   "udp",
+		HostAddr:  "127.0.0.1:0",
+		GuestPort: uint32(guestConn.LocalAddr().(*net.UDPAddr).Port),
+	})
+	require.NoError(t, err)
+
+	conn, err := net.Dial("udp", fwd.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for _, msg := range []string{"ping", "pong"} {
+		_, err = conn.Write([]byte(msg))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, msg, string(buf[:n]))
+	}
+
+	cancel()
+	assert.Eventually(t, func() bool {
+		select {
+		case <-fwd.done:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, 10*time.Millisecond, "expected forwarder to be closed once its context is done")
+	assert.NoError(t, fwd.Close())
+}
+
+func TestForwardPortVsock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestForwardPortVsock")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	udsPath := filepath.Join(dir, "v.sock")
+	vsock := fakeVsockServer(t, udsPath, map[uint32]func(net.Conn){
+		1024: echoTCP,
+	})
+	defer vsock.Close()
+
+	m, err := NewMachine(context.Background(), Config{
+		DisableValidation: true,
+		VsockDevices:      []VsockDevice{{Path: udsPath, CID: 3}},
+	})
+	require.NoError(t, err)
+
+	fwd, err := m.ForwardPort(context.Background(), PortForward{
+		HostAddr:  "127.0.0.1:0",
+		GuestPort: 1024,
+		Vsock:     true,
+	})
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", fwd.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	assertEchoes(t, conn, "hello")
+
+	assert.NoError(t, fwd.Close())
+}
+
+func TestForwardPortFails(t *testing.T) {
+	m, err := NewMachine(context.Background(), Config{DisableValidation: true})
+	require.NoError(t, err)
+
+	cases := []struct {
+		name string
+		fwd  PortForward
+	}{
+		{
+			name: "unsupported network",
+			fwd:  PortForward{Network: "unix", HostAddr: "127.0.0.1:0", GuestPort: 80, GuestIP: net.IPv4(127, 0, 0, 1)},
+		},
+		{
+			name: "udp over vsock",
+			fwd:  PortForward{Network: "udp", HostAddr: "127.0.0.1:0", GuestPort: 80, Vsock: true},
+		},
+		{
+			name: "no guest port",
+			fwd:  PortForward{HostAddr: "127.0.0.1:0", GuestIP: net.IPv4(127, 0, 0, 1)},
+		},
+		{
+			name: "invalid guest port",
+			fwd:  PortForward{HostAddr: "127.0.0.1:0", GuestPort: 65536, GuestIP: net.IPv4(127, 0, 0, 1)},
+		},
+		{
+			name: "no guest IP",
+			fwd:  PortForward{HostAddr: "127.0.0.1:0", GuestPort: 80},
+		},
+		{
+			name: "no vsock device",
+			fwd:  PortForward{HostAddr: "127.0.0.1:0", GuestPort: 80, Vsock: true},
+		},
+		{
+			name: "invalid host address",
+			fwd:  PortForward{HostAddr: "127.0.0.1:" + strconv.Itoa(1<<16), GuestPort: 80, GuestIP: net.IPv4(127, 0, 0, 1)},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			_, err := m.ForwardPort(context.Background(), c.fwd)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/pkg/errors"
+)
+
+const defaultProbeInterval = 50 * time.Millisecond
+
+// ReadinessProbe waits for some aspect of the guest to become ready.
+type ReadinessProbe interface {
+	// Name describes the probe in a ReadinessReport.
+	Name() string
+	// Wait blocks until the guest is ready or the context is done.
+	Wait(ctx context.Context, m *Machine) error
+}
+
+// ReadinessPhase records the outcome of a single probe.
+type ReadinessPhase struct {
+	// Name is the name of the probe.
+	Name string
+	// Duration is how long the probe took.
+	Duration time.Duration
+	// SinceInstanceStart is the time between the InstanceStart action and
+	// the end of the probe. It is zero if the instance start time is not
+	// known.
+	SinceInstanceStart time.Duration
+	// Err is the error returned by the probe, if any.
+	Err error
+}
+
+// ReadinessReport describes how long each phase of WaitReady took.
+type ReadinessReport struct {
+	Phases []ReadinessPhase
+	// Duration is the total time spent in WaitReady.
+	Duration time.Duration
+}
+
+func (r ReadinessReport) String() string {
+	var phases []string
+	for _, phase := range r.Phases {
+		status := "ready"
+		if phase.Err != nil {
+			status = "failed: " + phase.Err.Error()
+		}
+		phases = append(phases, fmt.Sprintf("%s %s after %s", phase.Name, status, phase.Duration))
+	}
+
+	return fmt.Sprintf("%s (total %s)", strings.Join(phases, ", "), r.Duration)
+}
+
+// WaitReady runs the provided probes one after the other, in order, until all
+// of them succeed. It returns a report of how long each phase took, even when
+// a probe fails. Waiting stops with an error when the context is done or the
+// VMM exits. Timeouts for individual probes can be set with
+// WithProbeTimeout.
+func (m *Machine) WaitReady(ctx context.Context, probes ...ReadinessProbe) (*ReadinessReport, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-m.exitCh:
+			close(exited)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	report := &ReadinessReport{}
+	start := time.Now()
+	defer func() {
+		report.Duration = time.Since(start)
+	}()
+
+	for _, probe := range probes {
+		phaseStart := time.Now()
+		err := probe.Wait(ctx, m)
+
+		select {
+		case <-exited:
+			err = errors.New("firecracker exited before the guest was ready")
+		default:
+		}
+
+		phase := ReadinessPhase{
+			Name:     probe.Name(),
+			Duration: time.Since(phaseStart),
+			Err:      err,
+		}
+		if !m.instanceStartTime.IsZero() {
+			phase.SinceInstanceStart = time.Since(m.instanceStartTime)
+		}
+		report.Phases = append(report.Phases, phase)
+
+		if err != nil {
+			return report, errors.Wrapf(err, "readiness probe %q failed", probe.Name())
+		}
+
+		m.logger.Debugf("readiness probe %q succeeded after %s", probe.Name(), phase.Duration)
+	}
+
+	return report, nil
+}
+
+// probeFunc is a ReadinessProbe made of a name and a function.
+type probeFunc struct {
+	name string
+	fn   func(context.Context, *Machine) error
+}
+
+func (p probeFunc) Name() string {
+	return p.name
+}
+
+func (p probeFunc) Wait(ctx context.Context, m *Machine) error {
+	return p.fn(ctx, m)
+}
+
+// NewReadinessProbe returns a ReadinessProbe with the given name that calls
+// check every interval until it returns nil.
+func NewReadinessProbe(name string, interval time.Duration, check func(context.Context, *Machine) error) ReadinessProbe {
+	return probeFunc{
+		name: name,
+		fn: func(ctx context.Context, m *Machine) error {
+			return poll(ctx, interval, func() error {
+				return check(ctx, m)
+			})
+		},
+	}
+}
+
+// WithProbeTimeout limits the time the probe may take.
+func WithProbeTimeout(probe ReadinessProbe, timeout time.Duration) ReadinessProbe {
+	return probeFunc{
+		name: probe.Name(),
+		fn: func(ctx context.Context, m *Machine) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			return probe.Wait(ctx, m)
+		},
+	}
+}
+
+// ConsoleProbe waits for the guest's serial console to produce output matching
+// pattern, for example a login prompt. It requires a Console attached with the
+// WithConsole option.
+func ConsoleProbe(pattern *regexp.Regexp) ReadinessProbe {
+	return probeFunc{
+		name: fmt.Sprintf("console matches %q", pattern.String()),
+		fn: func(ctx context.Context, m *Machine) error {
+			if m.console == nil {
+				return errors.New("no console is attached to the machine")
+			}
+
+			_, err := m.console.WaitFor(ctx, pattern)
+			return err
+		},
+	}
+}
+
+// VsockProbe waits for a process inside the guest to accept connections on the
+// given vsock port.
+func VsockProbe(port uint32) ReadinessProbe {
+	return NewReadinessProbe(fmt.Sprintf("vsock port %d", port), defaultProbeInterval,
+		func(ctx context.Context, m *Machine) error {
+			conn, err := m.DialVsock(ctx, port)
+			if err != nil {
+				return err
+			}
+
+			return conn.Close()
+		},
+	)
+}
+
+// TCPProbe waits for address, such as "172.16.0.2:22", to accept TCP
+// connections. When the machine runs in a network namespace, the connection
+// is made from inside that namespace, so that guests which are only reachable
+// from within their namespace can be probed.
+func TCPProbe(address string) ReadinessProbe {
+	return NewReadinessProbe(fmt.Sprintf("tcp %s", address), defaultProbeInterval,
+		func(ctx context.Context, m *Machine) error {
+			return m.dialInNetNS(ctx, "tcp", address)
+		},
+	)
+}
+
+// dialInNetNS dials address from the machine's network namespace, if any, and
+// closes the connection right away.
+func (m *Machine) dialInNetNS(ctx context.Context, network, address string) error {
+	dial := func() error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	}
+
+	if m.Cfg.NetNS == "" {
+		return dial()
+	}
+
+	return ns.WithNetNSPath(m.Cfg.NetNS, func(_ ns.NetNS) error {
+		return dial()
+	})
+}
+
+// MMDSProbe waits for the key at the given path to be present in the
+// machine's MMDS contents, for example MMDSProbe("status", "ready"). Guests
+// can only read from MMDS, so the key has to be written by a component on the
+// host that the guest reports its readiness to.
+func MMDSProbe(path ...string) ReadinessProbe {
+	return NewReadinessProbe(fmt.Sprintf("mmds key %q", strings.Join(path, "/")), defaultProbeInterval,
+		func(ctx context.Context, m *Machine) error {
+			var metadata interface{}
+			if err := m.GetMetadata(ctx, &metadata); err != nil {
+				return err
+			}
+
+			for _, key := range path {
+				object, ok := metadata.(map[string]interface{})
+				if !ok {
+					return errors.Errorf("mmds key %q not found", key)
+				}
+
+				if metadata, ok = object[key]; !ok {
+					return errors.Errorf("mmds key %q not found", key)
+				}
+			}
+
+			return nil
+		},
+	)
+}
+
+// poll calls fn every interval until it returns nil or the context is done,
+// in which case the last error returned by fn is included.
+func poll(ctx context.Context, interval time.Duration, fn func() error) error {
+	if interval <= 0 {
+		interval = defaultProbeInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "last error: %v", err)
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ops "github.com/firecracker-microvm/firecracker-go-sdk/client/operations"
+	"github.com/firecracker-microvm/firecracker-go-sdk/fctesting"
+)
+
+func TestWaitReady(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWaitReady")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	vsockPath := filepath.Join(dir, "v.sock")
+	vsockListener := fakeVsockServer(t, vsockPath, map[uint32]func(net.Conn){
+		52: func(conn net.Conn) { conn.Close() },
+	})
+	defer vsockListener.Close()
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer tcpListener.Close()
+
+	var mmdsCalls int32
+	opClient := fctesting.MockClient{
+		GetMmdsFn: func(params *ops.GetMmdsParams) (*ops.GetMmdsOK, error) {
+			payload := map[string]interface{}{}
+			if atomic.AddInt32(&mmdsCalls, 1) > 2 {
+				payload["status"] = map[string]interface{}{"ready": true}
+			}
+
+			return &ops.GetMmdsOK{Payload: payload}, nil
+		},
+	}
+
+	console := NewConsole(ConsoleConfig{})
+	m := &Machine{
+		Cfg: Config{
+			VsockDevices: []VsockDevice{{Path: vsockPath, CID: 3}},
+		},
+		client:            NewClient("socket-path", fctesting.NewLogEntry(t), true, WithOpsClient(&opClient)),
+		logger:            fctesting.NewLogEntry(t),
+		exitCh:            make(chan struct{}),
+		console:           console,
+		instanceStartTime: time.Now(),
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		console.Write([]byte("Welcome\nlocalhost login: "))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	report, err := m.WaitReady(ctx,
+		ConsoleProbe(regexp.MustCompile("login: ")),
+		VsockProbe(52),
+		TCPProbe(tcpListener.Addr().String()),
+		WithProbeTimeout(MMDSProbe("status", "ready"), time.Second),
+	)
+	require.NoError(t, err)
+	require.Len(t, report.Phases, 4)
+
+	for _, phase := range report.Phases {
+		assert.NoError(t, phase.Err)
+		assert.True(t, phase.SinceInstanceStart >= phase.Duration,
+			"expected %s to be at least %s", phase.SinceInstanceStart, phase.Duration)
+	}
+	assert.Equal(t, "vsock port 52", report.Phases[1].Name)
+	assert.True(t, report.Duration >= report.Phases[0].Duration)
+}
+
+func TestWaitReadyFailure(t *testing.T) {
+	m := &Machine{
+		logger: fctesting.NewLogEntry(t),
+		exitCh: make(chan struct{}),
+	}
+
+	probe := WithProbeTimeout(NewReadinessProbe("never", time.Millisecond,
+		func(context.Context, *Machine) error {
+			return assert.AnError
+		},
+	), 20*time.Millisecond)
+
+	report, err := m.WaitReady(context.Background(), probe, ConsoleProbe(regexp.MustCompile("unused")))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), assert.AnError.Error())
+	require.Len(t, report.Phases, 1, "expected probes after the failed one to be skipped")
+	assert.Equal(t, "never", report.Phases[0].Name)
+	assert.Error(t, report.Phases[0].Err)
+
+	close(m.exitCh)
+	_, err = m.WaitReady(context.Background(), NewReadinessProbe("exit", time.Millisecond,
+		func(context.Context, *Machine) error {
+			return assert.AnError
+		},
+	))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "firecracker exited")
+}
+
+func TestMMDSProbeMissingKey(t *testing.T) {
+	opClient := fctesting.MockClient{
+		GetMmdsFn: func(params *ops.GetMmdsParams) (*ops.GetMmdsOK, error) {
+			return &ops.GetMmdsOK{Payload: map[string]interface{}{"status": "booting"}}, nil
+		},
+	}
+	m := &Machine{
+		client: NewClient("socket-path", fctesting.NewLogEntry(t), true, WithOpsClient(&opClient)),
+		logger: fctesting.NewLogEntry(t),
+		exitCh: make(chan struct{}),
+	}
+
+	_, err := m.WaitReady(context.Background(), WithProbeTimeout(MMDSProbe("status", "ready"), 20*time.Millisecond))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `mmds key "ready" not found`)
+}
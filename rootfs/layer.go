@@ -0,0 +1,411 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package rootfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// whiteoutPrefix marks the files of a layer deleting the file of the same
+	// name, without the prefix, from the layers below.
+	whiteoutPrefix = ".wh."
+	// opaqueWhiteout marks the directories of a layer hiding the contents of
+	// the same directory in the layers below.
+	opaqueWhiteout = whiteoutPrefix + whiteoutPrefix + ".opq"
+
+	// maxSymlinks bounds the symbolic links followed when resolving a path.
+	maxSymlinks = 255
+)
+
+// fixup holds the attributes of a file the host could not apply in the
+// staging directory, which are applied to the image with debugfs instead.
+type fixup struct {
+	mode     os.FileMode
+	uid, gid int
+	modTime  time.Time
+	// device is set for device nodes, which are not created in the staging
+	// directory.
+	device       bool
+	major, minor uint32
+}
+
+// unpacker flattens the layers of an image into a staging directory.
+type unpacker struct {
+	root string
+
+	// dirs holds the headers of the directories, whose modes and
+	// modification times are applied once all layers are unpacked, so that
+	// read-only directories and the directories of later layers can still be
+	// written to.
+	dirs map[string]*tar.Header
+
+	// fixups holds the attributes to apply to the image, by path relative to
+	// root.
+	fixups map[string]fixup
+
+	// forceFixups makes every ownership and device node a fixup, as when
+	// unpacking as an unprivileged user.
+	forceFixups bool
+}
+
+func newUnpacker(root string) *unpacker {
+	return &unpacker{
+		root:        root,
+		dirs:        make(map[string]*tar.Header),
+		fixups:      make(map[string]fixup),
+		forceFixups: os.Geteuid() != 0,
+	}
+}
+
+// applyLayer unpacks a layer, which is a tar archive, optionally gzip
+// compressed, on top of the previous layers, applying its whiteouts.
+func (u *unpacker) applyLayer(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "failed to read layer")
+	}
+
+	var layer io.Reader = br
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gzipReader, err := gzip.NewReader(br)
+		if err != nil {
+			return errors.Wrap(err, "failed to read gzip compressed layer")
+		}
+		defer gzipReader.Close()
+		layer = gzipReader
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return errors.New("zstd compressed layers are not supported")
+	}
+
+	// the paths of the layer and their parents, which opaque whiteouts of
+	// the same layer must not remove
+	layerPaths := make(map[string]bool)
+
+	tr := tar.NewReader(layer)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "failed to read layer")
+		}
+
+		name := path.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+
+		dir, base := path.Split(name)
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			if err := u.applyWhiteout(dir, base, layerPaths); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for p := name; p != "/"; p = path.Dir(p) {
+			layerPaths[p] = true
+		}
+
+		if err := u.applyEntry(name, hdr, tr); err != nil {
+			return errors.Wrapf(err, "failed to unpack %q", name)
+		}
+	}
+
+	// read the end of the archive, so that callers can check its digest
+	_, err = io.Copy(ioutil.Discard, layer)
+	return errors.Wrap(err, "failed to read layer")
+}
+
+func (u *unpacker) applyWhiteout(dir, base string, layerPaths map[string]bool) error {
+	resolvedDir, err := u.resolveDir(dir)
+	if err != nil {
+		return err
+	}
+
+	if base != opaqueWhiteout {
+		return u.remove(path.Join(resolvedDir, strings.TrimPrefix(base, whiteoutPrefix)))
+	}
+
+	children, err := ioutil.ReadDir(filepath.Join(u.root, resolvedDir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to read directory %q", dir)
+	}
+
+	for _, child := range children {
+		if layerPaths[path.Join(dir, child.Name())] {
+			continue
+		}
+
+		if err := u.remove(path.Join(resolvedDir, child.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remove removes the file at the resolved path rel, and its contents.
+func (u *unpacker) remove(rel string) error {
+	if err := os.RemoveAll(filepath.Join(u.root, rel)); err != nil {
+		return errors.Wrapf(err, "failed to remove %q", rel)
+	}
+
+	u.forget(rel)
+	return nil
+}
+
+// forget drops the pending attributes of rel and its contents.
+func (u *unpacker) forget(rel string) {
+	for p := range u.fixups {
+		if p == rel || strings.HasPrefix(p, rel+"/") {
+			delete(u.fixups, p)
+		}
+	}
+
+	for p := range u.dirs {
+		if p == rel || strings.HasPrefix(p, rel+"/") {
+			delete(u.dirs, p)
+		}
+	}
+}
+
+func (u *unpacker) applyEntry(name string, hdr *tar.Header, r io.Reader) error {
+	dir, base := path.Split(name)
+	resolvedDir, err := u.resolveDir(dir)
+	if err != nil {
+		return err
+	}
+
+	rel := path.Join(resolvedDir, base)
+	hostPath := filepath.Join(u.root, rel)
+
+	if err := os.MkdirAll(filepath.Dir(hostPath), 0755); err != nil {
+		return errors.Wrap(err, "failed to create parent directories")
+	}
+
+	// replace what the layers below left at the same path, unless both are
+	// directories
+	if info, err := os.Lstat(hostPath); err == nil {
+		if !info.IsDir() || hdr.Typeflag != tar.TypeDir {
+			if err := u.remove(rel); err != nil {
+				return err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to stat")
+	}
+
+	mode := hdr.FileInfo().Mode()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(hostPath, 0700); err != nil && !os.IsExist(err) {
+			return errors.Wrap(err, "failed to create directory")
+		}
+		u.dirs[rel] = hdr
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(hostPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return errors.Wrap(err, "failed to create file")
+		}
+		_, err = io.Copy(f, r)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to write file")
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, hostPath); err != nil {
+			return errors.Wrap(err, "failed to create symbolic link")
+		}
+	case tar.TypeLink:
+		linkDir, linkBase := path.Split(path.Clean("/" + hdr.Linkname))
+		resolvedLinkDir, err := u.resolveDir(linkDir)
+		if err != nil {
+			return err
+		}
+		target := path.Join(resolvedLinkDir, linkBase)
+		if u.fixups[target].device {
+			return errors.Errorf("hard link to %q cannot be created when unpacking as an unprivileged user", hdr.Linkname)
+		}
+		if err := os.Link(filepath.Join(u.root, target), hostPath); err != nil {
+			return errors.Wrap(err, "failed to create hard link")
+		}
+		// hard links share the attributes of their target
+		return nil
+	case tar.TypeChar, tar.TypeBlock:
+		if u.forceFixups {
+			u.fixups[rel] = fixup{
+				mode:    mode,
+				uid:     hdr.Uid,
+				gid:     hdr.Gid,
+				modTime: hdr.ModTime,
+				device:  true,
+				major:   uint32(hdr.Devmajor),
+				minor:   uint32(hdr.Devminor),
+			}
+			return nil
+		}
+		devType := uint32(unix.S_IFBLK)
+		if hdr.Typeflag == tar.TypeChar {
+			devType = unix.S_IFCHR
+		}
+		dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		if err := unix.Mknod(hostPath, devType|0600, int(dev)); err != nil {
+			return errors.Wrap(err, "failed to create device node")
+		}
+	case tar.TypeFifo:
+		if err := unix.Mkfifo(hostPath, 0600); err != nil {
+			return errors.Wrap(err, "failed to create FIFO")
+		}
+	default:
+		// extended headers are consumed by the tar reader, and other entries
+		// have no use in a root filesystem
+		return nil
+	}
+
+	if u.forceFixups {
+		u.fixups[rel] = fixup{mode: mode, uid: hdr.Uid, gid: hdr.Gid, modTime: hdr.ModTime}
+	} else if err := os.Lchown(hostPath, hdr.Uid, hdr.Gid); err != nil {
+		return errors.Wrap(err, "failed to change owner")
+	}
+
+	if hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+
+	return setAttributes(hostPath, mode, hdr.ModTime)
+}
+
+// finish applies the modes and modification times of the directories, from
+// the deepest up, once all layers are unpacked.
+func (u *unpacker) finish() error {
+	paths := make([]string, 0, len(u.dirs))
+	for p := range u.dirs {
+		paths = append(paths, p)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+
+	for _, p := range paths {
+		hdr := u.dirs[p]
+		if err := setAttributes(filepath.Join(u.root, p), hdr.FileInfo().Mode(), hdr.ModTime); err != nil {
+			return errors.Wrapf(err, "failed to set attributes of %q", p)
+		}
+	}
+
+	// the root directory of images is owned by root and not writable by
+	// others, whatever the staging directory is
+	if err := os.Chmod(u.root, 0755); err != nil {
+		return errors.Wrap(err, "failed to chmod root directory")
+	}
+	if u.forceFixups {
+		u.fixups["/"] = fixup{mode: os.ModeDir | 0755}
+	} else if err := os.Lchown(u.root, 0, 0); err != nil {
+		return errors.Wrap(err, "failed to change owner of root directory")
+	}
+
+	return nil
+}
+
+// setAttributes sets the mode and modification time of the file at hostPath,
+// without following symbolic links.
+func setAttributes(hostPath string, mode os.FileMode, modTime time.Time) error {
+	if mode&os.ModeSymlink != 0 {
+		// symbolic links have no mode of their own
+		return errors.Wrap(lutimes(hostPath, modTime), "failed to set modification time")
+	}
+
+	// the mode is set after the owner, which clears the setuid and setgid bits
+	if err := os.Chmod(hostPath, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return errors.Wrap(err, "failed to chmod")
+	}
+
+	return errors.Wrap(lutimes(hostPath, modTime), "failed to set modification time")
+}
+
+func lutimes(hostPath string, modTime time.Time) error {
+	ts := unix.NsecToTimespec(modTime.UnixNano())
+	return unix.UtimesNanoAt(unix.AT_FDCWD, hostPath, []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// resolveDir resolves the directory dir of the image to a path relative to
+// the staging directory, following symbolic links as the guest would, which
+// cannot escape the staging directory.
+func (u *unpacker) resolveDir(dir string) (string, error) {
+	current := "/"
+	remaining := dir
+	links := 0
+	for remaining != "" {
+		part := remaining
+		remaining = ""
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			part, remaining = part[:i], part[i+1:]
+		}
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			current = path.Dir(current)
+			continue
+		}
+
+		next := path.Join(current, part)
+		info, err := os.Lstat(filepath.Join(u.root, next))
+		if err != nil && !os.IsNotExist(err) {
+			return "", errors.Wrapf(err, "failed to resolve %q", dir)
+		}
+
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			links++
+			if links > maxSymlinks {
+				return "", errors.Errorf("too many symbolic links resolving %q", dir)
+			}
+
+			target, err := os.Readlink(filepath.Join(u.root, next))
+			if err != nil {
+				return "", errors.Wrapf(err, "failed to resolve %q", dir)
+			}
+			if path.IsAbs(target) {
+				current = "/"
+			}
+			remaining = target + "/" + remaining
+			continue
+		}
+
+		current = next
+	}
+
+	return current, nil
+}
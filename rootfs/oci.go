@@ -0,0 +1,340 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package rootfs
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ociLayoutFile = "oci-layout"
+	ociIndexFile  = "index.json"
+
+	// refNameAnnotation holds the tag of the images of an OCI layout.
+	refNameAnnotation = "org.opencontainers.image.ref.name"
+	// containerdNameAnnotation holds the full name of the images exported by
+	// containerd and Docker.
+	containerdNameAnnotation = "io.containerd.image.name"
+
+	// maxIndexDepth bounds the image indexes nested in each other.
+	maxIndexDepth = 8
+)
+
+// ociDescriptor references a blob of an OCI image layout.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// ociManifest holds the fields of image indexes and image manifests, telling
+// them apart by which one is set.
+type ociManifest struct {
+	Manifests []ociDescriptor `json:"manifests"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+// ociLayout gives access to the files of an OCI image layout.
+type ociLayout interface {
+	Open(name string) (io.ReadCloser, error)
+	Close() error
+}
+
+// openOCILayout opens the OCI image layout at layoutPath, which is either a
+// directory or a tar archive of one.
+func openOCILayout(layoutPath string) (ociLayout, error) {
+	info, err := os.Stat(layoutPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to stat OCI image")
+	}
+
+	var layout ociLayout
+	if info.IsDir() {
+		layout = dirLayout(layoutPath)
+	} else {
+		layout, err = openTarLayout(layoutPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := layout.Open(ociLayoutFile)
+	if err != nil {
+		layout.Close()
+		return nil, errors.Wrapf(err, "%q is not an OCI image layout", layoutPath)
+	}
+	f.Close()
+
+	return layout, nil
+}
+
+type dirLayout string
+
+func (d dirLayout) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+func (d dirLayout) Close() error {
+	return nil
+}
+
+// tarLayout reads the files of a tar archive of an OCI image layout in place.
+type tarLayout struct {
+	f     *os.File
+	files map[string]*io.SectionReader
+}
+
+func openTarLayout(archivePath string) (*tarLayout, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open OCI image")
+	}
+
+	layout := &tarLayout{f: f, files: make(map[string]*io.SectionReader)}
+
+	// the tar reader seeks over the contents of the files, leaving the
+	// archive at the start of the contents of each file it returns
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			f.Close()
+			return nil, errors.Wrapf(err, "failed to read OCI image archive %q", archivePath)
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			f.Close()
+			return nil, errors.Wrap(err, "failed to seek OCI image archive")
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		layout.files[name] = io.NewSectionReader(f, offset, hdr.Size)
+	}
+
+	return layout, nil
+}
+
+func (l *tarLayout) Open(name string) (io.ReadCloser, error) {
+	section, ok := l.files[name]
+	if !ok {
+		return nil, errors.Errorf("%q not found in archive", name)
+	}
+
+	return ioutil.NopCloser(io.NewSectionReader(section, 0, section.Size())), nil
+}
+
+func (l *tarLayout) Close() error {
+	return l.f.Close()
+}
+
+// openBlob opens the blob of the descriptor. The digest of sha256 blobs is
+// checked once they have been read completely.
+func openBlob(layout ociLayout, desc ociDescriptor) (io.ReadCloser, error) {
+	parts := strings.SplitN(desc.Digest, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.Contains(parts[1], "/") {
+		return nil, errors.Errorf("invalid digest %q", desc.Digest)
+	}
+
+	r, err := layout.Open(path.Join("blobs", parts[0], parts[1]))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open blob %s", desc.Digest)
+	}
+
+	if parts[0] != "sha256" {
+		return r, nil
+	}
+
+	return &verifiedBlob{ReadCloser: r, digest: parts[1], hash: sha256.New()}, nil
+}
+
+type verifiedBlob struct {
+	io.ReadCloser
+	digest string
+	hash   hash.Hash
+}
+
+func (b *verifiedBlob) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+
+	if err == io.EOF && hex.EncodeToString(b.hash.Sum(nil)) != b.digest {
+		return n, errors.Errorf("blob sha256:%s does not match its digest", b.digest)
+	}
+
+	return n, err
+}
+
+func readJSON(layout ociLayout, name string, v interface{}) error {
+	r, err := layout.Open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return json.NewDecoder(r).Decode(v)
+}
+
+func readBlobJSON(layout ociLayout, desc ociDescriptor, v interface{}) error {
+	r, err := openBlob(layout, desc)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// read the blob completely to check its digest
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read blob %s", desc.Digest)
+	}
+
+	return errors.Wrapf(json.Unmarshal(data, v), "failed to parse blob %s", desc.Digest)
+}
+
+// imageLayers returns the layers of the image of the layout named ref, from
+// the bottom up. If ref is blank, the layout must hold a single image. Images
+// built for several platforms resolve to the Linux image of the host
+// architecture.
+func imageLayers(layout ociLayout, ref string) ([]ociDescriptor, error) {
+	var index ociManifest
+	if err := readJSON(layout, ociIndexFile, &index); err != nil {
+		return nil, errors.Wrap(err, "failed to read OCI image index")
+	}
+
+	candidates := index.Manifests
+	if ref != "" {
+		candidates = nil
+		for _, desc := range index.Manifests {
+			if desc.Annotations[refNameAnnotation] == ref || desc.Annotations[containerdNameAnnotation] == ref {
+				candidates = append(candidates, desc)
+			}
+		}
+		if len(candidates) == 0 {
+			return nil, errors.Errorf("image %q not found in OCI image layout", ref)
+		}
+	}
+
+	for depth := 0; depth < maxIndexDepth; depth++ {
+		desc, err := selectManifest(candidates)
+		if err != nil {
+			return nil, err
+		}
+
+		var manifest ociManifest
+		if err := readBlobJSON(layout, desc, &manifest); err != nil {
+			return nil, err
+		}
+
+		if len(manifest.Manifests) == 0 {
+			return manifest.Layers, nil
+		}
+
+		candidates = manifest.Manifests
+	}
+
+	return nil, errors.New("too many nested OCI image indexes")
+}
+
+// selectManifest returns the only candidate, or the only one for the Linux
+// platform of the host.
+func selectManifest(candidates []ociDescriptor) (ociDescriptor, error) {
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+
+	var matches []ociDescriptor
+	for _, desc := range candidates {
+		if desc.Platform != nil && desc.Platform.OS == "linux" && desc.Platform.Architecture == runtime.GOARCH {
+			matches = append(matches, desc)
+		}
+	}
+
+	switch len(matches) {
+	case 1:
+		return matches[0], nil
+	case 0:
+		if len(candidates) == 0 {
+			return ociDescriptor{}, errors.New("OCI image index is empty")
+		}
+		return ociDescriptor{}, errors.Errorf("none of the %d images is built for linux/%s, or the image must be selected by name",
+			len(candidates), runtime.GOARCH)
+	default:
+		return ociDescriptor{}, errors.Errorf("%d images are built for linux/%s, the image must be selected by name",
+			len(matches), runtime.GOARCH)
+	}
+}
+
+// unpackOCIImage flattens the layers of the image named ref of the OCI image
+// layout at layoutPath into the staging directory of u.
+func unpackOCIImage(ctx context.Context, u *unpacker, layoutPath, ref string) error {
+	layout, err := openOCILayout(layoutPath)
+	if err != nil {
+		return err
+	}
+	defer layout.Close()
+
+	layers, err := imageLayers(layout, ref)
+	if err != nil {
+		return err
+	}
+
+	for _, desc := range layers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		r, err := openBlob(layout, desc)
+		if err != nil {
+			return err
+		}
+
+		err = u.applyLayer(r)
+		if err == nil {
+			// check the digest of the whole blob
+			_, err = io.Copy(ioutil.Discard, r)
+		}
+		r.Close()
+		if err != nil {
+			return errors.Wrapf(err, "failed to apply layer %s", desc.Digest)
+		}
+	}
+
+	return u.finish()
+}
@@ -0,0 +1,467 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+/*
+Package rootfs builds ext4 filesystem images to be used as the drives of
+Firecracker VMs, such as their root drive, from a host directory or from a
+container image stored as an OCI image layout.
+
+The layers of OCI images are flattened as a container runtime would, applying
+their whiteouts. The images are sized from their contents, plus some free
+space:
+
+	img, err := rootfs.Build(ctx, "/path/to/rootfs.ext4", rootfs.Config{
+		OCIImage: "/path/to/alpine.tar",
+		Headroom: 256 << 20,
+	})
+	if err != nil {
+		return err
+	}
+
+	drives := img.WithRootDrive(firecracker.DrivesBuilder{}).Build()
+
+The images are created by mkfs.ext4 from e2fsprogs, which must be found in
+PATH unless configured otherwise.
+*/
+package rootfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+const (
+	// DefaultHeadroom is the free space of images whose Config has no
+	// Headroom.
+	DefaultHeadroom = 64 << 20
+
+	defaultMkfsPath    = "mkfs.ext4"
+	defaultDebugfsPath = "debugfs"
+
+	// blockSize is the block size of the filesystems.
+	blockSize = 4096
+	// inodeSize is the size of the inodes of the filesystems.
+	inodeSize = 256
+	// bytesPerInode is the ratio of free space to inodes, which is the
+	// default of mkfs.ext4.
+	bytesPerInode = 16384
+	// dirEntrySize is the space taken by the entry of a file in its directory,
+	// rounded up.
+	dirEntrySize = 64
+	// maxFastSymlinkLength is the longest target of symbolic links stored in
+	// their inode, longer targets take a block.
+	maxFastSymlinkLength = 59
+	// fixedOverhead accounts for the superblocks, the reserved inodes and the
+	// lost+found directory.
+	fixedOverhead = 1 << 20
+)
+
+// Config describes how to build an image. Exactly one of SourceDir and
+// OCIImage must be provided.
+type Config struct {
+	// SourceDir is a host directory whose contents are copied to the image,
+	// along with their owners, modes and modification times.
+	SourceDir string
+
+	// OCIImage is an OCI image layout, either a directory or a tar archive of
+	// one, such as written by "skopeo copy docker://alpine oci-archive:alpine.tar"
+	// or by "docker save" since Docker 25. Its layers are flattened into the
+	// image.
+	OCIImage string
+
+	// OCIRef (optional) selects the image of the OCI image layout by its
+	// name, as found in the "org.opencontainers.image.ref.name" or
+	// "io.containerd.image.name" annotations. It is required when the layout
+	// holds several images.
+	OCIRef string
+
+	// Size (optional) is the size of the image in bytes. If not provided, the
+	// image is sized to hold its contents and Headroom.
+	Size int64
+
+	// Headroom (optional) is the free space left in images sized from their
+	// contents, in bytes. If not provided, DefaultHeadroom is used.
+	Headroom int64
+
+	// Label (optional) is the volume label of the filesystem.
+	Label string
+
+	// TempDir (optional) is where the layers of OCI images are unpacked
+	// before being copied to the image, defaulting to the host temporary
+	// directory.
+	TempDir string
+
+	// MkfsPath (optional) is the path of mkfs.ext4, looked up in PATH by
+	// default.
+	MkfsPath string
+
+	// DebugfsPath (optional) is the path of debugfs, looked up in PATH by
+	// default. It is only used when OCI images are built by unprivileged
+	// users, to set the owners of files and create device nodes.
+	DebugfsPath string
+}
+
+// Validate checks the configuration.
+func (cfg Config) Validate() error {
+	if (cfg.SourceDir == "") == (cfg.OCIImage == "") {
+		return errors.New("exactly one of SourceDir and OCIImage must be provided")
+	}
+
+	if cfg.OCIRef != "" && cfg.OCIImage == "" {
+		return errors.New("OCIRef requires OCIImage")
+	}
+
+	if cfg.Size < 0 {
+		return errors.Errorf("invalid image size %d", cfg.Size)
+	}
+
+	if cfg.Headroom < 0 {
+		return errors.Errorf("invalid headroom %d", cfg.Headroom)
+	}
+
+	if cfg.Size != 0 && cfg.Headroom != 0 {
+		return errors.New("Size and Headroom cannot both be provided")
+	}
+
+	return nil
+}
+
+// Image is an ext4 filesystem image.
+type Image struct {
+	// Path is the path of the image file.
+	Path string
+	// Size is the size of the image in bytes.
+	Size int64
+}
+
+// WithRootDrive sets the image as the root drive of b.
+func (img *Image) WithRootDrive(b firecracker.DrivesBuilder, opts ...firecracker.DriveOpt) firecracker.DrivesBuilder {
+	return b.WithRootDrive(img.Path, opts...)
+}
+
+// AddDrive adds the image as a drive of b.
+func (img *Image) AddDrive(b firecracker.DrivesBuilder, readOnly bool, opts ...firecracker.DriveOpt) firecracker.DrivesBuilder {
+	return b.AddDrive(img.Path, readOnly, opts...)
+}
+
+// Build builds the ext4 image described by cfg at imagePath. The file is
+// replaced once the image has been built completely.
+//
+// Unpacking OCI images as root preserves the owners of their files and their
+// device nodes in the image. As an unprivileged user, they are set in the
+// image with debugfs, except for hard links to device nodes which fail the
+// build. Extended attributes, such as file capabilities, are not preserved.
+func Build(ctx context.Context, imagePath string, cfg Config) (*Image, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	sourceDir := cfg.SourceDir
+	var u *unpacker
+	if cfg.OCIImage != "" {
+		stagingDir, err := ioutil.TempDir(cfg.TempDir, "rootfs")
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create staging directory")
+		}
+		defer removeStagingDir(stagingDir)
+
+		u = newUnpacker(stagingDir)
+		if err := unpackOCIImage(ctx, u, cfg.OCIImage, cfg.OCIRef); err != nil {
+			return nil, errors.Wrapf(err, "failed to unpack OCI image %q", cfg.OCIImage)
+		}
+		sourceDir = stagingDir
+	}
+
+	usage, err := diskUsage(sourceDir)
+	if err != nil {
+		return nil, err
+	}
+
+	size := cfg.Size
+	if size == 0 {
+		headroom := cfg.Headroom
+		if headroom == 0 {
+			headroom = DefaultHeadroom
+		}
+		size = usage.imageSize(headroom)
+	}
+
+	if size < usage.bytes+fixedOverhead {
+		return nil, errors.Errorf("image size %d is too small for %d bytes of contents", size, usage.bytes)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(imagePath), "."+filepath.Base(imagePath))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create image file")
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "failed to size image file")
+	}
+
+	if err := f.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to close image file")
+	}
+
+	inodes := usage.inodes + (size-usage.bytes)/bytesPerInode
+	if err := mkfs(ctx, cfg, f.Name(), sourceDir, inodes); err != nil {
+		return nil, err
+	}
+
+	if u != nil && len(u.fixups) > 0 {
+		if err := applyFixups(ctx, cfg, f.Name(), u.fixups); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.Rename(f.Name(), imagePath); err != nil {
+		return nil, errors.Wrap(err, "failed to rename image file")
+	}
+
+	return &Image{Path: imagePath, Size: size}, nil
+}
+
+func mkfs(ctx context.Context, cfg Config, imagePath, sourceDir string, inodes int64) error {
+	mkfsPath := cfg.MkfsPath
+	if mkfsPath == "" {
+		mkfsPath = defaultMkfsPath
+	}
+
+	args := []string{
+		"-q", "-F",
+		"-b", strconv.Itoa(blockSize),
+		"-I", strconv.Itoa(inodeSize),
+		"-N", strconv.FormatInt(inodes, 10),
+		// no blocks are reserved for root, the headroom is for everyone
+		"-m", "0",
+		"-d", sourceDir,
+	}
+	if cfg.Label != "" {
+		args = append(args, "-L", cfg.Label)
+	}
+	args = append(args, imagePath)
+
+	output, err := exec.CommandContext(ctx, mkfsPath, args...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "failed to create ext4 filesystem: %s", strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// applyFixups sets the attributes of the files of the image the host could
+// not set in the staging directory.
+func applyFixups(ctx context.Context, cfg Config, imagePath string, fixups map[string]fixup) error {
+	debugfsPath := cfg.DebugfsPath
+	if debugfsPath == "" {
+		debugfsPath = defaultDebugfsPath
+	}
+
+	paths := make([]string, 0, len(fixups))
+	for p := range fixups {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var script bytes.Buffer
+	for _, p := range paths {
+		if strings.ContainsAny(p, "\"\n") {
+			return errors.Errorf("cannot set attributes of %q with debugfs", p)
+		}
+
+		fix := fixups[p]
+		if fix.device {
+			devType := "b"
+			if fix.mode&os.ModeCharDevice != 0 {
+				devType = "c"
+			}
+			// mknod creates the node in the current directory
+			fmt.Fprintf(&script, "cd \"%s\"\n", path.Dir(p))
+			fmt.Fprintf(&script, "mknod \"%s\" %s %d %d\n", path.Base(p), devType, fix.major, fix.minor)
+			fmt.Fprintf(&script, "sif \"%s\" mtime @%d\n", p, fix.modTime.Unix())
+		}
+
+		if fix.mode&os.ModeSymlink == 0 {
+			fmt.Fprintf(&script, "sif \"%s\" mode 0%o\n", p, unixMode(fix.mode))
+		}
+		fmt.Fprintf(&script, "sif \"%s\" uid %d\n", p, fix.uid)
+		fmt.Fprintf(&script, "sif \"%s\" gid %d\n", p, fix.gid)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, debugfsPath, "-w", "-f", "-", imagePath)
+	cmd.Stdin = &script
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "failed to set file attributes with debugfs: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	// debugfs reports the failures of commands on stderr, after its version
+	for _, line := range strings.Split(strings.TrimSpace(stderr.String()), "\n") {
+		if line != "" && !strings.HasPrefix(line, "debugfs ") {
+			return errors.Errorf("failed to set file attributes with debugfs: %s", line)
+		}
+	}
+
+	return nil
+}
+
+// unixMode converts mode to the type and permission bits of an inode.
+func unixMode(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= syscall.S_ISVTX
+	}
+
+	switch mode & os.ModeType {
+	case os.ModeDir:
+		return bits | syscall.S_IFDIR
+	case os.ModeSymlink:
+		return bits | syscall.S_IFLNK
+	case os.ModeDevice:
+		return bits | syscall.S_IFBLK
+	case os.ModeDevice | os.ModeCharDevice:
+		return bits | syscall.S_IFCHR
+	case os.ModeNamedPipe:
+		return bits | syscall.S_IFIFO
+	case os.ModeSocket:
+		return bits | syscall.S_IFSOCK
+	default:
+		return bits | syscall.S_IFREG
+	}
+}
+
+// usage is the space the files of a directory take in an ext4 filesystem.
+type usage struct {
+	bytes  int64
+	inodes int64
+}
+
+// diskUsage returns the space the files of dir take in an ext4 filesystem.
+func diskUsage(dir string) (usage, error) {
+	var u usage
+	seen := make(map[uint64]bool)
+
+	err := filepath.Walk(dir, func(hostPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.Wrapf(err, "failed to walk %q", hostPath)
+		}
+
+		// hard links take a directory entry each, but share their inode
+		u.bytes += dirEntrySize
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 && !info.IsDir() {
+			if seen[stat.Ino] {
+				return nil
+			}
+			seen[stat.Ino] = true
+		}
+
+		u.inodes++
+		u.bytes += inodeSize
+
+		switch {
+		case info.Mode().IsRegular():
+			u.bytes += roundUp(info.Size(), blockSize)
+		case info.IsDir():
+			u.bytes += blockSize
+		case info.Mode()&os.ModeSymlink != 0 && info.Size() > maxFastSymlinkLength:
+			u.bytes += blockSize
+		}
+
+		return nil
+	})
+
+	return u, err
+}
+
+// imageSize returns the size of an image holding the files and headroom free
+// bytes, accounting for the metadata of the filesystem.
+func (u usage) imageSize(headroom int64) int64 {
+	size := u.bytes + headroom
+	// extent trees, bitmaps and group descriptors
+	size += size / 32
+	// inodes of the headroom
+	size += headroom / bytesPerInode * inodeSize
+	size += fixedOverhead
+	size += journalSize(size)
+
+	return roundUp(size, 1<<20)
+}
+
+// journalSize returns the size of the journal mkfs.ext4 creates for a
+// filesystem of the given size.
+func journalSize(size int64) int64 {
+	blocks := size / blockSize
+	var journalBlocks int64
+	switch {
+	case blocks < 2048:
+		journalBlocks = 0
+	case blocks < 32768:
+		journalBlocks = 1024
+	case blocks < 256*1024:
+		journalBlocks = 4096
+	case blocks < 512*1024:
+		journalBlocks = 8192
+	case blocks < 4096*1024:
+		journalBlocks = 16384
+	case blocks < 8192*1024:
+		journalBlocks = 32768
+	case blocks < 16384*1024:
+		journalBlocks = 65536
+	case blocks < 32768*1024:
+		journalBlocks = 131072
+	default:
+		journalBlocks = 262144
+	}
+
+	return journalBlocks * blockSize
+}
+
+func roundUp(n, multiple int64) int64 {
+	return (n + multiple - 1) / multiple * multiple
+}
+
+// removeStagingDir removes the staging directory, including read-only
+// directories an unprivileged user could not remove files from.
+func removeStagingDir(dir string) error {
+	filepath.Walk(dir, func(hostPath string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(hostPath, 0700)
+		}
+		return nil
+	})
+
+	return os.RemoveAll(dir)
+}
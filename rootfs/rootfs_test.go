@@ -0,0 +1,459 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+var testModTime = time.Unix(1500000000, 0)
+
+// testLayer returns a tar archive of the given entries, gzip compressed if
+// requested.
+func testLayer(t *testing.T, compress bool, headers ...*tar.Header) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range headers {
+		if hdr.ModTime.IsZero() {
+			hdr.ModTime = testModTime
+		}
+
+		var data []byte
+		if hdr.Typeflag == tar.TypeReg {
+			data = []byte(hdr.Linkname)
+			hdr.Linkname = ""
+			hdr.Size = int64(len(data))
+		}
+
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	if !compress {
+		return buf.Bytes()
+	}
+
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	_, err := gw.Write(buf.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	return compressed.Bytes()
+}
+
+// tarFile returns the header of a regular file, whose contents are held in
+// Linkname until testLayer writes it.
+func tarFile(name, contents string, mode int64) *tar.Header {
+	return &tar.Header{Typeflag: tar.TypeReg, Name: name, Linkname: contents, Mode: mode}
+}
+
+func tarDir(name string, mode int64) *tar.Header {
+	return &tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: mode}
+}
+
+func tarSymlink(name, target string) *tar.Header {
+	return &tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: target, Mode: 0777}
+}
+
+// testLayout writes the blobs of an OCI image layout to dir.
+type testLayout struct {
+	t   *testing.T
+	dir string
+}
+
+func newTestLayout(t *testing.T, dir string) *testLayout {
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, ociLayoutFile), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644))
+	return &testLayout{t: t, dir: dir}
+}
+
+func (l *testLayout) blob(data []byte) ociDescriptor {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	require.NoError(l.t, ioutil.WriteFile(filepath.Join(l.dir, "blobs", "sha256", digest), data, 0644))
+	return ociDescriptor{Digest: "sha256:" + digest}
+}
+
+func (l *testLayout) jsonBlob(v interface{}) ociDescriptor {
+	data, err := json.Marshal(v)
+	require.NoError(l.t, err)
+	return l.blob(data)
+}
+
+func (l *testLayout) image(layers ...[]byte) ociDescriptor {
+	manifest := ociManifest{}
+	for _, layer := range layers {
+		manifest.Layers = append(manifest.Layers, l.blob(layer))
+	}
+	return l.jsonBlob(manifest)
+}
+
+func (l *testLayout) index(manifests ...ociDescriptor) {
+	data, err := json.Marshal(ociManifest{Manifests: manifests})
+	require.NoError(l.t, err)
+	require.NoError(l.t, ioutil.WriteFile(filepath.Join(l.dir, ociIndexFile), data, 0644))
+}
+
+// archive writes a tar archive of the layout to path.
+func (l *testLayout) archive(path string) {
+	f, err := os.Create(path)
+	require.NoError(l.t, err)
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	require.NoError(l.t, filepath.Walk(l.dir, func(hostPath string, info os.FileInfo, err error) error {
+		require.NoError(l.t, err)
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		name, err := filepath.Rel(l.dir, hostPath)
+		require.NoError(l.t, err)
+		data, err := ioutil.ReadFile(hostPath)
+		require.NoError(l.t, err)
+
+		require.NoError(l.t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "./" + name, Mode: 0644, Size: int64(len(data))}))
+		_, err = tw.Write(data)
+		return err
+	}))
+	require.NoError(l.t, tw.Close())
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestUnpackOCIImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestUnpackOCIImage")
+	require.NoError(t, err)
+	defer removeStagingDir(dir)
+
+	layout := newTestLayout(t, filepath.Join(dir, "layout"))
+	layout.index(layout.image(
+		testLayer(t, false,
+			tarDir("etc/", 0755),
+			tarFile("etc/hostname", "base", 0644),
+			tarFile("etc/removed", "removed", 0644),
+			tarDir("usr/lib/", 0755),
+			tarSymlink("lib", "usr/lib"),
+			tarDir("var/cache/old/", 0755),
+			tarFile("var/cache/old/file", "old", 0644),
+			&tar.Header{Typeflag: tar.TypeReg, Name: "bin/su", Mode: 04755, Uid: 1000, Gid: 1001},
+			tarDir("ro/", 0555),
+		),
+		testLayer(t, true,
+			tarFile("etc/.wh.removed", "", 0644),
+			tarFile("var/cache/new", "new", 0600),
+			tarFile("var/cache/.wh..wh..opq", "", 0644),
+			tarFile("lib/libc.so", "libc", 0755),
+			tarFile("../../escape", "escape", 0644),
+			tarSymlink("abs", "/../.."),
+			tarFile("abs/etc/through-abs", "abs", 0644),
+			tarFile("etc/hostname", "top", 0644),
+			&tar.Header{Typeflag: tar.TypeLink, Name: "etc/hostname.link", Linkname: "etc/hostname"},
+			tarFile("ro/file", "ro", 0644),
+		),
+	))
+
+	staging := filepath.Join(dir, "staging")
+	require.NoError(t, os.Mkdir(staging, 0700))
+	u := newUnpacker(staging)
+	require.NoError(t, unpackOCIImage(context.Background(), u, layout.dir, ""))
+
+	assert.Equal(t, "top", readFile(t, filepath.Join(staging, "etc", "hostname")))
+	assert.Equal(t, "top", readFile(t, filepath.Join(staging, "etc", "hostname.link")))
+	assert.NoFileExists(t, filepath.Join(staging, "etc", "removed"))
+	assert.NoFileExists(t, filepath.Join(staging, "etc", ".wh.removed"))
+
+	assert.Equal(t, "new", readFile(t, filepath.Join(staging, "var", "cache", "new")))
+	assert.NoDirExists(t, filepath.Join(staging, "var", "cache", "old"))
+	assert.NoFileExists(t, filepath.Join(staging, "var", "cache", opaqueWhiteout))
+
+	assert.Equal(t, "libc", readFile(t, filepath.Join(staging, "usr", "lib", "libc.so")))
+	assert.Equal(t, "escape", readFile(t, filepath.Join(staging, "escape")))
+	assert.Equal(t, "abs", readFile(t, filepath.Join(staging, "etc", "through-abs")))
+	assert.Equal(t, "ro", readFile(t, filepath.Join(staging, "ro", "file")))
+
+	info, err := os.Stat(filepath.Join(staging, "bin", "su"))
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSetuid|0755, info.Mode())
+	assert.Equal(t, testModTime, info.ModTime())
+
+	info, err = os.Stat(filepath.Join(staging, "ro"))
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeDir|0555, info.Mode())
+
+	info, err = os.Stat(staging)
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeDir|0755, info.Mode())
+
+	if u.forceFixups {
+		assert.Equal(t, fixup{mode: os.ModeSetuid | 0755, uid: 1000, gid: 1001, modTime: testModTime}, u.fixups["/bin/su"])
+		assert.NotContains(t, u.fixups, "/var/cache/old/file", "removed files need no fixup")
+	} else {
+		stat := info.Sys().(*syscall.Stat_t)
+		assert.Equal(t, uint32(0), stat.Uid)
+
+		info, err = os.Stat(filepath.Join(staging, "bin", "su"))
+		require.NoError(t, err)
+		stat = info.Sys().(*syscall.Stat_t)
+		assert.Equal(t, uint32(1000), stat.Uid)
+		assert.Equal(t, uint32(1001), stat.Gid)
+		assert.Empty(t, u.fixups)
+	}
+}
+
+func TestUnpackOCIImageSelection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestUnpackOCIImageSelection")
+	require.NoError(t, err)
+	defer removeStagingDir(dir)
+
+	layout := newTestLayout(t, filepath.Join(dir, "layout"))
+
+	hostImage := layout.image(testLayer(t, false, tarFile("arch", runtime.GOARCH, 0644)))
+	hostImage.Platform = &ociPlatform{OS: "linux", Architecture: runtime.GOARCH}
+	otherImage := layout.image(testLayer(t, false, tarFile("arch", "other", 0644)))
+	otherImage.Platform = &ociPlatform{OS: "linux", Architecture: "other"}
+
+	multiPlatform := layout.jsonBlob(ociManifest{Manifests: []ociDescriptor{otherImage, hostImage}})
+	multiPlatform.Annotations = map[string]string{refNameAnnotation: "latest"}
+
+	single := layout.image(testLayer(t, false, tarFile("arch", "single", 0644)))
+	single.Annotations = map[string]string{containerdNameAnnotation: "docker.io/library/single:latest"}
+
+	layout.index(multiPlatform, single)
+
+	archivePath := filepath.Join(dir, "layout.tar")
+	layout.archive(archivePath)
+
+	for _, c := range []struct {
+		layoutPath, ref, expected string
+	}{
+		{layoutPath: layout.dir, ref: "latest", expected: runtime.GOARCH},
+		{layoutPath: archivePath, ref: "latest", expected: runtime.GOARCH},
+		{layoutPath: archivePath, ref: "docker.io/library/single:latest", expected: "single"},
+	} {
+		staging, err := ioutil.TempDir(dir, "staging")
+		require.NoError(t, err)
+
+		require.NoError(t, unpackOCIImage(context.Background(), newUnpacker(staging), c.layoutPath, c.ref))
+		assert.Equal(t, c.expected, readFile(t, filepath.Join(staging, "arch")), "unpacking %q from %q", c.ref, c.layoutPath)
+	}
+
+	for _, c := range []struct {
+		layoutPath, ref, expectedErr string
+	}{
+		{layoutPath: layout.dir, expectedErr: "selected by name"},
+		{layoutPath: layout.dir, ref: "missing", expectedErr: "not found"},
+		{layoutPath: filepath.Join(dir, "missing"), expectedErr: "failed to stat"},
+		{layoutPath: dir, expectedErr: "not an OCI image layout"},
+	} {
+		staging, err := ioutil.TempDir(dir, "staging")
+		require.NoError(t, err)
+
+		err = unpackOCIImage(context.Background(), newUnpacker(staging), c.layoutPath, c.ref)
+		require.Error(t, err, "unpacking %q from %q", c.ref, c.layoutPath)
+		assert.Contains(t, err.Error(), c.expectedErr)
+	}
+
+	// corrupt the layer of the single image
+	var manifest ociManifest
+	require.NoError(t, readBlobJSON(dirLayout(layout.dir), single, &manifest))
+	layerPath := filepath.Join(layout.dir, "blobs", "sha256", strings.TrimPrefix(manifest.Layers[0].Digest, "sha256:"))
+	require.NoError(t, ioutil.WriteFile(layerPath, testLayer(t, false, tarFile("arch", "corrupt", 0644)), 0644))
+
+	staging, err := ioutil.TempDir(dir, "staging")
+	require.NoError(t, err)
+	err = unpackOCIImage(context.Background(), newUnpacker(staging), layout.dir, "docker.io/library/single:latest")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "does not match its digest")
+}
+
+func requiresE2fsprogs(t *testing.T) {
+	for _, tool := range []string{defaultMkfsPath, defaultDebugfsPath} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is required", tool)
+		}
+	}
+}
+
+// debugfs runs a read-only debugfs request against the image.
+func debugfs(t *testing.T, imagePath, request string) string {
+	t.Helper()
+
+	output, err := exec.Command(defaultDebugfsPath, "-R", request, imagePath).Output()
+	require.NoError(t, err)
+	return string(output)
+}
+
+func TestBuild(t *testing.T) {
+	requiresE2fsprogs(t)
+
+	dir, err := ioutil.TempDir("", "TestBuild")
+	require.NoError(t, err)
+	defer removeStagingDir(dir)
+
+	layout := newTestLayout(t, filepath.Join(dir, "layout"))
+	layout.index(layout.image(
+		testLayer(t, true,
+			tarFile("etc/hostname", "vm\n", 0644),
+			&tar.Header{Typeflag: tar.TypeChar, Name: "dev/console", Mode: 0600, Devmajor: 5, Devminor: 1},
+		),
+	))
+	archivePath := filepath.Join(dir, "layout.tar")
+	layout.archive(archivePath)
+
+	imagePath := filepath.Join(dir, "rootfs.ext4")
+	img, err := Build(context.Background(), imagePath, Config{
+		OCIImage: archivePath,
+		Headroom: 8 << 20,
+		Label:    "rootfs",
+		TempDir:  dir,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, imagePath, img.Path)
+
+	info, err := os.Stat(imagePath)
+	require.NoError(t, err)
+	assert.Equal(t, img.Size, info.Size())
+	assert.True(t, img.Size >= 8<<20, "image should have room for the headroom")
+
+	assert.Equal(t, "vm\n", debugfs(t, imagePath, "cat /etc/hostname"))
+	assert.Contains(t, debugfs(t, imagePath, "stat /dev/console"), "Type: character special")
+	assert.Contains(t, debugfs(t, imagePath, "stats"), "Filesystem volume name:   rootfs")
+
+	output, err := exec.Command("e2fsck", "-fn", imagePath).CombinedOutput()
+	assert.NoError(t, err, string(output))
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 3, "no staging directory or temporary file should be left behind")
+
+	drives := img.WithRootDrive(firecracker.DrivesBuilder{}).Build()
+	require.Len(t, drives, 1)
+	assert.Equal(t, imagePath, firecracker.StringValue(drives[0].PathOnHost))
+}
+
+func TestBuildSizing(t *testing.T) {
+	requiresE2fsprogs(t)
+
+	dir, err := ioutil.TempDir("", "TestBuildSizing")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// many small files need inodes and directory blocks more than space
+	sourceDir := filepath.Join(dir, "source")
+	for i := 0; i < 20; i++ {
+		subDir := filepath.Join(sourceDir, "dir", string(rune('a'+i)))
+		require.NoError(t, os.MkdirAll(subDir, 0755))
+		for j := 0; j < 200; j++ {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(subDir, strings.Repeat("f", 40)+string(rune('a'+j%26))+string(rune('a'+j/26))), []byte("x"), 0644))
+		}
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(sourceDir, "large"), make([]byte, 3<<20), 0644))
+
+	imagePath := filepath.Join(dir, "rootfs.ext4")
+	img, err := Build(context.Background(), imagePath, Config{SourceDir: sourceDir, Headroom: 1 << 20})
+	require.NoError(t, err)
+	assert.Contains(t, debugfs(t, imagePath, "ls /dir/t"), strings.Repeat("f", 40)+"rh")
+
+	_, err = Build(context.Background(), imagePath, Config{SourceDir: sourceDir, Size: 2 << 20})
+	require.Error(t, err, "an image too small for its contents should fail")
+
+	// the previous image is left in place
+	info, err := os.Stat(imagePath)
+	require.NoError(t, err)
+	assert.Equal(t, img.Size, info.Size())
+}
+
+func TestApplyFixups(t *testing.T) {
+	requiresE2fsprogs(t)
+
+	dir, err := ioutil.TempDir("", "TestApplyFixups")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sourceDir := filepath.Join(dir, "source")
+	require.NoError(t, os.MkdirAll(filepath.Join(sourceDir, "dev"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(sourceDir, "su"), nil, 0755))
+
+	imagePath := filepath.Join(dir, "rootfs.ext4")
+	_, err = Build(context.Background(), imagePath, Config{SourceDir: sourceDir, Headroom: 1 << 20})
+	require.NoError(t, err)
+
+	require.NoError(t, applyFixups(context.Background(), Config{}, imagePath, map[string]fixup{
+		"/":   {mode: os.ModeDir | 0755},
+		"/su": {mode: os.ModeSetuid | 0755, uid: 1000, gid: 1001},
+		"/dev/vd a": {
+			mode: os.ModeDevice | 0660, gid: 6, modTime: testModTime,
+			device: true, major: 254, minor: 1,
+		},
+	}))
+
+	su := debugfs(t, imagePath, "stat /su")
+	assert.Contains(t, su, "Mode:  04755")
+	assert.Contains(t, su, "User:  1000   Group:  1001")
+
+	device := debugfs(t, imagePath, `stat "/dev/vd a"`)
+	assert.Contains(t, device, "Type: block special")
+	assert.Contains(t, device, "Mode:  0660")
+	assert.Contains(t, device, "Group:     6")
+	assert.Contains(t, device, "Device major/minor number: 254:01")
+
+	err = applyFixups(context.Background(), Config{}, imagePath, map[string]fixup{"/missing": {}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "File not found")
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, cfg := range []Config{
+		{},
+		{SourceDir: "dir", OCIImage: "image.tar"},
+		{SourceDir: "dir", OCIRef: "latest"},
+		{SourceDir: "dir", Size: -1},
+		{SourceDir: "dir", Headroom: -1},
+		{SourceDir: "dir", Size: 1 << 30, Headroom: 1 << 20},
+	} {
+		assert.Error(t, cfg.Validate(), "%+v should be invalid", cfg)
+	}
+
+	assert.NoError(t, Config{OCIImage: "image.tar", OCIRef: "latest", Headroom: 1 << 20}.Validate())
+}
@@ -0,0 +1,274 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	// maxJailerIDLength is the longest VM id accepted by the jailer.
+	maxJailerIDLength = 64
+
+	// minGuestCID is the lowest context identifier that may be assigned to a
+	// guest. CIDs 0, 1 and 2 are reserved, see vsock(7).
+	minGuestCID = 3
+
+	// maxIfNameLength is the longest network interface name accepted by the
+	// kernel, which is IFNAMSIZ minus the trailing NUL byte.
+	maxIfNameLength = 15
+)
+
+var jailerIDPattern = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+
+// FieldError describes a single invalid configuration value.
+type FieldError struct {
+	// Field is the path to the offending value, such as
+	// "Drives[1].PathOnHost" or "JailerCfg.ID".
+	Field string
+	// Reason is a human readable description of the problem.
+	Reason string
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Reason)
+}
+
+// ValidationErrors is the error returned when a configuration fails
+// validation. It holds every problem that was found rather than only the
+// first one, so that callers can report all of them at once.
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, fieldErr := range e {
+		msgs = append(msgs, fieldErr.Error())
+	}
+
+	return fmt.Sprintf("invalid configuration, %d error(s) found: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// ErrorOrNil returns nil if no errors were recorded, otherwise it returns
+// the ValidationErrors as an error.
+func (e ValidationErrors) ErrorOrNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+// add records a new problem for the given field.
+func (e *ValidationErrors) add(field, format string, args ...interface{}) {
+	*e = append(*e, FieldError{
+		Field:  field,
+		Reason: fmt.Sprintf(format, args...),
+	})
+}
+
+func (cfg *Config) validateFiles(errs *ValidationErrors) {
+	if _, err := os.Stat(cfg.KernelImagePath); err != nil {
+		errs.add("KernelImagePath", "failed to stat kernel image path, %q: %v", cfg.KernelImagePath, err)
+	} else if err := checkKernelImage(cfg.KernelImagePath); err != nil {
+		errs.add("KernelImagePath", "invalid kernel image %q: %v", cfg.KernelImagePath, err)
+	}
+
+	if cfg.InitrdPath != "" {
+		if _, err := os.Stat(cfg.InitrdPath); err != nil {
+			errs.add("InitrdPath", "failed to stat initrd image path, %q: %v", cfg.InitrdPath, err)
+		} else if _, err := InspectInitrd(cfg.InitrdPath); err != nil {
+			errs.add("InitrdPath", "invalid initrd %q: %v", cfg.InitrdPath, err)
+		}
+	}
+
+	for i, drive := range cfg.Drives {
+		hostPath := StringValue(drive.PathOnHost)
+		if _, err := os.Stat(hostPath); err != nil {
+			errs.add(fmt.Sprintf("Drives[%d].PathOnHost", i), "failed to stat host path, %q: %v", hostPath, err)
+		} else if BoolValue(drive.IsRootDevice) && drive.Partuuid != "" {
+			validatePartuuid(errs, fmt.Sprintf("Drives[%d].Partuuid", i), hostPath, drive.Partuuid)
+		}
+	}
+
+	// Check the non-existence of some files:
+	if _, err := os.Stat(cfg.SocketPath); err == nil {
+		errs.add("SocketPath", "socket %s already exists", cfg.SocketPath)
+	}
+}
+
+// validatePartuuid checks that the partition table of the image at hostPath
+// has a partition with the given unique ID.
+func validatePartuuid(errs *ValidationErrors, field, hostPath, partuuid string) {
+	pt, err := ReadPartitionTable(hostPath)
+	if err == ErrNoPartitionTable {
+		errs.add(field, "partuuid %q is set but %q has no partition table", partuuid, hostPath)
+		return
+	} else if err != nil {
+		errs.add(field, "failed to read partition table of %q: %v", hostPath, err)
+		return
+	}
+
+	if _, err := pt.PartitionByPartUUID(partuuid); err != nil {
+		errs.add(field, "invalid partuuid of %q: %v", hostPath, err)
+	}
+}
+
+func (cfg *Config) validateDrives(errs *ValidationErrors) {
+	driveIDs := make(map[string]int)
+	rootDrive := -1
+	for i, drive := range cfg.Drives {
+		driveID := StringValue(drive.DriveID)
+		if driveID == "" {
+			errs.add(fmt.Sprintf("Drives[%d].DriveID", i), "drive id must be specified")
+		} else if prev, ok := driveIDs[driveID]; ok {
+			errs.add(fmt.Sprintf("Drives[%d].DriveID", i), "duplicate drive id %q, also used by Drives[%d]", driveID, prev)
+		} else {
+			driveIDs[driveID] = i
+		}
+
+		if BoolValue(drive.IsRootDevice) {
+			if rootDrive >= 0 {
+				errs.add(fmt.Sprintf("Drives[%d].IsRootDevice", i), "only one root drive may be specified, Drives[%d] is already the root drive", rootDrive)
+			} else {
+				rootDrive = i
+			}
+		}
+	}
+}
+
+func (cfg *Config) validateVsocks(errs *ValidationErrors) {
+	cids := make(map[uint32]int)
+	for i, dev := range cfg.VsockDevices {
+		if dev.CID < minGuestCID {
+			errs.add(fmt.Sprintf("VsockDevices[%d].CID", i), "CID must be at least %d, got %d", minGuestCID, dev.CID)
+		} else if prev, ok := cids[dev.CID]; ok {
+			errs.add(fmt.Sprintf("VsockDevices[%d].CID", i), "duplicate CID %d, also used by VsockDevices[%d]", dev.CID, prev)
+		} else {
+			cids[dev.CID] = i
+		}
+
+		if dev.Path == "" {
+			errs.add(fmt.Sprintf("VsockDevices[%d].Path", i), "path must be specified")
+		}
+	}
+}
+
+func (cfg *Config) validateNetworkInterfaceFields(errs *ValidationErrors) {
+	for i, iface := range cfg.NetworkInterfaces {
+		if iface.StaticConfiguration != nil {
+			field := fmt.Sprintf("NetworkInterfaces[%d].StaticConfiguration", i)
+			validateMacAddress(errs, field+".MacAddress", iface.StaticConfiguration.MacAddress)
+			validateIfName(errs, field+".HostDevName", iface.StaticConfiguration.HostDevName)
+		}
+
+		if iface.CNIConfiguration != nil {
+			validateIfName(errs, fmt.Sprintf("NetworkInterfaces[%d].CNIConfiguration.IfName", i), iface.CNIConfiguration.IfName)
+		}
+	}
+}
+
+func validateMacAddress(errs *ValidationErrors, field, mac string) {
+	if mac == "" {
+		return
+	}
+
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		errs.add(field, "invalid MAC address %q: %v", mac, err)
+		return
+	}
+
+	if len(hwAddr) != 6 {
+		errs.add(field, "MAC address %q must be a 48-bit EUI-48 address", mac)
+		return
+	}
+
+	// the least significant bit of the first octet marks a multicast address
+	if hwAddr[0]&0x01 != 0 {
+		errs.add(field, "MAC address %q must be a unicast address", mac)
+	}
+}
+
+func validateIfName(errs *ValidationErrors, field, name string) {
+	if len(name) > maxIfNameLength {
+		errs.add(field, "interface name %q is longer than %d characters", name, maxIfNameLength)
+	}
+}
+
+func (cfg *Config) validateMachineCfg(errs *ValidationErrors) {
+	vcpuCount := Int64Value(cfg.MachineCfg.VcpuCount)
+	if cfg.MachineCfg.VcpuCount == nil || vcpuCount < 1 {
+		errs.add("MachineCfg.VcpuCount", "machine needs a nonzero VcpuCount")
+	}
+
+	if cfg.MachineCfg.MemSizeMib == nil ||
+		Int64Value(cfg.MachineCfg.MemSizeMib) < 1 {
+		errs.add("MachineCfg.MemSizeMib", "machine needs a nonzero amount of memory")
+	}
+
+	if cfg.MachineCfg.HtEnabled == nil {
+		errs.add("MachineCfg.HtEnabled", "machine needs a setting for ht_enabled")
+	} else if BoolValue(cfg.MachineCfg.HtEnabled) && vcpuCount > 1 && vcpuCount%2 != 0 {
+		errs.add("MachineCfg.VcpuCount", "VcpuCount must be 1 or an even number when hyperthreading is enabled, got %d", vcpuCount)
+	}
+}
+
+func (cfg *Config) validateJailerCfg(errs *ValidationErrors) {
+	jailerCfg := cfg.JailerCfg
+
+	hasRoot := false
+	for _, drive := range cfg.Drives {
+		if BoolValue(drive.IsRootDevice) {
+			hasRoot = true
+			break
+		}
+	}
+
+	if !hasRoot {
+		errs.add("Drives", "a root drive must be present in the drive list")
+	}
+
+	if jailerCfg.ChrootStrategy == nil {
+		errs.add("JailerCfg.ChrootStrategy", "ChrootStrategy cannot be nil")
+	}
+
+	if len(jailerCfg.ExecFile) == 0 {
+		errs.add("JailerCfg.ExecFile", "exec file must be specified when using jailer mode")
+	}
+
+	switch {
+	case len(jailerCfg.ID) == 0:
+		errs.add("JailerCfg.ID", "id must be specified when using jailer mode")
+	case len(jailerCfg.ID) > maxJailerIDLength:
+		errs.add("JailerCfg.ID", "id must be at most %d characters, got %d", maxJailerIDLength, len(jailerCfg.ID))
+	case !jailerIDPattern.MatchString(jailerCfg.ID):
+		errs.add("JailerCfg.ID", "id %q may only contain alphanumeric characters and hyphens", jailerCfg.ID)
+	}
+
+	if jailerCfg.GID == nil {
+		errs.add("JailerCfg.GID", "GID must be specified when using jailer mode")
+	}
+
+	if jailerCfg.UID == nil {
+		errs.add("JailerCfg.UID", "UID must be specified when using jailer mode")
+	}
+
+	if jailerCfg.NumaNode == nil {
+		errs.add("JailerCfg.NumaNode", "NumaNode must be specified when using jailer mode")
+	}
+}
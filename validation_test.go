@@ -0,0 +1,175 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+)
+
+func fieldsOf(t *testing.T, err error) []string {
+	t.Helper()
+
+	validationErrs, ok := err.(ValidationErrors)
+	require.True(t, ok, "expected ValidationErrors, got %T: %v", err, err)
+
+	var fields []string
+	for _, fieldErr := range validationErrs {
+		fields = append(fields, fieldErr.Field)
+	}
+	return fields
+}
+
+func TestConfigValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestConfigValidate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	kernelPath := filepath.Join(dir, "vmlinux")
+	writeTestKernel(t, kernelPath)
+	rootPath := filepath.Join(dir, "root.img")
+	require.NoError(t, ioutil.WriteFile(rootPath, nil, 0600))
+
+	cfg := Config{
+		SocketPath:      filepath.Join(dir, "fc.sock"),
+		KernelImagePath: kernelPath,
+		Drives:          NewDrivesBuilder(rootPath).Build(),
+		MachineCfg: models.MachineConfiguration{
+			VcpuCount:  Int64(2),
+			MemSizeMib: Int64(256),
+			HtEnabled:  Bool(true),
+		},
+		VsockDevices: []VsockDevice{{Path: "vsock.sock", CID: 3}},
+		NetworkInterfaces: NetworkInterfaces{
+			validStaticNetworkInterface,
+		},
+	}
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Drives = append(cfg.Drives,
+		models.Drive{
+			DriveID:      String(rootDriveName),
+			PathOnHost:   String(filepath.Join(dir, "missing.img")),
+			IsRootDevice: Bool(true),
+		},
+	)
+	cfg.MachineCfg.VcpuCount = Int64(3)
+	cfg.VsockDevices = append(cfg.VsockDevices,
+		VsockDevice{Path: "other.sock", CID: 3},
+		VsockDevice{Path: "reserved.sock", CID: 2},
+	)
+	cfg.NetworkInterfaces = NetworkInterfaces{
+		{
+			StaticConfiguration: &StaticNetworkConfiguration{
+				MacAddress:  "01:00:5e:00:00:01",
+				HostDevName: "a-tap-name-that-is-too-long",
+			},
+		},
+	}
+
+	err = cfg.Validate()
+	require.Error(t, err)
+	assert.Equal(t, []string{
+		"Drives[1].PathOnHost",
+		"Drives[1].DriveID",
+		"Drives[1].IsRootDevice",
+		"VsockDevices[1].CID",
+		"VsockDevices[2].CID",
+		"NetworkInterfaces[0].StaticConfiguration.MacAddress",
+		"NetworkInterfaces[0].StaticConfiguration.HostDevName",
+		"MachineCfg.VcpuCount",
+	}, fieldsOf(t, err))
+	assert.True(t, strings.HasPrefix(err.Error(), "invalid configuration, 8 error(s) found: "), err.Error())
+}
+
+func TestConfigValidateBootImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestConfigValidateBootImages")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a bzImage is the usual mistake
+	kernelPath := filepath.Join(dir, "bzImage")
+	bzImage := make([]byte, 1024)
+	copy(bzImage[bzImageMagicOffset:], bzImageMagic)
+	require.NoError(t, ioutil.WriteFile(kernelPath, bzImage, 0600))
+
+	initrdPath := filepath.Join(dir, "initrd.img")
+	require.NoError(t, ioutil.WriteFile(initrdPath, []byte("not an initrd"), 0600))
+
+	cfg := Config{
+		SocketPath:      filepath.Join(dir, "fc.sock"),
+		KernelImagePath: kernelPath,
+		InitrdPath:      initrdPath,
+		MachineCfg: models.MachineConfiguration{
+			VcpuCount:  Int64(1),
+			MemSizeMib: Int64(256),
+			HtEnabled:  Bool(false),
+		},
+	}
+
+	err = cfg.Validate()
+	require.Error(t, err)
+	assert.Equal(t, []string{"KernelImagePath", "InitrdPath"}, fieldsOf(t, err))
+	assert.Contains(t, err.Error(), "bzImage")
+}
+
+func TestConfigValidateJailer(t *testing.T) {
+	cfg := Config{
+		Drives: NewDrivesBuilder("root.img").Build(),
+		MachineCfg: models.MachineConfiguration{
+			VcpuCount:  Int64(1),
+			MemSizeMib: Int64(256),
+			HtEnabled:  Bool(false),
+		},
+		JailerCfg: &JailerConfig{
+			ID:             "my-vm-1",
+			UID:            Int(123),
+			GID:            Int(100),
+			NumaNode:       Int(0),
+			ExecFile:       "/usr/bin/firecracker",
+			ChrootStrategy: NewNaiveChrootStrategy("/srv/jailer", "vmlinux"),
+		},
+	}
+	assert.NoError(t, cfg.ValidateJailer())
+
+	cfg.Drives = nil
+	cfg.JailerCfg.ID = "my_vm"
+	cfg.JailerCfg.NumaNode = nil
+	err := cfg.ValidateJailer()
+	require.Error(t, err)
+	assert.Equal(t, []string{"Drives", "JailerCfg.ID", "JailerCfg.NumaNode"}, fieldsOf(t, err))
+	assert.Contains(t, err.Error(), "NumaNode must be specified")
+
+	cfg.Drives = NewDrivesBuilder("root.img").Build()
+	cfg.JailerCfg.ID = strings.Repeat("a", maxJailerIDLength+1)
+	cfg.JailerCfg.NumaNode = Int(0)
+	assert.Equal(t, []string{"JailerCfg.ID"}, fieldsOf(t, cfg.ValidateJailer()))
+
+	// only the jailer configuration is checked when validation is disabled
+	cfg.DisableValidation = true
+	cfg.MachineCfg.VcpuCount = nil
+	cfg.JailerCfg.ExecFile = ""
+	assert.Equal(t, []string{"JailerCfg.ExecFile", "JailerCfg.ID"}, fieldsOf(t, cfg.ValidateJailer()))
+
+	cfg.JailerCfg = nil
+	assert.NoError(t, cfg.ValidateJailer())
+}
@@ -0,0 +1,264 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxVsockAckLength bounds the size of the "OK <port>\n" acknowledgement
+	// sent back by Firecracker.
+	maxVsockAckLength = 32
+
+	defaultVsockHandshakeTimeout = 5 * time.Second
+)
+
+// ErrNoVsockDevice is returned when a vsock operation is requested on a
+// Machine that was not configured with any VsockDevices.
+var ErrNoVsockDevice = errors.New("no vsock device configured")
+
+// VsockDialer connects to ports inside the guest through the unix domain
+// socket backing a Firecracker vsock device. Firecracker requires that each
+// host-initiated connection start with a "CONNECT <port>\n" request, which is
+// answered with "OK <host port>\n" once the guest accepts the connection.
+//
+// See https://github.com/firecracker-microvm/firecracker/blob/master/docs/vsock.md
+type VsockDialer struct {
+	// Path is the host path of the vsock device's unix domain socket.
+	Path string
+
+	// HandshakeTimeout bounds how long to wait for Firecracker to acknowledge
+	// the CONNECT request when the context has no earlier deadline. If zero,
+	// a default of 5 seconds is used.
+	HandshakeTimeout time.Duration
+}
+
+// NewVsockDialer returns a VsockDialer for the vsock unix domain socket at the
+// given host path.
+func NewVsockDialer(udsPath string) *VsockDialer {
+	return &VsockDialer{
+		Path: udsPath,
+	}
+}
+
+// DialPort connects to the given vsock port inside the guest.
+func (d *VsockDialer) DialPort(ctx context.Context, port uint32) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", d.Path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to dial vsock socket %q", d.Path)
+	}
+
+	if err := d.handshake(ctx, conn, port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// DialContext connects to the vsock port found in the port part of address.
+// The host part of address is ignored, which allows the dialer to be used
+// wherever a net.Dialer's DialContext is expected, such as an http.Transport
+// or a gRPC context dialer.
+func (d *VsockDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	port, err := vsockPortFromAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.DialPort(ctx, port)
+}
+
+// HTTPTransport returns an http.Transport that sends all requests over the
+// vsock device to the port given in the request URL, for example
+// "http://guest:8080/".
+func (d *VsockDialer) HTTPTransport() *http.Transport {
+	return &http.Transport{
+		DialContext: d.DialContext,
+	}
+}
+
+func (d *VsockDialer) handshake(ctx context.Context, conn net.Conn, port uint32) error {
+	timeout := d.HandshakeTimeout
+	if timeout == 0 {
+		timeout = defaultVsockHandshakeTimeout
+	}
+
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	if err := conn.SetDeadline(deadline); err != nil {
+		return errors.Wrap(err, "failed to set vsock handshake deadline")
+	}
+
+	if _, err := fmt.Fprintf(conn, "CONNECT %d\n", port); err != nil {
+		return errors.Wrapf(err, "failed to send CONNECT for vsock port %d", port)
+	}
+
+	ack, err := readVsockAck(conn)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read CONNECT acknowledgement for vsock port %d", port)
+	}
+
+	if !strings.HasPrefix(ack, "OK ") {
+		return errors.Errorf("unexpected CONNECT acknowledgement for vsock port %d: %q", port, ack)
+	}
+
+	// clear the handshake deadline so it does not apply to the caller's usage
+	return conn.SetDeadline(time.Time{})
+}
+
+// readVsockAck reads a single newline terminated line from conn. It reads one
+// byte at a time so that no data sent by the guest after the acknowledgement
+// is consumed.
+func readVsockAck(conn net.Conn) (string, error) {
+	var line []byte
+	buf := make([]byte, 1)
+	for len(line) < maxVsockAckLength {
+		if _, err := conn.Read(buf); err != nil {
+			return string(line), err
+		}
+
+		if buf[0] == '\n' {
+			return string(line), nil
+		}
+
+		line = append(line, buf[0])
+	}
+
+	return string(line), errors.Errorf("acknowledgement exceeds %d bytes", maxVsockAckLength)
+}
+
+func vsockPortFromAddress(address string) (uint32, error) {
+	portStr := address
+	if _, p, err := net.SplitHostPort(address); err == nil {
+		portStr = p
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 32)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid vsock port in address %q", address)
+	}
+
+	return uint32(port), nil
+}
+
+// vsockDevice returns the vsock device the machine was configured with.
+func (m *Machine) vsockDevice() (*VsockDevice, error) {
+	if len(m.Cfg.VsockDevices) == 0 {
+		return nil, ErrNoVsockDevice
+	}
+
+	return &m.Cfg.VsockDevices[0], nil
+}
+
+// VsockDialer returns a VsockDialer for the machine's vsock device. When the
+// jailer is used, the device path is translated to its location inside the
+// jail.
+func (m *Machine) VsockDialer() (*VsockDialer, error) {
+	dev, err := m.vsockDevice()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewVsockDialer(m.hostPath(dev.Path)), nil
+}
+
+// DialVsock connects to the given vsock port inside the guest and returns the
+// connection once Firecracker has acknowledged it.
+func (m *Machine) DialVsock(ctx context.Context, port uint32) (net.Conn, error) {
+	dialer, err := m.VsockDialer()
+	if err != nil {
+		return nil, err
+	}
+
+	return dialer.DialPort(ctx, port)
+}
+
+// ListenVsock returns a listener that accepts connections initiated by the
+// guest to the given vsock port. Firecracker forwards such connections to the
+// unix domain socket "<uds_path>_<port>" on the host, which is created inside
+// the jail when the jailer is used. The listener is closed, and its socket
+// removed, when the VMM exits.
+func (m *Machine) ListenVsock(port uint32) (net.Listener, error) {
+	dev, err := m.vsockDevice()
+	if err != nil {
+		return nil, err
+	}
+
+	path := vsockListenerPath(m.hostPath(dev.Path), port)
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen on vsock port %d at %q", port, path)
+	}
+
+	if jailerCfg := m.Cfg.JailerCfg; jailerCfg != nil && jailerCfg.UID != nil && jailerCfg.GID != nil {
+		// the jailed Firecracker process must be able to connect to the socket
+		if err := os.Chown(path, *jailerCfg.UID, *jailerCfg.GID); err != nil {
+			listener.Close()
+			return nil, errors.Wrapf(err, "failed to chown vsock listener socket %q", path)
+		}
+	}
+
+	go func() {
+		<-m.exitCh
+		if err := listener.Close(); err != nil {
+			m.logger.WithError(err).Debugf("failed to close vsock listener on port %d", port)
+		}
+	}()
+
+	m.logger.Debugf("Listening for guest vsock connections on port %d at %s", port, path)
+	return listener, nil
+}
+
+// vsockListenerPath returns the path of the unix domain socket Firecracker
+// connects to for guest-initiated connections to the given port.
+func vsockListenerPath(udsPath string, port uint32) string {
+	return fmt.Sprintf("%s_%d", udsPath, port)
+}
+
+// removeStaleSocket removes a unix domain socket left behind at path, for
+// example by a previous process that crashed. Paths that are not sockets are
+// left in place.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to stat %q", path)
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.Errorf("%q exists and is not a socket", path)
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,212 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firecracker
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeVsockServer emulates the host side of a Firecracker vsock device. It
+// accepts CONNECT requests for the given ports and hands the connection to
+// serve after acknowledging it.
+func fakeVsockServer(t *testing.T, path string, ports map[uint32]func(net.Conn)) net.Listener {
+	t.Helper()
+
+	listener, err := net.Listen("unix", path)
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				reader := bufio.NewReader(conn)
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					conn.Close()
+					return
+				}
+
+				var port uint32
+				if _, err := fmt.Sscanf(line, "CONNECT %d\n", &port); err != nil {
+					conn.Close()
+					return
+				}
+
+				serve, ok := ports[port]
+				if !ok {
+					conn.Close()
+					return
+				}
+
+				fmt.Fprintf(conn, "OK 1073741824\n")
+				serve(conn)
+			}()
+		}
+	}()
+
+	return listener
+}
+
+func TestVsockDialer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestVsockDialer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "v.sock")
+	listener := fakeVsockServer(t, path, map[uint32]func(net.Conn){
+		52: func(conn net.Conn) {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		},
+		80: func(conn net.Conn) {
+			defer conn.Close()
+			req, err := http.ReadRequest(bufio.NewReader(conn))
+			if err != nil {
+				return
+			}
+			body := "hello from " + req.URL.Path
+			fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+		},
+	})
+	defer listener.Close()
+
+	dialer := NewVsockDialer(path)
+
+	conn, err := dialer.DialPort(context.Background(), 52)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("ping\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ping\n", line)
+	conn.Close()
+
+	_, err = dialer.DialPort(context.Background(), 53)
+	assert.Error(t, err, "expected dial of a port without a listener to fail")
+
+	client := http.Client{Transport: dialer.HTTPTransport()}
+	resp, err := client.Get("http://guest:80/status")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello from /status", string(body))
+}
+
+func TestVsockPortFromAddress(t *testing.T) {
+	for _, c := range []struct {
+		address string
+		port    uint32
+		err     bool
+	}{
+		{address: "guest:1024", port: 1024},
+		{address: "1024", port: 1024},
+		{address: "guest:http", err: true},
+		{address: "guest:4294967296", err: true},
+	} {
+		port, err := vsockPortFromAddress(c.address)
+		if c.err {
+			assert.Error(t, err, c.address)
+			continue
+		}
+		assert.NoError(t, err, c.address)
+		assert.Equal(t, c.port, port, c.address)
+	}
+}
+
+func TestMachineVsockDialerPath(t *testing.T) {
+	m := &Machine{}
+	_, err := m.VsockDialer()
+	assert.Equal(t, ErrNoVsockDevice, err)
+
+	m.Cfg.VsockDevices = []VsockDevice{{Path: "/tmp/v.sock", CID: 3}}
+	dialer, err := m.VsockDialer()
+	require.NoError(t, err)
+	assert.Equal(t, "/tmp/v.sock", dialer.Path)
+
+	m.Cfg.JailerCfg = &JailerConfig{
+		ID:            "my-vm",
+		ExecFile:      "/usr/bin/firecracker",
+		ChrootBaseDir: "/jail",
+	}
+	m.Cfg.VsockDevices = []VsockDevice{{Path: "v.sock", CID: 3}}
+	dialer, err = m.VsockDialer()
+	require.NoError(t, err)
+	assert.Equal(t, "/jail/firecracker/my-vm/root/v.sock", dialer.Path)
+}
+
+func TestListenVsock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestListenVsock")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	udsPath := filepath.Join(dir, "v.sock")
+	m, err := NewMachine(context.Background(), Config{
+		DisableValidation: true,
+		VsockDevices:      []VsockDevice{{Path: udsPath, CID: 3}},
+	})
+	require.NoError(t, err)
+
+	listenerPath := udsPath + "_1024"
+	// a stale socket from a previous run should be replaced
+	stale, err := net.Listen("unix", listenerPath)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := m.ListenVsock(1024)
+	require.NoError(t, err)
+
+	go func() {
+		conn, err := net.Dial("unix", listenerPath)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("hello\n"))
+	}()
+
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", line)
+	conn.Close()
+
+	// simulate the VMM exiting
+	close(m.exitCh)
+	_, err = listener.Accept()
+	assert.Error(t, err, "expected listener to be closed after the VMM exited")
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(listenerPath)
+		return os.IsNotExist(err)
+	}, time.Second, 10*time.Millisecond, "expected listener socket to be removed")
+}